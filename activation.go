@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/quic-go/quic-go"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd socket
+// activation, following stdin, stdout and stderr.
+const listenFdsStart = 3
+
+// activationFiles returns the sockets passed to the process by systemd
+// socket activation, or nil if it was not socket activated. The environment
+// variables are cleared so they are not inherited by child processes.
+func activationFiles() []*os.File {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil
+	}
+
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	var files []*os.File
+	for i := 0; i < count; i++ {
+		name := "LISTEN_FD_" + strconv.Itoa(listenFdsStart+i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		files = append(files, os.NewFile(uintptr(listenFdsStart+i), name))
+	}
+
+	return files
+}
+
+// serveActivated serves DNS on sockets passed by systemd instead of binding
+// the configured listen addresses. Stream sockets are served over TCP and
+// datagram sockets over UDP, except that sockets given the
+// FileDescriptorName "dot" or "doq" serve DNS-over-TLS and DNS-over-QUIC.
+func (s *dnsServer) serveActivated(files []*os.File) error {
+	var tlsConfig *tls.Config
+
+	for _, file := range files {
+		encrypted := file.Name() == "dot" || file.Name() == "doq"
+		if encrypted && tlsConfig == nil {
+			var err error
+			tlsConfig, err = s.config.TLS.serverTLSConfig()
+			if err != nil {
+				return err
+			}
+		}
+
+		if listener, err := net.FileListener(file); err == nil {
+			if file.Name() == "dot" {
+				listener = tls.NewListener(listener, tlsConfig)
+			}
+
+			log.Printf("Serving TCP on activated socket %s (%s)", file.Name(), listener.Addr())
+			go s.runTCP(listener)
+			continue
+		}
+
+		packetConn, err := net.FilePacketConn(file)
+		if err != nil {
+			return fmt.Errorf("unsupported activated socket %s: %v", file.Name(), err)
+		}
+
+		conn, ok := packetConn.(*net.UDPConn)
+		if !ok {
+			return fmt.Errorf("unsupported activated socket %s", file.Name())
+		}
+
+		if file.Name() == "doq" {
+			quicTLSConfig := tlsConfig.Clone()
+			quicTLSConfig.NextProtos = []string{"doq"}
+
+			listener, err := quic.Listen(conn, quicTLSConfig, &quic.Config{
+				MaxIdleTimeout: s.config.TCPTimeout,
+			})
+			if err != nil {
+				return err
+			}
+
+			log.Printf("Serving QUIC on activated socket %s (%s)", file.Name(), conn.LocalAddr())
+			go s.runQUIC(listener)
+			continue
+		}
+
+		log.Printf("Serving UDP on activated socket %s (%s)", file.Name(), conn.LocalAddr())
+		go s.runUDP(conn)
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// The ways ANY queries for local names can be answered.
+const (
+	// anyMinimal answers with a single synthesised HINFO record, as
+	// recommended by RFC 8482.
+	anyMinimal = "minimal"
+
+	// anyAggregate answers with every record held for the name.
+	anyAggregate = "aggregate"
+)
+
+// minimalANY returns the HINFO record that RFC 8482 section 4.2 suggests as
+// the answer to an ANY query.
+func minimalANY(name string) dns.RR {
+	return &dns.HINFO{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeHINFO,
+			Class:  dns.ClassINET,
+			Ttl:    300, // Time-to-live in seconds
+		},
+		Cpu: "RFC8482",
+		Os:  "",
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// apiMaxBody is the largest request body the management API reads.
+const apiMaxBody = 1 << 20
+
+// Errors listing and changing a zone through the management APIs, which
+// are answered with their own statuses.
+var (
+	errNoZone        = errors.New("no such zone")
+	errSecondaryZone = errors.New("secondary zones cannot be changed")
+	errInvalidChange = errors.New("invalid change")
+)
+
+// APIConfig serves an HTTP API on Listen to list and change the records of
+// the zones, applied and saved as dynamic updates are.
+type APIConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Listen is the address the API is served on.
+	Listen string `yaml:"listen"`
+
+	// Token is the bearer token requests must carry in their Authorization
+	// header. Requests need none if it is empty.
+	Token string `yaml:"token"`
+}
+
+// parse validates the address the API is served on.
+func (c *APIConfig) parse() error {
+	if c.Listen == "" {
+		return fmt.Errorf("api needs a listen address")
+	}
+	if c.Token == "" {
+		log.Printf("The management API on %s accepts requests without a token", c.Listen)
+	}
+
+	return nil
+}
+
+// apiRecord is a record as the API gives and takes it, its data in zone
+// file format. Names not ending with a dot are relative to the zone, and @
+// is the zone itself.
+type apiRecord struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	TTL  uint32 `json:"ttl,omitempty"`
+	Data string `json:"data"`
+}
+
+// apiRRset is the body of a request replacing the records of a name of a
+// type.
+type apiRRset struct {
+	TTL     uint32   `json:"ttl,omitempty"`
+	Records []string `json:"records"`
+}
+
+// apiZone is a zone as the API lists it.
+type apiZone struct {
+	Origin    string `json:"origin"`
+	Serial    uint32 `json:"serial"`
+	Secondary bool   `json:"secondary,omitempty"`
+}
+
+// serveAPI serves the management API, if it is enabled.
+func (s *dnsServer) serveAPI() {
+	config := &s.config.API
+	if !config.Enabled {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/zones", s.apiListZones)
+	mux.HandleFunc("GET /api/v1/zones/{zone}/records", s.apiListRecords)
+	mux.HandleFunc("POST /api/v1/zones/{zone}/records", s.apiAddRecord)
+	mux.HandleFunc("PUT /api/v1/zones/{zone}/records/{name}/{type}", s.apiReplaceRRset)
+	mux.HandleFunc("DELETE /api/v1/zones/{zone}/records/{name}/{type}", s.apiDeleteRecords)
+
+	server := &http.Server{
+		Addr:              config.Listen,
+		Handler:           config.authorize(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		log.Printf("Serving the management API on %s", config.Listen)
+		err := server.ListenAndServe()
+		if err != nil {
+			log.Printf("Failed to serve the management API: %v", err)
+		}
+	}()
+}
+
+// authorize refuses requests without the token, if one is set.
+func (c *APIConfig) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if c.Token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) != 1 {
+			apiError(w, http.StatusUnauthorized, fmt.Errorf("missing or wrong token"))
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiListZones lists the zones served.
+func (s *dnsServer) apiListZones(w http.ResponseWriter, r *http.Request) {
+	zones := []apiZone{}
+	for _, zone := range s.records.Load().Zones {
+		zones = append(zones, apiZone{Origin: zone.Origin, Serial: zone.SOA.Serial, Secondary: len(zone.Primaries) > 0})
+	}
+
+	apiRespond(w, http.StatusOK, zones)
+}
+
+// apiListRecords lists the records of a zone, or those of the name and type
+// given by the name and type parameters.
+func (s *dnsServer) apiListRecords(w http.ResponseWriter, r *http.Request) {
+	records, err := s.zoneRecords(r.PathValue("zone"), r.URL.Query().Get("name"), r.URL.Query().Get("type"))
+	if err != nil {
+		apiError(w, apiStatus(err), err)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, records)
+}
+
+// apiAddRecord adds a record to a zone.
+func (s *dnsServer) apiAddRecord(w http.ResponseWriter, r *http.Request) {
+	var record apiRecord
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody)).Decode(&record)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.apiChange(w, r.PathValue("zone"), addRecord(record))
+}
+
+// apiReplaceRRset replaces the records of a name of a type with those
+// given, deleting them if none are given.
+func (s *dnsServer) apiReplaceRRset(w http.ResponseWriter, r *http.Request) {
+	var rrset apiRRset
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, apiMaxBody)).Decode(&rrset)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	s.apiChange(w, r.PathValue("zone"), replaceRRset(r.PathValue("name"), r.PathValue("type"), rrset.TTL, rrset.Records))
+}
+
+// apiDeleteRecords deletes the records of a name of a type, or only the one
+// holding the data parameter if it is given.
+func (s *dnsServer) apiDeleteRecords(w http.ResponseWriter, r *http.Request) {
+	s.apiChange(w, r.PathValue("zone"), deleteRecords(r.PathValue("name"), r.PathValue("type"), r.URL.Query().Get("data")))
+}
+
+// apiChange changes a zone, answering with its records of the names
+// changed.
+func (s *dnsServer) apiChange(w http.ResponseWriter, origin string, change zoneChange) {
+	records, err := s.changeZone(origin, change)
+	if err != nil {
+		apiError(w, apiStatus(err), err)
+		return
+	}
+
+	apiRespond(w, http.StatusOK, records)
+}
+
+// apiStatus returns the HTTP status a failure to list or change a zone is
+// answered with.
+func apiStatus(err error) int {
+	switch {
+	case errors.Is(err, errNoZone):
+		return http.StatusNotFound
+	case errors.Is(err, errSecondaryZone):
+		return http.StatusConflict
+	case errors.Is(err, errInvalidChange):
+		return http.StatusBadRequest
+	}
+
+	return http.StatusInternalServerError
+}
+
+// zoneChange builds the updates changing a zone from its origin and default
+// TTL.
+type zoneChange func(origin string, ttl uint32) ([]dns.RR, error)
+
+// addRecord adds a record.
+func addRecord(record apiRecord) zoneChange {
+	return func(origin string, ttl uint32) ([]dns.RR, error) {
+		if record.TTL != 0 {
+			ttl = record.TTL
+		}
+		rr, err := apiRR(origin, record.Name, record.Type, ttl, record.Data)
+		if err != nil {
+			return nil, err
+		}
+		return []dns.RR{rr}, nil
+	}
+}
+
+// replaceRRset replaces the records of a name of a type with records
+// holding data, deleting them if there is none.
+func replaceRRset(name, rrtype string, ttl uint32, data []string) zoneChange {
+	return func(origin string, defaultTTL uint32) ([]dns.RR, error) {
+		deletion, err := apiDeletion(origin, name, rrtype)
+		if err != nil {
+			return nil, err
+		}
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+
+		updates := []dns.RR{deletion}
+		for _, data := range data {
+			rr, err := apiRR(origin, name, rrtype, ttl, data)
+			if err != nil {
+				return nil, err
+			}
+			updates = append(updates, rr)
+		}
+		return updates, nil
+	}
+}
+
+// deleteRecords deletes the records of a name of a type, or only the one
+// holding data if it is given.
+func deleteRecords(name, rrtype, data string) zoneChange {
+	return func(origin string, ttl uint32) ([]dns.RR, error) {
+		if data == "" {
+			deletion, err := apiDeletion(origin, name, rrtype)
+			if err != nil {
+				return nil, err
+			}
+			return []dns.RR{deletion}, nil
+		}
+
+		rr, err := apiRR(origin, name, rrtype, 0, data)
+		if err != nil {
+			return nil, err
+		}
+		rr.Header().Class = dns.ClassNONE
+		return []dns.RR{rr}, nil
+	}
+}
+
+// zoneRecords returns the records of a zone, or only those of a name, a
+// type or both if they are given.
+func (s *dnsServer) zoneRecords(origin, name, rrtype string) ([]apiRecord, error) {
+	records := s.records.Load()
+	zone := apiFindZone(records, origin)
+	if zone == nil || zone.expired {
+		return nil, errNoZone
+	}
+	rrs, err := records.zoneRRs(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	if name != "" {
+		name = apiName(zone.Origin, name)
+	}
+	rrtype = strings.ToUpper(rrtype)
+
+	listed := []apiRecord{}
+	for _, rr := range rrs[:len(rrs)-1] {
+		record := apiRecordOf(rr)
+		if (name == "" || record.Name == name) && (rrtype == "" || record.Type == rrtype) {
+			listed = append(listed, record)
+		}
+	}
+	return listed, nil
+}
+
+// changeZone applies a change to a zone as a dynamic update without
+// prerequisites, returning the zone's records of the names changed.
+func (s *dnsServer) changeZone(origin string, change zoneChange) ([]apiRecord, error) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	found := apiFindZone(current, origin)
+	switch {
+	case found == nil:
+		return nil, errNoZone
+	case len(found.Primaries) > 0:
+		return nil, errSecondaryZone
+	}
+	zone := *found
+
+	updates, err := change(zone.Origin, zone.TTL)
+	if err == nil {
+		_, err = checkUpdates(zone.Origin, updates)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidChange, err)
+	}
+
+	rrs, err := current.zoneRRs(&zone)
+	if err != nil {
+		return nil, err
+	}
+	content, changed := applyUpdates(zone.Origin, rrs[:len(rrs)-1], updates)
+	if changed {
+		err = s.storeZone(current, zone, content, current.expiries(zone.Origin), true)
+		if err != nil {
+			log.Printf("Failed to change zone %s through the API: %v", zone.Origin, err)
+			return nil, err
+		}
+	}
+
+	names := map[string]bool{}
+	for _, rr := range updates {
+		names[dns.CanonicalName(rr.Header().Name)] = true
+	}
+	records := []apiRecord{}
+	for _, rr := range content[1:] {
+		if names[dns.CanonicalName(rr.Header().Name)] {
+			records = append(records, apiRecordOf(rr))
+		}
+	}
+	return records, nil
+}
+
+// apiFindZone returns the zone with the given origin, or nil if there is
+// none.
+func apiFindZone(records *DNSRecords, origin string) *Zone {
+	origin = dns.CanonicalName(origin)
+	zone := records.FindZone(origin)
+	if zone == nil || zone.Origin != origin {
+		return nil
+	}
+
+	return zone
+}
+
+// apiName returns the full name of a name given relative to a zone.
+func apiName(origin, name string) string {
+	switch {
+	case name == "@" || name == "":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return dns.CanonicalName(name)
+	}
+
+	return dns.CanonicalName(name + "." + origin)
+}
+
+// apiRR parses a record given to the API.
+func apiRR(origin, name, rrtype string, ttl uint32, data string) (dns.RR, error) {
+	if _, ok := dns.StringToType[strings.ToUpper(rrtype)]; !ok {
+		return nil, fmt.Errorf("unknown record type %q", rrtype)
+	}
+
+	rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", apiName(origin, name), ttl, strings.ToUpper(rrtype), data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record %q: %v", rrtype, data, err)
+	}
+	if rr == nil {
+		return nil, fmt.Errorf("missing %s record data", rrtype)
+	}
+	return rr, nil
+}
+
+// apiDeletion returns the update deleting the records of a name of a type.
+func apiDeletion(origin, name, rrtype string) (dns.RR, error) {
+	code, ok := dns.StringToType[strings.ToUpper(rrtype)]
+	if !ok {
+		return nil, fmt.Errorf("unknown record type %q", rrtype)
+	}
+
+	return &dns.ANY{Hdr: dns.RR_Header{Name: apiName(origin, name), Rrtype: code, Class: dns.ClassANY}}, nil
+}
+
+// apiRecordOf returns a record as the API gives it.
+func apiRecordOf(rr dns.RR) apiRecord {
+	header := rr.Header()
+	return apiRecord{
+		Name: dns.CanonicalName(header.Name),
+		Type: dns.TypeToString[header.Rrtype],
+		TTL:  header.Ttl,
+		Data: strings.TrimPrefix(rr.String(), header.String()),
+	}
+}
+
+// apiRespond answers a request with a value as JSON.
+func apiRespond(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// apiError answers a request with an error.
+func apiError(w http.ResponseWriter, status int, err error) {
+	apiRespond(w, status, map[string]string{"error": err.Error()})
+}
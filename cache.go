@@ -0,0 +1,331 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheKey identifies a cached response by its question and, for answers
+// tailored to an EDNS Client Subnet, the subnet they were given for.
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	subnet string
+}
+
+// newCacheKey returns the cache key for a question, ignoring the case of
+// the name.
+func newCacheKey(question dns.Question, subnet string) cacheKey {
+	return cacheKey{
+		name:   dns.CanonicalName(question.Name),
+		qtype:  question.Qtype,
+		qclass: question.Qclass,
+		subnet: subnet,
+	}
+}
+
+// lookup returns the cache element for a question, preferring an answer
+// tailored to the subnet over one that applies to every client. The caller
+// must hold the lock.
+func (c *responseCache) lookup(question dns.Question, subnet string) (*list.Element, bool) {
+	if subnet != "" {
+		if element, ok := c.entries[newCacheKey(question, subnet)]; ok {
+			return element, true
+		}
+	}
+
+	element, ok := c.entries[newCacheKey(question, "")]
+	return element, ok
+}
+
+// cacheEntry is a response held in the cache along with when it was stored
+// and when it expires.
+type cacheEntry struct {
+	key     cacheKey
+	msg     *dns.Msg
+	stored  time.Time
+	expires time.Time
+
+	// hits counts how often the entry has been served, and prefetching is
+	// set once a refresh has been requested so only one is made.
+	hits        int
+	prefetching bool
+}
+
+// responseCache holds upstream responses until their records' TTLs expire,
+// evicting the least recently used entries once it reaches its maximum size.
+// Expired entries are kept for a further staleFor so they can be served
+// stale while upstreams are unreachable. Entries served at least
+// prefetchHits times are flagged for refresh shortly before they expire.
+type responseCache struct {
+	maxSize      int
+	staleFor     time.Duration
+	prefetchHits int
+
+	mu      sync.Mutex
+	entries map[cacheKey]*list.Element
+	lru     *list.List
+
+	// hits and misses count the lookups Get answered from the cache and
+	// those it could not.
+	hits   uint64
+	misses uint64
+}
+
+// newResponseCache creates a cache holding at most maxSize responses, which
+// remain available to GetStale for staleFor after they expire. A
+// prefetchHits of zero disables prefetching.
+func newResponseCache(maxSize int, staleFor time.Duration, prefetchHits int) *responseCache {
+	return &responseCache{
+		maxSize:      maxSize,
+		staleFor:     staleFor,
+		prefetchHits: prefetchHits,
+		entries:      map[cacheKey]*list.Element{},
+		lru:          list.New(),
+	}
+}
+
+// prefetchThreshold is the fraction of an entry's lifetime, in percent, left
+// when a popular entry is refreshed ahead of expiring.
+const prefetchThreshold = 10
+
+// Get returns a copy of the cached response to a question from a client in
+// subnet with its TTLs reduced by the time spent in the cache, or nil if
+// there is none. It also reports whether the caller should refresh the entry
+// in the background because it is popular and about to expire.
+func (c *responseCache) Get(question dns.Question, subnet string) (*dns.Msg, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.lookup(question, subnet)
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	now := time.Now()
+	if !now.Before(entry.expires) {
+		if !now.Before(entry.expires.Add(c.staleFor)) {
+			c.remove(element)
+		}
+		c.misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(element)
+	c.hits++
+
+	entry.hits++
+	prefetch := false
+	if c.prefetchHits > 0 && entry.hits >= c.prefetchHits && !entry.prefetching {
+		lifetime := entry.expires.Sub(entry.stored)
+		if entry.expires.Sub(now) < lifetime*prefetchThreshold/100 {
+			entry.prefetching = true
+			prefetch = true
+		}
+	}
+
+	msg := entry.msg.Copy()
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl -= age
+		}
+	}
+
+	return msg, prefetch
+}
+
+// maxNegativeTTL caps how long NXDOMAIN and NODATA responses are cached, as
+// suggested by RFC 2308 section 5.
+const maxNegativeTTL = 3 * 60 * 60
+
+// staleTTL is the TTL given to records served from expired cache entries, as
+// recommended by RFC 8767 section 4.
+const staleTTL = 30
+
+// GetStale returns a copy of an expired cached response to a question from
+// a client in subnet that is still within the stale window, with its TTLs
+// set to staleTTL, or nil if there is none.
+func (c *responseCache) GetStale(question dns.Question, subnet string) *dns.Msg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.lookup(question, subnet)
+	if !ok {
+		return nil
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires.Add(c.staleFor)) {
+		c.remove(element)
+		return nil
+	}
+
+	msg := entry.msg.Copy()
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			rr.Header().Ttl = staleTTL
+		}
+	}
+
+	return msg
+}
+
+// Put stores a response to a question, tailored to subnet if that is not
+// empty, for as long as the smallest TTL of its records. NXDOMAIN and NODATA
+// responses are cached according to the SOA record in their authority
+// section (RFC 2308), and are not cached at all without one.
+func (c *responseCache) Put(question dns.Question, subnet string, msg *dns.Msg) {
+	if c.maxSize <= 0 || msg.Truncated {
+		return
+	}
+
+	msg = msg.Copy()
+	stripOPT(msg)
+
+	ttl, ok := minTTL(msg)
+	if !ok {
+		return
+	}
+
+	switch {
+	case msg.Rcode == dns.RcodeNameError, msg.Rcode == dns.RcodeSuccess && len(msg.Answer) == 0:
+		negative, ok := negativeTTL(msg)
+		if !ok {
+			return
+		}
+
+		if negative < ttl {
+			ttl = negative
+		}
+	case msg.Rcode != dns.RcodeSuccess:
+		return
+	}
+
+	if ttl == 0 {
+		return
+	}
+
+	c.store(newCacheKey(question, subnet), msg, ttl)
+}
+
+// negativeTTL returns how long a negative response may be cached, which is
+// the lesser of its SOA record's TTL and minimum field (RFC 2308 section 5).
+// The SOA's TTL is lowered to match, as it is when served by the zone.
+func negativeTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Hdr.Ttl
+		if soa.Minttl < ttl {
+			ttl = soa.Minttl
+		}
+		if ttl > maxNegativeTTL {
+			ttl = maxNegativeTTL
+		}
+		soa.Hdr.Ttl = ttl
+
+		return ttl, true
+	}
+
+	return 0, false
+}
+
+// store adds a response to the cache with the given TTL, replacing any
+// existing entry and evicting the oldest entries to stay within maxSize.
+func (c *responseCache) store(key cacheKey, msg *dns.Msg, ttl uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	entry := &cacheEntry{
+		key:     key,
+		msg:     msg,
+		stored:  now,
+		expires: now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	if element, ok := c.entries[key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.maxSize {
+		c.remove(c.lru.Back())
+	}
+}
+
+// Flush drops the responses to questions for a name and the names under
+// it, or every response if name is empty, returning how many it dropped.
+func (c *responseCache) Flush(name string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	flushed := 0
+	for key, element := range c.entries {
+		if name == "" || dns.IsSubDomain(name, key.name) {
+			c.remove(element)
+			flushed++
+		}
+	}
+
+	return flushed
+}
+
+// Stats returns how many responses the cache holds, and how many lookups
+// it has answered and missed.
+func (c *responseCache) Stats() (entries int, hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.lru.Len(), c.hits, c.misses
+}
+
+// remove drops an element from the cache. The caller must hold the lock.
+func (c *responseCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// minTTL returns the smallest TTL of the records in a message, ignoring any
+// OPT record, and whether the message held any records at all.
+func minTTL(msg *dns.Msg) (uint32, bool) {
+	var ttl uint32
+	found := false
+	for _, section := range [][]dns.RR{msg.Answer, msg.Ns, msg.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+
+	return ttl, found
+}
+
+// stripOPT removes any OPT record from the additional section of a message.
+func stripOPT(msg *dns.Msg) {
+	extra := msg.Extra[:0]
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	msg.Extra = extra
+}
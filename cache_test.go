@@ -0,0 +1,232 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cachedResponse returns a response to an A query for name with the given
+// answers, written in the master file format.
+func cachedResponse(t *testing.T, name string, answers ...string) *dns.Msg {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.SetQuestion(name, dns.TypeA)
+	msg.Response = true
+	for _, answer := range answers {
+		rr, err := dns.NewRR(answer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+
+	return msg
+}
+
+// age moves the entry of a question back in time, as if it had been held
+// for d longer than it has.
+func age(c *responseCache, question dns.Question, d time.Duration) {
+	entry := c.entries[newCacheKey(question, "")].Value.(*cacheEntry)
+	entry.stored = entry.stored.Add(-d)
+	entry.expires = entry.expires.Add(-d)
+}
+
+// negative turns a response into a negative one with an rcode, carrying
+// the SOA record of its zone.
+func negative(t *testing.T, msg *dns.Msg, rcode int) {
+	t.Helper()
+
+	soa, err := dns.NewRR("example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 1 3600 600 86400 300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg.Rcode = rcode
+	msg.Answer = nil
+	msg.Ns = []dns.RR{soa}
+}
+
+func TestResponseCacheTTL(t *testing.T) {
+	c := newResponseCache(10, 0, 0)
+	msg := cachedResponse(t, "www.example.com.",
+		"www.example.com. 300 IN A 192.0.2.1",
+		"www.example.com. 60 IN A 192.0.2.2")
+	question := msg.Question[0]
+	c.Put(question, "", msg)
+
+	// Names are looked up whatever their case
+	upper := question
+	upper.Name = "WWW.Example.COM."
+	got, _ := c.Get(upper, "")
+	if got == nil || len(got.Answer) != 2 {
+		t.Fatalf("got %v, want the cached response", got)
+	}
+
+	age(c, question, 40*time.Second)
+	got, _ = c.Get(question, "")
+	if got == nil {
+		t.Fatal("response expired before its smallest TTL")
+	}
+	for i, want := range []uint32{260, 20} {
+		if ttl := got.Answer[i].Header().Ttl; ttl != want {
+			t.Fatalf("got TTL %d for answer %d, want %d", ttl, i, want)
+		}
+	}
+
+	age(c, question, 20*time.Second)
+	if got, _ := c.Get(question, ""); got != nil {
+		t.Fatalf("got %v after the smallest TTL, want it expired", got)
+	}
+}
+
+func TestResponseCachePut(t *testing.T) {
+	tests := []struct {
+		name   string
+		edit   func(t *testing.T, msg *dns.Msg)
+		cached bool
+	}{
+		{"answered", func(t *testing.T, msg *dns.Msg) {}, true},
+		{"truncated", func(t *testing.T, msg *dns.Msg) { msg.Truncated = true }, false},
+		{"zero TTL", func(t *testing.T, msg *dns.Msg) { msg.Answer[0].Header().Ttl = 0 }, false},
+		{"failed", func(t *testing.T, msg *dns.Msg) { msg.Rcode = dns.RcodeServerFailure }, false},
+		{"NODATA without SOA", func(t *testing.T, msg *dns.Msg) { msg.Answer = nil }, false},
+		{"NODATA", func(t *testing.T, msg *dns.Msg) { negative(t, msg, dns.RcodeSuccess) }, true},
+		{"NXDOMAIN", func(t *testing.T, msg *dns.Msg) { negative(t, msg, dns.RcodeNameError) }, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := newResponseCache(10, 0, 0)
+			msg := cachedResponse(t, "www.example.com.", "www.example.com. 300 IN A 192.0.2.1")
+			test.edit(t, msg)
+			c.Put(msg.Question[0], "", msg)
+
+			got, _ := c.Get(msg.Question[0], "")
+			if (got != nil) != test.cached {
+				t.Fatalf("got %v, want cached %t", got, test.cached)
+			}
+		})
+	}
+}
+
+func TestResponseCacheNegativeTTL(t *testing.T) {
+	c := newResponseCache(10, 0, 0)
+	msg := cachedResponse(t, "missing.example.com.")
+	negative(t, msg, dns.RcodeNameError)
+	question := msg.Question[0]
+	c.Put(question, "", msg)
+
+	// The SOA minimum of 300 seconds is less than its TTL, and bounds the
+	// time the response is cached
+	got, _ := c.Get(question, "")
+	if got == nil || got.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %v, want the cached NXDOMAIN", got)
+	}
+	if ttl := got.Ns[0].Header().Ttl; ttl != 300 {
+		t.Fatalf("got SOA TTL %d, want 300", ttl)
+	}
+
+	age(c, question, 300*time.Second)
+	if got, _ := c.Get(question, ""); got != nil {
+		t.Fatalf("got %v after the SOA minimum, want it expired", got)
+	}
+}
+
+func TestResponseCacheStale(t *testing.T) {
+	c := newResponseCache(10, time.Hour, 0)
+	msg := cachedResponse(t, "www.example.com.", "www.example.com. 300 IN A 192.0.2.1")
+	question := msg.Question[0]
+	c.Put(question, "", msg)
+
+	if got := c.GetStale(question, ""); got == nil || got.Answer[0].Header().Ttl != staleTTL {
+		t.Fatalf("got %v, want the response with TTL %d", got, staleTTL)
+	}
+
+	// Expired responses are only served stale, until the stale window
+	// passes too
+	age(c, question, 30*time.Minute)
+	if got, _ := c.Get(question, ""); got != nil {
+		t.Fatalf("got %v after the TTL, want it expired", got)
+	}
+	if got := c.GetStale(question, ""); got == nil {
+		t.Fatal("stale response missing within the stale window")
+	}
+
+	age(c, question, time.Hour)
+	if got := c.GetStale(question, ""); got != nil {
+		t.Fatalf("got %v after the stale window, want it dropped", got)
+	}
+}
+
+func TestResponseCachePrefetch(t *testing.T) {
+	c := newResponseCache(10, 0, 2)
+	msg := cachedResponse(t, "www.example.com.", "www.example.com. 100 IN A 192.0.2.1")
+	question := msg.Question[0]
+	c.Put(question, "", msg)
+
+	// Only an entry served often enough that is close to expiring is
+	// prefetched, and only once
+	age(c, question, 95*time.Second)
+	for i, want := range []bool{false, true, false} {
+		got, prefetch := c.Get(question, "")
+		if got == nil {
+			t.Fatal("response expired early")
+		}
+		if prefetch != want {
+			t.Fatalf("got prefetch %t on hit %d, want %t", prefetch, i+1, want)
+		}
+	}
+}
+
+func TestResponseCacheSubnets(t *testing.T) {
+	c := newResponseCache(10, 0, 0)
+	tailored := cachedResponse(t, "www.example.com.", "www.example.com. 300 IN A 192.0.2.1")
+	shared := cachedResponse(t, "www.example.com.", "www.example.com. 300 IN A 198.51.100.1")
+	question := tailored.Question[0]
+	c.Put(question, "192.168.1.0/24", tailored)
+	c.Put(question, "", shared)
+
+	tests := []struct {
+		subnet string
+		want   string
+	}{
+		{"192.168.1.0/24", "192.0.2.1"},
+		{"10.0.0.0/24", "198.51.100.1"},
+		{"", "198.51.100.1"},
+	}
+
+	for _, test := range tests {
+		got, _ := c.Get(question, test.subnet)
+		if got == nil || got.Answer[0].(*dns.A).A.String() != test.want {
+			t.Fatalf("got %v for subnet %q, want %s", got, test.subnet, test.want)
+		}
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(2, 0, 0)
+	var questions []dns.Question
+	for i := 1; i <= 3; i++ {
+		name := fmt.Sprintf("host%d.example.com.", i)
+		msg := cachedResponse(t, name, fmt.Sprintf("%s 300 IN A 192.0.2.%d", name, i))
+		questions = append(questions, msg.Question[0])
+		c.Put(msg.Question[0], "", msg)
+
+		// The first response is used again before the third is stored,
+		// leaving the second the least recently used
+		if i == 2 {
+			if got, _ := c.Get(questions[0], ""); got == nil {
+				t.Fatal("first response missing")
+			}
+		}
+	}
+
+	for i, want := range []bool{true, false, true} {
+		if got, _ := c.Get(questions[i], ""); (got != nil) != want {
+			t.Fatalf("got %v for %s, want cached %t", got, questions[i].Name, want)
+		}
+	}
+}
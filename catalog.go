@@ -0,0 +1,247 @@
+package main
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// catalogVersion is the version of the catalog zone schema that is produced
+// and understood (RFC 9432 section 4.2.1).
+const catalogVersion = "2"
+
+// CatalogZone makes a zone a catalog zone (RFC 9432), produced from the
+// zones the server serves or, with primaries, consumed by serving each of
+// its members as a secondary zone.
+type CatalogZone struct {
+	// Members are the zones a produced catalog lists, or every other zone
+	// if none are given.
+	Members []string `yaml:"members,omitempty"`
+
+	// Directory is where the member zones of a consumed catalog are saved.
+	Directory string `yaml:"directory,omitempty"`
+}
+
+// catalogRecords returns the records of a catalog zone the server produces:
+// its schema version and a PTR record for each member zone, named by a hash
+// of the member so that the name stays the same from version to version.
+func (r *DNSRecords) catalogRecords(catalog *Zone) []DNSRecord {
+	header := func(name string, rrtype uint16) dns.RR_Header {
+		return dns.RR_Header{Name: name, Rrtype: rrtype, Class: dns.ClassINET, Ttl: catalog.TTL}
+	}
+
+	version := "version." + catalog.Origin
+	records := []DNSRecord{{
+		Hostname: version,
+		rr:       &dns.TXT{Hdr: header(version, dns.TypeTXT), Txt: []string{catalogVersion}},
+	}}
+
+	members := catalog.Catalog.Members
+	if len(members) == 0 {
+		for _, zone := range r.Zones {
+			if zone.Catalog == nil && zone.member == "" {
+				members = append(members, zone.Origin)
+			}
+		}
+	}
+
+	for _, member := range members {
+		member = dns.CanonicalName(member)
+		name := fmt.Sprintf("%x.zones.%s", sha1.Sum([]byte(member)), catalog.Origin)
+		records = append(records, DNSRecord{
+			Hostname: name,
+			rr:       &dns.PTR{Hdr: header(name, dns.TypePTR), Ptr: member},
+		})
+	}
+
+	return records
+}
+
+// catalogMembers returns the member zones listed in a consumed catalog
+// zone, or nil if the catalog is of an unsupported version.
+func (r *DNSRecords) catalogMembers(catalog *Zone) []string {
+	version := "version." + catalog.Origin
+	zones := "zones." + catalog.Origin
+
+	var supported bool
+	var members []string
+	for _, record := range r.Records {
+		if owner := r.FindZone(record.Hostname); owner == nil || owner.Origin != catalog.Origin {
+			continue
+		}
+
+		rrs, err := record.RRs(record.Hostname)
+		if err != nil {
+			continue
+		}
+		for _, rr := range rrs {
+			switch rr := rr.(type) {
+			case *dns.TXT:
+				if record.Hostname == version && len(rr.Txt) == 1 && rr.Txt[0] == catalogVersion {
+					supported = true
+				}
+			case *dns.PTR:
+				// Members are named by a single label below zones
+				if _, parent, _ := strings.Cut(record.Hostname, "."); parent == zones {
+					members = append(members, dns.CanonicalName(rr.Ptr))
+				}
+			}
+		}
+	}
+
+	if !supported {
+		log.Printf("Ignoring the members of catalog zone %s, which is not of version %s", catalog.Origin, catalogVersion)
+		return nil
+	}
+
+	return members
+}
+
+// withCatalogMembers returns the records with the member zones of each
+// consumed catalog served as secondary zones, adding zones newly listed in
+// a catalog and dropping those no longer listed. The members of a catalog
+// that has expired are kept as they are. A member added is carried over
+// from previous if it is served there, and otherwise loaded from its file
+// in the catalog's directory or left to be transferred. Zones listed in the
+// records file are never replaced by catalog members.
+func (r *DNSRecords) withCatalogMembers(previous *DNSRecords) (*DNSRecords, error) {
+	wanted := map[string]*Zone{}
+	for i := range r.Zones {
+		catalog := &r.Zones[i]
+		if catalog.Catalog == nil || len(catalog.Primaries) == 0 {
+			continue
+		}
+
+		var members []string
+		if catalog.expired {
+			for _, zone := range r.Zones {
+				if zone.member == catalog.Origin {
+					members = append(members, zone.Origin)
+				}
+			}
+		} else {
+			members = r.catalogMembers(catalog)
+		}
+
+		for _, member := range members {
+			if zone := r.FindZone(member); zone != nil && zone.Origin == member && zone.member == "" {
+				continue
+			}
+			if wanted[member] == nil {
+				wanted[member] = catalog
+			}
+		}
+	}
+
+	next := &DNSRecords{
+		TTL:      r.TTL,
+		Views:    append([]View{}, r.Views...),
+		includes: r.includes,
+	}
+	dropped := map[string]bool{}
+	for _, zone := range r.Zones {
+		if zone.member != "" && (wanted[zone.Origin] == nil || wanted[zone.Origin].Origin != zone.member) {
+			log.Printf("Dropped zone %s, no longer a member of catalog zone %s", zone.Origin, zone.member)
+			dropped[zone.Origin] = true
+			continue
+		}
+		if zone.member != "" {
+			delete(wanted, zone.Origin)
+		}
+		next.Zones = append(next.Zones, zone)
+	}
+	if len(dropped) == 0 && len(wanted) == 0 {
+		return r, nil
+	}
+
+	for _, record := range r.Records {
+		if owner := r.FindZone(record.Hostname); owner == nil || !dropped[owner.Origin] {
+			next.Records = append(next.Records, record)
+		}
+	}
+
+	for origin, catalog := range wanted {
+		zone, records, err := catalogMember(origin, catalog, previous)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Added zone %s as a member of catalog zone %s", origin, catalog.Origin)
+
+		next.Zones = append(next.Zones, zone)
+		for _, record := range records {
+			record.Hostname = canonicalHostname(record.Hostname)
+			record.ttl = next.recordTTL(record)
+			next.Records = append(next.Records, record)
+		}
+	}
+
+	for i := range next.Views {
+		view := &next.Views[i]
+		view.Records = append([]DNSRecord{}, view.Records...)
+		err := view.prepare(next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return next, nil
+}
+
+// catalogMember returns a member zone of a consumed catalog, as a secondary
+// zone of the catalog's primaries, along with its records.
+func catalogMember(origin string, catalog *Zone, previous *DNSRecords) (Zone, []DNSRecord, error) {
+	if previous != nil {
+		if old := previous.secondaryZone(origin); old != nil && old.member == catalog.Origin && !old.expired {
+			rrs, err := previous.zoneRRs(old)
+			if err != nil {
+				return Zone{}, nil, err
+			}
+
+			zone := *old
+			records := zone.loadRRs(rrs[:len(rrs)-1])
+			return zone, records, nil
+		}
+	}
+
+	zone := Zone{
+		Origin:      origin,
+		Primaries:   catalog.Primaries,
+		TransferKey: catalog.TransferKey,
+		member:      catalog.Origin,
+	}
+	if catalog.Catalog.Directory != "" {
+		zone.File = filepath.Join(catalog.Catalog.Directory, origin+"zone")
+	}
+
+	// The member is served once it has been transferred, unless a copy was
+	// saved before
+	var records []DNSRecord
+	zone.expired = true
+	if zone.File != "" {
+		var err error
+		records, err = zone.loadFile()
+		if err == nil {
+			zone.expired = false
+		} else if !os.IsNotExist(err) {
+			return Zone{}, nil, err
+		}
+	}
+	zone.setDefaults()
+
+	return zone, records, nil
+}
+
+// setCatalogSerial gives a catalog zone the server produces, if it sets no
+// serial of its own, the time it is loaded as its serial, so that each
+// version of the catalog is newer than the last.
+func (z *Zone) setCatalogSerial() {
+	if z.Catalog != nil && len(z.Primaries) == 0 && z.SOA.Serial == 0 {
+		z.SOA.Serial = uint32(time.Now().Unix())
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// query is a query passing through the chain of handlers, with the
+// response it is answered with so far.
+type query struct {
+	request  *dns.Msg
+	response *dns.Msg
+	client   net.IP
+
+	// exempt is set by a handler to exempt the query from filtering, as a
+	// PASSTHRU rule of a response policy zone does.
+	exempt bool
+}
+
+// queryHandler answers a query, or passes it on to the rest of the chain
+// by calling next, which returns the response the rest of the chain built.
+// It returns the response to send, or nil if none should be sent.
+type queryHandler func(s *dnsServer, q *query, next func() *dns.Msg) *dns.Msg
+
+// chainHandler is a handler of the chain and the name it is known by.
+type chainHandler struct {
+	name   string
+	handle queryHandler
+}
+
+// defaultChain is the chain of handlers every query of the Internet class
+// passes through, in order, as in the plugin chain of CoreDNS. Rewriting
+// wraps the rest of the chain to change its answers, local and published
+// names are answered before names are filtered, and what no handler
+// answers is relayed to the upstreams or resolved recursively, through
+// the cache.
+var defaultChain = []chainHandler{
+	{"rewrite", (*dnsServer).rewriteHandler},
+	{"local", (*dnsServer).localHandler},
+	{"policy", (*dnsServer).policyHandler},
+	{"filter", (*dnsServer).filterHandler},
+	{"consul", (*dnsServer).consulHandler},
+	{"remote", (*dnsServer).remoteHandler},
+	{"exec", (*dnsServer).execHandler},
+	{"mdns", (*dnsServer).mdnsHandler},
+	{"forward", (*dnsServer).forwardHandler},
+}
+
+// registerHandler adds a handler to the chain of the server ahead of the
+// handler named before, or at the end of the chain if before is empty, so
+// that behaviours can be added without changing how queries are handled.
+// Handlers must be registered before the server starts.
+func (s *dnsServer) registerHandler(name, before string, handle queryHandler) error {
+	position := len(s.chain)
+	for i, handler := range s.chain {
+		if handler.name == name {
+			return fmt.Errorf("handler %s is already registered", name)
+		}
+		if handler.name == before {
+			position = i
+		}
+	}
+	if before != "" && position == len(s.chain) {
+		return fmt.Errorf("no handler %s to register %s before", before, name)
+	}
+
+	s.chain = append(s.chain[:position], append([]chainHandler{{name, handle}}, s.chain[position:]...)...)
+	return nil
+}
+
+// handle passes a query to the handler at position in the chain. Past the
+// end of the chain the query is answered with the response as it stands.
+func (s *dnsServer) handle(q *query, position int) *dns.Msg {
+	if position == len(s.chain) {
+		return q.response
+	}
+
+	return s.chain[position].handle(s, q, func() *dns.Msg {
+		return s.handle(q, position+1)
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// tracing returns a handler noting its name in trace before passing the
+// query on.
+func tracing(name string, trace *[]string) queryHandler {
+	return func(s *dnsServer, q *query, next func() *dns.Msg) *dns.Msg {
+		*trace = append(*trace, name)
+		return next()
+	}
+}
+
+func TestRegisterHandler(t *testing.T) {
+	var trace []string
+	s := &dnsServer{}
+	for _, name := range []string{"first", "last"} {
+		err := s.registerHandler(name, "", tracing(name, &trace))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		before string
+		err    bool
+	}{
+		{"middle", "last", false},
+		{"start", "first", false},
+		{"middle", "", true},
+		{"orphan", "missing", true},
+	}
+
+	for _, test := range tests {
+		err := s.registerHandler(test.name, test.before, tracing(test.name, &trace))
+		if (err != nil) != test.err {
+			t.Fatalf("registering %s before %q: got %v, want error %v", test.name, test.before, err, test.err)
+		}
+	}
+
+	// Queries pass through the handlers in the order they were placed in
+	q := &query{request: new(dns.Msg), response: new(dns.Msg)}
+	if response := s.handle(q, 0); response != q.response {
+		t.Fatalf("got %v, want the response built by the chain", response)
+	}
+	if want := []string{"start", "first", "middle", "last"}; !reflect.DeepEqual(trace, want) {
+		t.Fatalf("got %v, want %v", trace, want)
+	}
+}
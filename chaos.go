@@ -0,0 +1,62 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ChaosConfig controls the CHAOS class TXT records that report the server's
+// version and hostname, as queried by "dig CH TXT version.bind".
+type ChaosConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Version is the version string reported. Hostname is the hostname
+	// reported, which defaults to the system hostname.
+	Version  string `yaml:"version"`
+	Hostname string `yaml:"hostname"`
+}
+
+// answerChaos builds the response to a query outside the IN class. Only the
+// CHAOS version and hostname names are answered, and only if enabled; every
+// other query from a class the server does not serve is refused.
+func (s *dnsServer) answerChaos(request *dns.Msg) *dns.Msg {
+	question := request.Question[0]
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+
+	var value string
+	if s.config.Chaos.Enabled && question.Qclass == dns.ClassCHAOS {
+		switch strings.ToLower(question.Name) {
+		case "version.bind.", "version.server.":
+			value = s.config.Chaos.Version
+		case "hostname.bind.", "id.server.":
+			value = s.config.Chaos.Hostname
+			if value == "" {
+				hostname, err := os.Hostname()
+				if err != nil {
+					log.Printf("Failed to get hostname: %v", err)
+				}
+				value = hostname
+			}
+		}
+	}
+
+	if value == "" {
+		response.Rcode = dns.RcodeRefused
+		return response
+	}
+
+	response.Authoritative = true
+	if question.Qtype == dns.TypeTXT || question.Qtype == dns.TypeANY {
+		response.Answer = []dns.RR{&dns.TXT{
+			Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassCHAOS, Ttl: 0},
+			Txt: []string{value},
+		}}
+	}
+
+	return response
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// maxTTL is the largest TTL a record may have, as RFC 2181 section 8 treats
+// larger values as zero.
+const maxTTL = 1<<31 - 1
+
+// checkFiles loads the config and records files as the server would at
+// startup, without serving them, and checks the records for mistakes that
+// would otherwise only show when they are queried. Every problem found is
+// printed, and it reports whether there were none.
+func checkFiles(configFile string) bool {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", configFile, err)
+		return false
+	}
+
+	records, err := readRecords(config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.recordsSource(), err)
+		return false
+	}
+
+	problems := records.check()
+	if err := config.checkKeys(records); err != nil {
+		problems = append(problems, err)
+	}
+	for _, problem := range problems {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", config.recordsSource(), problem)
+	}
+	if len(problems) > 0 {
+		return false
+	}
+
+	fmt.Printf("%s and %s are valid\n", configFile, config.recordsSource())
+	return true
+}
+
+// check returns every problem with the records: records that cannot be
+// served, duplicated records, zones and views, CNAME records sharing their
+// name with other records and TTLs too large to be honoured.
+func (r *DNSRecords) check() []error {
+	var problems []error
+	if r.TTL > maxTTL {
+		problems = append(problems, fmt.Errorf("ttl %d is too large", r.TTL))
+	}
+
+	origins := map[string]bool{}
+	for _, zone := range r.Zones {
+		if origins[zone.Origin] {
+			problems = append(problems, fmt.Errorf("zone %s is listed more than once", zone.Origin))
+		}
+		origins[zone.Origin] = true
+
+		if _, ok := dns.IsDomainName(zone.Origin); !ok {
+			problems = append(problems, fmt.Errorf("invalid origin %q", zone.Origin))
+		}
+		if zone.TTL > maxTTL {
+			problems = append(problems, fmt.Errorf("ttl %d of zone %s is too large", zone.TTL, zone.Origin))
+		}
+		if zone.SOA.Minimum > maxTTL {
+			problems = append(problems, fmt.Errorf("soa minimum %d of zone %s is too large", zone.SOA.Minimum, zone.Origin))
+		}
+	}
+
+	problems = append(problems, checkRecords(r.Records, "")...)
+
+	names := map[string]bool{}
+	for _, view := range r.Views {
+		if names[view.Name] {
+			problems = append(problems, fmt.Errorf("view %s is listed more than once", view.Name))
+		}
+		names[view.Name] = true
+
+		problems = append(problems, checkRecords(view.Records, fmt.Sprintf(" in view %s", view.Name))...)
+	}
+
+	return problems
+}
+
+// checkRecords returns the problems with one set of records, those of the
+// global records or of a view, with where describing which.
+func checkRecords(records []DNSRecord, where string) []error {
+	var problems []error
+
+	seen := map[string]bool{}
+	types := map[string]map[uint16]bool{}
+	for _, record := range records {
+		if _, ok := dns.IsDomainName(record.Hostname); !ok {
+			problems = append(problems, fmt.Errorf("invalid hostname %q%s", record.Hostname, where))
+			continue
+		}
+		if record.rr == nil && record.dataKinds() > 1 {
+			problems = append(problems, fmt.Errorf("record for hostname %s%s holds more than one kind of data", record.Hostname, where))
+		}
+
+		rrs, err := record.RRs(record.Hostname)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("%v%s", err, where))
+			continue
+		}
+
+		for _, rr := range rrs {
+			// Other records take the TTL of their zone, checked above
+			if (record.rr != nil || record.TTL != 0) && rr.Header().Ttl > maxTTL {
+				problems = append(problems, fmt.Errorf("ttl %d of hostname %s%s is too large", rr.Header().Ttl, record.Hostname, where))
+			}
+
+			// Records are duplicates regardless of their TTL
+			key := dns.Copy(rr)
+			key.Header().Ttl = 0
+			if seen[key.String()] {
+				problems = append(problems, fmt.Errorf("duplicate %s record for hostname %s%s", dns.TypeToString[rr.Header().Rrtype], record.Hostname, where))
+			}
+			seen[key.String()] = true
+
+			if types[record.Hostname] == nil {
+				types[record.Hostname] = map[uint16]bool{}
+			}
+			types[record.Hostname][rr.Header().Rrtype] = true
+		}
+	}
+
+	for _, record := range records {
+		rrtypes := types[record.Hostname]
+		if rrtypes[dns.TypeCNAME] && len(rrtypes) > 1 {
+			problems = append(problems, fmt.Errorf("hostname %s%s has a CNAME record alongside other records", record.Hostname, where))
+			delete(types, record.Hostname)
+		}
+	}
+
+	return problems
+}
+
+// dataKinds returns how many kinds of record data the record holds, of
+// which only the first is served. An ip and ips together count as one.
+func (r DNSRecord) dataKinds() int {
+	kinds := 0
+	for _, set := range []bool{
+		r.Type != "",
+		r.IP != "" || len(r.IPs) > 0,
+		r.CNAME != "",
+		r.MX != nil,
+		len(r.TXT) > 0,
+		r.SRV != nil,
+		r.PTR != "",
+		r.CAA != nil,
+		r.SVCB != nil,
+		r.HTTPS != nil,
+		r.NAPTR != nil,
+		r.TLSA != nil,
+	} {
+		if set {
+			kinds++
+		}
+	}
+
+	return kinds
+}
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// Config represents the server configuration.
+type Config struct {
+	// RecordsFile is the path to the YAML file holding the DNS records.
+	RecordsFile string `yaml:"records_file"`
+
+	// Backend selects where the records are kept: "yaml" reads them from
+	// RecordsFile, "sqlite" keeps them in the SQLite database at
+	// DatabaseFile, and "postgres" and "mysql" in the database DatabaseDSN
+	// connects to, in the tables of DatabaseSchema if one is given. Dynamic
+	// updates are saved to databases atomically. "redis" and "etcd" read
+	// RecordsFile and add the records kept in Redis or etcd.
+	Backend        string `yaml:"backend"`
+	DatabaseFile   string `yaml:"database_file"`
+	DatabaseDSN    string `yaml:"database_dsn"`
+	DatabaseSchema string `yaml:"database_schema"`
+
+	// DatabasePollInterval is how often the records database is checked
+	// for changes made by other systems or servers sharing it, which are
+	// then served as a reload would serve them. With the postgres backend,
+	// changes announced with NOTIFY on DatabaseChannel are served at once.
+	DatabasePollInterval time.Duration `yaml:"database_poll_interval"`
+	DatabaseChannel      string        `yaml:"database_channel"`
+
+	// RedisAddress, RedisPassword and RedisDB select the Redis database of
+	// the redis backend, whose keys starting with RedisPrefix hold records.
+	RedisAddress  string `yaml:"redis_address"`
+	RedisPassword string `yaml:"redis_password"`
+	RedisDB       int    `yaml:"redis_db"`
+	RedisPrefix   string `yaml:"redis_prefix"`
+
+	// EtcdEndpoints, EtcdUsername and EtcdPassword select the etcd cluster
+	// of the etcd backend, whose keys below EtcdPrefix hold records in the
+	// layout of SkyDNS.
+	EtcdEndpoints []string `yaml:"etcd_endpoints"`
+	EtcdUsername  string   `yaml:"etcd_username"`
+	EtcdPassword  string   `yaml:"etcd_password"`
+	EtcdPrefix    string   `yaml:"etcd_prefix"`
+
+	// HostsFiles are files in the /etc/hosts format whose entries are
+	// served as A and AAAA records alongside those of the records file.
+	HostsFiles []string `yaml:"hosts_files"`
+
+	// DnsmasqFiles are dnsmasq configuration files whose address,
+	// host-record and cname options are served as records, and whose
+	// server options add upstreams and forwarding rules.
+	DnsmasqFiles []string `yaml:"dnsmasq_files"`
+
+	// StateFile is where dynamic updates to zones that are not read from a
+	// file of their own are saved, so that they survive restarts.
+	StateFile string `yaml:"state_file"`
+
+	// WatchFiles reloads the records whenever the records file, a file it
+	// includes, a hosts file or a zone file changes, as sending SIGHUP does.
+	WatchFiles bool `yaml:"watch_files"`
+
+	// Listen is the list of host:port endpoints to serve DNS on over UDP
+	// and TCP.
+	Listen []string `yaml:"listen"`
+
+	// UDPSockets is the number of UDP sockets opened for each listen
+	// address. More than one shares the address using SO_REUSEPORT so the
+	// kernel spreads queries across them, and zero opens one per CPU.
+	UDPSockets int `yaml:"udp_sockets"`
+
+	// Upstreams are the servers queries for non-local names are relayed
+	// to, tried in order. Each is a plain host:port, a tls:// DNS-over-TLS
+	// address or an https:// DNS-over-HTTPS URL. With none configured such
+	// queries are refused.
+	Upstreams []Upstream `yaml:"upstreams"`
+
+	// FallbackUpstreams are only used when none of the upstreams answer,
+	// for example plain servers to turn to when encrypted ones are
+	// blocked.
+	FallbackUpstreams []Upstream `yaml:"fallback_upstreams"`
+
+	// UpstreamStrategy selects how queries are sent to several upstreams:
+	// "sequential" tries them in order, while "race" queries them in
+	// parallel, starting each RaceStagger after the last, and takes the
+	// first answer.
+	UpstreamStrategy string        `yaml:"upstream_strategy"`
+	RaceStagger      time.Duration `yaml:"race_stagger"`
+
+	// CaseRandomization randomizes the case of the names in queries sent
+	// upstream and rejects answers that do not match it, unless an
+	// upstream turns it off for itself.
+	CaseRandomization bool `yaml:"case_randomization"`
+
+	// UpstreamTimeout is how long each attempt at a query waits for an
+	// upstream to answer, and UpstreamRetries how many more times the
+	// query is sent to it if an attempt fails. Retries are spaced by
+	// UpstreamRetryDelay, which doubles after each one under the
+	// "exponential" UpstreamBackoff and stays the same under "constant".
+	// Each upstream may override these for itself.
+	UpstreamTimeout    time.Duration `yaml:"upstream_timeout"`
+	UpstreamRetries    int           `yaml:"upstream_retries"`
+	UpstreamRetryDelay time.Duration `yaml:"upstream_retry_delay"`
+	UpstreamBackoff    string        `yaml:"upstream_backoff"`
+
+	// UpstreamPrivacy is the privacy profile of DNS-over-TLS and
+	// DNS-over-HTTPS upstreams: "strict" fails queries rather than send
+	// them in cleartext, while "opportunistic" falls back to plain DNS on
+	// port 53 of the same host when the encrypted transport fails.
+	UpstreamPrivacy string `yaml:"upstream_privacy"`
+
+	// UpstreamIdleTimeout is how long idle TCP, DNS-over-TLS and
+	// DNS-over-HTTPS connections to upstreams are kept open for reuse,
+	// unless the upstream asks for a shorter time (RFC 7828). Zero closes
+	// connections after each query.
+	UpstreamIdleTimeout time.Duration `yaml:"upstream_idle_timeout"`
+
+	// HealthCheck probes the upstreams periodically so that queries are
+	// only relayed to those that are answering.
+	HealthCheck HealthCheckConfig `yaml:"health_check"`
+
+	// ForwardRules relay queries for particular domains to their own
+	// upstream servers, ahead of the default upstreams or recursion.
+	ForwardRules []ForwardRule `yaml:"forward_rules"`
+
+	// Rewrites change answers before they are returned to clients, such
+	// as mapping public addresses to internal ones.
+	Rewrites []RewriteRule `yaml:"rewrites"`
+
+	// Download downloads the records file from a URL or an S3 bucket,
+	// and again every interval for changes.
+	Download RecordsDownload `yaml:"download"`
+
+	// Git keeps the records file and zone files in a Git repository that
+	// is cloned and pulled for changes.
+	Git GitConfig `yaml:"git"`
+
+	// Webhooks are sent the changes to the records served, whether they
+	// are made by editing the records, dynamic updates, zone transfers or
+	// the backends publishing them.
+	Webhooks []Webhook `yaml:"webhooks"`
+
+	// API serves an HTTP API to list and change the records of the zones
+	// at runtime.
+	API APIConfig `yaml:"api"`
+
+	// GRPC serves the management API of lacuna.proto over gRPC, with
+	// streaming of the changes to the records served.
+	GRPC GRPCConfig `yaml:"grpc"`
+
+	// ECS attaches the client's subnet to forwarded queries so that
+	// upstreams can tailor their answers to it.
+	ECS ECSConfig `yaml:"ecs"`
+
+	// DNS64 synthesizes AAAA records for remote names that only have A
+	// records, for IPv6-only clients behind a NAT64 gateway.
+	DNS64 DNS64Config `yaml:"dns64"`
+
+	// Consul answers names under its domain, such as web.service.consul,
+	// from the Consul catalog.
+	Consul ConsulConfig `yaml:"consul"`
+
+	// Remote answers the names of its zones by looking them up from an
+	// HTTP endpoint, in the manner of the PowerDNS remote backend.
+	Remote RemoteConfig `yaml:"remote"`
+
+	// Exec answers the names matching its pattern by running a program
+	// that is given the query as JSON.
+	Exec ExecConfig `yaml:"exec"`
+
+	// Lua runs the hooks of a Lua script as queries are received and
+	// before responses are sent, to route, filter or rewrite them.
+	Lua LuaConfig `yaml:"lua"`
+
+	// WASM passes queries to the filter and lookup functions of a
+	// WebAssembly plugin, loaded again as its module changes.
+	WASM WASMConfig `yaml:"wasm"`
+
+	// Kubernetes publishes the Services and Ingresses of a cluster in a
+	// zone of their own, such as web.default.k8s.lan.
+	Kubernetes KubernetesConfig `yaml:"kubernetes"`
+
+	// Docker publishes the names of running containers, removing them as
+	// the containers stop.
+	Docker DockerConfig `yaml:"docker"`
+
+	// Overlay publishes the machines of a Tailscale or WireGuard network in
+	// a zone of their own, such as laptop.vpn.lan.
+	Overlay OverlayConfig `yaml:"overlay"`
+
+	// LDAP publishes the hosts of an LDAP directory, such as Active
+	// Directory, in a zone of their own.
+	LDAP LDAPConfig `yaml:"ldap"`
+
+	// Filter answers the names of blocklists without resolving them, such
+	// as those of advertising and tracking domains.
+	Filter FilterConfig `yaml:"filter"`
+
+	// Route53 keeps a copy of a hosted zone of AWS Route 53, so that a
+	// public zone is also served on the LAN.
+	Route53 Route53Config `yaml:"route53"`
+
+	// MDNS resolves names such as printer.local that are not local by
+	// asking the LAN with multicast DNS.
+	MDNS MDNSConfig `yaml:"mdns"`
+
+	// CacheSize is the most responses to non-local queries held in the
+	// cache. Zero disables caching.
+	CacheSize int `yaml:"cache_size"`
+
+	// PrefetchHits is how often a cached response must be served before it
+	// is refreshed in the background shortly before expiring. Zero
+	// disables prefetching.
+	PrefetchHits int `yaml:"prefetch_hits"`
+
+	// ServeStale answers from expired cache entries when the upstreams
+	// cannot be reached, for up to StaleMaxAge after they expire.
+	ServeStale  bool          `yaml:"serve_stale"`
+	StaleMaxAge time.Duration `yaml:"stale_max_age"`
+
+	// Recursive resolves non-local names by iterating from the root
+	// servers instead of relaying them to the upstream servers.
+	Recursive bool `yaml:"recursive"`
+
+	// RootHints overrides the root server addresses used to prime the
+	// recursive resolver, for example to use a private root.
+	RootHints []string `yaml:"root_hints"`
+
+	// HonorRD answers queries with the RD flag clear from the cache alone,
+	// refusing them rather than resolving names that are not cached.
+	HonorRD bool `yaml:"honor_rd"`
+
+	// TCPTimeout is how long an idle TCP connection is kept open while
+	// waiting for the next query.
+	TCPTimeout time.Duration `yaml:"tcp_timeout"`
+
+	// MaxUDPSize is the largest UDP payload the server will send or
+	// advertise in its EDNS0 OPT record.
+	MaxUDPSize uint16 `yaml:"max_udp_size"`
+
+	// LocalDomain is appended to single-label queries, so that a query for
+	// "nas" is answered from the records of nas.<LocalDomain>.
+	LocalDomain string `yaml:"local_domain"`
+
+	// AutoPTR answers reverse lookups for the addresses of local A and
+	// AAAA records that have no explicit PTR record.
+	AutoPTR bool `yaml:"auto_ptr"`
+
+	// AnyQueries selects how ANY queries for local names are answered,
+	// either "minimal" or "aggregate".
+	AnyQueries string `yaml:"any_queries"`
+
+	// DNSSEC configures validation of non-local answers.
+	DNSSEC DNSSECConfig `yaml:"dnssec"`
+
+	// Chaos configures the CHAOS class version.bind and hostname.bind
+	// answers. Queries in classes other than IN are otherwise refused.
+	Chaos ChaosConfig `yaml:"chaos"`
+
+	// TSIGKeys are the shared secrets that zones may require zone transfers,
+	// NOTIFY and dynamic updates to be signed with.
+	TSIGKeys []TSIGKey `yaml:"tsig_keys"`
+
+	// TLS configures the optional DNS-over-TLS listener.
+	TLS TLSConfig `yaml:"tls"`
+
+	// QUIC configures the optional DNS-over-QUIC listener.
+	QUIC QUICConfig `yaml:"quic"`
+}
+
+// DefaultConfig returns the configuration used when no config file exists.
+func DefaultConfig() *Config {
+	return &Config{
+		RecordsFile:   "dns_records.yaml",
+		Backend:       backendYAML,
+		RedisAddress:  "localhost:6379",
+		RedisPrefix:   "dns",
+		EtcdEndpoints: []string{"localhost:2379"},
+		EtcdPrefix:    "/skydns",
+		Listen:        []string{"0.0.0.0:53"},
+		UDPSockets:    1,
+		ECS: ECSConfig{
+			IPv4Prefix: 24,
+			IPv6Prefix: 56,
+		},
+		DNS64: DNS64Config{
+			Prefix: "64:ff9b::/96",
+		},
+		Consul: ConsulConfig{
+			Address: "http://127.0.0.1:8500",
+			Domain:  "consul.",
+		},
+		Remote: RemoteConfig{
+			Timeout: 2 * time.Second,
+		},
+		Exec: ExecConfig{
+			Timeout: 2 * time.Second,
+		},
+		Lua: LuaConfig{
+			Timeout: 100 * time.Millisecond,
+		},
+		WASM: WASMConfig{
+			Timeout: 100 * time.Millisecond,
+		},
+		Kubernetes: KubernetesConfig{
+			Zone: "k8s.lan.",
+		},
+		Docker: DockerConfig{
+			Host:          "unix:///var/run/docker.sock",
+			Domain:        "docker.lan.",
+			HostnameLabel: "lacuna.hostname",
+			Addresses:     dockerAddressContainer,
+		},
+		Overlay: OverlayConfig{
+			Source:   overlayTailscale,
+			Socket:   "/var/run/tailscale/tailscaled.sock",
+			Zone:     "vpn.lan.",
+			Interval: time.Minute,
+		},
+		Download: RecordsDownload{
+			Interval: 5 * time.Minute,
+			Region:   "us-east-1",
+		},
+		Git: GitConfig{
+			Branch:   "main",
+			Interval: time.Minute,
+		},
+		API: APIConfig{
+			Listen: "127.0.0.1:8080",
+		},
+		GRPC: GRPCConfig{
+			Listen: "127.0.0.1:8081",
+		},
+		LDAP: LDAPConfig{
+			Filter: "(objectClass=ipHost)",
+			Attributes: LDAPAttributes{
+				Hostname:  "cn",
+				Addresses: "ipHostNumber",
+			},
+			Timeout:  10 * time.Second,
+			Interval: 5 * time.Minute,
+		},
+		Filter: FilterConfig{
+			RefreshInterval: 24 * time.Hour,
+			Response:        filterNull,
+			TTL:             60,
+		},
+		Route53: Route53Config{
+			Endpoint: "https://route53.amazonaws.com",
+			Interval: 5 * time.Minute,
+		},
+		MDNS: MDNSConfig{
+			Domains: []string{"local."},
+			Timeout: time.Second,
+		},
+		CacheSize:           10000,
+		StaleMaxAge:         24 * time.Hour,
+		Upstreams:           []Upstream{{Address: "8.8.8.8:53"}},
+		UpstreamStrategy:    strategySequential,
+		UpstreamTimeout:     2 * time.Second,
+		UpstreamRetryDelay:  100 * time.Millisecond,
+		UpstreamBackoff:     backoffExponential,
+		UpstreamPrivacy:     privacyStrict,
+		UpstreamIdleTimeout: 30 * time.Second,
+		HealthCheck: HealthCheckConfig{
+			Interval:   30 * time.Second,
+			MaxBackoff: 10 * time.Minute,
+			Timeout:    2 * time.Second,
+		},
+		HonorRD:    true,
+		TCPTimeout: 10 * time.Second,
+		MaxUDPSize: 1232,
+		AnyQueries: anyMinimal,
+		DNSSEC: DNSSECConfig{
+			TrustAnchors: []string{rootTrustAnchor},
+		},
+		Chaos: ChaosConfig{
+			Version: "lacuna",
+		},
+		TLS: TLSConfig{
+			Port:       853,
+			MinVersion: "1.2",
+		},
+		QUIC: QUICConfig{
+			Port: 853,
+		},
+	}
+}
+
+// recordsSource returns where the records are kept for messages: the
+// records file, the database file of the sqlite backend, or the backend of
+// another database, whose connection string may hold a password.
+func (c *Config) recordsSource() string {
+	switch c.Backend {
+	case backendYAML:
+		return c.RecordsFile
+	case backendSQLite:
+		return c.DatabaseFile
+	case backendRedis:
+		return c.RecordsFile + " and Redis"
+	case backendEtcd:
+		return c.RecordsFile + " and etcd"
+	}
+
+	return "the " + c.Backend + " database"
+}
+
+// databaseBackend reports whether the records are kept in a records
+// database rather than the records file.
+func (c *Config) databaseBackend() bool {
+	switch c.Backend {
+	case backendSQLite, backendPostgres, backendMySQL:
+		return true
+	}
+
+	return false
+}
+
+// staleWindow returns how long expired cache entries are kept to be served
+// stale, which is zero unless serve-stale is enabled.
+func (c *Config) staleWindow() time.Duration {
+	if !c.ServeStale {
+		return 0
+	}
+
+	return c.StaleMaxAge
+}
+
+// allUpstreams returns every upstream server the configuration relays
+// queries to.
+func (c *Config) allUpstreams() []Upstream {
+	upstreams := append([]Upstream{}, c.Upstreams...)
+	upstreams = append(upstreams, c.FallbackUpstreams...)
+	for _, rule := range c.ForwardRules {
+		upstreams = append(upstreams, rule.Upstreams...)
+	}
+
+	return upstreams
+}
+
+// LoadConfig loads the server configuration from a YAML file. Any setting
+// missing from the file keeps its default value, and a missing file yields
+// the default configuration. References to environment variables in string
+// settings, written ${NAME}, are replaced by their values.
+func LoadConfig(filename string) (*Config, error) {
+	config := DefaultConfig()
+
+	// The default upstreams only apply if neither the config file nor a
+	// dnsmasq file names any, which leaves them nil
+	defaultUpstreams := config.Upstreams
+	config.Upstreams = nil
+
+	// Without a config file the defaults are prepared and checked as if
+	// they had been read from one
+	file, err := os.Open(filename)
+	switch {
+	case os.IsNotExist(err):
+		log.Printf("No config file found at %s, using defaults", filename)
+	case err != nil:
+		return nil, err
+	default:
+		defer file.Close()
+		err = yaml.NewDecoder(file).Decode(config)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = expandEnv(reflect.ValueOf(config).Elem())
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Backend {
+	case backendYAML:
+	case backendRedis:
+		if config.RedisPrefix == "" {
+			return nil, fmt.Errorf("the redis backend needs a redis_prefix")
+		}
+	case backendEtcd:
+		if len(config.EtcdEndpoints) == 0 || strings.Trim(config.EtcdPrefix, "/") == "" {
+			return nil, fmt.Errorf("the etcd backend needs etcd_endpoints and an etcd_prefix")
+		}
+	case backendSQLite:
+		if config.DatabaseFile == "" {
+			return nil, fmt.Errorf("the sqlite backend needs a database_file")
+		}
+	case backendPostgres, backendMySQL:
+		if config.DatabaseDSN == "" {
+			return nil, fmt.Errorf("the %s backend needs a database_dsn", config.Backend)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported backend %q", config.Backend)
+	}
+	if config.DatabaseChannel != "" && config.Backend != backendPostgres {
+		return nil, fmt.Errorf("database_channel needs the postgres backend")
+	}
+	if config.DatabasePollInterval < 0 {
+		return nil, fmt.Errorf("invalid database_poll_interval %v", config.DatabasePollInterval)
+	}
+	if config.AnyQueries != anyMinimal && config.AnyQueries != anyAggregate {
+		return nil, fmt.Errorf("unsupported any_queries %q", config.AnyQueries)
+	}
+	if config.UpstreamStrategy != strategySequential && config.UpstreamStrategy != strategyRace {
+		return nil, fmt.Errorf("unsupported upstream_strategy %q", config.UpstreamStrategy)
+	}
+	if config.UpstreamBackoff != backoffConstant && config.UpstreamBackoff != backoffExponential {
+		return nil, fmt.Errorf("unsupported upstream_backoff %q", config.UpstreamBackoff)
+	}
+	if config.UpstreamPrivacy != privacyOpportunistic && config.UpstreamPrivacy != privacyStrict {
+		return nil, fmt.Errorf("unsupported upstream_privacy %q", config.UpstreamPrivacy)
+	}
+	if config.HealthCheck.Enabled && config.HealthCheck.Interval <= 0 {
+		return nil, fmt.Errorf("invalid health_check interval %v", config.HealthCheck.Interval)
+	}
+	if config.UDPSockets < 0 {
+		return nil, fmt.Errorf("invalid udp_sockets %d", config.UDPSockets)
+	}
+	if config.ECS.IPv4Prefix < 0 || config.ECS.IPv4Prefix > 32 {
+		return nil, fmt.Errorf("invalid ecs ipv4_prefix %d", config.ECS.IPv4Prefix)
+	}
+	if config.ECS.IPv6Prefix < 0 || config.ECS.IPv6Prefix > 128 {
+		return nil, fmt.Errorf("invalid ecs ipv6_prefix %d", config.ECS.IPv6Prefix)
+	}
+
+	if config.DNS64.Enabled {
+		err = config.DNS64.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Consul.Enabled {
+		err = config.Consul.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Remote.Enabled {
+		err = config.Remote.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Exec.Enabled {
+		err = config.Exec.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Lua.Enabled {
+		err = config.Lua.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.WASM.Enabled {
+		err = config.WASM.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Kubernetes.Enabled {
+		err = config.Kubernetes.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Docker.Enabled {
+		err = config.Docker.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Overlay.Enabled {
+		err = config.Overlay.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.LDAP.Enabled {
+		err = config.LDAP.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Filter.Enabled {
+		err = config.Filter.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Route53.Enabled {
+		err = config.Route53.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.MDNS.Enabled {
+		err = config.MDNS.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.LocalDomain != "" {
+		config.LocalDomain = dns.CanonicalName(config.LocalDomain)
+	}
+
+	for i := range config.Rewrites {
+		err = config.Rewrites[i].parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Download.Enabled {
+		if config.Backend != backendYAML {
+			return nil, fmt.Errorf("download needs the yaml backend")
+		}
+		err = config.Download.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Git.Enabled {
+		err = config.Git.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range config.Webhooks {
+		err = config.Webhooks[i].parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.API.Enabled {
+		err = config.API.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if config.GRPC.Enabled {
+		err = config.GRPC.parse()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, filename := range config.DnsmasqFiles {
+		dnsmasq, err := readDnsmasqFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		config.Upstreams = append(config.Upstreams, dnsmasq.upstreams...)
+		config.ForwardRules = append(config.ForwardRules, dnsmasq.forwardRules...)
+	}
+	if config.Upstreams == nil {
+		config.Upstreams = defaultUpstreams
+	}
+
+	err = config.prepareUpstreams(config.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+	err = config.prepareUpstreams(config.FallbackUpstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range config.TSIGKeys {
+		err = config.TSIGKeys[i].prepare()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range config.ForwardRules {
+		rule := &config.ForwardRules[i]
+		rule.Domain = dns.CanonicalName(rule.Domain)
+		err = config.prepareUpstreams(rule.Upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, upstreams := range config.Lua.Routes {
+		err = config.prepareUpstreams(upstreams)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfigWithoutFile(t *testing.T) {
+	config, err := LoadConfig(filepath.Join(t.TempDir(), "missing.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The default upstreams are prepared as those of a config file are
+	if len(config.Upstreams) != 1 {
+		t.Fatalf("got upstreams %v, want the default", config.Upstreams)
+	}
+	upstream := config.Upstreams[0]
+	if upstream.Timeout != config.UpstreamTimeout || upstream.Retries == nil || *upstream.Retries != config.UpstreamRetries {
+		t.Fatalf("got upstream %+v, want the default timeout and retries", upstream)
+	}
+	if upstream.CaseRandomization == nil || upstream.Backoff != config.UpstreamBackoff {
+		t.Fatalf("got upstream %+v, want the default case randomization and backoff", upstream)
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// consulTimeout is how long a query to the Consul HTTP API may take.
+const consulTimeout = 2 * time.Second
+
+// consulClient sends the queries to the Consul HTTP API.
+var consulClient = &http.Client{Timeout: consulTimeout}
+
+// ConsulConfig answers names under Domain from the Consul catalog, in the
+// forms Consul's own DNS interface answers: service.service.consul and
+// tag.service.service.consul, _service._tag.service.consul for SRV queries,
+// node.node.consul, each optionally followed by a datacenter before the
+// domain.
+type ConsulConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Address is the URL of the Consul HTTP API, and Token the ACL token
+	// its queries are made with, if any.
+	Address string `yaml:"address"`
+	Token   string `yaml:"token"`
+
+	// Domain is the suffix of the names answered from Consul.
+	Domain string `yaml:"domain"`
+
+	// TTL is the time-to-live of the answers, zero by default as with
+	// Consul, so that clients always see the healthy instances.
+	TTL uint32 `yaml:"ttl"`
+}
+
+// parse validates the Consul address and canonicalises the domain.
+func (c *ConsulConfig) parse() error {
+	address, err := url.Parse(c.Address)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return fmt.Errorf("invalid consul address %q", c.Address)
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("consul needs a domain")
+	}
+
+	c.Address = strings.TrimSuffix(c.Address, "/")
+	c.Domain = dns.CanonicalName(c.Domain)
+	return nil
+}
+
+// consulNode is a node of the Consul catalog.
+type consulNode struct {
+	Node       string `json:"Node"`
+	Address    string `json:"Address"`
+	Datacenter string `json:"Datacenter"`
+}
+
+// consulInstance is a healthy instance of a service, as the health endpoint
+// of the Consul HTTP API lists it.
+type consulInstance struct {
+	Node    consulNode `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    uint16 `json:"Port"`
+	} `json:"Service"`
+}
+
+// consulGet queries the Consul HTTP API, decoding the JSON it answers with
+// into value. It reports false if Consul knows nothing of what was asked.
+func (c *ConsulConfig) consulGet(path string, query url.Values, value interface{}) (bool, error) {
+	request, err := http.NewRequest(http.MethodGet, c.Address+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	if c.Token != "" {
+		request.Header.Set("X-Consul-Token", c.Token)
+	}
+
+	response, err := consulClient.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("consul answered %s for %s", response.Status, path)
+	}
+
+	err = json.NewDecoder(response.Body).Decode(value)
+	return err == nil, err
+}
+
+// consulKinds are the kinds of names under the Consul domain, given by the
+// label before the domain or the datacenter.
+var consulKinds = map[string]bool{"service": true, "node": true, "addr": true}
+
+// consulQuery is what a query for a name under the Consul domain asks for.
+type consulQuery struct {
+	kind       string
+	name       string
+	tag        string
+	datacenter string
+}
+
+// parseConsulName parses a name under the Consul domain, returning false if
+// it is not of a form Consul answers.
+func (c *ConsulConfig) parseConsulName(name string) (consulQuery, bool) {
+	labels := dns.SplitDomainName(strings.ToLower(strings.TrimSuffix(dns.CanonicalName(name), c.Domain)))
+	var query consulQuery
+	switch n := len(labels); {
+	case n >= 2 && consulKinds[labels[n-1]]:
+		query.kind = labels[n-1]
+		labels = labels[:n-1]
+	case n >= 3 && consulKinds[labels[n-2]]:
+		query.kind, query.datacenter = labels[n-2], labels[n-1]
+		labels = labels[:n-2]
+	default:
+		return query, false
+	}
+
+	switch {
+	case query.kind == "service" && len(labels) == 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_"):
+		// An RFC 2782 name, whose protocol stands for any tag
+		query.name = labels[0][1:]
+		if tag := labels[1][1:]; tag != "tcp" && tag != "udp" {
+			query.tag = tag
+		}
+	case query.kind == "service" && len(labels) == 2:
+		query.tag, query.name = labels[0], labels[1]
+	case len(labels) == 1:
+		query.name = labels[0]
+	default:
+		return query, false
+	}
+
+	return query, query.name != ""
+}
+
+// consulAddressRR returns the A or AAAA record giving name the address, or
+// nil if the address is not one of the type asked for.
+func (c *ConsulConfig) consulAddressRR(name, address string, qtype uint16) dns.RR {
+	ip := net.ParseIP(address)
+	header := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: c.TTL}
+	switch {
+	case ip == nil:
+		return nil
+	case ip.To4() != nil && (qtype == dns.TypeA || qtype == dns.TypeANY):
+		header.Rrtype = dns.TypeA
+		return &dns.A{Hdr: header, A: ip.To4()}
+	case ip.To4() == nil && (qtype == dns.TypeAAAA || qtype == dns.TypeANY):
+		header.Rrtype = dns.TypeAAAA
+		return &dns.AAAA{Hdr: header, AAAA: ip}
+	}
+
+	return nil
+}
+
+// consulSOA returns the SOA record given with negative answers for names
+// under the Consul domain.
+func (c *ConsulConfig) consulSOA() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: c.Domain, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: c.TTL},
+		Ns:      "ns." + c.Domain,
+		Mbox:    "hostmaster." + c.Domain,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  c.TTL,
+	}
+}
+
+// consulHandler answers the names under the Consul domain from its
+// catalog.
+func (s *dnsServer) consulHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	if !s.config.Consul.Enabled || !dns.IsSubDomain(s.config.Consul.Domain, q.request.Question[0].Name) {
+		return next()
+	}
+
+	s.answerConsul(q.request, q.response)
+	return q.response
+}
+
+// answerConsul answers a query for a name under the Consul domain from the
+// Consul catalog. Services are answered with the addresses of their healthy
+// instances, and SRV queries with their ports, each pointing at the node of
+// the instance, or at an address name when the instance has an address of
+// its own, whose records are given as additional records.
+func (s *dnsServer) answerConsul(request *dns.Msg, response *dns.Msg) {
+	c := &s.config.Consul
+	question := request.Question[0]
+	response.Authoritative = true
+	if dns.CanonicalName(question.Name) == c.Domain {
+		if question.Qtype == dns.TypeSOA || question.Qtype == dns.TypeANY {
+			response.Answer = []dns.RR{c.consulSOA()}
+		} else {
+			response.Ns = []dns.RR{c.consulSOA()}
+		}
+		return
+	}
+
+	query, ok := c.parseConsulName(question.Name)
+	if !ok {
+		response.Rcode = dns.RcodeNameError
+		response.Ns = []dns.RR{c.consulSOA()}
+		return
+	}
+
+	params := url.Values{}
+	if query.datacenter != "" {
+		params.Set("dc", query.datacenter)
+	}
+
+	var answers, extra []dns.RR
+	var found bool
+	var err error
+	switch query.kind {
+	case "service":
+		var instances []consulInstance
+		params.Set("passing", "")
+		if query.tag != "" {
+			params.Set("tag", query.tag)
+		}
+		found, err = c.consulGet("/v1/health/service/"+url.PathEscape(query.name), params, &instances)
+		found = found && len(instances) > 0
+		for _, instance := range instances {
+			address := instance.Service.Address
+			target := dns.Fqdn(instance.Node.Node) + "node." + dns.Fqdn(instance.Node.Datacenter) + c.Domain
+			if address == "" || address == instance.Node.Address {
+				address = instance.Node.Address
+			} else if ip := net.ParseIP(address); ip != nil {
+				if ip.To4() != nil {
+					ip = ip.To4()
+				}
+				target = hex.EncodeToString(ip) + ".addr." + dns.Fqdn(instance.Node.Datacenter) + c.Domain
+			} else {
+				target = dns.Fqdn(address)
+			}
+
+			if question.Qtype == dns.TypeSRV {
+				answers = append(answers, &dns.SRV{
+					Hdr:      dns.RR_Header{Name: question.Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: c.TTL},
+					Priority: 1,
+					Weight:   1,
+					Port:     instance.Service.Port,
+					Target:   target,
+				})
+				for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+					if rr := c.consulAddressRR(target, address, qtype); rr != nil {
+						extra = append(extra, rr)
+					}
+				}
+			} else if rr := c.consulAddressRR(question.Name, address, question.Qtype); rr != nil {
+				answers = append(answers, rr)
+			}
+		}
+	case "node":
+		var node struct {
+			Node *consulNode `json:"Node"`
+		}
+		found, err = c.consulGet("/v1/catalog/node/"+url.PathEscape(query.name), params, &node)
+		found = found && node.Node != nil
+		if found {
+			if rr := c.consulAddressRR(question.Name, node.Node.Address, question.Qtype); rr != nil {
+				answers = append(answers, rr)
+			}
+		}
+	case "addr":
+		ip, decodeErr := hex.DecodeString(query.name)
+		found = decodeErr == nil && (len(ip) == net.IPv4len || len(ip) == net.IPv6len)
+		if found {
+			if rr := c.consulAddressRR(question.Name, net.IP(ip).String(), question.Qtype); rr != nil {
+				answers = append(answers, rr)
+			}
+		}
+	}
+	if err != nil {
+		log.Printf("Failed to query Consul for %s: %v", question.Name, err)
+		response.Authoritative = false
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	rotate(answers, atomic.AddUint64(&s.rotation, 1))
+	response.Answer = answers
+	response.Extra = extra
+	if !found {
+		response.Rcode = dns.RcodeNameError
+	}
+	if len(answers) == 0 {
+		response.Ns = []dns.RR{c.consulSOA()}
+	}
+}
@@ -0,0 +1,643 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+	_ "modernc.org/sqlite"
+)
+
+// Backends the records can be kept in.
+const (
+	backendYAML     = "yaml"
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+	backendMySQL    = "mysql"
+	backendRedis    = "redis"
+	backendEtcd     = "etcd"
+)
+
+// settleDelay is how long the server waits after a change to the records of
+// a key-value store is announced before reloading, so that a burst of
+// changes, such as those of a script setting many keys, is served with a
+// single reload.
+const settleDelay = 100 * time.Millisecond
+
+// databaseSchemas create the tables of a records database for each backend.
+// Zones and views keep their settings in the records file format, while
+// every record is a row of its own, in the master file format, so that the
+// records can be queried and edited with SQL. Records of a view give its
+// name as their view_name, while the global records, including those of
+// zones, leave it empty. Table names are written in braces, to be qualified
+// with the configured schema.
+var databaseSchemas = map[string]string{
+	backendSQLite: `
+CREATE TABLE IF NOT EXISTS {settings} (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {zones} (
+	origin TEXT PRIMARY KEY,
+	settings TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS {views} (
+	name TEXT PRIMARY KEY,
+	position INTEGER NOT NULL DEFAULT 0,
+	settings TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS {records} (
+	id INTEGER PRIMARY KEY,
+	view_name TEXT NOT NULL DEFAULT '',
+	hostname TEXT NOT NULL,
+	type TEXT NOT NULL,
+	data TEXT NOT NULL,
+	ttl INTEGER NOT NULL DEFAULT 0,
+	expires TEXT
+);
+CREATE INDEX IF NOT EXISTS records_hostname ON {records} (hostname)`,
+
+	backendPostgres: `
+CREATE TABLE IF NOT EXISTS {settings} (
+	name TEXT PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {zones} (
+	origin TEXT PRIMARY KEY,
+	settings TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS {views} (
+	name TEXT PRIMARY KEY,
+	position INTEGER NOT NULL DEFAULT 0,
+	settings TEXT NOT NULL DEFAULT ''
+);
+CREATE TABLE IF NOT EXISTS {records} (
+	id BIGSERIAL PRIMARY KEY,
+	view_name TEXT NOT NULL DEFAULT '',
+	hostname TEXT NOT NULL,
+	type TEXT NOT NULL,
+	data TEXT NOT NULL,
+	ttl BIGINT NOT NULL DEFAULT 0,
+	expires TEXT
+);
+CREATE INDEX IF NOT EXISTS records_hostname ON {records} (hostname)`,
+
+	backendMySQL: `
+CREATE TABLE IF NOT EXISTS {settings} (
+	name VARCHAR(255) PRIMARY KEY,
+	value TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {zones} (
+	origin VARCHAR(255) PRIMARY KEY,
+	settings TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {views} (
+	name VARCHAR(255) PRIMARY KEY,
+	position INTEGER NOT NULL DEFAULT 0,
+	settings TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS {records} (
+	id BIGINT AUTO_INCREMENT PRIMARY KEY,
+	view_name VARCHAR(255) NOT NULL DEFAULT '',
+	hostname VARCHAR(255) NOT NULL,
+	type VARCHAR(16) NOT NULL,
+	data TEXT NOT NULL,
+	ttl BIGINT NOT NULL DEFAULT 0,
+	expires VARCHAR(32),
+	INDEX records_hostname (hostname)
+)`,
+}
+
+// databaseTables are the tables of a records database.
+var databaseTables = []string{"settings", "zones", "views", "records"}
+
+// recordsDatabase is the database a database backend keeps the records in.
+type recordsDatabase struct {
+	*sql.DB
+	backend string
+	tables  *strings.Replacer
+}
+
+// openDatabase opens the records database of the configured backend,
+// creating its tables if they do not exist yet. Writes to a SQLite database
+// wait for other writers, such as an operator's sqlite3 shell, for up to
+// five seconds.
+func openDatabase(config *Config) (*recordsDatabase, error) {
+	var db *sql.DB
+	var err error
+	switch config.Backend {
+	case backendSQLite:
+		db, err = sql.Open("sqlite", config.DatabaseFile+"?_pragma=busy_timeout(5000)")
+	case backendPostgres, backendMySQL:
+		db, err = sql.Open(config.Backend, config.DatabaseDSN)
+	default:
+		return nil, fmt.Errorf("the %s backend does not keep records in a database", config.Backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, table := range databaseTables {
+		name := table
+		if config.DatabaseSchema != "" {
+			name = config.DatabaseSchema + "." + table
+		}
+		names = append(names, "{"+table+"}", name)
+	}
+	database := &recordsDatabase{DB: db, backend: config.Backend, tables: strings.NewReplacer(names...)}
+
+	// Statements are run one at a time, as MySQL takes no more at once
+	for _, statement := range strings.Split(databaseSchemas[config.Backend], ";") {
+		if strings.TrimSpace(statement) == "" {
+			continue
+		}
+		_, err = db.Exec(database.query(statement))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+
+	return database, nil
+}
+
+// query returns a query written with ? placeholders and table names in
+// braces in the form the database takes.
+func (d *recordsDatabase) query(text string) string {
+	text = d.tables.Replace(text)
+	if d.backend != backendPostgres {
+		return text
+	}
+
+	var query strings.Builder
+	n := 0
+	for _, c := range text {
+		if c == '?' {
+			n++
+			fmt.Fprintf(&query, "$%d", n)
+			continue
+		}
+		query.WriteRune(c)
+	}
+
+	return query.String()
+}
+
+// readDatabase reads the records kept in the records database, in the form
+// the records file would hold them.
+func readDatabase(config *Config) (*DNSRecords, error) {
+	db, err := openDatabase(config)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	records := &DNSRecords{}
+	var ttl string
+	err = db.QueryRow(db.query(`SELECT value FROM {settings} WHERE name = 'ttl'`)).Scan(&ttl)
+	if err == nil {
+		value, err := strconv.ParseUint(ttl, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ttl setting %q", ttl)
+		}
+		records.TTL = uint32(value)
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	rows, err := db.Query(db.query(`SELECT origin, settings FROM {zones} ORDER BY origin`))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var origin, settings string
+		var zone Zone
+		err = rows.Scan(&origin, &settings)
+		if err == nil {
+			err = yaml.Unmarshal([]byte(settings), &zone)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("invalid settings of zone %s: %v", origin, err)
+		}
+		zone.Origin = origin
+		records.Zones = append(records.Zones, zone)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	views := map[string]int{}
+	rows, err = db.Query(db.query(`SELECT name, settings FROM {views} ORDER BY position, name`))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, settings string
+		var view View
+		err = rows.Scan(&name, &settings)
+		if err == nil {
+			err = yaml.Unmarshal([]byte(settings), &view)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("invalid settings of view %s: %v", name, err)
+		}
+		view.Name = name
+		views[name] = len(records.Views)
+		records.Views = append(records.Views, view)
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return nil, rows.Err()
+	}
+
+	rows, err = db.Query(db.query(`SELECT id, view_name, hostname, type, data, ttl, expires FROM {records} ORDER BY id`))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var view string
+		var expires sql.NullString
+		var record DNSRecord
+		err := rows.Scan(&id, &view, &record.Hostname, &record.Type, &record.Data, &record.TTL, &expires)
+		if err != nil {
+			return nil, err
+		}
+		if expires.Valid && expires.String != "" {
+			record.Expires, err = time.Parse(time.RFC3339, expires.String)
+			if err != nil {
+				return nil, fmt.Errorf("invalid expires time of record %d: %v", id, err)
+			}
+		}
+
+		if view == "" {
+			records.Records = append(records.Records, record)
+			continue
+		}
+		i, ok := views[view]
+		if !ok {
+			return nil, fmt.Errorf("record %d belongs to unknown view %s", id, view)
+		}
+		records.Views[i].Records = append(records.Views[i].Records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// importRecords replaces the contents of the records database with those
+// of a records file and the files it includes. Generated records and the
+// records of zones are stored as rows of their own, while zones read from a
+// file of their own keep reading it.
+func importRecords(configFile, filename string) error {
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+	if !config.databaseBackend() {
+		return fmt.Errorf("no database backend is configured in %s", configFile)
+	}
+	if filename == "" {
+		filename = config.RecordsFile
+	}
+
+	records, err := readRecordsFile(filename, map[string]bool{})
+	if err != nil {
+		return err
+	}
+
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range databaseTables {
+		_, err = tx.Exec(db.query(`DELETE FROM {` + table + `}`))
+		if err != nil {
+			return err
+		}
+	}
+	if records.TTL != 0 {
+		_, err = tx.Exec(db.query(`INSERT INTO {settings} (name, value) VALUES ('ttl', ?)`), strconv.FormatUint(uint64(records.TTL), 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	global, err := generateRecords(records.Generate)
+	if err != nil {
+		return err
+	}
+	global = append(records.Records, global...)
+
+	count := 0
+	for _, zone := range records.Zones {
+		generated, err := generateRecords(zone.Generate)
+		if err != nil {
+			return fmt.Errorf("%v in zone %s", err, zone.Origin)
+		}
+		zone.Records = append(zone.Records, generated...)
+		global = append(global, zone.qualifiedRecords()...)
+
+		zone.Records, zone.Generate = nil, nil
+		err = db.insertSettings(tx, "zones", "origin", zone.Origin, zone, -1)
+		if err != nil {
+			return err
+		}
+	}
+	n, err := db.insertRecords(tx, "", global)
+	if err != nil {
+		return err
+	}
+	count += n
+
+	for i, view := range records.Views {
+		n, err := db.insertRecords(tx, view.Name, view.Records)
+		if err != nil {
+			return fmt.Errorf("%v in view %s", err, view.Name)
+		}
+		count += n
+
+		view.Records = nil
+		err = db.insertSettings(tx, "views", "name", view.Name, view, i)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Imported %d records in %d zones from %s into %s", count, len(records.Zones), filename, config.recordsSource())
+	return nil
+}
+
+// insertSettings inserts the settings of a zone or view into its table,
+// with the view's position if it has one.
+func (d *recordsDatabase) insertSettings(tx *sql.Tx, table, key, name string, settings interface{}, position int) error {
+	data, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+
+	if position < 0 {
+		_, err = tx.Exec(d.query(`INSERT INTO {`+table+`} (`+key+`, settings) VALUES (?, ?)`), name, string(data))
+	} else {
+		_, err = tx.Exec(d.query(`INSERT INTO {`+table+`} (`+key+`, position, settings) VALUES (?, ?, ?)`), name, position, string(data))
+	}
+
+	return err
+}
+
+// insertRecords inserts records into the records table as rows in the
+// master file format, one for each resource record they are served as, and
+// returns how many were inserted. Each row keeps the record's own TTL, or
+// zero to take the default of its zone.
+func (d *recordsDatabase) insertRecords(tx *sql.Tx, view string, records []DNSRecord) (int, error) {
+	count := 0
+	for _, record := range records {
+		hostname := canonicalHostname(record.Hostname)
+		rrs, err := record.RRs(hostname)
+		if err != nil {
+			return count, err
+		}
+
+		var expires sql.NullString
+		if !record.Expires.IsZero() {
+			expires = sql.NullString{String: record.Expires.UTC().Format(time.RFC3339), Valid: true}
+		}
+		for _, rr := range rrs {
+			header := rr.Header()
+			_, err = tx.Exec(d.query(`INSERT INTO {records} (view_name, hostname, type, data, ttl, expires) VALUES (?, ?, ?, ?, ?, ?)`),
+				view, hostname, dns.Type(header.Rrtype).String(), strings.TrimPrefix(rr.String(), header.String()), record.TTL, expires)
+			if err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// saveZoneDatabase saves a zone's SOA and NS settings and its records to the
+// records database in a single transaction, replacing the rows of the
+// records it held before. The zones of records decide which rows belong to
+// the zone.
+func saveZoneDatabase(config *Config, records *DNSRecords, zone *Zone, zoneRecords []DNSRecord) error {
+	db, err := openDatabase(config)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var settings string
+	err = tx.QueryRow(db.query(`SELECT settings FROM {zones} WHERE origin = ?`), zone.Origin).Scan(&settings)
+	if err != nil {
+		return err
+	}
+	var saved Zone
+	err = yaml.Unmarshal([]byte(settings), &saved)
+	if err != nil {
+		return err
+	}
+	saved.SOA, saved.NS = zone.SOA, zone.NS
+	data, err := yaml.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(db.query(`UPDATE {zones} SET settings = ? WHERE origin = ?`), string(data), zone.Origin)
+	if err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(db.query(`SELECT id, hostname FROM {records} WHERE view_name = ''`))
+	if err != nil {
+		return err
+	}
+	var held []int64
+	for rows.Next() {
+		var id int64
+		var hostname string
+		err = rows.Scan(&id, &hostname)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if owner := records.FindZone(canonicalHostname(hostname)); owner != nil && owner.Origin == zone.Origin {
+			held = append(held, id)
+		}
+	}
+	rows.Close()
+	if rows.Err() != nil {
+		return rows.Err()
+	}
+	for _, id := range held {
+		_, err = tx.Exec(db.query(`DELETE FROM {records} WHERE id = ?`), id)
+		if err != nil {
+			return err
+		}
+	}
+
+	var saves []DNSRecord
+	for _, record := range zoneRecords {
+		saves = append(saves, savedRecord(record))
+	}
+	_, err = db.insertRecords(tx, "", saves)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// databaseFingerprint returns a hash of the contents of the records
+// database, which changes whenever any of its rows do.
+func databaseFingerprint(config *Config) ([]byte, error) {
+	db, err := openDatabase(config)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	hash := sha256.New()
+	for _, query := range []string{
+		`SELECT name, value FROM {settings} ORDER BY name`,
+		`SELECT origin, settings FROM {zones} ORDER BY origin`,
+		`SELECT name, position, settings FROM {views} ORDER BY name`,
+		`SELECT id, view_name, hostname, type, data, ttl, expires FROM {records} ORDER BY id`,
+	} {
+		rows, err := db.Query(db.query(query))
+		if err != nil {
+			return nil, err
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+
+		values := make([]sql.RawBytes, len(columns))
+		pointers := make([]interface{}, len(columns))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		for rows.Next() {
+			err = rows.Scan(pointers...)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			for _, value := range values {
+				fmt.Fprintf(hash, "%q,", value)
+			}
+		}
+		rows.Close()
+		if rows.Err() != nil {
+			return nil, rows.Err()
+		}
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// pollDatabase serves the changes other systems and servers make to the
+// records database, checking for them every DatabasePollInterval and, with
+// the postgres backend, as soon as they are announced on DatabaseChannel.
+func (s *dnsServer) pollDatabase() {
+	interval := s.config.DatabasePollInterval
+	if !s.config.databaseBackend() || (interval == 0 && s.config.DatabaseChannel == "") {
+		return
+	}
+
+	notifications := make(chan struct{}, 1)
+	if s.config.DatabaseChannel != "" {
+		s.listenDatabase(notifications)
+	}
+
+	go func() {
+		var ticks <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			ticks = ticker.C
+		}
+
+		last, err := databaseFingerprint(s.config)
+		if err != nil {
+			log.Printf("Failed to check the records database for changes: %v", err)
+		}
+		for {
+			select {
+			case <-ticks:
+			case <-notifications:
+			}
+
+			fingerprint, err := databaseFingerprint(s.config)
+			if err != nil {
+				log.Printf("Failed to check the records database for changes: %v", err)
+				continue
+			}
+			if bytes.Equal(fingerprint, last) {
+				continue
+			}
+			last = fingerprint
+
+			log.Printf("The records database changed, reloading DNS records")
+			s.reloadRecords()
+		}
+	}()
+}
+
+// listenDatabase listens for notifications on DatabaseChannel, signalling
+// notifications for each one. The channel is listened to again whenever
+// the connection to the database is lost, and the database checked in case
+// a change was announced in the meantime.
+func (s *dnsServer) listenDatabase(notifications chan<- struct{}) {
+	listener := pq.NewListener(s.config.DatabaseDSN, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Failed to listen for changes to the records database: %v", err)
+		}
+	})
+	err := listener.Listen(s.config.DatabaseChannel)
+	if err != nil {
+		log.Printf("Failed to listen for changes to the records database on %s: %v", s.config.DatabaseChannel, err)
+	}
+
+	go func() {
+		for range listener.Notify {
+			select {
+			case notifications <- struct{}{}:
+			default:
+			}
+		}
+	}()
+}
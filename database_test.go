@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// writeTestFile writes a file in dir, returning its path.
+func writeTestFile(t *testing.T, dir, name, content string) string {
+	t.Helper()
+
+	filename := filepath.Join(dir, name)
+	err := os.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return filename
+}
+
+// databaseRows returns the records read from a records database, by the
+// view holding them, as their names, types, data and TTLs.
+func databaseRows(records *DNSRecords) map[string][]string {
+	rows := map[string][]string{}
+	add := func(view string, records []DNSRecord) {
+		for _, record := range records {
+			rows[view] = append(rows[view], fmt.Sprintf("%s %s %s %d", record.Hostname, record.Type, record.Data, record.TTL))
+		}
+	}
+	add("", records.Records)
+	for _, view := range records.Views {
+		add(view.Name, view.Records)
+	}
+
+	return rows
+}
+
+func TestRecordsDatabase(t *testing.T) {
+	dir := t.TempDir()
+	database := filepath.Join(dir, "records.db")
+	configFile := writeTestFile(t, dir, "lacuna.yaml", "backend: sqlite\ndatabase_file: "+database+"\n")
+	file := writeTestFile(t, dir, "records.yaml", `
+ttl: 600
+zones:
+  - origin: example.lan.
+    ns: [ns1.example.lan.]
+    records:
+      - hostname: ns1
+        ip: 192.168.1.1
+views:
+  - name: office
+    match: [192.168.5.0/24]
+    records:
+      - hostname: printer.lan.
+        ip: 192.168.5.5
+records:
+  - hostname: www.lan.
+    ttl: 60
+    ips: [192.168.1.10, 192.168.1.11]
+`)
+
+	err := importRecords(configFile, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := readDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each record is stored as a row for every resource record it is
+	// served as, while zones and views keep their settings
+	want := map[string][]string{
+		"": {
+			"www.lan. A 192.168.1.10 60",
+			"www.lan. A 192.168.1.11 60",
+			"ns1.example.lan. A 192.168.1.1 0",
+		},
+		"office": {"printer.lan. A 192.168.5.5 0"},
+	}
+	if got := databaseRows(records); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	if records.TTL != 600 || len(records.Zones) != 1 || !reflect.DeepEqual(records.Zones[0].NS, []string{"ns1.example.lan."}) {
+		t.Fatalf("got TTL %d and zones %+v, want the settings imported", records.TTL, records.Zones)
+	}
+	if len(records.Views) != 1 || !reflect.DeepEqual(records.Views[0].Match, []string{"192.168.5.0/24"}) {
+		t.Fatalf("got views %+v, want the settings imported", records.Views)
+	}
+
+	// Saving a zone, as dynamic updates do, replaces only the rows of its
+	// records
+	zone := records.Zones[0]
+	zoneRecords := zone.loadRRs(testRRs(t, "mail.example.lan. 300 IN A 192.168.1.25"))
+	zone.SOA.Serial = 5
+	err = saveZoneDatabase(config, records, &zone, zoneRecords)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err = readDatabase(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want[""] = []string{
+		"www.lan. A 192.168.1.10 60",
+		"www.lan. A 192.168.1.11 60",
+		"mail.example.lan. A 192.168.1.25 300",
+	}
+	if got := databaseRows(records); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q after saving the zone, want %q", got, want)
+	}
+	if records.Zones[0].SOA.Serial != 5 {
+		t.Fatalf("got serial %d, want the zone's SOA saved", records.Zones[0].SOA.Serial)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// delegation returns the NS records delegating the part of a zone holding
+// name to other name servers, or nil if name is not delegated. NS records
+// at any name below the zone's apex delegate that name and everything below
+// it, and the delegation closest to the apex hides any beneath it.
+func (r *DNSRecords) delegation(zone *Zone, name string) []dns.RR {
+	var cuts []string
+	for cut := dns.CanonicalName(name); cut != zone.Origin && dns.IsSubDomain(zone.Origin, cut); cut = parentName(cut) {
+		cuts = append(cuts, cut)
+	}
+
+	for i := len(cuts) - 1; i >= 0; i-- {
+		var ns []dns.RR
+		for _, record := range r.Lookup(cuts[i]) {
+			rrs, err := record.RRs(cuts[i])
+			if err != nil {
+				continue
+			}
+			for _, rr := range rrs {
+				if rr.Header().Rrtype == dns.TypeNS {
+					ns = append(ns, rr)
+				}
+			}
+		}
+		if len(ns) > 0 {
+			return ns
+		}
+	}
+
+	return nil
+}
+
+// isReferred reports whether a question about a delegated name is answered
+// with a referral to the delegation's name servers. DS records are held by
+// the parent side of the delegation, so are answered from the zone itself.
+func isReferred(question dns.Question, ns []dns.RR) bool {
+	if len(ns) == 0 {
+		return false
+	}
+
+	return question.Qtype != dns.TypeDS || dns.CanonicalName(question.Name) != ns[0].Header().Name
+}
+
+// delegationProof returns the signed DS records of a delegation from a
+// signed zone, or signed proof that it has none, so that validating
+// resolvers can tell whether the delegated zone is signed. The NS records of
+// the delegation themselves are not signed, as they belong to the child.
+func (s *dnsServer) delegationProof(records *DNSRecords, zone *Zone, cut string) []dns.RR {
+	var proof []dns.RR
+	for _, rr := range s.lookupRRs(records, cut) {
+		if rr.Header().Rrtype == dns.TypeDS {
+			proof = append(proof, rr)
+		}
+	}
+	if len(proof) == 0 {
+		proof = s.denialRecords(records, zone, cut, false)
+	}
+
+	signed := &dns.Msg{Ns: proof}
+	signResponse(records, signed)
+
+	return signed.Ns
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/base32"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Denial-of-existence record types for signed zones.
+const (
+	denialNSEC  = "nsec"
+	denialNSEC3 = "nsec3"
+)
+
+// maxLabelLength and maxNameLength are the limits on the wire length of a
+// label and a name.
+const (
+	maxLabelLength = 63
+	maxNameLength  = 253
+)
+
+// base32Hex encodes NSEC3 hashes.
+var base32Hex = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+// denialRecords returns the NSEC or NSEC3 records proving that name does not
+// exist, for NXDOMAIN, or has no records of qtype, for NODATA. The records
+// are minimally covering "white lies" (RFC 4470, RFC 7129 section 5)
+// generated for each query, so they never reveal the zone's other names.
+func (s *dnsServer) denialRecords(records *DNSRecords, zone *Zone, name string, nxdomain bool) []dns.RR {
+	name = dns.CanonicalName(name)
+	ttl := zone.NegativeSOA().Hdr.Ttl
+
+	if !nxdomain {
+		types := s.nameTypes(records, name)
+		if zone.DNSSEC.Denial == denialNSEC3 {
+			return []dns.RR{nsec3Record(zone, nsec3Hash(name), 0, types, ttl)}
+		}
+		return []dns.RR{nsecRecord(name, successor(name), append(types, dns.TypeNSEC), ttl)}
+	}
+
+	// The closest existing ancestor of the name bounds the proof, and a
+	// wildcard below it must be denied too
+	encloser := name
+	for encloser != zone.Origin {
+		encloser = parentName(encloser)
+		if encloser == zone.Origin || records.NameExists(encloser) {
+			break
+		}
+	}
+	wildcard := "*." + encloser
+
+	if zone.DNSSEC.Denial == denialNSEC3 {
+		nextCloser := name
+		for parentName(nextCloser) != encloser {
+			nextCloser = parentName(nextCloser)
+		}
+
+		return []dns.RR{
+			nsec3Record(zone, nsec3Hash(encloser), 0, s.nameTypes(records, encloser), ttl),
+			nsec3Record(zone, nsec3Hash(nextCloser), -1, nil, ttl),
+			nsec3Record(zone, nsec3Hash(wildcard), -1, nil, ttl),
+		}
+	}
+
+	return []dns.RR{
+		nsecRecord(predecessor(name), successor(name), []uint16{dns.TypeNSEC}, ttl),
+		nsecRecord(predecessor(wildcard), successor(wildcard), []uint16{dns.TypeNSEC}, ttl),
+	}
+}
+
+// nameTypes returns the types of the local records held at a name, plus
+// RRSIG since every RRset in a signed zone is signed.
+func (s *dnsServer) nameTypes(records *DNSRecords, name string) []uint16 {
+	types := []uint16{dns.TypeRRSIG}
+	for _, rr := range s.lookupRRs(records, name) {
+		if !hasBit(types, rr.Header().Rrtype) {
+			types = append(types, rr.Header().Rrtype)
+		}
+	}
+
+	return types
+}
+
+// nsecRecord returns an NSEC record from owner to next listing the types.
+func nsecRecord(owner, next string, types []uint16, ttl uint32) *dns.NSEC {
+	if !hasBit(types, dns.TypeRRSIG) {
+		types = append(types, dns.TypeRRSIG)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return &dns.NSEC{
+		Hdr: dns.RR_Header{
+			Name:   owner,
+			Rrtype: dns.TypeNSEC,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		NextDomain: next,
+		TypeBitMap: types,
+	}
+}
+
+// parentName returns the name with its leftmost label removed.
+func parentName(name string) string {
+	off, end := dns.NextLabel(name, 0)
+	if end {
+		return "."
+	}
+
+	return name[off:]
+}
+
+// successor returns the name that immediately follows name in canonical
+// order, its child with a single zero octet label.
+func successor(name string) string {
+	return `\000.` + name
+}
+
+// predecessor returns a name just before name in canonical order, found by
+// decrementing the last octet of its leftmost label and padding the label
+// out with 0xff octets, as RFC 4470 section 2 suggests.
+func predecessor(name string) string {
+	labels := dns.SplitDomainName(name)
+	if len(labels) == 0 {
+		return name
+	}
+
+	parent := parentName(name)
+	label := unescapeLabel(labels[0])
+	last := label[len(label)-1]
+	if last == 0 {
+		// Dropping a trailing zero octet gives the label just before it
+		label = label[:len(label)-1]
+		if len(label) == 0 {
+			return parent
+		}
+		return escapeLabel(label) + "." + parent
+	}
+
+	last--
+	if last >= 'A' && last <= 'Z' {
+		// Uppercase letters sort as lowercase, so step back past them
+		last = 'A' - 1
+	}
+	label[len(label)-1] = last
+
+	room := maxNameLength - len(parent) - 1
+	for len(label) < maxLabelLength && len(label) < room {
+		label = append(label, 0xff)
+	}
+
+	return escapeLabel(label) + "." + parent
+}
+
+// unescapeLabel returns the octets of a label in presentation format.
+func unescapeLabel(label string) []byte {
+	var octets []byte
+	for i := 0; i < len(label); i++ {
+		if label[i] != '\\' || i+1 >= len(label) {
+			octets = append(octets, label[i])
+			continue
+		}
+
+		if i+3 < len(label) && isDigit(label[i+1]) && isDigit(label[i+2]) && isDigit(label[i+3]) {
+			octets = append(octets, (label[i+1]-'0')*100+(label[i+2]-'0')*10+(label[i+3]-'0'))
+			i += 3
+		} else {
+			octets = append(octets, label[i+1])
+			i++
+		}
+	}
+
+	return octets
+}
+
+// isDigit reports whether a character is a decimal digit.
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// escapeLabel returns the presentation format of a label's octets.
+func escapeLabel(octets []byte) string {
+	var label strings.Builder
+	for _, c := range octets {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', isDigit(c), c == '-', c == '_', c == '*':
+			label.WriteByte(c)
+		default:
+			fmt.Fprintf(&label, `\%03d`, c)
+		}
+	}
+
+	return label.String()
+}
+
+// nsec3Hash returns the NSEC3 hash of a name, using no extra iterations or
+// salt as RFC 9276 recommends.
+func nsec3Hash(name string) string {
+	return dns.HashName(name, dns.SHA1, 0, "")
+}
+
+// nsec3Record returns an NSEC3 record for a hash offset by delta, running to
+// just past the hash. An offset of -1 gives a record covering the hash,
+// while 0 gives one matching it.
+func nsec3Record(zone *Zone, hash string, delta int64, types []uint16, ttl uint32) *dns.NSEC3 {
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+
+	return &dns.NSEC3{
+		Hdr: dns.RR_Header{
+			Name:   strings.ToLower(offsetHash(hash, delta)) + "." + zone.Origin,
+			Rrtype: dns.TypeNSEC3,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash:       dns.SHA1,
+		HashLength: 20,
+		NextDomain: offsetHash(hash, 1),
+		TypeBitMap: types,
+	}
+}
+
+// offsetHash adds delta to a base32hex NSEC3 hash, wrapping around.
+func offsetHash(hash string, delta int64) string {
+	raw, err := base32Hex.DecodeString(strings.ToUpper(hash))
+	if err != nil {
+		return hash
+	}
+
+	n := new(big.Int).SetBytes(raw)
+	n.Add(n, big.NewInt(delta))
+
+	modulus := new(big.Int).Lsh(big.NewInt(1), uint(8*len(raw)))
+	n.Mod(n, modulus)
+
+	out := make([]byte, len(raw))
+	n.FillBytes(out)
+
+	return base32Hex.EncodeToString(out)
+}
+
+// nsec3Param returns the NSEC3PARAM record served at a zone's apex.
+func nsec3Param(name string, ttl uint32) *dns.NSEC3PARAM {
+	return &dns.NSEC3PARAM{
+		Hdr: dns.RR_Header{
+			Name:   name,
+			Rrtype: dns.TypeNSEC3PARAM,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Hash: dns.SHA1,
+	}
+}
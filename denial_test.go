@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestDenialRecords(t *testing.T) {
+	tests := []struct {
+		name  string
+		qtype uint16
+		rcode int
+	}{
+		{"missing.example.lan.", dns.TypeA, dns.RcodeNameError},
+		{"a.b.missing.example.lan.", dns.TypeA, dns.RcodeNameError},
+		{"www.example.lan.", dns.TypeAAAA, dns.RcodeSuccess},
+		{"example.lan.", dns.TypeMX, dns.RcodeSuccess},
+	}
+
+	for _, denial := range []string{denialNSEC, denialNSEC3} {
+		s := signedServer(t)
+		zone := &s.records.Load().Zones[0]
+		zone.DNSSEC.Denial = denial
+
+		for _, test := range tests {
+			t.Run(denial+" "+dns.TypeToString[test.qtype]+" "+test.name, func(t *testing.T) {
+				response := signedQuery(s, test.name, test.qtype, true)
+				if response.Rcode != test.rcode || len(response.Answer) != 0 {
+					t.Fatalf("got %v, want a negative answer with rcode %s", response, dns.RcodeToString[test.rcode])
+				}
+
+				// The proof satisfies the validator and is signed
+				question := dns.Question{Name: test.name, Qtype: test.qtype, Qclass: dns.ClassINET}
+				if !deniesName(question, response) {
+					t.Fatalf("got authority %v, which does not deny %s", response.Ns, test.name)
+				}
+				verifySection(t, zone.signer, response.Ns)
+
+				for _, rr := range response.Ns {
+					switch rr := rr.(type) {
+					case *dns.NSEC:
+						// White lies never name the other names of the zone
+						for _, name := range []string{"www.example.lan.", "ns1.example.lan."} {
+							if name != test.name && (rr.Hdr.Name == name || rr.NextDomain == name) {
+								t.Fatalf("got %v, revealing %s", rr, name)
+							}
+						}
+					case *dns.NSEC3:
+						if denial != denialNSEC3 {
+							t.Fatalf("got %v, want NSEC records", rr)
+						}
+					}
+				}
+			})
+		}
+
+		// The types a name has are not denied
+		response := signedQuery(s, "www.example.lan.", dns.TypeAAAA, true)
+		question := dns.Question{Name: "www.example.lan.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+		if deniesName(question, response) {
+			t.Fatalf("%s proof %v denies the A record of www.example.lan.", denial, response.Ns)
+		}
+	}
+}
+
+func TestPredecessor(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{`www.example.lan.`, `wwv\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255\255.example.lan.`},
+		{`\000.example.lan.`, `example.lan.`},
+		{`a\000.example.lan.`, `a.example.lan.`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := predecessor(test.name)
+			if got != test.want {
+				t.Fatalf("got %s, want %s", got, test.want)
+			}
+			if !nsecCovers(nsecRecord(got, successor(test.name), nil, 0), test.name) {
+				t.Fatalf("%s to %s does not cover %s", got, successor(test.name), test.name)
+			}
+		})
+	}
+}
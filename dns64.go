@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// DNS64Config controls synthesis of AAAA records from A records (RFC 6147)
+// so that IPv6-only clients can reach IPv4-only hosts through a NAT64
+// gateway.
+type DNS64Config struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Prefix is the NAT64 prefix the IPv4 addresses are embedded in, one
+	// of the lengths allowed by RFC 6052.
+	Prefix string `yaml:"prefix"`
+
+	prefix *net.IPNet
+}
+
+// dns64PrefixLengths are the NAT64 prefix lengths defined by RFC 6052.
+var dns64PrefixLengths = map[int]bool{32: true, 40: true, 48: true, 56: true, 64: true, 96: true}
+
+// parse validates the configured NAT64 prefix.
+func (c *DNS64Config) parse() error {
+	_, prefix, err := net.ParseCIDR(c.Prefix)
+	if err != nil || prefix.IP.To4() != nil {
+		return fmt.Errorf("invalid dns64 prefix %q", c.Prefix)
+	}
+
+	ones, _ := prefix.Mask.Size()
+	if !dns64PrefixLengths[ones] {
+		return fmt.Errorf("unsupported dns64 prefix length /%d", ones)
+	}
+
+	c.prefix = prefix
+	return nil
+}
+
+// embed returns the IPv6 address mapping an IPv4 address into the NAT64
+// prefix, skipping bits 64 to 71 as RFC 6052 section 2.2 requires.
+func (c *DNS64Config) embed(ip net.IP) net.IP {
+	synthesized := make(net.IP, net.IPv6len)
+	copy(synthesized, c.prefix.IP)
+
+	ones, _ := c.prefix.Mask.Size()
+	pos := ones / 8
+	for _, b := range ip.To4() {
+		if pos == 8 {
+			pos++
+		}
+		synthesized[pos] = b
+		pos++
+	}
+
+	return synthesized
+}
+
+// dns64 returns the response to a AAAA query for a remote name, replacing an
+// answer without AAAA records by one synthesized from the name's A records.
+// Queries from validating clients that set CD are left alone, since the
+// synthesized records cannot pass DNSSEC validation.
+func (s *dnsServer) dns64(request *dns.Msg, response *dns.Msg, client net.IP) *dns.Msg {
+	question := request.Question[0]
+	if !s.config.DNS64.Enabled || question.Qtype != dns.TypeAAAA || request.CheckingDisabled {
+		return response
+	}
+	if response.Rcode != dns.RcodeSuccess || hasType(response.Answer, dns.TypeAAAA) {
+		return response
+	}
+
+	query := request.Copy()
+	query.Question[0].Qtype = dns.TypeA
+	ipv4, err := s.resolveRemote(query, client)
+	if err != nil {
+		log.Printf("Failed to resolve A records for DNS64: %v", err)
+		return response
+	}
+	if ipv4.Rcode != dns.RcodeSuccess || !hasType(ipv4.Answer, dns.TypeA) {
+		return response
+	}
+
+	synthesized := response.Copy()
+	synthesized.Answer = nil
+	synthesized.Ns = ipv4.Ns
+	synthesized.Extra = nil
+	for _, rr := range ipv4.Answer {
+		a, ok := rr.(*dns.A)
+		if !ok {
+			// CNAMEs leading to the A records are kept as they are
+			synthesized.Answer = append(synthesized.Answer, rr)
+			continue
+		}
+
+		header := a.Hdr
+		header.Rrtype = dns.TypeAAAA
+		synthesized.Answer = append(synthesized.Answer, &dns.AAAA{Hdr: header, AAAA: s.config.DNS64.embed(a.A)})
+	}
+
+	return synthesized
+}
+
+// hasType reports whether any of the records is of the given type.
+func hasType(rrs []dns.RR, rrtype uint16) bool {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == rrtype {
+			return true
+		}
+	}
+
+	return false
+}
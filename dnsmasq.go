@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// dnsmasqFile holds what is taken from a dnsmasq configuration file: the
+// records of its address, host-record and cname options, and the upstreams
+// and forwarding rules of its server options. Other options are ignored,
+// and counted.
+type dnsmasqFile struct {
+	records      []DNSRecord
+	upstreams    []Upstream
+	forwardRules []ForwardRule
+	ignored      int
+}
+
+// readDnsmasqFile reads a dnsmasq configuration file.
+func readDnsmasqFile(filename string) (*dnsmasqFile, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parsed := &dnsmasqFile{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		option, value, _ := strings.Cut(text, "=")
+		switch strings.TrimSpace(option) {
+		case "address":
+			err = parsed.address(strings.TrimSpace(value))
+		case "host-record":
+			err = parsed.hostRecord(strings.TrimSpace(value))
+		case "cname":
+			err = parsed.cname(strings.TrimSpace(value))
+		case "server":
+			err = parsed.server(strings.TrimSpace(value))
+		default:
+			parsed.ignored++
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d of dnsmasq file %s: %v", line, filename, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return parsed, nil
+}
+
+// address adds the records of an address=/domain/[domain/...]ip option,
+// which answers for the domains and every name below them.
+func (f *dnsmasqFile) address(value string) error {
+	domains, ip, err := splitDnsmasqDomains(value)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(ip) == nil {
+		return fmt.Errorf("unsupported address %q", ip)
+	}
+
+	for _, domain := range domains {
+		f.records = append(f.records,
+			DNSRecord{Hostname: domain, IP: ip},
+			DNSRecord{Hostname: "*." + domain, IP: ip},
+		)
+	}
+
+	return nil
+}
+
+// hostRecord adds the records of a host-record=name[,name...],[ipv4],[ipv6]
+// [,ttl] option.
+func (f *dnsmasqFile) hostRecord(value string) error {
+	fields, ttl := splitDnsmasqTTL(value)
+
+	var names, ips []string
+	for _, field := range fields {
+		if net.ParseIP(field) != nil {
+			ips = append(ips, field)
+		} else if field != "" {
+			names = append(names, field)
+		}
+	}
+	if len(names) == 0 || len(ips) == 0 {
+		return fmt.Errorf("host-record needs a name and an address")
+	}
+
+	for _, name := range names {
+		f.records = append(f.records, DNSRecord{Hostname: name, IPs: ips, TTL: ttl})
+	}
+
+	return nil
+}
+
+// cname adds the records of a cname=alias[,alias...],target[,ttl] option.
+func (f *dnsmasqFile) cname(value string) error {
+	fields, ttl := splitDnsmasqTTL(value)
+	if len(fields) < 2 {
+		return fmt.Errorf("cname needs an alias and a target")
+	}
+
+	target := fields[len(fields)-1]
+	for _, alias := range fields[:len(fields)-1] {
+		f.records = append(f.records, DNSRecord{Hostname: alias, CNAME: target, TTL: ttl})
+	}
+
+	return nil
+}
+
+// server adds the upstream of a server=[/domain/[domain/...]]ip[#port]
+// option, used for the domains if any are given and as a default upstream
+// otherwise. Options keeping the domains local, or sending them to the
+// default upstreams, are left to the records and default upstreams.
+func (f *dnsmasqFile) server(value string) error {
+	var domains []string
+	address := value
+	if strings.HasPrefix(value, "/") {
+		var err error
+		domains, address, err = splitDnsmasqDomains(value)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Any source address or interface to send from is not supported
+	address, _, _ = strings.Cut(address, "@")
+	if address == "" || address == "#" {
+		return nil
+	}
+	if host, port, ok := strings.Cut(address, "#"); ok {
+		address = net.JoinHostPort(host, port)
+	}
+	upstream := Upstream{Address: address}
+
+	if len(domains) == 0 {
+		f.upstreams = append(f.upstreams, upstream)
+		return nil
+	}
+
+	for _, domain := range domains {
+		rule := f.forwardRule(domain)
+		rule.Upstreams = append(rule.Upstreams, upstream)
+	}
+
+	return nil
+}
+
+// forwardRule returns the forwarding rule for a domain, adding one if there
+// is none yet.
+func (f *dnsmasqFile) forwardRule(domain string) *ForwardRule {
+	for i := range f.forwardRules {
+		if f.forwardRules[i].Domain == domain {
+			return &f.forwardRules[i]
+		}
+	}
+
+	f.forwardRules = append(f.forwardRules, ForwardRule{Domain: domain})
+	return &f.forwardRules[len(f.forwardRules)-1]
+}
+
+// splitDnsmasqDomains splits a value of the form /domain/[domain/...]rest
+// into its domains and the rest.
+func splitDnsmasqDomains(value string) ([]string, string, error) {
+	if !strings.HasPrefix(value, "/") {
+		return nil, "", fmt.Errorf("%q does not start with /domain/", value)
+	}
+
+	parts := strings.Split(value[1:], "/")
+	if len(parts) < 2 {
+		return nil, "", fmt.Errorf("%q does not start with /domain/", value)
+	}
+
+	var domains []string
+	for _, domain := range parts[:len(parts)-1] {
+		if domain == "" || domain == "#" {
+			return nil, "", fmt.Errorf("unsupported domain %q", domain)
+		}
+		domains = append(domains, domain)
+	}
+
+	return domains, parts[len(parts)-1], nil
+}
+
+// splitDnsmasqTTL splits a comma separated value into its fields, taking a
+// trailing number as a TTL.
+func splitDnsmasqTTL(value string) ([]string, uint32) {
+	fields := strings.Split(value, ",")
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+
+	last := fields[len(fields)-1]
+	if ttl, err := strconv.ParseUint(last, 10, 32); err == nil && len(fields) > 1 {
+		return fields[:len(fields)-1], uint32(ttl)
+	}
+
+	return fields, 0
+}
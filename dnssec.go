@@ -0,0 +1,604 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSSECConfig controls validation of the answers to forwarded and
+// recursively resolved queries.
+type DNSSECConfig struct {
+	Validate bool `yaml:"validate"`
+
+	// TrustAnchors are the DS records, in presentation format, that
+	// validation chains are anchored to. The default is the root zone's
+	// current key signing key.
+	TrustAnchors []string `yaml:"trust_anchors"`
+
+	// TrustAnchorFile is where the trust anchors' key signing keys are
+	// tracked across restarts as they roll over (RFC 5011). Without it,
+	// keys learnt during a rollover are forgotten on restart.
+	TrustAnchorFile string `yaml:"trust_anchor_file"`
+}
+
+// rootTrustAnchor is the DS record of the root zone's KSK-2017.
+const rootTrustAnchor = ". 86400 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBC683457104237C7F8EC8D"
+
+// Validation results, as defined in RFC 4035 section 4.3.
+type security int
+
+const (
+	secure security = iota
+	insecure
+	bogus
+)
+
+// errBogus is returned for data whose signatures fail to validate, or that
+// lacks the signatures its zone's chain of trust requires.
+var errBogus = errors.New("DNSSEC validation failed")
+
+// maxChainDepth bounds how many zones a chain of trust is followed through.
+const maxChainDepth = 32
+
+// minKeyTTL is the shortest time validated zone keys are remembered for.
+const minKeyTTL = 60
+
+// zoneKeys are the validated DNSKEY records of a zone, or none for a zone
+// proven to be unsigned.
+type zoneKeys struct {
+	keys     []*dns.DNSKEY
+	insecure bool
+	expires  time.Time
+}
+
+// validator checks the DNSSEC signatures of responses, following their
+// chain of trust from the configured trust anchors (RFC 4035 section 5).
+type validator struct {
+	// resolve looks up the DNSKEY, DS and SOA records validation needs.
+	resolve func(request *dns.Msg) (*dns.Msg, error)
+	anchors *trustAnchors
+
+	mu   sync.Mutex
+	keys map[string]*zoneKeys
+}
+
+// newValidator creates a validator anchored to the given trust anchors,
+// looking up the records it needs with resolve.
+func newValidator(anchors *trustAnchors, resolve func(*dns.Msg) (*dns.Msg, error)) *validator {
+	return &validator{
+		resolve: resolve,
+		anchors: anchors,
+		keys:    map[string]*zoneKeys{},
+	}
+}
+
+// Validate reports whether a response to a question is secure, insecure
+// because it comes from an unsigned zone, or bogus. The records in the
+// answer section must be signed by keys that chain to a trust anchor, and
+// NXDOMAIN and NODATA responses must carry signed NSEC or NSEC3 records in
+// their authority section denying the name or type.
+func (v *validator) Validate(question dns.Question, response *dns.Msg) security {
+	negative := response.Rcode == dns.RcodeNameError || response.Rcode == dns.RcodeSuccess && !answersQuestion(question, response.Answer)
+
+	sections := [][]dns.RR{response.Answer}
+	if negative {
+		sections = append(sections, response.Ns)
+	}
+
+	result := secure
+	validated := 0
+	for _, section := range sections {
+		for _, rrset := range rrsets(section) {
+			if rrset[0].Header().Rrtype == dns.TypeNS && negative {
+				// Delegation NS records in the authority section are
+				// never signed
+				continue
+			}
+
+			status := v.validateRRset(rrset, section, 0)
+			if status == bogus {
+				log.Printf("DNSSEC validation of %s %s failed", rrset[0].Header().Name, dns.TypeToString[rrset[0].Header().Rrtype])
+				return bogus
+			}
+			if status == insecure {
+				result = insecure
+			}
+			validated++
+		}
+	}
+
+	if validated == 0 {
+		// An empty response still has to be shown to come from an unsigned
+		// zone before it can be trusted
+		return v.insecureName(question.Name, 0)
+	}
+
+	if result == secure && negative && !deniesName(question, response) {
+		log.Printf("DNSSEC denial of %s %s not proven", question.Name, dns.TypeToString[question.Qtype])
+		return bogus
+	}
+
+	return result
+}
+
+// answersQuestion reports whether an answer section holds records of the
+// type asked for, at the end of any CNAME chain.
+func answersQuestion(question dns.Question, answer []dns.RR) bool {
+	for _, rr := range answer {
+		if rr.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+			return true
+		}
+	}
+
+	return question.Qtype == dns.TypeCNAME && len(answer) > 0
+}
+
+// rrsets groups the records of a section other than signatures and OPT
+// records into RRsets.
+func rrsets(section []dns.RR) [][]dns.RR {
+	var sets [][]dns.RR
+	index := map[[2]string]int{}
+	for _, rr := range section {
+		header := rr.Header()
+		if header.Rrtype == dns.TypeRRSIG || header.Rrtype == dns.TypeOPT {
+			continue
+		}
+
+		key := [2]string{dns.CanonicalName(header.Name), dns.TypeToString[header.Rrtype]}
+		i, ok := index[key]
+		if !ok {
+			i = len(sets)
+			index[key] = i
+			sets = append(sets, nil)
+		}
+		sets[i] = append(sets[i], rr)
+	}
+
+	return sets
+}
+
+// signatures returns the RRSIG records in a section covering an RRset.
+func signatures(rrset []dns.RR, section []dns.RR) []*dns.RRSIG {
+	header := rrset[0].Header()
+
+	var sigs []*dns.RRSIG
+	for _, rr := range section {
+		sig, ok := rr.(*dns.RRSIG)
+		if ok && sig.TypeCovered == header.Rrtype && strings.EqualFold(sig.Hdr.Name, header.Name) {
+			sigs = append(sigs, sig)
+		}
+	}
+
+	return sigs
+}
+
+// validateRRset checks an RRset against its signatures in section. An
+// unsigned RRset is only insecure if its zone is proven to be unsigned.
+func (v *validator) validateRRset(rrset []dns.RR, section []dns.RR, depth int) security {
+	sigs := signatures(rrset, section)
+	if len(sigs) == 0 {
+		return v.insecureName(rrset[0].Header().Name, depth)
+	}
+
+	for _, sig := range sigs {
+		signer := dns.CanonicalName(sig.SignerName)
+		if !dns.IsSubDomain(signer, rrset[0].Header().Name) {
+			continue
+		}
+
+		keys, err := v.zoneKeys(signer, depth)
+		if err != nil {
+			log.Printf("Failed to get DNSSEC keys for %s: %v", signer, err)
+			return bogus
+		}
+		if keys.insecure {
+			return insecure
+		}
+
+		if verifyRRset(rrset, []*dns.RRSIG{sig}, keys.keys) {
+			return secure
+		}
+	}
+
+	return bogus
+}
+
+// verifyRRset reports whether any of the signatures over an RRset is
+// currently valid and made by one of the keys.
+func verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG, keys []*dns.DNSKEY) bool {
+	now := time.Now()
+	for _, sig := range sigs {
+		if !sig.ValidityPeriod(now) {
+			continue
+		}
+
+		for _, key := range keys {
+			if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+				continue
+			}
+			if key.Flags&dns.ZONE == 0 || key.Flags&dns.REVOKE != 0 {
+				continue
+			}
+
+			if sig.Verify(key, rrset) == nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// insecureName reports whether the zone holding name is proven to be
+// unsigned, returning bogus if the zone is signed after all.
+func (v *validator) insecureName(name string, depth int) security {
+	zone, err := v.zoneOf(name)
+	if err != nil {
+		log.Printf("Failed to find the zone of %s: %v", name, err)
+		return bogus
+	}
+
+	keys, err := v.zoneKeys(zone, depth)
+	if err != nil {
+		log.Printf("Failed to get DNSSEC keys for %s: %v", zone, err)
+		return bogus
+	}
+	if keys.insecure {
+		return insecure
+	}
+
+	return bogus
+}
+
+// zoneOf returns the zone a name belongs to, taken from the SOA record
+// returned for it.
+func (v *validator) zoneOf(name string) (string, error) {
+	response, err := v.query(name, dns.TypeSOA)
+	if err != nil {
+		return "", err
+	}
+
+	for _, rr := range append(response.Answer, response.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok && dns.IsSubDomain(soa.Hdr.Name, name) {
+			return dns.CanonicalName(soa.Hdr.Name), nil
+		}
+	}
+
+	return "", fmt.Errorf("no SOA record found for %s", name)
+}
+
+// query looks up a record set needed for validation, with DNSSEC records
+// requested and validation by the upstream disabled so that its signatures
+// can be checked here.
+func (v *validator) query(name string, qtype uint16) (*dns.Msg, error) {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	request.SetEdns0(dns.DefaultMsgSize, true)
+	request.CheckingDisabled = true
+
+	response, err := v.resolve(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.Rcode != dns.RcodeSuccess && response.Rcode != dns.RcodeNameError {
+		return nil, fmt.Errorf("lookup of %s %s answered %s", name, dns.TypeToString[qtype], dns.RcodeToString[response.Rcode])
+	}
+
+	return response, nil
+}
+
+// zoneKeys returns the validated keys of a zone, following its chain of
+// trust up to a trust anchor, or marks the zone insecure if a validated
+// parent proves it has no DS records.
+func (v *validator) zoneKeys(zone string, depth int) (*zoneKeys, error) {
+	if depth > maxChainDepth {
+		return nil, fmt.Errorf("chain of trust for %s is too long", zone)
+	}
+
+	v.mu.Lock()
+	cached, ok := v.keys[zone]
+	v.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached, nil
+	}
+
+	var keys *zoneKeys
+	var err error
+	if v.anchors.Anchored(zone) {
+		keys, err = v.anchoredKeys(zone)
+	} else {
+		keys, err = v.delegatedKeys(zone, depth)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v.mu.Lock()
+	v.keys[zone] = keys
+	v.mu.Unlock()
+
+	return keys, nil
+}
+
+// anchoredKeys fetches and validates the keys of a zone with a trust anchor.
+func (v *validator) anchoredKeys(zone string) (*zoneKeys, error) {
+	dnskeys, sigs, ttl, err := v.fetchKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := v.anchors.Validate(zone, dnskeys, sigs)
+	if err != nil {
+		return nil, err
+	}
+
+	return &zoneKeys{keys: keys, expires: keyExpiry(ttl)}, nil
+}
+
+// delegatedKeys validates the keys of a zone using the DS records held by
+// its parent, or marks the zone insecure if the parent has none.
+func (v *validator) delegatedKeys(zone string, depth int) (*zoneKeys, error) {
+	response, err := v.query(zone, dns.TypeDS)
+	if err != nil {
+		return nil, err
+	}
+
+	var ds []*dns.DS
+	var dsset []dns.RR
+	for _, rr := range response.Answer {
+		if record, ok := rr.(*dns.DS); ok && strings.EqualFold(record.Hdr.Name, zone) {
+			ds = append(ds, record)
+			dsset = append(dsset, rr)
+		}
+	}
+
+	if len(ds) == 0 {
+		// The parent must prove the zone has no DS records for it to be
+		// treated as unsigned
+		for _, rrset := range rrsets(response.Ns) {
+			status := v.validateRRset(rrset, response.Ns, depth+1)
+			if status == bogus {
+				return nil, errBogus
+			}
+			if status == insecure {
+				return &zoneKeys{insecure: true, expires: keyExpiry(minKeyTTL)}, nil
+			}
+		}
+
+		if !deniesDS(zone, response) {
+			return nil, fmt.Errorf("%w: no proof %s is unsigned", errBogus, zone)
+		}
+
+		ttl, _ := minTTL(response)
+		return &zoneKeys{insecure: true, expires: keyExpiry(ttl)}, nil
+	}
+
+	switch v.validateRRset(dsset, response.Answer, depth+1) {
+	case insecure:
+		return &zoneKeys{insecure: true, expires: keyExpiry(minKeyTTL)}, nil
+	case bogus:
+		return nil, fmt.Errorf("%w: DS records of %s", errBogus, zone)
+	}
+
+	dnskeys, sigs, ttl, err := v.fetchKeys(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := keysMatchingDS(dnskeys, ds)
+	if !verifyRRset(keySet(dnskeys), sigs, keys) {
+		return nil, fmt.Errorf("%w: DNSKEY records of %s", errBogus, zone)
+	}
+
+	return &zoneKeys{keys: dnskeys, expires: keyExpiry(ttl)}, nil
+}
+
+// fetchKeys looks up the DNSKEY records of a zone and their signatures.
+func (v *validator) fetchKeys(zone string) ([]*dns.DNSKEY, []*dns.RRSIG, uint32, error) {
+	response, err := v.query(zone, dns.TypeDNSKEY)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	var keys []*dns.DNSKEY
+	var sigs []*dns.RRSIG
+	for _, rr := range response.Answer {
+		switch record := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, record)
+		case *dns.RRSIG:
+			if record.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, record)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil, 0, fmt.Errorf("%w: no DNSKEY records for %s", errBogus, zone)
+	}
+
+	ttl, _ := minTTL(response)
+	return keys, sigs, ttl, nil
+}
+
+// keysMatchingDS returns the keys whose digest matches one of the DS records.
+func keysMatchingDS(keys []*dns.DNSKEY, ds []*dns.DS) []*dns.DNSKEY {
+	var matching []*dns.DNSKEY
+	for _, key := range keys {
+		for _, record := range ds {
+			if key.KeyTag() != record.KeyTag || key.Algorithm != record.Algorithm {
+				continue
+			}
+
+			digest := key.ToDS(record.DigestType)
+			if digest != nil && strings.EqualFold(digest.Digest, record.Digest) {
+				matching = append(matching, key)
+				break
+			}
+		}
+	}
+
+	return matching
+}
+
+// keySet returns DNSKEY records as an RRset.
+func keySet(keys []*dns.DNSKEY) []dns.RR {
+	rrset := make([]dns.RR, len(keys))
+	for i, key := range keys {
+		rrset[i] = key
+	}
+
+	return rrset
+}
+
+// keyExpiry returns when keys with the given TTL should be fetched again.
+func keyExpiry(ttl uint32) time.Time {
+	if ttl < minKeyTTL {
+		ttl = minKeyTTL
+	}
+
+	return time.Now().Add(time.Duration(ttl) * time.Second)
+}
+
+// deniesDS reports whether the authority section of a response holds an
+// NSEC or NSEC3 record proving a delegation has no DS records, including an
+// opt-out NSEC3 record covering it (RFC 5155 section 6).
+func deniesDS(zone string, response *dns.Msg) bool {
+	for _, rr := range response.Ns {
+		switch record := rr.(type) {
+		case *dns.NSEC:
+			if strings.EqualFold(record.Hdr.Name, zone) && !hasBit(record.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+		case *dns.NSEC3:
+			if record.Match(zone) && !hasBit(record.TypeBitMap, dns.TypeDS) {
+				return true
+			}
+			if record.Cover(zone) && record.Flags&1 != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// deniesName reports whether a negative response carries an NSEC or NSEC3
+// record denying the name, for NXDOMAIN, or the type, for NODATA. Only a
+// record matching or covering the name, or for NSEC3 the next closer name,
+// is looked for; the closest encloser and wildcard proofs of RFC 5155 are
+// not checked.
+func deniesName(question dns.Question, response *dns.Msg) bool {
+	name := question.Name
+	if response.Rcode == dns.RcodeSuccess {
+		// A NODATA answer at the end of a CNAME chain denies the target
+		if n := len(response.Answer); n > 0 {
+			if cname, ok := response.Answer[n-1].(*dns.CNAME); ok {
+				name = cname.Target
+			}
+		}
+	}
+
+	for _, rr := range response.Ns {
+		switch record := rr.(type) {
+		case *dns.NSEC:
+			if response.Rcode == dns.RcodeNameError && nsecCovers(record, name) {
+				return true
+			}
+			if response.Rcode == dns.RcodeSuccess && strings.EqualFold(record.Hdr.Name, name) &&
+				!hasBit(record.TypeBitMap, question.Qtype) && !hasBit(record.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if response.Rcode == dns.RcodeSuccess && strings.HasPrefix(record.Hdr.Name, "*.") &&
+				dns.IsSubDomain(strings.TrimPrefix(record.Hdr.Name, "*."), name) && !hasBit(record.TypeBitMap, question.Qtype) {
+				return true
+			}
+		case *dns.NSEC3:
+			if response.Rcode == dns.RcodeNameError && coversNextCloser(record, name) {
+				return true
+			}
+			if response.Rcode == dns.RcodeSuccess && record.Match(name) &&
+				!hasBit(record.TypeBitMap, question.Qtype) && !hasBit(record.TypeBitMap, dns.TypeCNAME) {
+				return true
+			}
+			if response.Rcode == dns.RcodeSuccess && record.Cover(name) && record.Flags&1 != 0 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// coversNextCloser reports whether an NSEC3 record covers a name or one of
+// its ancestors, one of which is the next closer name of an NXDOMAIN proof.
+func coversNextCloser(nsec3 *dns.NSEC3, name string) bool {
+	for ; name != "."; name = parentName(name) {
+		if nsec3.Cover(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nsecCovers reports whether name falls strictly between the owner of an
+// NSEC record and the next name in the zone, in canonical order.
+func nsecCovers(nsec *dns.NSEC, name string) bool {
+	owner := nsec.Hdr.Name
+	next := nsec.NextDomain
+	if canonicalCompare(owner, next) >= 0 {
+		// The last NSEC in the zone wraps back round to the apex
+		return canonicalCompare(owner, name) < 0 && dns.IsSubDomain(next, name)
+	}
+
+	return canonicalCompare(owner, name) < 0 && canonicalCompare(name, next) < 0
+}
+
+// canonicalCompare orders two names as RFC 4034 section 6.1 describes,
+// comparing their labels case-insensitively from the rightmost.
+func canonicalCompare(a, b string) int {
+	la := dns.SplitDomainName(strings.ToLower(a))
+	lb := dns.SplitDomainName(strings.ToLower(b))
+	for i := 1; i <= len(la) && i <= len(lb); i++ {
+		if c := strings.Compare(la[len(la)-i], lb[len(lb)-i]); c != 0 {
+			return c
+		}
+	}
+
+	return len(la) - len(lb)
+}
+
+// hasBit reports whether a type bitmap includes a type.
+func hasBit(bitmap []uint16, rrtype uint16) bool {
+	for _, t := range bitmap {
+		if t == rrtype {
+			return true
+		}
+	}
+
+	return false
+}
+
+// stripDNSSEC removes the DNSSEC records from a response to a client that
+// did not ask for them, keeping any of the type it asked for.
+func stripDNSSEC(question dns.Question, msg *dns.Msg) {
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns, &msg.Extra} {
+		kept := (*section)[:0]
+		for _, rr := range *section {
+			switch rrtype := rr.Header().Rrtype; rrtype {
+			case dns.TypeRRSIG, dns.TypeNSEC, dns.TypeNSEC3, dns.TypeDNSKEY, dns.TypeDS:
+				if rrtype != question.Qtype {
+					continue
+				}
+			}
+			kept = append(kept, rr)
+		}
+		*section = kept
+	}
+}
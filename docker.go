@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dockerTimeout is how long listing the containers of Docker may take.
+const dockerTimeout = 10 * time.Second
+
+// Addresses the names of containers may point at.
+const (
+	dockerAddressContainer = "container"
+	dockerAddressHost      = "host"
+)
+
+// dockerEventFilters select the events of the Docker API announcing that the
+// names of containers or their addresses may have changed.
+const dockerEventFilters = `{"type":["container","network"],"event":["start","die","rename","connect","disconnect"]}`
+
+// DockerConfig publishes the names of running Docker containers in Domain,
+// taken from their names or from the HostnameLabel they carry, and removes
+// them again as the containers stop.
+type DockerConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Host is the address of the Docker API, either a unix:// socket or a
+	// tcp:// address.
+	Host string `yaml:"host"`
+
+	// Domain is the zone the name of each container, name.domain, is
+	// published in.
+	Domain string `yaml:"domain"`
+
+	// HostnameLabel is the label giving a container hostnames of its own
+	// in place of its name, several of them separated by commas.
+	HostnameLabel string `yaml:"hostname_label"`
+
+	// Addresses selects what the names point at: "container" for the
+	// addresses of the containers on their networks, or "host" for HostIP,
+	// the address of the Docker host their ports are published on.
+	Addresses string `yaml:"addresses"`
+	HostIP    string `yaml:"host_ip"`
+}
+
+// parse validates the Docker address and the addresses to publish, and
+// canonicalises the domain.
+func (c *DockerConfig) parse() error {
+	host, err := url.Parse(c.Host)
+	if err != nil || (host.Scheme != "unix" && host.Scheme != "tcp") {
+		return fmt.Errorf("invalid docker host %q", c.Host)
+	}
+	switch c.Addresses {
+	case dockerAddressContainer:
+	case dockerAddressHost:
+		if net.ParseIP(c.HostIP) == nil {
+			return fmt.Errorf("invalid docker host_ip %q", c.HostIP)
+		}
+	default:
+		return fmt.Errorf("unsupported docker addresses %q", c.Addresses)
+	}
+	if c.Domain == "" {
+		return fmt.Errorf("docker needs a domain")
+	}
+
+	c.Domain = dns.CanonicalName(c.Domain)
+	return nil
+}
+
+// dockerContainer is a container as the Docker API lists it.
+type dockerContainer struct {
+	Names           []string          `json:"Names"`
+	Labels          map[string]string `json:"Labels"`
+	NetworkSettings struct {
+		Networks map[string]struct {
+			IPAddress         string `json:"IPAddress"`
+			GlobalIPv6Address string `json:"GlobalIPv6Address"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+// dockerGet sends a request to the Docker API, without a timeout of its own
+// so that the stream of events can be followed.
+func (c *DockerConfig) dockerGet(ctx context.Context, path string) (*http.Response, error) {
+	host, err := url.Parse(c.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	transport := &http.Transport{}
+	base := "http://" + host.Host
+	if host.Scheme == "unix" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", host.Path)
+		}
+		base = "http://docker"
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, base+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := (&http.Client{Transport: transport}).Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		response.Body.Close()
+		return nil, fmt.Errorf("docker answered %s for %s", response.Status, path)
+	}
+
+	return response, nil
+}
+
+func (c *DockerConfig) Put(record DNSRecord) error {
+	return errPublished
+}
+
+func (c *DockerConfig) Delete(record DNSRecord) error {
+	return errPublished
+}
+
+// List returns the records of the running containers.
+func (c *DockerConfig) List() ([]DNSRecord, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dockerTimeout)
+	defer cancel()
+
+	response, err := c.dockerGet(ctx, "/containers/json")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	var containers []dockerContainer
+	err = json.NewDecoder(response.Body).Decode(&containers)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, container := range containers {
+		records = append(records, c.containerRecords(container)...)
+	}
+
+	return records, nil
+}
+
+// containerRecords returns the records giving each hostname of a container
+// its addresses.
+func (c *DockerConfig) containerRecords(container dockerContainer) []DNSRecord {
+	var hostnames []string
+	if label := container.Labels[c.HostnameLabel]; c.HostnameLabel != "" && label != "" {
+		for _, hostname := range strings.Split(label, ",") {
+			if hostname = strings.TrimSpace(hostname); hostname != "" {
+				hostnames = append(hostnames, hostname)
+			}
+		}
+	} else if len(container.Names) > 0 {
+		hostnames = []string{strings.TrimPrefix(container.Names[0], "/") + "." + c.Domain}
+	}
+
+	var ips []string
+	if c.Addresses == dockerAddressHost {
+		ips = []string{c.HostIP}
+	} else {
+		for _, network := range container.NetworkSettings.Networks {
+			for _, ip := range []string{network.IPAddress, network.GlobalIPv6Address} {
+				if net.ParseIP(ip) != nil {
+					ips = append(ips, ip)
+				}
+			}
+		}
+	}
+
+	var records []DNSRecord
+	for _, hostname := range hostnames {
+		for _, ip := range ips {
+			records = append(records, DNSRecord{Hostname: hostname, IP: ip})
+		}
+	}
+
+	return records
+}
+
+// Watch follows the containers as they start and stop, following the
+// events of the Docker API. The events are followed again whenever the
+// connection to Docker is lost, announcing a change in case containers
+// started or stopped in the meantime.
+func (c *DockerConfig) Watch(changed func()) error {
+	go func() {
+		first, failing := true, false
+		for {
+			response, err := c.dockerGet(context.Background(), "/events?filters="+url.QueryEscape(dockerEventFilters))
+			if err != nil {
+				if !failing {
+					log.Printf("Failed to watch Docker: %v", err)
+				}
+				failing = true
+				time.Sleep(time.Second)
+				continue
+			}
+			if !first {
+				changed()
+			}
+			first, failing = false, false
+
+			decoder := json.NewDecoder(response.Body)
+			for {
+				var event json.RawMessage
+				if decoder.Decode(&event) != nil {
+					break
+				}
+				changed()
+			}
+			response.Body.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// downloadTimeout is how long downloading the records file may take.
+const downloadTimeout = time.Minute
+
+// emptyPayloadHash is the SHA-256 of an empty payload, which S3 is told
+// requests without a body carry.
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// RecordsDownload downloads the records file from an HTTP(S) or S3 URL every
+// Interval, saving it to RecordsFile, which is served if a download fails.
+type RecordsDownload struct {
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the records file to download, such as
+	// https://config.example.com/dns_records.yaml or
+	// s3://dns-config/dns_records.yaml.
+	URL string `yaml:"url"`
+
+	// ChecksumURL is a file holding the SHA-256 of the records file, as
+	// sha256sum writes it, that the download must match, so that a file
+	// that is partly published or corrupted is never served.
+	ChecksumURL string `yaml:"checksum_url"`
+
+	// Interval is how often the records file is downloaded again. Zero
+	// downloads it only at startup.
+	Interval time.Duration `yaml:"interval"`
+
+	// Region is the region of the S3 bucket.
+	Region string `yaml:"region"`
+
+	// Endpoint is the server of an S3-compatible service such as MinIO,
+	// whose buckets are addressed by path. Buckets of S3 itself are
+	// addressed as bucket.s3.region.amazonaws.com.
+	Endpoint string `yaml:"endpoint"`
+
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials
+	// for S3, taken from the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+	// AWS_SESSION_TOKEN environment variables if not set. Buckets that
+	// are readable publicly need none.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+
+	client *http.Client
+	etag   string
+}
+
+// parse validates the URLs and the interval, and takes the credentials from
+// the environment if they are not set.
+func (c *RecordsDownload) parse() error {
+	if c.URL == "" {
+		return fmt.Errorf("download needs a url")
+	}
+	for _, address := range []string{c.URL, c.ChecksumURL} {
+		if address == "" {
+			continue
+		}
+		parsed, err := url.Parse(address)
+		if err != nil || parsed.Host == "" || (parsed.Scheme != "http" && parsed.Scheme != "https" && parsed.Scheme != "s3") {
+			return fmt.Errorf("invalid download url %q", address)
+		}
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid download interval %v", c.Interval)
+	}
+
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	c.client = &http.Client{Timeout: downloadTimeout}
+	return nil
+}
+
+// get starts a download, asking for it only if it has changed since the
+// version with etag, if one is given.
+func (c *RecordsDownload) get(address, etag string) (*http.Response, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.Scheme == "s3" {
+		object := strings.TrimPrefix(parsed.Path, "/")
+		if c.Endpoint != "" {
+			address = c.Endpoint + "/" + parsed.Host + "/" + object
+		} else {
+			address = "https://" + parsed.Host + ".s3." + c.Region + ".amazonaws.com/" + object
+		}
+	}
+
+	request, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	if parsed.Scheme == "s3" && c.AccessKeyID != "" {
+		request.Header.Set("X-Amz-Content-Sha256", emptyPayloadHash)
+		credentials := awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}
+		credentials.sign(request, nil, time.Now().UTC(), c.Region, "s3")
+	}
+
+	return c.client.Do(request)
+}
+
+// fetch downloads the records file to filename, checking it against its
+// checksum, and reports whether it changed. The file is replaced only once
+// the download is complete and checked.
+func (c *RecordsDownload) fetch(filename string) (bool, error) {
+	response, err := c.get(c.URL, c.etag)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server answered %s", response.Status)
+	}
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+
+	if c.ChecksumURL != "" {
+		err = c.verify(body)
+		if err != nil {
+			return false, err
+		}
+	}
+	c.etag = response.Header.Get("ETag")
+
+	current, err := os.ReadFile(filename)
+	if err == nil && bytes.Equal(current, body) {
+		return false, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return false, err
+	}
+	err = os.WriteFile(filename+".tmp", body, 0644)
+	if err != nil {
+		return false, err
+	}
+	return true, os.Rename(filename+".tmp", filename)
+}
+
+// verify checks a download against the checksum published for it.
+func (c *RecordsDownload) verify(body []byte) error {
+	response, err := c.get(c.ChecksumURL, "")
+	if err != nil {
+		return fmt.Errorf("failed to download checksum: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download checksum: server answered %s", response.Status)
+	}
+	published, err := io.ReadAll(io.LimitReader(response.Body, 4096))
+	if err != nil {
+		return fmt.Errorf("failed to download checksum: %v", err)
+	}
+
+	fields := strings.Fields(string(published))
+	sum := sha256.Sum256(body)
+	if len(fields) == 0 || !strings.EqualFold(fields[0], hex.EncodeToString(sum[:])) {
+		return fmt.Errorf("download does not match its checksum")
+	}
+	return nil
+}
+
+// download downloads the records file before the records are first loaded.
+// The copy saved by an earlier download is served if it fails.
+func (c *Config) download() error {
+	_, err := c.Download.fetch(c.RecordsFile)
+	if err == nil {
+		return nil
+	}
+	if _, statErr := os.Stat(c.RecordsFile); statErr != nil {
+		return fmt.Errorf("failed to download %s: %v", c.Download.URL, err)
+	}
+
+	log.Printf("Failed to download %s, serving the last copy: %v", c.Download.URL, err)
+	return nil
+}
+
+// followDownload downloads the records file again every Interval, reloading
+// the records whenever it changes.
+func (s *dnsServer) followDownload() {
+	config := &s.config.Download
+	if !config.Enabled || config.Interval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.Interval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			changed, err := config.fetch(s.config.RecordsFile)
+			if err != nil {
+				log.Printf("Failed to download %s, keeping the last copy: %v", config.URL, err)
+				continue
+			}
+			if changed {
+				log.Printf("Downloaded a new version of %s", config.URL)
+				s.reloadRecords()
+			}
+		}
+	}()
+}
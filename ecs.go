@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"strconv"
+
+	"github.com/miekg/dns"
+)
+
+// ECSConfig controls the EDNS Client Subnet option (RFC 7871) attached to
+// forwarded queries, which lets upstreams tailor answers such as CDN
+// addresses to where the client is.
+type ECSConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// IPv4Prefix and IPv6Prefix are how many bits of the client's address
+	// are revealed to the upstreams.
+	IPv4Prefix int `yaml:"ipv4_prefix"`
+	IPv6Prefix int `yaml:"ipv6_prefix"`
+}
+
+// clientSubnet returns the ECS option to attach when forwarding a query from
+// client, or nil if none should be sent. A subnet supplied by the client is
+// used in place of its address but is still truncated to the configured
+// prefix, and a client asking for a zero-length prefix opts out entirely.
+func (s *dnsServer) clientSubnet(request *dns.Msg, client net.IP) *dns.EDNS0_SUBNET {
+	if !s.config.ECS.Enabled {
+		return nil
+	}
+
+	ip := client
+	prefix := 128
+	if requested := requestSubnet(request); requested != nil {
+		if requested.SourceNetmask == 0 {
+			return nil
+		}
+		ip = requested.Address
+		prefix = int(requested.SourceNetmask)
+	}
+
+	// Addresses that only make sense locally tell the upstream nothing
+	if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() {
+		return nil
+	}
+
+	subnet := &dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET}
+	if ip4 := ip.To4(); ip4 != nil {
+		prefix = min(prefix, s.config.ECS.IPv4Prefix, 8*net.IPv4len)
+		subnet.Family = 1
+		subnet.Address = ip4.Mask(net.CIDRMask(prefix, 8*net.IPv4len))
+	} else {
+		prefix = min(prefix, s.config.ECS.IPv6Prefix)
+		subnet.Family = 2
+		subnet.Address = ip.Mask(net.CIDRMask(prefix, 8*net.IPv6len))
+	}
+	subnet.SourceNetmask = uint8(prefix)
+
+	return subnet
+}
+
+// requestSubnet returns the ECS option of a message, or nil if it has none.
+func requestSubnet(msg *dns.Msg) *dns.EDNS0_SUBNET {
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, option := range opt.Option {
+		if subnet, ok := option.(*dns.EDNS0_SUBNET); ok {
+			return subnet
+		}
+	}
+
+	return nil
+}
+
+// withClientSubnet returns a copy of a request carrying the given ECS option
+// in place of any the client sent.
+func (s *dnsServer) withClientSubnet(request *dns.Msg, subnet *dns.EDNS0_SUBNET) *dns.Msg {
+	request = request.Copy()
+
+	opt := request.IsEdns0()
+	if opt == nil {
+		request.SetEdns0(s.config.MaxUDPSize, false)
+		opt = request.IsEdns0()
+	}
+
+	options := opt.Option[:0]
+	for _, option := range opt.Option {
+		if option.Option() != dns.EDNS0SUBNET {
+			options = append(options, option)
+		}
+	}
+	opt.Option = append(options, subnet)
+
+	return request
+}
+
+// subnetCacheKey returns the part of the cache key distinguishing a response
+// to a query sent with the given ECS option. Responses whose scope covers
+// every client, as well as queries sent without ECS, share the empty key.
+func subnetCacheKey(subnet *dns.EDNS0_SUBNET, response *dns.Msg) string {
+	if subnet == nil {
+		return ""
+	}
+
+	if response != nil {
+		if scope := requestSubnet(response); scope == nil || scope.SourceScope == 0 {
+			return ""
+		}
+	}
+
+	return subnet.Address.String() + "/" + strconv.Itoa(int(subnet.SourceNetmask))
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"github.com/miekg/dns"
+)
+
+// udpPayloadSize returns the largest response that can be sent to the client
+// over UDP. Clients without EDNS0 are limited to 512 bytes, and clients that
+// advertise a larger buffer are capped at the configured maximum.
+func (s *dnsServer) udpPayloadSize(request *dns.Msg) int {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return dns.MinMsgSize
+	}
+
+	size := opt.UDPSize()
+	if size > s.config.MaxUDPSize {
+		size = s.config.MaxUDPSize
+	}
+	if size < dns.MinMsgSize {
+		size = dns.MinMsgSize
+	}
+
+	return int(size)
+}
+
+// setResponseEDNS replaces any OPT record in the response, such as one copied
+// from an upstream server, with our own. An OPT record is only included when
+// the client sent one, as required by RFC 6891 section 7.
+func (s *dnsServer) setResponseEDNS(request *dns.Msg, response *dns.Msg) {
+	stripOPT(response)
+
+	opt := request.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	response.SetEdns0(s.config.MaxUDPSize, opt.Do())
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Schemes marking upstreams reached over DNS-over-TLS and DNS-over-HTTPS.
+const (
+	schemeTLS   = "tls://"
+	schemeHTTPS = "https://"
+)
+
+// encryptedTimeout bounds connecting to and querying an upstream over TCP,
+// TLS or HTTPS when the query has no deadline of its own.
+const encryptedTimeout = 5 * time.Second
+
+// httpsClients holds the client for each DNS-over-HTTPS upstream so that
+// their connections are reused across queries.
+var httpsClients = struct {
+	sync.Mutex
+	clients map[string]*http.Client
+}{
+	clients: map[string]*http.Client{},
+}
+
+// normalizeTLSUpstream adds the default DNS-over-TLS port to a tls://
+// upstream that does not name one, keeping any #servername suffix.
+func normalizeTLSUpstream(upstream string) string {
+	address, name, _ := strings.Cut(strings.TrimPrefix(upstream, schemeTLS), "#")
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), "853")
+	}
+
+	if name != "" {
+		return schemeTLS + address + "#" + name
+	}
+	return schemeTLS + address
+}
+
+// exchangeTLS sends a query to a DNS-over-TLS upstream (RFC 7858) over a
+// pooled connection.
+func exchangeTLS(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	return poolFor(upstream).Exchange(ctx, request)
+}
+
+// httpsClient returns the client for a DNS-over-HTTPS upstream, which keeps
+// its connections open for the upstream's idle timeout.
+func httpsClient(upstream Upstream) *http.Client {
+	httpsClients.Lock()
+	defer httpsClients.Unlock()
+
+	client, ok := httpsClients.clients[upstream.Address]
+	if !ok {
+		transport := &http.Transport{
+			ForceAttemptHTTP2:   true,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     upstream.IdleTimeout,
+			TLSClientConfig:     &tls.Config{MinVersion: tls.VersionTLS12},
+		}
+		if upstream.IdleTimeout <= 0 {
+			transport.DisableKeepAlives = true
+		}
+
+		client = &http.Client{Timeout: encryptedTimeout, Transport: transport}
+		httpsClients.clients[upstream.Address] = client
+	}
+
+	return client
+}
+
+// exchangeHTTPS sends a query to a DNS-over-HTTPS upstream (RFC 8484) as a
+// POST request. The query ID is sent as zero, as the RFC recommends for
+// cacheability, and restored in the response.
+func exchangeHTTPS(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	query := request.Copy()
+	query.Id = 0
+	buf, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, upstream.Address, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", dohMediaType)
+	httpRequest.Header.Set("Accept", dohMediaType)
+
+	httpResponse, err := httpsClient(upstream).Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned HTTP status %s", httpResponse.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(httpResponse.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	err = response.Unpack(body)
+	if err != nil {
+		return nil, err
+	}
+	response.Id = request.Id
+
+	return response, nil
+}
+
+// dohMediaType is the content type of DNS messages sent over HTTPS.
+const dohMediaType = "application/dns-message"
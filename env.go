@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+)
+
+// envReference matches a ${NAME} reference to an environment variable in a
+// config value.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces the references to environment variables in every string
+// setting held in value, so that one config file can serve several
+// environments and keep its secrets out of the file. Only settings given as
+// strings, such as addresses, paths and secrets, are expanded. A reference
+// to a variable that is not set is an error, rather than silently leaving
+// the setting empty.
+func expandEnv(value reflect.Value) error {
+	return replaceStrings(value, func(text string) (string, error) {
+		var err error
+		expanded := envReference.ReplaceAllStringFunc(text, func(reference string) string {
+			name := envReference.FindStringSubmatch(reference)[1]
+			env, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("environment variable %s is not set", name)
+			}
+			return env
+		})
+
+		return expanded, err
+	})
+}
+
+// replaceStrings replaces every exported string held in value, walking
+// through its structs, slices and pointers, with what replace returns for
+// it.
+func replaceStrings(value reflect.Value, replace func(string) (string, error)) error {
+	switch value.Kind() {
+	case reflect.String:
+		if !value.CanSet() {
+			return nil
+		}
+
+		replaced, err := replace(value.String())
+		if err != nil {
+			return err
+		}
+		value.SetString(replaced)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			err := replaceStrings(value.Field(i), replace)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < value.Len(); i++ {
+			err := replaceStrings(value.Index(i), replace)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Ptr:
+		if !value.IsNil() {
+			return replaceStrings(value.Elem(), replace)
+		}
+	}
+
+	return nil
+}
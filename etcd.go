@@ -0,0 +1,336 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcdTimeout is how long reading the records kept in etcd may take.
+const etcdTimeout = 10 * time.Second
+
+// etcdService is a service entry kept in etcd in the format of SkyDNS.
+type etcdService struct {
+	Host     string `json:"host,omitempty"`
+	Port     uint16 `json:"port,omitempty"`
+	Priority uint16 `json:"priority,omitempty"`
+	Weight   uint16 `json:"weight,omitempty"`
+	Text     string `json:"text,omitempty"`
+	Mail     bool   `json:"mail,omitempty"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// newEtcdClient returns a client for the configured etcd cluster.
+func newEtcdClient(config *Config) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   config.EtcdEndpoints,
+		Username:    config.EtcdUsername,
+		Password:    config.EtcdPassword,
+		DialTimeout: etcdTimeout,
+	})
+}
+
+// etcdStore is the store of the records kept in etcd by the etcd backend.
+type etcdStore struct {
+	config *Config
+}
+
+// List reads the records kept in etcd under EtcdPrefix, laid out as
+// SkyDNS lays them out: the path of each key spells its hostname with the
+// labels reversed, so /skydns/lan/cluster/web holds web.cluster.lan, and
+// its value is a service entry in JSON, or a list of them.
+func (e *etcdStore) List() ([]DNSRecord, error) {
+	config := e.config
+	client, err := newEtcdClient(config)
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	response, err := client.Get(ctx, etcdKeyPrefix(config), clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var records []DNSRecord
+	for _, kv := range response.Kvs {
+		key := string(kv.Key)
+		hostname := etcdHostname(config, key)
+		if hostname == "" {
+			continue
+		}
+
+		services, err := parseEtcdServices(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid service entry in etcd key %s: %v", key, err)
+		}
+
+		var expires time.Time
+		if kv.Lease != 0 {
+			lease, err := client.TimeToLive(ctx, clientv3.LeaseID(kv.Lease))
+			if err == nil && lease.TTL > 0 {
+				expires = now.Add(time.Duration(lease.TTL) * time.Second)
+			}
+		}
+		for _, service := range services {
+			serviceRecords, err := service.records(hostname)
+			if err != nil {
+				return nil, fmt.Errorf("invalid service entry in etcd key %s: %v", key, err)
+			}
+			for _, record := range serviceRecords {
+				record.Expires = expires
+				records = append(records, record)
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// parseEtcdServices parses the value of a key, a service entry in JSON or a
+// list of them.
+func parseEtcdServices(value []byte) ([]etcdService, error) {
+	var services []etcdService
+	if strings.HasPrefix(strings.TrimSpace(string(value)), "[") {
+		err := json.Unmarshal(value, &services)
+		return services, err
+	}
+
+	services = make([]etcdService, 1)
+	err := json.Unmarshal(value, &services[0])
+	return services, err
+}
+
+// etcdKeyPrefix returns the prefix of the keys holding records.
+func etcdKeyPrefix(config *Config) string {
+	return strings.TrimSuffix(config.EtcdPrefix, "/") + "/"
+}
+
+// etcdKey returns the key holding the records of a hostname, the reverse of
+// etcdHostname.
+func etcdKey(config *Config, hostname string) string {
+	labels := dns.SplitDomainName(canonicalHostname(hostname))
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return etcdKeyPrefix(config) + strings.Join(labels, "/")
+}
+
+// etcdHostname returns the hostname an etcd key holds the records of, or an
+// empty string for the key of the prefix itself.
+func etcdHostname(config *Config, key string) string {
+	var labels []string
+	for _, label := range strings.Split(strings.TrimPrefix(key, etcdKeyPrefix(config)), "/") {
+		if label != "" {
+			labels = append([]string{label}, labels...)
+		}
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+
+	return strings.Join(labels, ".") + "."
+}
+
+// records returns the records a service entry gives hostname. A host that is
+// an address is served as an A or AAAA record, and one that is a name as a
+// CNAME, or as an MX record for mail. With a port, an SRV record points at
+// the host, or at hostname itself when the host is an address.
+func (e etcdService) records(hostname string) ([]DNSRecord, error) {
+	var records []DNSRecord
+	target := dns.Fqdn(e.Host)
+	if ip := net.ParseIP(e.Host); ip != nil {
+		records = append(records, DNSRecord{Hostname: hostname, TTL: e.TTL, IP: e.Host})
+		target = hostname
+	} else if e.Host != "" && e.Mail {
+		records = append(records, DNSRecord{Hostname: hostname, TTL: e.TTL, MX: &MXRecord{Preference: e.priority(), Exchange: target}})
+	} else if e.Host != "" && e.Port == 0 {
+		records = append(records, DNSRecord{Hostname: hostname, TTL: e.TTL, CNAME: target})
+	}
+
+	if e.Port != 0 {
+		if e.Host == "" {
+			return nil, fmt.Errorf("port %d without a host", e.Port)
+		}
+		records = append(records, DNSRecord{Hostname: hostname, TTL: e.TTL, SRV: &SRVRecord{Priority: e.priority(), Weight: e.Weight, Port: e.Port, Target: target}})
+	}
+	if e.Text != "" {
+		records = append(records, DNSRecord{Hostname: hostname, TTL: e.TTL, TXT: TXTRecord{e.Text}})
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("neither a host nor text")
+	}
+
+	return records, nil
+}
+
+// priority returns the priority of the service entry, which is 10 unless it
+// sets its own, as with SkyDNS.
+func (e etcdService) priority() uint16 {
+	if e.Priority == 0 {
+		return 10
+	}
+
+	return e.Priority
+}
+
+// Put adds the service entries serving a record to those of its hostname.
+// Only records of the types service entries can hold are kept.
+func (e *etcdStore) Put(record DNSRecord) error {
+	rrs, err := record.RRs(canonicalHostname(record.Hostname))
+	if err != nil {
+		return err
+	}
+
+	return e.update(record.Hostname, func(services []etcdService) ([]etcdService, error) {
+		for _, rr := range rrs {
+			service, err := etcdServiceOf(rr)
+			if err != nil {
+				return nil, err
+			}
+			services = append(services, service)
+		}
+		return services, nil
+	})
+}
+
+// Delete removes the service entries of the hostname of a record that are
+// served as the same answers as the record.
+func (e *etcdStore) Delete(record DNSRecord) error {
+	deleted, err := recordAnswers(record)
+	if err != nil {
+		return err
+	}
+
+	return e.update(record.Hostname, func(services []etcdService) ([]etcdService, error) {
+		var kept []etcdService
+		for _, service := range services {
+			records, err := service.records(record.Hostname)
+			if err != nil {
+				return nil, err
+			}
+			answers := map[string][]string{}
+			for _, served := range records {
+				servedAnswers, err := recordAnswers(served)
+				if err != nil {
+					return nil, err
+				}
+				for rrtype, data := range servedAnswers {
+					answers[rrtype] = append(answers[rrtype], data...)
+				}
+			}
+			if !sameAnswers(answers, deleted) {
+				kept = append(kept, service)
+			}
+		}
+		return kept, nil
+	})
+}
+
+// update replaces the service entries of a hostname with those update
+// returns for them, deleting the key of the hostname when none are left.
+func (e *etcdStore) update(hostname string, update func([]etcdService) ([]etcdService, error)) error {
+	client, err := newEtcdClient(e.config)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), etcdTimeout)
+	defer cancel()
+	key := etcdKey(e.config, hostname)
+	response, err := client.Get(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	var services []etcdService
+	if len(response.Kvs) > 0 {
+		services, err = parseEtcdServices(response.Kvs[0].Value)
+		if err != nil {
+			return fmt.Errorf("invalid service entry in etcd key %s: %v", key, err)
+		}
+	}
+	services, err = update(services)
+	if err != nil {
+		return err
+	}
+
+	if len(services) == 0 {
+		_, err = client.Delete(ctx, key)
+		return err
+	}
+	value, err := json.Marshal(services)
+	if err != nil {
+		return err
+	}
+	_, err = client.Put(ctx, key, string(value))
+	return err
+}
+
+// etcdServiceOf returns the service entry serving a resource record.
+func etcdServiceOf(rr dns.RR) (etcdService, error) {
+	service := etcdService{TTL: rr.Header().Ttl}
+	switch rr := rr.(type) {
+	case *dns.A:
+		service.Host = rr.A.String()
+	case *dns.AAAA:
+		service.Host = rr.AAAA.String()
+	case *dns.CNAME:
+		service.Host = rr.Target
+	case *dns.MX:
+		service.Host, service.Priority, service.Mail = rr.Mx, rr.Preference, true
+	case *dns.SRV:
+		service.Host, service.Port, service.Priority, service.Weight = rr.Target, rr.Port, rr.Priority, rr.Weight
+	case *dns.TXT:
+		service.Text = strings.Join(rr.Txt, "")
+	default:
+		return service, fmt.Errorf("%s records cannot be kept in etcd", dns.TypeToString[rr.Header().Rrtype])
+	}
+
+	return service, nil
+}
+
+// Watch follows the changes other systems make to the records kept in etcd
+// as a watch announces them. The watch is started again should etcd cancel
+// it, announcing a change in case changes were missed in the meantime.
+func (e *etcdStore) Watch(changed func()) error {
+	client, err := newEtcdClient(e.config)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		first := true
+		for {
+			ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(context.Background()))
+			watch := client.Watch(ctx, etcdKeyPrefix(e.config), clientv3.WithPrefix(), clientv3.WithCreatedNotify())
+			for response := range watch {
+				if response.Err() != nil {
+					log.Printf("Failed to watch the records in etcd: %v", response.Err())
+					break
+				}
+				if response.Created && first {
+					first = false
+					continue
+				}
+				changed()
+			}
+			cancel()
+			time.Sleep(time.Second)
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestEtcdHostname(t *testing.T) {
+	config := DefaultConfig()
+	config.EtcdPrefix = "/skydns"
+
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"/skydns/lan/example/www", "www.example.lan."},
+		{"/skydns/lan/example/www/", "www.example.lan."},
+		{"/skydns/lan", "lan."},
+		{"/skydns/", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := etcdHostname(config, test.key); got != test.want {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestEtcdServiceRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		service etcdService
+		want    []string
+	}{
+		{"address", etcdService{Host: "192.168.1.10"}, []string{"A 192.168.1.10"}},
+		{"name", etcdService{Host: "www.example.lan"}, []string{"CNAME www.example.lan."}},
+		{"mail", etcdService{Host: "mx.example.lan", Mail: true, Priority: 5}, []string{"MX 5 mx.example.lan."}},
+		{"service at an address", etcdService{Host: "fd00::10", Port: 8080}, []string{"AAAA fd00::10", "SRV 10 0 8080 svc.example.lan."}},
+		{"service at a name", etcdService{Host: "www.example.lan", Port: 443, Weight: 50}, []string{"SRV 10 50 443 www.example.lan."}},
+		{"text", etcdService{Text: "hello"}, []string{`TXT "hello"`}},
+		{"port without a host", etcdService{Port: 80}, nil},
+		{"empty", etcdService{}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := test.service.records("svc.example.lan.")
+			if test.want == nil {
+				if err == nil {
+					t.Fatalf("got %+v, want an error", records)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, record := range records {
+				rrs, err := record.RRs(record.Hostname)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, rr := range rrs {
+					// Each record is given as its type and data
+					got = append(got, strings.Join(strings.Fields(rr.String())[3:], " "))
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
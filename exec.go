@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ExecConfig answers the names matching Pattern by running a program,
+// which is given the query as JSON and answers as the remote backend does.
+type ExecConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Command is the program to run and its arguments.
+	Command []string `yaml:"command"`
+
+	// Pattern is the regular expression the names answered by the program
+	// match, such as \.lab\.lan\.$.
+	Pattern string `yaml:"pattern"`
+
+	// Timeout is how long the program may take to answer a query.
+	Timeout time.Duration `yaml:"timeout"`
+
+	pattern *regexp.Regexp
+}
+
+// parse validates the command, pattern and timeout.
+func (c *ExecConfig) parse() error {
+	if len(c.Command) == 0 || c.Command[0] == "" {
+		return fmt.Errorf("exec needs a command")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid exec timeout %v", c.Timeout)
+	}
+
+	pattern, err := regexp.Compile(c.Pattern)
+	if err != nil {
+		return fmt.Errorf("invalid exec pattern %q: %v", c.Pattern, err)
+	}
+	c.pattern = pattern
+	return nil
+}
+
+// covers reports whether name is answered by the program.
+func (c *ExecConfig) covers(name string) bool {
+	return c.pattern.MatchString(dns.CanonicalName(name))
+}
+
+// lookupExec runs the program for a query, returning the records it
+// answers with.
+func (c *ExecConfig) lookupExec(question dns.Question, client string) ([]dns.RR, error) {
+	input, err := json.Marshal(pluginQuery{
+		Qname:  question.Name,
+		Qtype:  dns.TypeToString[question.Qtype],
+		Client: client,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, c.Command[0], c.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return nil, fmt.Errorf("%v: %s", err, message)
+		}
+		return nil, err
+	}
+
+	rrs, err := decodeRemoteRecords(bytes.NewReader(output))
+	if err != nil {
+		return nil, fmt.Errorf("invalid answer from %s: %v", c.Command[0], err)
+	}
+
+	return rrs, nil
+}
+
+// execHandler answers the names matching the pattern by running the
+// program.
+func (s *dnsServer) execHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	if !s.config.Exec.Enabled || !s.config.Exec.covers(q.request.Question[0].Name) {
+		return next()
+	}
+
+	s.answerExec(q.request, q.response, q.client)
+	return q.response
+}
+
+// answerExec answers a query with the records the program gives for its
+// name. Names it has no records for are NXDOMAIN, and names without records
+// of the type asked for NODATA, so programs should give every record of a
+// name whatever the type asked for. A failing program is SERVFAIL.
+func (s *dnsServer) answerExec(request *dns.Msg, response *dns.Msg, client net.IP) {
+	question := request.Question[0]
+	var address string
+	if client != nil {
+		address = client.String()
+	}
+	rrs, err := s.config.Exec.lookupExec(question, address)
+	if err != nil {
+		log.Printf("Failed to look up %s with exec: %v", question.Name, err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	response.Authoritative = true
+	answers := questionAnswers(question, rrs)
+	rotate(answers, atomic.AddUint64(&s.rotation, 1))
+	response.Answer = answers
+	if len(rrs) == 0 {
+		response.Rcode = dns.RcodeNameError
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// execTestProgram answers host.lab.lan with the client that asked, fails
+// for broken.lab.lan and has no records for other names.
+const execTestProgram = `#!/bin/sh
+query=$(cat)
+case "$query" in
+*'"qname":"host.lab.lan."'*)
+	client=$(echo "$query" | sed 's/.*"client":"\([^"]*\)".*/\1/')
+	echo '{"result": [{"qname": "host.lab.lan", "qtype": "A", "content": "10.1.0.1", "ttl": 60},'
+	echo ' {"qname": "host.lab.lan", "qtype": "TXT", "content": "\"'"$client"'\"", "ttl": 60}]}'
+	;;
+*'"qname":"broken.lab.lan."'*)
+	echo "broken" >&2
+	exit 1
+	;;
+*)
+	echo '{"result": false}'
+	;;
+esac
+`
+
+func TestExecHandler(t *testing.T) {
+	program := filepath.Join(t.TempDir(), "lab-dns")
+	err := os.WriteFile(program, []byte(execTestProgram), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := DefaultConfig()
+	config.Exec = ExecConfig{Enabled: true, Command: []string{program}, Pattern: `\.lab\.lan\.$`, Timeout: 2 * time.Second}
+	err = config.Exec.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{config: config}
+
+	answer := func(name string, qtype uint16) *dns.Msg {
+		request := new(dns.Msg).SetQuestion(name, qtype)
+		q := &query{request: request, response: new(dns.Msg).SetReply(request), client: net.ParseIP("192.168.1.20")}
+		return s.execHandler(q, func() *dns.Msg { return nil })
+	}
+
+	// Only the records of the type asked for are answered, and the
+	// program is told who asked
+	response := answer("host.lab.lan.", dns.TypeA)
+	if len(response.Answer) != 1 || response.Answer[0].String() != "host.lab.lan.\t60\tIN\tA\t10.1.0.1" {
+		t.Fatalf("got %v, want the A record", response.Answer)
+	}
+	response = answer("host.lab.lan.", dns.TypeTXT)
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.TXT).Txt[0] != "192.168.1.20" {
+		t.Fatalf("got %v, want a TXT record of the client", response.Answer)
+	}
+	response = answer("host.lab.lan.", dns.TypeAAAA)
+	if response.Rcode != dns.RcodeSuccess || len(response.Answer) != 0 {
+		t.Fatalf("got %s with %v, want NODATA", dns.RcodeToString[response.Rcode], response.Answer)
+	}
+
+	if response = answer("missing.lab.lan.", dns.TypeA); response.Rcode != dns.RcodeNameError {
+		t.Fatalf("got %s, want NXDOMAIN", dns.RcodeToString[response.Rcode])
+	}
+	if response = answer("broken.lab.lan.", dns.TypeA); response.Rcode != dns.RcodeServerFailure {
+		t.Fatalf("got %s, want SERVFAIL", dns.RcodeToString[response.Rcode])
+	}
+
+	// Names not matching the pattern are passed on
+	if response = answer("host.lan.", dns.TypeA); response != nil {
+		t.Fatalf("got %v, want the query passed on", response)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// exportZone prints a zone as a master file (RFC 1035), as the running
+// server holds it, including any records added by dynamic updates. The zone
+// is transferred from the server, so its allow_transfer networks must
+// include the address the export is made from, and the export signed with
+// the zone's transfer key if it has one.
+func exportZone(configFile, server, keyName, origin string) error {
+	if origin == "" {
+		return errors.New("no zone given")
+	}
+
+	config, err := LoadConfig(configFile)
+	if err != nil {
+		return err
+	}
+
+	if server == "" {
+		if len(config.Listen) == 0 {
+			return errors.New("no listen address to export from")
+		}
+		server = localAddress(config.Listen[0])
+	}
+
+	request := new(dns.Msg)
+	request.SetAxfr(dns.Fqdn(origin))
+
+	transfer := &dns.Transfer{DialTimeout: transferTimeout, ReadTimeout: transferTimeout}
+	if keyName != "" {
+		key := config.tsigKey(keyName)
+		if key == nil {
+			return fmt.Errorf("unknown TSIG key %s", keyName)
+		}
+		transfer.TsigSecret = map[string]string{key.Name: key.Secret}
+		request.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	envelopes, err := transfer.In(request, upstreamAddress(server))
+	if err != nil {
+		return err
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+	if len(rrs) < 2 || !isSOA(rrs[0]) {
+		return errors.New("transfer does not start with an SOA record")
+	}
+
+	// The transfer ends by repeating the SOA record
+	_, err = os.Stdout.WriteString(zoneFileText(rrs[:len(rrs)-1]))
+	return err
+}
+
+// localAddress returns the address to reach a listen address on from the
+// same host, which for a wildcard address is the loopback address.
+func localAddress(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		} else {
+			host = "127.0.0.1"
+		}
+	}
+
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Answers given to blocked names.
+const (
+	filterNXDomain = "nxdomain"
+	filterNull     = "null"
+)
+
+// FilterConfig blocks the names of Blocklists, in the Pi-hole and AdGuard
+// Home formats, except those of Allowlists.
+type FilterConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Blocklists and Allowlists are files or http:// and https:// URLs of
+	// lists in the hosts format, as adblock rules such as
+	// ||ads.example.com^, or with a domain to a line, in any mix.
+	// Exceptions such as @@||cdn.example.com^ in a blocklist allow names
+	// as an allowlist does.
+	Blocklists []string `yaml:"blocklists"`
+	Allowlists []string `yaml:"allowlists"`
+
+	// RefreshInterval is how often the lists given as URLs are downloaded
+	// again, if they have changed. Zero downloads them only at startup.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// ListDirectory keeps the last copy downloaded of each list, which is
+	// used when the list cannot be downloaded at startup.
+	ListDirectory string `yaml:"list_directory"`
+
+	// PolicyZones are zones of the records file, read from a file or
+	// transferred from their primaries, applied as response policy zones
+	// (RPZ), in order of precedence.
+	PolicyZones []string `yaml:"policy_zones"`
+
+	// Response is how blocked names are answered: "nxdomain", or "null"
+	// with the unspecified addresses 0.0.0.0 and :: as Pi-hole does.
+	Response string `yaml:"response"`
+
+	// TTL is the time-to-live of the answers to blocked names.
+	TTL uint32 `yaml:"ttl"`
+
+	subscriptions *listSubscriptions
+}
+
+// parse validates the response to blocked names and canonicalises the
+// policy zones.
+func (c *FilterConfig) parse() error {
+	if c.Response != filterNXDomain && c.Response != filterNull {
+		return fmt.Errorf("unsupported filter response %q", c.Response)
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("invalid filter refresh_interval %v", c.RefreshInterval)
+	}
+
+	for i, zone := range c.PolicyZones {
+		c.PolicyZones[i] = dns.CanonicalName(zone)
+	}
+	c.subscriptions = newListSubscriptions(c.ListDirectory)
+	return nil
+}
+
+// listURLs returns the lists given as URLs.
+func (c *FilterConfig) listURLs() []string {
+	var urls []string
+	for _, list := range append(append([]string{}, c.Blocklists...), c.Allowlists...) {
+		if isListURL(list) {
+			urls = append(urls, list)
+		}
+	}
+
+	return urls
+}
+
+// filter holds the names the filter blocks and allows. Names are matched
+// exactly, while domains also match every name below them.
+type filter struct {
+	blocked        map[string]bool
+	blockedDomains map[string]bool
+	allowed        map[string]bool
+	allowedDomains map[string]bool
+}
+
+// hostsPlaceholders are the names hosts-format lists give their own
+// addresses, which are not meant to be blocked.
+var hostsPlaceholders = map[string]bool{
+	"localhost.":             true,
+	"localhost.localdomain.": true,
+	"local.":                 true,
+	"broadcasthost.":         true,
+	"ip6-localhost.":         true,
+	"ip6-loopback.":          true,
+	"ip6-localnet.":          true,
+	"ip6-mcastprefix.":       true,
+	"ip6-allnodes.":          true,
+	"ip6-allrouters.":        true,
+	"ip6-allhosts.":          true,
+}
+
+// loadFilter reads the configured blocklists and allowlists, those given as
+// URLs from their latest copies. Lists at URLs that have never been
+// downloaded are left out until they are.
+func loadFilter(config *FilterConfig) (*filter, error) {
+	f := &filter{
+		blocked:        map[string]bool{},
+		blockedDomains: map[string]bool{},
+		allowed:        map[string]bool{},
+		allowedDomains: map[string]bool{},
+	}
+	for i, list := range append(append([]string{}, config.Blocklists...), config.Allowlists...) {
+		allow := i >= len(config.Blocklists)
+		if !isListURL(list) {
+			err := f.readFile(list, allow)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		latest, err := config.subscriptions.open(list)
+		if err != nil {
+			log.Printf("Leaving out filter list %s: %v", list, err)
+			continue
+		}
+		skipped, err := f.read(latest, allow)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", list, err)
+		}
+		if skipped > 0 {
+			log.Printf("Skipped %d rules of %s that cannot be applied to names", skipped, list)
+		}
+	}
+
+	log.Printf("Loaded %d blocked names and domains, allowing %d", len(f.blocked)+len(f.blockedDomains), len(f.allowed)+len(f.allowedDomains))
+	return f, nil
+}
+
+// readFile reads a blocklist, or an allowlist with allow.
+func (f *filter) readFile(filename string, allow bool) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	skipped, err := f.read(file, allow)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", filename, err)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d rules of %s that cannot be applied to names", skipped, filename)
+	}
+
+	return nil
+}
+
+// read reads the lines of a list, in the hosts format, as adblock rules or
+// as plain domains, returning how many rules it skipped. Comments start
+// with '#', or with '!' in adblock lists. Hosts entries and plain domains
+// match their names exactly, as in Pi-hole, while ||domain^ rules match
+// the names below the domain as well.
+func (f *filter) read(list io.Reader, allow bool) (int, error) {
+	skipped := 0
+	scanner := bufio.NewScanner(list)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '#' || line[0] == '[' {
+			continue
+		}
+		if text, _, found := strings.Cut(line, " #"); found {
+			line = strings.TrimSpace(text)
+		}
+
+		if strings.HasPrefix(line, "||") || strings.HasPrefix(line, "@@||") {
+			if !f.addRule(line, allow) {
+				skipped++
+			}
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			for _, name := range fields[1:] {
+				if !hostsPlaceholders[dns.CanonicalName(name)] {
+					f.add(name, false, allow)
+				}
+			}
+			continue
+		}
+		if len(fields) != 1 || !f.add(fields[0], false, allow) {
+			skipped++
+		}
+	}
+
+	return skipped, scanner.Err()
+}
+
+// addRule adds an adblock rule, ||domain^ or the exception @@||domain^,
+// reporting false for rules the filter cannot apply, such as those matching
+// parts of URLs or limited to some clients or requests. Of the modifiers,
+// only $important is accepted, as every rule applies to every client.
+func (f *filter) addRule(rule string, allow bool) bool {
+	if strings.HasPrefix(rule, "@@") {
+		rule, allow = rule[2:], true
+	}
+	rule, modifiers, _ := strings.Cut(strings.TrimPrefix(rule, "||"), "$")
+	if modifiers != "" && modifiers != "important" {
+		return false
+	}
+	domain, found := strings.CutSuffix(rule, "^")
+	if !found {
+		domain = rule
+	}
+
+	return f.add(domain, true, allow)
+}
+
+// add adds a name, or a domain with the names below it, reporting false if
+// it is not a valid name.
+func (f *filter) add(name string, domain, allow bool) bool {
+	if strings.ContainsAny(name, "*/|^:") {
+		return false
+	}
+	if _, ok := dns.IsDomainName(name); !ok || net.ParseIP(name) != nil {
+		return false
+	}
+
+	name = dns.CanonicalName(name)
+	switch {
+	case allow && domain:
+		f.allowedDomains[name] = true
+	case allow:
+		f.allowed[name] = true
+	case domain:
+		f.blockedDomains[name] = true
+	default:
+		f.blocked[name] = true
+	}
+	return true
+}
+
+// blocks reports whether a name is blocked and not allowed.
+func (f *filter) blocks(name string) bool {
+	name = dns.CanonicalName(name)
+	if f.allowed[name] || matchesDomain(f.allowedDomains, name) {
+		return false
+	}
+
+	return f.blocked[name] || matchesDomain(f.blockedDomains, name)
+}
+
+// matchesDomain reports whether a name is one of the domains or lies below
+// one of them.
+func matchesDomain(domains map[string]bool, name string) bool {
+	if len(domains) == 0 {
+		return false
+	}
+	for offset, end := 0, false; !end; offset, end = dns.NextLabel(name, offset) {
+		if domains[name[offset:]] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterHandler answers blocked names without resolving them.
+func (s *dnsServer) filterHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	if q.exempt || !s.blocked(q.request.Question[0].Name) {
+		return next()
+	}
+
+	s.answerBlocked(q.request, q.response)
+	return q.response
+}
+
+// answerBlocked answers a query for a blocked name as the filter is
+// configured to, with NXDOMAIN or the unspecified address of the type
+// asked for.
+func (s *dnsServer) answerBlocked(request *dns.Msg, response *dns.Msg) {
+	config := &s.config.Filter
+	question := request.Question[0]
+	if config.Response == filterNXDomain {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+
+	header := dns.RR_Header{Name: question.Name, Rrtype: question.Qtype, Class: dns.ClassINET, Ttl: config.TTL}
+	switch question.Qtype {
+	case dns.TypeA:
+		response.Answer = []dns.RR{&dns.A{Hdr: header, A: net.IPv4zero}}
+	case dns.TypeAAAA:
+		response.Answer = []dns.RR{&dns.AAAA{Hdr: header, AAAA: net.IPv6zero}}
+	}
+}
+
+// blocked reports whether a name is blocked by the filter.
+func (s *dnsServer) blocked(name string) bool {
+	f := s.filter.Load()
+	return f != nil && f.blocks(name)
+}
+
+// reloadFilter reads the blocklists and allowlists again, keeping the
+// previous ones if they cannot be read.
+func (s *dnsServer) reloadFilter() {
+	if !s.config.Filter.Enabled {
+		return
+	}
+
+	f, err := loadFilter(&s.config.Filter)
+	if err != nil {
+		log.Printf("Failed to reload the filter lists, keeping the previous ones: %v", err)
+		return
+	}
+	s.filter.Store(f)
+}
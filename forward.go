@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// errNoUpstreams is returned when a query needs forwarding but no upstream
+// servers are configured.
+var errNoUpstreams = errors.New("no upstream servers configured")
+
+// errNotCached is returned for a query with the RD flag clear whose answer is
+// not already cached, since the client asked for no resolution to be done.
+var errNotCached = errors.New("recursion not desired and answer not cached")
+
+// ForwardRule sends queries for names under Domain to its own upstream
+// servers instead of the default ones.
+type ForwardRule struct {
+	Domain    string     `yaml:"domain"`
+	Upstreams []Upstream `yaml:"upstreams"`
+}
+
+// forwardRule returns the most specific forwarding rule covering name, or nil
+// if the default upstreams apply.
+func (s *dnsServer) forwardRule(name string) *ForwardRule {
+	var best *ForwardRule
+	for i := range s.config.ForwardRules {
+		rule := &s.config.ForwardRules[i]
+		if !dns.IsSubDomain(rule.Domain, name) {
+			continue
+		}
+
+		if best == nil || dns.CountLabel(rule.Domain) > dns.CountLabel(best.Domain) {
+			best = rule
+		}
+	}
+
+	return best
+}
+
+// resolveRemote answers a query for a non-local name from the cache, or else
+// resolves it upstream and caches the result. With ECS enabled the query is
+// forwarded carrying the client's subnet, and answers tailored to it are
+// cached for that subnet alone. Queries with the RD flag clear are only
+// answered from the cache when HonorRD is set.
+func (s *dnsServer) resolveRemote(request *dns.Msg, client net.IP) (*dns.Msg, error) {
+	question := request.Question[0]
+
+	upstreamRequest := request
+	subnet := s.clientSubnet(request, client)
+	if subnet != nil {
+		upstreamRequest = s.withClientSubnet(request, subnet)
+	}
+	if s.validator != nil {
+		// Validation needs the signatures whether or not the client does
+		upstreamRequest = s.withDNSSEC(upstreamRequest)
+	}
+
+	if cached, prefetch := s.cache.Get(question, subnetCacheKey(subnet, nil)); cached != nil {
+		if prefetch {
+			go s.prefetch(upstreamRequest.Copy(), subnet)
+		}
+
+		return cachedReply(request, cached), nil
+	}
+
+	if !request.RecursionDesired && s.config.HonorRD {
+		return nil, errNotCached
+	}
+
+	response, err := s.resolveValidated(upstreamRequest)
+	if err == errBogus && request.CheckingDisabled {
+		// Clients that disable checking are given the data to validate
+		// for themselves, but it is not cached
+		return response, nil
+	}
+	if err != nil || response.Rcode == dns.RcodeServerFailure {
+		// Answer from an expired cache entry rather than failing while the
+		// upstreams are unreachable (RFC 8767)
+		if s.config.ServeStale {
+			if stale := s.cache.GetStale(question, subnetCacheKey(subnet, nil)); stale != nil {
+				log.Printf("Serving stale answer for %s", question.Name)
+				return cachedReply(request, stale), nil
+			}
+		}
+
+		return response, err
+	}
+
+	s.cache.Put(question, subnetCacheKey(subnet, response), response)
+
+	return response, nil
+}
+
+// forwardHandler relays the queries no other handler answered to the
+// upstreams, or resolves them recursively, through the cache.
+func (s *dnsServer) forwardHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	request, response, client := q.request, q.response, q.client
+	question := request.Question[0]
+
+	remote, err := s.resolveRemote(request, client)
+	if err == errNoUpstreams || err == errNotCached {
+		response.Rcode = dns.RcodeRefused
+	} else if err != nil {
+		log.Printf("Failed to relay DNS query: %v", err)
+		response.Rcode = dns.RcodeServerFailure
+	} else {
+		// The server is not authoritative for answers it relays
+		response = s.dns64(request, remote, client)
+		response.Authoritative = false
+
+		// DNSSEC records and the AD flag are only for clients that
+		// ask for them with the DO or AD flags
+		if opt := request.IsEdns0(); opt == nil || !opt.Do() {
+			stripDNSSEC(question, response)
+			if !request.AuthenticatedData {
+				response.AuthenticatedData = false
+			}
+		}
+	}
+
+	return response
+}
+
+// resolveUpstream relays a query to the upstream servers for its domain, or
+// else resolves it recursively or relays it to the default upstream servers,
+// turning to the fallback upstreams if none of those answer.
+func (s *dnsServer) resolveUpstream(request *dns.Msg) (*dns.Msg, error) {
+	if rule := s.forwardRule(request.Question[0].Name); rule != nil {
+		return s.forward(request, rule.Upstreams)
+	}
+
+	if s.recursor != nil {
+		return s.recursor.Resolve(request)
+	}
+
+	response, err := s.forward(request, s.config.Upstreams)
+	if err != nil && err != errNoUpstreams && len(s.config.FallbackUpstreams) > 0 {
+		log.Printf("Relaying DNS query to fallback upstreams: %v", err)
+		return s.forward(request, s.config.FallbackUpstreams)
+	}
+
+	return response, err
+}
+
+// resolveValidated resolves a query upstream and, with DNSSEC validation
+// enabled, sets the AD flag on secure answers. Bogus answers are returned
+// along with errBogus.
+func (s *dnsServer) resolveValidated(request *dns.Msg) (*dns.Msg, error) {
+	response, err := s.resolveUpstream(request)
+	if err != nil || s.validator == nil || response.Rcode == dns.RcodeServerFailure {
+		return response, err
+	}
+
+	switch s.validator.Validate(request.Question[0], response) {
+	case secure:
+		response.AuthenticatedData = true
+	case insecure:
+		response.AuthenticatedData = false
+	case bogus:
+		response.AuthenticatedData = false
+		return response, errBogus
+	}
+
+	return response, nil
+}
+
+// withDNSSEC returns a copy of a request with the DO flag set.
+func (s *dnsServer) withDNSSEC(request *dns.Msg) *dns.Msg {
+	request = request.Copy()
+	if opt := request.IsEdns0(); opt != nil {
+		opt.SetDo()
+	} else {
+		request.SetEdns0(s.config.MaxUDPSize, true)
+	}
+
+	return request
+}
+
+// prefetch refreshes the cached response to a popular query before it
+// expires, so that clients never wait on the upstream for it.
+func (s *dnsServer) prefetch(request *dns.Msg, subnet *dns.EDNS0_SUBNET) {
+	response, err := s.resolveValidated(request)
+	if err != nil {
+		log.Printf("Failed to prefetch %s: %v", request.Question[0].Name, err)
+		return
+	}
+
+	s.cache.Put(request.Question[0], subnetCacheKey(subnet, response), response)
+}
+
+// cachedReply builds the reply to a request from a cached response.
+func cachedReply(request *dns.Msg, cached *dns.Msg) *dns.Msg {
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Rcode = cached.Rcode
+	response.AuthenticatedData = cached.AuthenticatedData
+	response.Answer = cached.Answer
+	response.Ns = cached.Ns
+	response.Extra = cached.Extra
+
+	return response
+}
+
+// upstreamAddress adds the default port to an upstream address that does
+// not name one. DNS-over-HTTPS URLs are left as they are.
+func upstreamAddress(address string) string {
+	if strings.HasPrefix(address, schemeHTTPS) {
+		return address
+	}
+	if strings.HasPrefix(address, schemeTLS) {
+		return normalizeTLSUpstream(address)
+	}
+
+	if _, _, err := net.SplitHostPort(address); err == nil {
+		return address
+	}
+
+	return net.JoinHostPort(address, "53")
+}
+
+// forward relays a query to the given upstream servers in turn and returns
+// the first usable answer. Upstreams failing their health checks are left
+// out while others are healthy. An upstream that refuses the query or fails
+// to answer it is skipped, but its response is still returned if no other
+// upstream does better.
+func (s *dnsServer) forward(request *dns.Msg, upstreams []Upstream) (*dns.Msg, error) {
+	if len(upstreams) == 0 {
+		return nil, errNoUpstreams
+	}
+	if s.health != nil {
+		upstreams = s.health.Healthy(upstreams)
+	}
+	if s.config.UpstreamStrategy == strategyRace && len(upstreams) > 1 {
+		return s.race(request, upstreams)
+	}
+
+	var fallback *dns.Msg
+	var lastErr error
+	for _, upstream := range upstreams {
+		response, err := exchange(context.Background(), request, upstream)
+		if err != nil {
+			logFailure(upstream, err)
+			lastErr = err
+			continue
+		}
+
+		if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+			log.Printf("Upstream %s answered %s", upstream, dns.RcodeToString[response.Rcode])
+			fallback = response
+			continue
+		}
+
+		return response, nil
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, fmt.Errorf("all upstream servers failed, last error: %v", lastErr)
+}
+
+// send sends a query to an upstream. Plain upstreams are queried over UDP,
+// retrying over a pooled TCP connection if the answer was truncated, while
+// tls:// and https:// upstreams are queried over DNS-over-TLS and
+// DNS-over-HTTPS.
+func send(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	switch {
+	case strings.HasPrefix(upstream.Address, schemeTLS):
+		return exchangeTLS(ctx, request, upstream)
+	case strings.HasPrefix(upstream.Address, schemeHTTPS):
+		return exchangeHTTPS(ctx, request, upstream)
+	}
+
+	client := new(dns.Client)
+	response, _, err := client.ExchangeContext(ctx, request, upstream.Address)
+	if err == nil && response.Truncated {
+		// The upstream answer did not fit over UDP, so fetch the full
+		// answer over TCP and truncate it ourselves if needed
+		response, err = poolFor(upstream).Exchange(ctx, request)
+	}
+
+	return response, err
+}
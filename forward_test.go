@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testUpstream starts a server on a local UDP port answering queries with
+// handler, returning its address.
+func testUpstream(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+// answering returns a handler answering every query with an A record for
+// address.
+func answering(address string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetReply(request)
+		rr, _ := dns.NewRR(request.Question[0].Name + " 60 IN A " + address)
+		response.Answer = append(response.Answer, rr)
+		w.WriteMsg(response)
+	}
+}
+
+// failing returns a handler answering every query with rcode.
+func failing(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, request *dns.Msg) {
+		response := new(dns.Msg)
+		response.SetRcode(request, rcode)
+		w.WriteMsg(response)
+	}
+}
+
+// deadUpstream returns the address of a local UDP port nothing listens on,
+// which refuses queries at once.
+func deadUpstream(t *testing.T) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := conn.LocalAddr().String()
+	conn.Close()
+
+	return address
+}
+
+func TestForwardFailover(t *testing.T) {
+	dead := Upstream{Address: deadUpstream(t)}
+	servfail := Upstream{Address: testUpstream(t, failing(dns.RcodeServerFailure))}
+	refused := Upstream{Address: testUpstream(t, failing(dns.RcodeRefused))}
+	good := Upstream{Address: testUpstream(t, answering("192.0.2.1"))}
+
+	tests := []struct {
+		name      string
+		upstreams []Upstream
+		rcode     int
+		answered  bool
+		err       bool
+	}{
+		{"first answers", []Upstream{good, dead}, dns.RcodeSuccess, true, false},
+		{"unreachable skipped", []Upstream{dead, good}, dns.RcodeSuccess, true, false},
+		{"failures skipped", []Upstream{servfail, refused, good}, dns.RcodeSuccess, true, false},
+		{"last failure kept", []Upstream{dead, servfail}, dns.RcodeServerFailure, false, false},
+		{"none reachable", []Upstream{dead}, 0, false, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := &dnsServer{config: DefaultConfig()}
+			request := new(dns.Msg)
+			request.SetQuestion("www.example.com.", dns.TypeA)
+
+			response, err := s.forward(request, test.upstreams)
+			if test.err {
+				if err == nil {
+					t.Fatalf("got %v, want an error", response)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Rcode != test.rcode || (len(response.Answer) > 0) != test.answered {
+				t.Fatalf("got %v, want rcode %s answered %t", response, dns.RcodeToString[test.rcode], test.answered)
+			}
+		})
+	}
+}
+
+func TestResolveUpstreamFallback(t *testing.T) {
+	config := DefaultConfig()
+	config.Upstreams = []Upstream{{Address: deadUpstream(t)}}
+	config.FallbackUpstreams = []Upstream{{Address: testUpstream(t, answering("192.0.2.2"))}}
+	s := &dnsServer{config: config}
+
+	request := new(dns.Msg)
+	request.SetQuestion("www.example.com.", dns.TypeA)
+	response, err := s.resolveUpstream(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 1 || response.Answer[0].(*dns.A).A.String() != "192.0.2.2" {
+		t.Fatalf("got %v, want the answer of the fallback upstream", response)
+	}
+
+	// Forwarding rules have no fallback
+	config.ForwardRules = []ForwardRule{{Domain: "example.com.", Upstreams: config.Upstreams}}
+	if response, err := s.resolveUpstream(request); err == nil {
+		t.Fatalf("got %v for a domain with a forwarding rule, want an error", response)
+	}
+}
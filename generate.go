@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// maxGenerated is the most records a single generator may expand into, to
+// catch ranges mistyped with too many digits.
+const maxGenerated = 65536
+
+// RecordGenerator expands into one record for each value of its Range, in
+// the manner of the $GENERATE directive of BIND.
+type RecordGenerator struct {
+	// Range is written start-stop, optionally followed by /step. Each $ in
+	// the record is replaced by the value, and ${offset,width,base} by the
+	// value plus offset, padded to width digits in base d, o, x or X.
+	Range     string `yaml:"range"`
+	DNSRecord `yaml:",inline"`
+}
+
+// generateRecords returns the records every generator expands into.
+func generateRecords(generators []RecordGenerator) ([]DNSRecord, error) {
+	var records []DNSRecord
+	for _, generator := range generators {
+		generated, err := generator.records()
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, generated...)
+	}
+
+	return records, nil
+}
+
+// records returns the records the generator expands into.
+func (g RecordGenerator) records() ([]DNSRecord, error) {
+	start, stop, step, err := parseRange(g.Range)
+	if err != nil {
+		return nil, fmt.Errorf("invalid generate range %q: %v", g.Range, err)
+	}
+
+	// Each record starts from its own copy of the template, as the template
+	// shares its pointers with every copy made by assignment
+	template, err := yaml.Marshal(g.DNSRecord)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for i := start; i <= stop; i += step {
+		var record DNSRecord
+		err := yaml.Unmarshal(template, &record)
+		if err != nil {
+			return nil, err
+		}
+
+		err = replaceStrings(reflect.ValueOf(&record).Elem(), func(text string) (string, error) {
+			return generatedText(text, i)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid generate template for hostname %s: %v", g.Hostname, err)
+		}
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// parseRange parses a range written start-stop or start-stop/step.
+func parseRange(text string) (int, int, int, error) {
+	bounds, stepText, hasStep := strings.Cut(text, "/")
+	startText, stopText, ok := strings.Cut(bounds, "-")
+	if !ok {
+		return 0, 0, 0, fmt.Errorf("not of the form start-stop")
+	}
+
+	start, err := strconv.Atoi(strings.TrimSpace(startText))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	stop, err := strconv.Atoi(strings.TrimSpace(stopText))
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	step := 1
+	if hasStep {
+		step, err = strconv.Atoi(strings.TrimSpace(stepText))
+		if err != nil {
+			return 0, 0, 0, err
+		}
+	}
+
+	switch {
+	case start < 0 || stop < start:
+		return 0, 0, 0, fmt.Errorf("start must be at least 0 and no more than stop")
+	case step < 1:
+		return 0, 0, 0, fmt.Errorf("step must be at least 1")
+	case (stop-start)/step >= maxGenerated:
+		return 0, 0, 0, fmt.Errorf("more than %d records", maxGenerated)
+	}
+
+	return start, stop, step, nil
+}
+
+// generatedText returns a generator's template text for one value of its
+// range.
+func generatedText(template string, value int) (string, error) {
+	var text strings.Builder
+	for i := 0; i < len(template); i++ {
+		switch {
+		case template[i] == '\\' && strings.HasPrefix(template[i+1:], "$"):
+			text.WriteByte('$')
+			i++
+		case strings.HasPrefix(template[i:], "${"):
+			end := strings.IndexByte(template[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in %q", template)
+			}
+
+			formatted, err := formatValue(value, template[i+2:i+end])
+			if err != nil {
+				return "", err
+			}
+			text.WriteString(formatted)
+			i += end
+		case template[i] == '$':
+			text.WriteString(strconv.Itoa(value))
+		default:
+			text.WriteByte(template[i])
+		}
+	}
+
+	return text.String(), nil
+}
+
+// formatValue formats a value of a generator's range as an offset,width,base
+// modifier asks.
+func formatValue(value int, modifier string) (string, error) {
+	fields := strings.Split(modifier, ",")
+	if len(fields) > 3 {
+		return "", fmt.Errorf("invalid modifier ${%s}", modifier)
+	}
+
+	offset, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+	if err != nil {
+		return "", fmt.Errorf("invalid offset in ${%s}", modifier)
+	}
+	width := 0
+	if len(fields) > 1 {
+		width, err = strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil || width < 0 {
+			return "", fmt.Errorf("invalid width in ${%s}", modifier)
+		}
+	}
+	base := "d"
+	if len(fields) > 2 {
+		base = strings.TrimSpace(fields[2])
+	}
+
+	switch base {
+	case "d", "o", "x", "X":
+		return fmt.Sprintf("%0*"+base, width, value+offset), nil
+	}
+
+	return "", fmt.Errorf("invalid base in ${%s}", modifier)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		text              string
+		start, stop, step int
+		valid             bool
+	}{
+		{"1-10", 1, 10, 1, true},
+		{"0-0", 0, 0, 1, true},
+		{" 5 - 20 / 5 ", 5, 20, 5, true},
+		{"0-254/2", 0, 254, 2, true},
+		{"0-65535", 0, 65535, 1, true},
+		{"0-131071/2", 0, 131071, 2, true},
+		{"0-65536", 0, 0, 0, false},
+		{"1-10/0", 0, 0, 0, false},
+		{"1-10/-1", 0, 0, 0, false},
+		{"10-1", 0, 0, 0, false},
+		{"-1-10", 0, 0, 0, false},
+		{"10", 0, 0, 0, false},
+		{"a-10", 0, 0, 0, false},
+		{"1-b", 0, 0, 0, false},
+		{"1-10/c", 0, 0, 0, false},
+		{"", 0, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			start, stop, step, err := parseRange(test.text)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("got %d-%d/%d, want an error", start, stop, step)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != test.start || stop != test.stop || step != test.step {
+				t.Fatalf("got %d-%d/%d, want %d-%d/%d", start, stop, step, test.start, test.stop, test.step)
+			}
+		})
+	}
+}
+
+func TestGeneratedText(t *testing.T) {
+	tests := []struct {
+		template string
+		value    int
+		text     string
+		valid    bool
+	}{
+		{"host-$.lan.", 7, "host-7.lan.", true},
+		{"$-$", 12, "12-12", true},
+		{"no-value.lan.", 7, "no-value.lan.", true},
+		{`price-\$.lan.`, 7, "price-$.lan.", true},
+		{`\$$`, 7, "$7", true},
+		{`a\b`, 7, `a\b`, true},
+		{`trailing\`, 7, `trailing\`, true},
+		{"host-${0}.lan.", 7, "host-7.lan.", true},
+		{"host-${10}.lan.", 7, "host-17.lan.", true},
+		{"host-${-1,3}.lan.", 7, "host-006.lan.", true},
+		{"${0,3,d}", 7, "007", true},
+		{"${0,3,o}", 8, "010", true},
+		{"${0,2,x}", 171, "ab", true},
+		{"${0,4,X}", 171, "00AB", true},
+		{"${ 1 , 2 , x }", 9, "0a", true},
+		{"10.0.0.$", 254, "10.0.0.254", true},
+		{"host-${0", 7, "", false},
+		{"host-${}", 7, "", false},
+		{"host-${0,3,b}", 7, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.template, func(t *testing.T) {
+			text, err := generatedText(test.template, test.value)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("got %q, want an error", text)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Fatalf("got %q, want %q", text, test.text)
+			}
+		})
+	}
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		modifier string
+		value    int
+		text     string
+		valid    bool
+	}{
+		{"0", 5, "5", true},
+		{"3", 5, "8", true},
+		{"-5", 5, "0", true},
+		{"0,0", 5, "5", true},
+		{"0,3", 5, "005", true},
+		{"0,1", 123, "123", true},
+		{"0,3,d", 10, "010", true},
+		{"0,3,o", 10, "012", true},
+		{"0,3,x", 255, "0ff", true},
+		{"0,3,X", 255, "0FF", true},
+		{"1,0,x", 15, "10", true},
+		{"", 5, "", false},
+		{"a", 5, "", false},
+		{"0,b", 5, "", false},
+		{"0,-1", 5, "", false},
+		{"0,3,b", 5, "", false},
+		{"0,3,d,1", 5, "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.modifier+"/"+strconv.Itoa(test.value), func(t *testing.T) {
+			text, err := formatValue(test.value, test.modifier)
+			if !test.valid {
+				if err == nil {
+					t.Fatalf("got %q, want an error", text)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if text != test.text {
+				t.Fatalf("got %q, want %q", text, test.text)
+			}
+		})
+	}
+}
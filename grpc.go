@@ -0,0 +1,302 @@
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative lacunav1/lacuna.proto
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/chris-tomich/lacuna-dns-server/lacunav1"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// watchQueueSize is how many batches of changes may wait to be sent to a
+// client watching them before further ones are dropped.
+const watchQueueSize = 100
+
+// GRPCConfig serves the management API of lacunav1/lacuna.proto over gRPC
+// on Listen.
+type GRPCConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Listen is the address the API is served on.
+	Listen string `yaml:"listen"`
+
+	// Token is the bearer token calls must carry in their authorization
+	// metadata. Calls need none if it is empty.
+	Token string `yaml:"token"`
+}
+
+// parse validates the address the API is served on.
+func (c *GRPCConfig) parse() error {
+	if c.Listen == "" {
+		return fmt.Errorf("grpc needs a listen address")
+	}
+	if c.Token == "" {
+		log.Printf("The gRPC management API on %s accepts calls without a token", c.Listen)
+	}
+
+	return nil
+}
+
+// serveGRPC serves the gRPC management API, if it is enabled.
+func (s *dnsServer) serveGRPC() {
+	config := &s.config.GRPC
+	if !config.Enabled {
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.Listen)
+	if err != nil {
+		log.Printf("Failed to serve the gRPC management API: %v", err)
+		return
+	}
+	server := s.grpcServer()
+
+	go func() {
+		log.Printf("Serving the gRPC management API on %s", config.Listen)
+		err := server.Serve(listener)
+		if err != nil {
+			log.Printf("Failed to serve the gRPC management API: %v", err)
+		}
+	}()
+}
+
+// grpcServer returns a gRPC server of the management API, refusing calls
+// without the token.
+func (s *dnsServer) grpcServer() *grpc.Server {
+	config := &s.config.GRPC
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, request any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			err := config.authorize(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, request)
+		}),
+		grpc.StreamInterceptor(func(srv any, stream grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			err := config.authorize(stream.Context())
+			if err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	)
+	lacunav1.RegisterManagementServer(server, &managementServer{s: s})
+
+	return server
+}
+
+// authorize refuses calls without the token, if one is set.
+func (c *GRPCConfig) authorize(ctx context.Context) error {
+	if c.Token == "" {
+		return nil
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		token, _ := strings.CutPrefix(value, "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(c.Token)) == 1 {
+			return nil
+		}
+	}
+	return status.Error(codes.Unauthenticated, "missing or wrong token")
+}
+
+// managementServer implements the Management service of lacuna.proto.
+type managementServer struct {
+	lacunav1.UnimplementedManagementServer
+
+	s *dnsServer
+}
+
+// ListZones lists the zones served.
+func (m *managementServer) ListZones(context.Context, *lacunav1.ListZonesRequest) (*lacunav1.ListZonesResponse, error) {
+	response := &lacunav1.ListZonesResponse{}
+	for _, zone := range m.s.records.Load().Zones {
+		response.Zones = append(response.Zones, &lacunav1.Zone{
+			Origin:    zone.Origin,
+			Serial:    zone.SOA.Serial,
+			Secondary: len(zone.Primaries) > 0,
+		})
+	}
+
+	return response, nil
+}
+
+// ListRecords lists the records of a zone.
+func (m *managementServer) ListRecords(_ context.Context, request *lacunav1.ListRecordsRequest) (*lacunav1.ListRecordsResponse, error) {
+	records, err := m.s.zoneRecords(request.Zone, request.Name, request.Type)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &lacunav1.ListRecordsResponse{Records: grpcRecords(records)}, nil
+}
+
+// AddRecord adds a record to a zone.
+func (m *managementServer) AddRecord(_ context.Context, request *lacunav1.AddRecordRequest) (*lacunav1.ChangeResponse, error) {
+	record := request.GetRecord()
+	change := addRecord(apiRecord{Name: record.GetName(), Type: record.GetType(), TTL: record.GetTtl(), Data: record.GetData()})
+
+	return m.change(request.Zone, change)
+}
+
+// ReplaceRecords replaces the records of a name of a type.
+func (m *managementServer) ReplaceRecords(_ context.Context, request *lacunav1.ReplaceRecordsRequest) (*lacunav1.ChangeResponse, error) {
+	return m.change(request.Zone, replaceRRset(request.Name, request.Type, request.Ttl, request.Records))
+}
+
+// DeleteRecords deletes the records of a name of a type, or one of them.
+func (m *managementServer) DeleteRecords(_ context.Context, request *lacunav1.DeleteRecordsRequest) (*lacunav1.ChangeResponse, error) {
+	return m.change(request.Zone, deleteRecords(request.Name, request.Type, request.Data))
+}
+
+// change changes a zone, answering with its records of the names changed.
+func (m *managementServer) change(origin string, change zoneChange) (*lacunav1.ChangeResponse, error) {
+	records, err := m.s.changeZone(origin, change)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return &lacunav1.ChangeResponse{Records: grpcRecords(records)}, nil
+}
+
+// FlushCache drops the cached responses for a name and the names under it,
+// or every cached response.
+func (m *managementServer) FlushCache(_ context.Context, request *lacunav1.FlushCacheRequest) (*lacunav1.FlushCacheResponse, error) {
+	name := request.Name
+	if name != "" {
+		name = dns.CanonicalName(name)
+	}
+
+	flushed := m.s.cache.Flush(name)
+	log.Printf("Flushed %d cached responses", flushed)
+	return &lacunav1.FlushCacheResponse{Flushed: uint32(flushed)}, nil
+}
+
+// GetStats reports the server's counters.
+func (m *managementServer) GetStats(context.Context, *lacunav1.GetStatsRequest) (*lacunav1.Stats, error) {
+	entries, hits, misses := m.s.cache.Stats()
+	return &lacunav1.Stats{
+		UptimeSeconds: uint64(time.Since(m.s.started) / time.Second),
+		Queries:       m.s.queries.Load(),
+		Zones:         uint32(len(m.s.records.Load().Zones)),
+		CacheEntries:  uint32(entries),
+		CacheHits:     hits,
+		CacheMisses:   misses,
+	}, nil
+}
+
+// WatchChanges streams the changes to the records served under the zones
+// asked for until the client goes away.
+func (m *managementServer) WatchChanges(request *lacunav1.WatchChangesRequest, stream lacunav1.Management_WatchChangesServer) error {
+	zones := make([]string, len(request.Zones))
+	for i, zone := range request.Zones {
+		zones[i] = dns.CanonicalName(zone)
+	}
+
+	changes, stop := m.s.watch()
+	defer stop()
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case batch := <-changes:
+			now := timestamppb.Now()
+			for _, change := range batch {
+				if !inZones(zones, change.Name) {
+					continue
+				}
+				err := stream.Send(&lacunav1.Change{
+					Action:   change.Action,
+					Zone:     change.Zone,
+					Name:     change.Name,
+					Type:     change.Type,
+					Records:  change.Records,
+					Previous: change.Previous,
+					Time:     now,
+				})
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// grpcRecords returns records as the gRPC API gives them.
+func grpcRecords(records []apiRecord) []*lacunav1.Record {
+	converted := make([]*lacunav1.Record, len(records))
+	for i, record := range records {
+		converted[i] = &lacunav1.Record{Name: record.Name, Type: record.Type, Ttl: record.TTL, Data: record.Data}
+	}
+
+	return converted
+}
+
+// grpcError returns the status a failure to list or change a zone is
+// answered with.
+func grpcError(err error) error {
+	switch {
+	case errors.Is(err, errNoZone):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, errSecondaryZone):
+		return status.Error(codes.FailedPrecondition, err.Error())
+	case errors.Is(err, errInvalidChange):
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// watch starts sending the changes to the records served to a channel,
+// returning it with the function that stops sending them.
+func (s *dnsServer) watch() (chan []recordChange, func()) {
+	changes := make(chan []recordChange, watchQueueSize)
+
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	s.watchers[changes] = true
+
+	return changes, func() {
+		s.watchMu.Lock()
+		defer s.watchMu.Unlock()
+		delete(s.watchers, changes)
+	}
+}
+
+// watched reports whether any client is watching the changes to the
+// records served.
+func (s *dnsServer) watched() bool {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	return len(s.watchers) > 0
+}
+
+// sendWatchers sends changes to the records served to the clients watching
+// them, dropping them for clients too slow to keep up.
+func (s *dnsServer) sendWatchers(changes []recordChange) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+
+	for watcher := range s.watchers {
+		select {
+		case watcher <- changes:
+		default:
+			log.Printf("Dropped %d changes for a gRPC watcher: too many waiting to be sent", len(changes))
+		}
+	}
+}
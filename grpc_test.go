@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/chris-tomich/lacuna-dns-server/lacunav1"
+	"github.com/miekg/dns"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	grpcinsecure "google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const grpcTestRecords = `zones:
+  - origin: lan.
+    ttl: 600
+    ns: [ns1.lan.]
+    soa:
+      rname: hostmaster.lan.
+      serial: 2024010101
+records:
+  - hostname: nas.lan.
+    ip: 192.168.1.10
+`
+
+// startGRPC serves the management API of a server with the test records on
+// a local port, returning a client of it and the server.
+func startGRPC(t *testing.T) (lacunav1.ManagementClient, *dnsServer) {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.RecordsFile = filepath.Join(t.TempDir(), "records.yaml")
+	config.GRPC.Token = "secret"
+	err := os.WriteFile(config.RecordsFile, []byte(grpcTestRecords), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := LoadRecords(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &dnsServer{
+		config:   config,
+		cache:    newResponseCache(100, 0, 0),
+		pushes:   make(chan zonePush, pushQueueSize),
+		watchers: map[chan []recordChange]bool{},
+		started:  time.Now(),
+	}
+	s.records.Store(records)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := s.grpcServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient(listener.Addr().String(), grpc.WithTransportCredentials(grpcinsecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return lacunav1.NewManagementClient(conn), s
+}
+
+// grpcContext returns a context carrying the token, with a deadline.
+func grpcContext(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+}
+
+func TestGRPCRefusesCallsWithoutToken(t *testing.T) {
+	client, _ := startGRPC(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := client.ListZones(ctx, &lacunav1.ListZonesRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("ListZones without token: got %v, want Unauthenticated", err)
+	}
+}
+
+func TestGRPCListsZonesAndRecords(t *testing.T) {
+	client, _ := startGRPC(t)
+	ctx := grpcContext(t)
+
+	zones, err := client.ListZones(ctx, &lacunav1.ListZonesRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(zones.Zones) != 1 || zones.Zones[0].Origin != "lan." || zones.Zones[0].Serial != 2024010101 {
+		t.Fatalf("ListZones: got %v", zones.Zones)
+	}
+
+	records, err := client.ListRecords(ctx, &lacunav1.ListRecordsRequest{Zone: "lan", Name: "nas", Type: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records.Records) != 1 || records.Records[0].Name != "nas.lan." || records.Records[0].Data != "192.168.1.10" {
+		t.Fatalf("ListRecords: got %v", records.Records)
+	}
+
+	_, err = client.ListRecords(ctx, &lacunav1.ListRecordsRequest{Zone: "example.com."})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("ListRecords of unknown zone: got %v, want NotFound", err)
+	}
+}
+
+func TestGRPCChangesRecords(t *testing.T) {
+	client, s := startGRPC(t)
+	ctx := grpcContext(t)
+
+	added, err := client.AddRecord(ctx, &lacunav1.AddRecordRequest{
+		Zone:   "lan.",
+		Record: &lacunav1.Record{Name: "nas", Type: "A", Data: "192.168.1.11"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(added.Records) != 2 {
+		t.Fatalf("AddRecord: got %v, want both addresses of nas.lan.", added.Records)
+	}
+	if served := s.records.Load().Lookup("nas.lan."); len(served) != 2 {
+		t.Fatalf("AddRecord: %d records served for nas.lan., want 2", len(served))
+	}
+
+	replaced, err := client.ReplaceRecords(ctx, &lacunav1.ReplaceRecordsRequest{
+		Zone:    "lan.",
+		Name:    "www",
+		Type:    "CNAME",
+		Ttl:     60,
+		Records: []string{"nas.lan."},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replaced.Records) != 1 || replaced.Records[0].Ttl != 60 || replaced.Records[0].Data != "nas.lan." {
+		t.Fatalf("ReplaceRecords: got %v", replaced.Records)
+	}
+
+	deleted, err := client.DeleteRecords(ctx, &lacunav1.DeleteRecordsRequest{Zone: "lan.", Name: "nas", Type: "A", Data: "192.168.1.10"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted.Records) != 1 || deleted.Records[0].Data != "192.168.1.11" {
+		t.Fatalf("DeleteRecords: got %v", deleted.Records)
+	}
+
+	_, err = client.AddRecord(ctx, &lacunav1.AddRecordRequest{
+		Zone:   "lan.",
+		Record: &lacunav1.Record{Name: "nas", Type: "A", Data: "not an address"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("AddRecord of invalid record: got %v, want InvalidArgument", err)
+	}
+}
+
+func TestGRPCWatchesChanges(t *testing.T) {
+	client, s := startGRPC(t)
+	ctx := grpcContext(t)
+
+	stream, err := client.WatchChanges(ctx, &lacunav1.WatchChangesRequest{Zones: []string{"lan"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for !s.watched() {
+		if ctx.Err() != nil {
+			t.Fatal("watcher never registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	_, err = client.AddRecord(ctx, &lacunav1.AddRecordRequest{
+		Zone:   "lan.",
+		Record: &lacunav1.Record{Name: "printer", Type: "A", Data: "192.168.1.20"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	change, err := stream.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if change.Action != changeAdded || change.Zone != "lan." || change.Name != "printer.lan." || change.Type != "A" {
+		t.Fatalf("WatchChanges: got %v", change)
+	}
+	if len(change.Records) != 1 || change.Time == nil {
+		t.Fatalf("WatchChanges: got %v", change)
+	}
+}
+
+func TestGRPCFlushesCacheAndReportsStats(t *testing.T) {
+	client, s := startGRPC(t)
+	ctx := grpcContext(t)
+
+	for _, name := range []string{"www.example.com.", "example.com.", "example.org."} {
+		msg := new(dns.Msg)
+		msg.SetQuestion(name, dns.TypeA)
+		rr, _ := dns.NewRR(name + " 300 IN A 192.0.2.1")
+		msg.Answer = append(msg.Answer, rr)
+		s.cache.Put(msg.Question[0], "", msg)
+	}
+
+	flushed, err := client.FlushCache(ctx, &lacunav1.FlushCacheRequest{Name: "example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flushed.Flushed != 2 {
+		t.Fatalf("FlushCache: flushed %d, want 2", flushed.Flushed)
+	}
+
+	stats, err := client.GetStats(ctx, &lacunav1.GetStatsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Zones != 1 || stats.CacheEntries != 1 {
+		t.Fatalf("GetStats: got %v", stats)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// HealthCheckConfig controls the periodic probing of upstream servers, so
+// that queries are only relayed to those that are answering.
+type HealthCheckConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Interval is how often a healthy upstream is probed. A failing
+	// upstream is re-probed with exponential backoff from Interval up to
+	// MaxBackoff.
+	Interval   time.Duration `yaml:"interval"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+
+	// Timeout is how long a probe waits for an answer.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// errServerFailure is returned when a probed upstream answers SERVFAIL.
+var errServerFailure = errors.New("upstream answered SERVFAIL")
+
+// healthChecker tracks which upstream servers are currently answering.
+type healthChecker struct {
+	config HealthCheckConfig
+
+	mu   sync.RWMutex
+	down map[string]bool
+}
+
+// newHealthChecker creates a health checker treating every upstream as
+// healthy until a probe fails.
+func newHealthChecker(config HealthCheckConfig) *healthChecker {
+	return &healthChecker{
+		config: config,
+		down:   map[string]bool{},
+	}
+}
+
+// Start begins probing each of the given upstreams in the background.
+func (h *healthChecker) Start(upstreams []Upstream) {
+	seen := map[string]bool{}
+	for _, upstream := range upstreams {
+		if seen[upstream.Address] {
+			continue
+		}
+		seen[upstream.Address] = true
+
+		go h.monitor(upstream)
+	}
+}
+
+// monitor probes an upstream until the process exits, backing off while
+// the upstream keeps failing.
+func (h *healthChecker) monitor(upstream Upstream) {
+	failures := 0
+	for {
+		err := h.probe(upstream)
+		if err == nil {
+			if failures > 0 {
+				log.Printf("Upstream %s is back up", upstream)
+				h.setDown(upstream.Address, false)
+			}
+			failures = 0
+		} else {
+			if failures == 0 {
+				log.Printf("Upstream %s is down: %v", upstream, err)
+				h.setDown(upstream.Address, true)
+			}
+			failures++
+		}
+
+		time.Sleep(h.backoff(failures))
+	}
+}
+
+// backoff returns how long to wait before the next probe of an upstream
+// that has failed the given number of probes in a row.
+func (h *healthChecker) backoff(failures int) time.Duration {
+	wait := h.config.Interval
+	for i := 1; i < failures && wait < h.config.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if failures > 0 && wait > h.config.MaxBackoff {
+		wait = h.config.MaxBackoff
+	}
+
+	return wait
+}
+
+// probe queries an upstream for the root NS records and reports whether it
+// answered usefully.
+func (h *healthChecker) probe(upstream Upstream) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.config.Timeout)
+	defer cancel()
+
+	query := new(dns.Msg)
+	query.SetQuestion(".", dns.TypeNS)
+
+	// Probes are not retried, so that a failing upstream is noticed at once
+	response, err := exchangeOnce(ctx, query, upstream)
+	if err != nil {
+		return err
+	}
+	if response.Rcode == dns.RcodeServerFailure {
+		return errServerFailure
+	}
+
+	return nil
+}
+
+// setDown records whether an upstream is failing its probes.
+func (h *healthChecker) setDown(upstream string, down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if down {
+		h.down[upstream] = true
+	} else {
+		delete(h.down, upstream)
+	}
+}
+
+// Healthy returns the upstreams that are not failing their probes, keeping
+// their order. If every upstream is failing they are all returned, as
+// trying them is better than answering nothing.
+func (h *healthChecker) Healthy(upstreams []Upstream) []Upstream {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if len(h.down) == 0 {
+		return upstreams
+	}
+
+	var healthy []Upstream
+	for _, upstream := range upstreams {
+		if !h.down[upstream.Address] {
+			healthy = append(healthy, upstream)
+		}
+	}
+	if len(healthy) == 0 {
+		return upstreams
+	}
+
+	return healthy
+}
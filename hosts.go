@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+// loadHostsFile reads a file in the /etc/hosts format, in which each line
+// gives an address followed by the hostnames it belongs to, returning an A
+// or AAAA record for each hostname. Comments start with '#', and lines
+// without a valid address are skipped.
+func loadHostsFile(filename string) ([]DNSRecord, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var records []DNSRecord
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text, _, _ := strings.Cut(scanner.Text(), "#")
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if net.ParseIP(fields[0]) == nil {
+			log.Printf("Skipping line %d of hosts file %s: invalid address %q", line, filename, fields[0])
+			continue
+		}
+		for _, hostname := range fields[1:] {
+			records = append(records, DNSRecord{Hostname: hostname, IP: fields[0]})
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	log.Printf("Loaded %d records from hosts file %s", len(records), filename)
+
+	return records, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// readRecordsFile decodes a records file along with the files it includes,
+// whose zones, views, records and generators are added to its own. Each
+// include is a path or glob pattern, relative to the directory of the file
+// naming it, of files in the same format, which may include further files in
+// turn. Patterns matching no files include nothing, while a missing file
+// named outright is an error, as is a file included more than once. The
+// default TTL is only taken from the records file itself.
+func readRecordsFile(filename string, included map[string]bool) (*DNSRecords, error) {
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	if included[path] {
+		return nil, fmt.Errorf("included more than once")
+	}
+	included[path] = true
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	decoder := yaml.NewDecoder(file)
+	records := &DNSRecords{}
+	err = decoder.Decode(records)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range records.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(filename), pattern)
+		}
+		records.includes = append(records.includes, pattern)
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include %s: %v", pattern, err)
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			matches = []string{pattern}
+		}
+
+		for _, match := range matches {
+			include, err := readRecordsFile(match, included)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", match, err)
+			}
+			records.Zones = append(records.Zones, include.Zones...)
+			records.Views = append(records.Views, include.Views...)
+			records.Records = append(records.Records, include.Records...)
+			records.Generate = append(records.Generate, include.Generate...)
+			records.includes = append(records.includes, include.includes...)
+		}
+	}
+
+	return records, nil
+}
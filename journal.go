@@ -0,0 +1,273 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// maxZoneDeltas is the most changes kept in a zone's journal. Secondaries
+// further behind than that are sent the whole zone.
+const maxZoneDeltas = 100
+
+// zoneJournal records how a zone has changed from serial to serial, so that
+// secondaries can be sent just the changes since the version they hold
+// (RFC 1995). It is saved to the zone's journal file, and compared with the
+// zone each time the zone is loaded to record what was changed.
+type zoneJournal struct {
+	file string
+
+	mu sync.Mutex
+
+	// rrs is the zone's current content, starting with its SOA record, or
+	// nil until the content is known.
+	rrs []dns.RR
+
+	// deltas are the changes to the zone, oldest first.
+	deltas []zoneDelta
+}
+
+// zoneDelta is one change to a zone, laid out as in an IXFR response: the
+// removed records follow the old SOA record and the added ones the new SOA
+// record.
+type zoneDelta struct {
+	removed []dns.RR
+	added   []dns.RR
+}
+
+// journalFile is the layout of a journal saved to disk, with each record in
+// the master file format.
+type journalFile struct {
+	Records []string       `yaml:"records"`
+	Deltas  []journalDelta `yaml:"deltas,omitempty"`
+}
+
+// journalDelta is a change saved in a journal file.
+type journalDelta struct {
+	Removed []string `yaml:"removed"`
+	Added   []string `yaml:"added"`
+}
+
+// loadJournal loads the zone's journal, if it has one, and records the
+// changes made to the zone since the journal was last saved.
+func (z *Zone) loadJournal(records *DNSRecords) error {
+	if z.Journal == "" {
+		return nil
+	}
+
+	journal, err := readJournal(z.Journal)
+	if os.IsNotExist(err) {
+		journal, err = &zoneJournal{file: z.Journal}, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load journal of zone %s: %v", z.Origin, err)
+	}
+	z.journal = journal
+
+	// The content of a secondary zone is only known once it is transferred
+	if z.expired {
+		return nil
+	}
+
+	rrs, err := records.zoneRRs(z)
+	if err != nil {
+		return err
+	}
+
+	// The journal holds the version a serial policy follows on from
+	if z.SerialPolicy != "" && journal.rrs != nil {
+		z.followSerial(rrs[:len(rrs)-1], journal.rrs)
+		rrs, err = records.zoneRRs(z)
+		if err != nil {
+			return err
+		}
+	}
+
+	return journal.record(z.Origin, rrs[:len(rrs)-1])
+}
+
+// readJournal reads a journal saved to a file.
+func readJournal(filename string) (*zoneJournal, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var saved journalFile
+	err = yaml.Unmarshal(data, &saved)
+	if err != nil {
+		return nil, err
+	}
+
+	journal := &zoneJournal{file: filename}
+	journal.rrs, err = parseRRs(saved.Records)
+	if err != nil {
+		return nil, err
+	}
+	if len(journal.rrs) == 0 || journal.rrs[0].Header().Rrtype != dns.TypeSOA {
+		return nil, fmt.Errorf("journal %s does not start with an SOA record", filename)
+	}
+
+	for _, delta := range saved.Deltas {
+		removed, err := parseRRs(delta.Removed)
+		if err != nil {
+			return nil, err
+		}
+		added, err := parseRRs(delta.Added)
+		if err != nil {
+			return nil, err
+		}
+		if len(removed) == 0 || removed[0].Header().Rrtype != dns.TypeSOA || len(added) == 0 || added[0].Header().Rrtype != dns.TypeSOA {
+			return nil, fmt.Errorf("journal %s holds a change without SOA records", filename)
+		}
+
+		journal.deltas = append(journal.deltas, zoneDelta{removed: removed, added: added})
+	}
+
+	return journal, nil
+}
+
+// parseRRs parses records written in the master file format.
+func parseRRs(lines []string) ([]dns.RR, error) {
+	var rrs []dns.RR
+	for _, line := range lines {
+		rr, err := dns.NewRR(line)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, rr)
+	}
+
+	return rrs, nil
+}
+
+// save writes the journal to its file, with mu held once the journal is in
+// use.
+func (j *zoneJournal) save() error {
+	saved := journalFile{Records: rrStrings(j.rrs)}
+	for _, delta := range j.deltas {
+		saved.Deltas = append(saved.Deltas, journalDelta{
+			Removed: rrStrings(delta.removed),
+			Added:   rrStrings(delta.added),
+		})
+	}
+
+	data, err := yaml.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(j.file, data, 0644)
+}
+
+// rrStrings returns records in the master file format.
+func rrStrings(rrs []dns.RR) []string {
+	var lines []string
+	for _, rr := range rrs {
+		lines = append(lines, rr.String())
+	}
+
+	return lines
+}
+
+// serial returns the serial of the zone's current version.
+func (j *zoneJournal) serial() uint32 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.rrs[0].(*dns.SOA).Serial
+}
+
+// record replaces the journal's content with the zone's new content, which
+// starts with its SOA record, adding the change between them to its deltas
+// and saving the journal if the zone changed. A zone changed without its
+// serial increasing has its history discarded, as secondaries could not
+// tell the versions apart.
+func (j *zoneJournal) record(origin string, rrs []dns.RR) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.rrs == nil {
+		j.rrs = rrs
+		return j.save()
+	}
+
+	removed := []dns.RR{j.rrs[0]}
+	added := []dns.RR{rrs[0]}
+	removed = append(removed, missingRRs(j.rrs[1:], rrs[1:])...)
+	added = append(added, missingRRs(rrs[1:], j.rrs[1:])...)
+
+	if len(removed) == 1 && len(added) == 1 && removed[0].String() == added[0].String() {
+		return nil
+	}
+
+	oldSerial := j.rrs[0].(*dns.SOA).Serial
+	newSerial := rrs[0].(*dns.SOA).Serial
+	j.rrs = rrs
+	if serialNewer(newSerial, oldSerial) {
+		log.Printf("Recorded changes to zone %s from serial %d to %d", origin, oldSerial, newSerial)
+		j.deltas = append(j.deltas, zoneDelta{removed: removed, added: added})
+		if len(j.deltas) > maxZoneDeltas {
+			j.deltas = j.deltas[len(j.deltas)-maxZoneDeltas:]
+		}
+	} else {
+		log.Printf("Zone %s changed without its serial increasing, discarding its IXFR history", origin)
+		j.deltas = nil
+	}
+
+	return j.save()
+}
+
+// missingRRs returns the records of from that are not in to.
+func missingRRs(from, to []dns.RR) []dns.RR {
+	present := map[string]bool{}
+	for _, rr := range to {
+		present[rr.String()] = true
+	}
+
+	var missing []dns.RR
+	for _, rr := range from {
+		if !present[rr.String()] {
+			missing = append(missing, rr)
+		}
+	}
+
+	return missing
+}
+
+// changesSince returns the records of an IXFR response taking a secondary
+// from the given serial to the zone's current version, or nil if the
+// journal does not reach back that far.
+func (j *zoneJournal) changesSince(serial uint32) []dns.RR {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	start := -1
+	for i, delta := range j.deltas {
+		if delta.removed[0].(*dns.SOA).Serial == serial {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		return nil
+	}
+
+	rrs := []dns.RR{j.rrs[0]}
+	for _, delta := range j.deltas[start:] {
+		rrs = append(rrs, delta.removed...)
+		rrs = append(rrs, delta.added...)
+	}
+
+	return append(rrs, j.rrs[0])
+}
+
+// serialNewer reports whether serial a is newer than b under the serial
+// number arithmetic of RFC 1982.
+func serialNewer(a, b uint32) bool {
+	return int32(a-b) > 0
+}
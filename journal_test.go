@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// zoneVersion is a version of the zone example.lan., with its serial and
+// the addresses of its hosts.
+type zoneVersion struct {
+	serial uint32
+	hosts  []DNSRecord
+}
+
+// journalVersions loads each version of example.lan. in turn with the
+// journal in file, returning the records of the last.
+func journalVersions(t *testing.T, file string, versions ...zoneVersion) *DNSRecords {
+	t.Helper()
+
+	var records *DNSRecords
+	for _, version := range versions {
+		records = &DNSRecords{
+			Zones: []Zone{{
+				Origin:        "example.lan.",
+				SOA:           SOARecord{Serial: version.serial},
+				AllowTransfer: []string{"127.0.0.0/8"},
+				Journal:       file,
+			}},
+			Records: append([]DNSRecord{}, version.hosts...),
+		}
+		err := records.prepare()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = records.Zones[0].loadJournal(records)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return records
+}
+
+// summarize returns the records of a transfer as the serials of its SOA
+// records and the names and data of the rest.
+func summarize(rrs []dns.RR) []string {
+	var summary []string
+	for _, rr := range rrs {
+		if soa, ok := rr.(*dns.SOA); ok {
+			summary = append(summary, fmt.Sprintf("SOA %d", soa.Serial))
+			continue
+		}
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		summary = append(summary, rr.Header().Name+" "+data)
+	}
+
+	return summary
+}
+
+var journalTestVersions = []zoneVersion{
+	{1, []DNSRecord{{Hostname: "www.example.lan.", IP: "192.168.1.10"}}},
+	{2, []DNSRecord{{Hostname: "www.example.lan.", IP: "192.168.1.11"}, {Hostname: "mail.example.lan.", IP: "192.168.1.20"}}},
+	{3, []DNSRecord{{Hostname: "www.example.lan.", IP: "192.168.1.11"}}},
+}
+
+func TestZoneJournal(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "example.lan.journal")
+	records := journalVersions(t, file, journalTestVersions...)
+	journal := records.Zones[0].journal
+
+	tests := []struct {
+		serial uint32
+		want   []string
+	}{
+		{1, []string{
+			"SOA 3",
+			"SOA 1", "www.example.lan. 192.168.1.10",
+			"SOA 2", "www.example.lan. 192.168.1.11", "mail.example.lan. 192.168.1.20",
+			"SOA 2", "mail.example.lan. 192.168.1.20",
+			"SOA 3",
+			"SOA 3",
+		}},
+		{2, []string{"SOA 3", "SOA 2", "mail.example.lan. 192.168.1.20", "SOA 3", "SOA 3"}},
+		{7, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.serial), func(t *testing.T) {
+			got := summarize(journal.changesSince(test.serial))
+			if !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+
+	// The journal is saved as it changes, and loading the same version
+	// again records nothing
+	saved, err := readJournal(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.serial() != 3 || len(saved.deltas) != 2 {
+		t.Fatalf("got serial %d with %d changes saved, want serial 3 with 2", saved.serial(), len(saved.deltas))
+	}
+	records = journalVersions(t, file, journalTestVersions[2])
+	if got := len(records.Zones[0].journal.deltas); got != 2 {
+		t.Fatalf("got %d changes after loading the same version, want 2", got)
+	}
+}
+
+func TestZoneJournalSerialNotIncreased(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "example.lan.journal")
+	records := journalVersions(t, file,
+		journalTestVersions[0],
+		journalTestVersions[1],
+		zoneVersion{2, journalTestVersions[2].hosts},
+	)
+
+	if deltas := records.Zones[0].journal.deltas; len(deltas) != 0 {
+		t.Fatalf("got %d changes, want the history discarded", len(deltas))
+	}
+}
+
+func TestIncrementalTransfer(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "example.lan.journal")
+	records := journalVersions(t, file, journalTestVersions...)
+	address := serveTestTCP(t, testServer(DefaultConfig(), records))
+
+	tests := []struct {
+		name   string
+		serial uint32
+		want   []string
+	}{
+		{"behind", 2, []string{"SOA 3", "SOA 2", "mail.example.lan. 192.168.1.20", "SOA 3", "SOA 3"}},
+		{"up to date", 3, []string{"SOA 3"}},
+		{"newer", 9, []string{"SOA 3"}},
+		{"unknown serial", 0, []string{"SOA 3", "www.example.lan. 192.168.1.11", "SOA 3"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := new(dns.Msg)
+			request.SetIxfr("example.lan.", test.serial, "ns.example.lan.", "hostmaster.example.lan.")
+			envelopes, err := new(dns.Transfer).In(request, address)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var rrs []dns.RR
+			for envelope := range envelopes {
+				if envelope.Error != nil {
+					t.Fatal(envelope.Error)
+				}
+				rrs = append(rrs, envelope.RR...)
+			}
+			if got := summarize(rrs); !reflect.DeepEqual(got, test.want) {
+				t.Fatalf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/miekg/dns"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// kubernetesTimeout is how long listing the services and ingresses of the
+// cluster may take.
+const kubernetesTimeout = 10 * time.Second
+
+// KubernetesConfig publishes the Services and Ingresses of a Kubernetes
+// cluster in Zone, so that what the cluster exposes resolves on the LAN.
+type KubernetesConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Kubeconfig is the kubeconfig file giving the cluster and the
+	// credentials to watch it with. Without one the server uses the
+	// service account it is given when running in the cluster.
+	Kubeconfig string `yaml:"kubeconfig"`
+
+	// Zone holds a name for each Service, service.namespace.zone, as well
+	// as the hosts of Ingresses that fall inside it.
+	Zone string `yaml:"zone"`
+
+	// Namespaces limits the Services and Ingresses published to those of
+	// the namespaces given, rather than those of the whole cluster.
+	Namespaces []string `yaml:"namespaces"`
+}
+
+// parse canonicalises the zone.
+func (c *KubernetesConfig) parse() error {
+	if c.Zone == "" {
+		return fmt.Errorf("kubernetes needs a zone")
+	}
+
+	c.Zone = dns.CanonicalName(c.Zone)
+	return nil
+}
+
+// namespaces returns the namespaces to publish, of which the empty one
+// stands for every namespace.
+func (c *KubernetesConfig) namespaces() []string {
+	if len(c.Namespaces) == 0 {
+		return []string{metav1.NamespaceAll}
+	}
+
+	return c.Namespaces
+}
+
+// newKubernetesClient returns a client for the configured cluster.
+func newKubernetesClient(config *KubernetesConfig) (*kubernetes.Clientset, error) {
+	var restConfig *rest.Config
+	var err error
+	if config.Kubeconfig != "" {
+		restConfig, err = clientcmd.BuildConfigFromFlags("", config.Kubeconfig)
+	} else {
+		restConfig, err = rest.InClusterConfig()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return kubernetes.NewForConfig(restConfig)
+}
+
+func (c *KubernetesConfig) Put(record DNSRecord) error {
+	return errPublished
+}
+
+func (c *KubernetesConfig) Delete(record DNSRecord) error {
+	return errPublished
+}
+
+// List returns the records of the Services and Ingresses of the cluster.
+func (c *KubernetesConfig) List() ([]DNSRecord, error) {
+	client, err := newKubernetesClient(c)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), kubernetesTimeout)
+	defer cancel()
+
+	var records []DNSRecord
+	for _, namespace := range c.namespaces() {
+		services, err := client.CoreV1().Services(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range services.Items {
+			records = append(records, c.serviceRecords(&services.Items[i])...)
+		}
+
+		ingresses, err := client.NetworkingV1().Ingresses(namespace).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		for i := range ingresses.Items {
+			records = append(records, c.ingressRecords(&ingresses.Items[i])...)
+		}
+	}
+
+	return records, nil
+}
+
+// serviceRecords returns the records of a Service, giving its name in the
+// zone the addresses reachable from outside the cluster: those of its load
+// balancer and its external IPs. Services with neither, reachable only
+// inside the cluster, are left out.
+func (c *KubernetesConfig) serviceRecords(service *corev1.Service) []DNSRecord {
+	hostname := service.Name + "." + service.Namespace + "." + c.Zone
+	var records []DNSRecord
+	for _, ingress := range service.Status.LoadBalancer.Ingress {
+		records = append(records, loadBalancerRecords(hostname, ingress.IP, ingress.Hostname)...)
+	}
+	for _, ip := range service.Spec.ExternalIPs {
+		records = append(records, loadBalancerRecords(hostname, ip, "")...)
+	}
+
+	return records
+}
+
+// ingressRecords returns the records giving the hosts of an Ingress that
+// fall inside the zone the addresses of its load balancer.
+func (c *KubernetesConfig) ingressRecords(ingress *networkingv1.Ingress) []DNSRecord {
+	var records []DNSRecord
+	for _, rule := range ingress.Spec.Rules {
+		hostname := dns.Fqdn(rule.Host)
+		if rule.Host == "" || !dns.IsSubDomain(c.Zone, hostname) {
+			continue
+		}
+		for _, lb := range ingress.Status.LoadBalancer.Ingress {
+			records = append(records, loadBalancerRecords(hostname, lb.IP, lb.Hostname)...)
+		}
+	}
+
+	return records
+}
+
+// loadBalancerRecords returns the record giving hostname a load balancer's
+// address, or a CNAME to its hostname for load balancers known by name.
+func loadBalancerRecords(hostname, ip, target string) []DNSRecord {
+	switch {
+	case net.ParseIP(ip) != nil:
+		return []DNSRecord{{Hostname: hostname, IP: ip}}
+	case target != "":
+		return []DNSRecord{{Hostname: hostname, CNAME: dns.Fqdn(target)}}
+	}
+
+	return nil
+}
+
+// Watch follows the changes to the Services and Ingresses of the cluster as
+// informers announce them. Changes that leave the records of a Service or
+// Ingress as they were, such as those to its labels, are ignored.
+func (c *KubernetesConfig) Watch(changed func()) error {
+	client, err := newKubernetesClient(c)
+	if err != nil {
+		return err
+	}
+
+	handler := func(records func(interface{}) []DNSRecord) cache.ResourceEventHandler {
+		return cache.ResourceEventHandlerDetailedFuncs{
+			AddFunc: func(object interface{}, initial bool) {
+				if !initial && len(records(object)) > 0 {
+					changed()
+				}
+			},
+			UpdateFunc: func(old, object interface{}) {
+				if !reflect.DeepEqual(records(old), records(object)) {
+					changed()
+				}
+			},
+			DeleteFunc: func(object interface{}) {
+				if tombstone, ok := object.(cache.DeletedFinalStateUnknown); ok {
+					object = tombstone.Obj
+				}
+				if len(records(object)) > 0 {
+					changed()
+				}
+			},
+		}
+	}
+
+	for _, namespace := range c.namespaces() {
+		factory := informers.NewSharedInformerFactoryWithOptions(client, 0, informers.WithNamespace(namespace))
+		factory.Core().V1().Services().Informer().AddEventHandler(handler(func(object interface{}) []DNSRecord {
+			if service, ok := object.(*corev1.Service); ok {
+				return c.serviceRecords(service)
+			}
+			return nil
+		}))
+		factory.Networking().V1().Ingresses().Informer().AddEventHandler(handler(func(object interface{}) []DNSRecord {
+			if ingress, ok := object.(*networkingv1.Ingress); ok {
+				return c.ingressRecords(ingress)
+			}
+			return nil
+		}))
+		factory.Start(nil)
+	}
+
+	return nil
+}
@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ldapPageSize is how many entries the directory is asked for at a time,
+// which keeps searches within the limits servers such as Active Directory
+// place on a single page of results.
+const ldapPageSize = 500
+
+// ldapPagedResults is the OID of the simple paged results control (RFC
+// 2696).
+const ldapPagedResults = "1.2.840.113556.1.4.319"
+
+// LDAPConfig publishes the hosts of an LDAP directory in Zone, from the
+// entries under BaseDN matching Filter.
+type LDAPConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the directory server, ldap://host or ldaps://host, on port
+	// 389 or 636 unless another is given.
+	URL string `yaml:"url"`
+
+	// BindDN and BindPassword are the credentials the server binds with.
+	// The search is made anonymously if BindDN is empty.
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+
+	// BaseDN is the entry the search is made under, such as
+	// ou=Servers,dc=corp,dc=example,dc=com.
+	BaseDN string `yaml:"base_dn"`
+
+	// Filter selects the entries of hosts, such as (objectClass=ipHost).
+	Filter string `yaml:"filter"`
+
+	// Attributes names the attributes each record is taken from.
+	Attributes LDAPAttributes `yaml:"attributes"`
+
+	// Zone holds the records of the hosts. Names of a single label are
+	// placed in the zone, and other names outside it are left out.
+	Zone string `yaml:"zone"`
+
+	// Timeout is how long reading the directory may take.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Interval is how often the directory is read again for changes. Zero
+	// reads it only when the records are reloaded.
+	Interval time.Duration `yaml:"interval"`
+
+	address string
+	tls     bool
+}
+
+// LDAPAttributes names the attributes of an entry that give a host's name,
+// its addresses and the aliases that are CNAME records of it.
+type LDAPAttributes struct {
+	Hostname  string `yaml:"hostname"`
+	Addresses string `yaml:"addresses"`
+	Aliases   string `yaml:"aliases"`
+}
+
+// parse validates the server, filter and attributes and canonicalises the
+// zone.
+func (c *LDAPConfig) parse() error {
+	address, err := url.Parse(c.URL)
+	if err != nil || (address.Scheme != "ldap" && address.Scheme != "ldaps") || address.Hostname() == "" {
+		return fmt.Errorf("invalid ldap url %q", c.URL)
+	}
+	c.tls = address.Scheme == "ldaps"
+	c.address = address.Host
+	if address.Port() == "" {
+		port := "389"
+		if c.tls {
+			port = "636"
+		}
+		c.address = net.JoinHostPort(address.Hostname(), port)
+	}
+
+	_, err = encodeLDAPFilter(c.Filter)
+	if err != nil {
+		return fmt.Errorf("invalid ldap filter %q: %v", c.Filter, err)
+	}
+	if c.Attributes.Hostname == "" {
+		return fmt.Errorf("ldap needs a hostname attribute")
+	}
+	if c.Zone == "" {
+		return fmt.Errorf("ldap needs a zone")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid ldap timeout %v", c.Timeout)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid ldap interval %v", c.Interval)
+	}
+
+	c.Zone = dns.CanonicalName(c.Zone)
+	return nil
+}
+
+func (c *LDAPConfig) Put(record DNSRecord) error {
+	return errPublished
+}
+
+func (c *LDAPConfig) Delete(record DNSRecord) error {
+	return errPublished
+}
+
+// List returns the records of the hosts of the directory.
+func (c *LDAPConfig) List() ([]DNSRecord, error) {
+	attributes := c.Attributes
+	entries, err := c.search([]string{attributes.Hostname, attributes.Addresses, attributes.Aliases})
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, entry := range entries {
+		for _, hostname := range entry[strings.ToLower(attributes.Hostname)] {
+			hostname = c.hostname(hostname)
+			if hostname == "" {
+				continue
+			}
+
+			for _, ip := range entry[strings.ToLower(attributes.Addresses)] {
+				if net.ParseIP(ip) != nil {
+					records = append(records, DNSRecord{Hostname: hostname, IP: ip})
+				}
+			}
+			for _, alias := range entry[strings.ToLower(attributes.Aliases)] {
+				if alias = c.hostname(alias); alias != "" && alias != hostname {
+					records = append(records, DNSRecord{Hostname: alias, CNAME: hostname})
+				}
+			}
+		}
+	}
+
+	return records, nil
+}
+
+// hostname returns the name of a host in the zone, or "" if it lies
+// outside the zone or is not a valid name.
+func (c *LDAPConfig) hostname(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return ""
+	}
+	if !strings.Contains(strings.TrimSuffix(name, "."), ".") {
+		name = strings.TrimSuffix(name, ".") + "." + c.Zone
+	}
+	if _, ok := dns.IsDomainName(name); !ok {
+		return ""
+	}
+
+	name = dns.CanonicalName(name)
+	if !dns.IsSubDomain(c.Zone, name) {
+		return ""
+	}
+	return name
+}
+
+func (c *LDAPConfig) Watch(changed func()) error {
+	if c.Interval == 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		last, err := c.List()
+		if err != nil {
+			log.Printf("Failed to read the LDAP directory: %v", err)
+		}
+		for range ticker.C {
+			records, err := c.List()
+			if err != nil {
+				log.Printf("Failed to read the LDAP directory: %v", err)
+				continue
+			}
+			if reflect.DeepEqual(records, last) {
+				continue
+			}
+			last = records
+			changed()
+		}
+	}()
+
+	return nil
+}
+
+// ldapEntry holds the values of the attributes of an entry, keyed by the
+// lowercased names of the attributes.
+type ldapEntry map[string][]string
+
+// ldapConn is a connection to the directory server.
+type ldapConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	id     int64
+}
+
+// search binds to the directory and reads the attributes of the entries
+// under the base DN matching the filter, a page at a time.
+func (c *LDAPConfig) search(attributes []string) ([]ldapEntry, error) {
+	dialer := &net.Dialer{Timeout: c.Timeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.address)
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.address, &tls.Config{ServerName: host})
+	} else {
+		conn, err = dialer.Dial("tcp", c.address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(c.Timeout))
+
+	l := &ldapConn{conn: conn, reader: bufio.NewReader(conn)}
+	defer l.send(berElement(0x42, nil))
+
+	if c.BindDN != "" {
+		_, err = l.request(berElement(0x60,
+			berInteger(0x02, 3),
+			berElement(0x04, []byte(c.BindDN)),
+			berElement(0x80, []byte(c.BindPassword)),
+		), nil, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to bind as %s: %v", c.BindDN, err)
+		}
+	}
+
+	filter, err := encodeLDAPFilter(c.Filter)
+	if err != nil {
+		return nil, err
+	}
+	var requested [][]byte
+	for _, attribute := range attributes {
+		if attribute != "" {
+			requested = append(requested, berElement(0x04, []byte(attribute)))
+		}
+	}
+
+	var entries []ldapEntry
+	var cookie []byte
+	for {
+		search := berElement(0x63,
+			berElement(0x04, []byte(c.BaseDN)),
+			berInteger(0x0a, 2), // the whole subtree
+			berInteger(0x0a, 0), // never dereferencing aliases
+			berInteger(0x02, 0),
+			berInteger(0x02, int64(c.Timeout/time.Second)),
+			berElement(0x01, []byte{0}),
+			filter,
+			berElement(0x30, requested...),
+		)
+		paging := berElement(0xa0, berElement(0x30,
+			berElement(0x04, []byte(ldapPagedResults)),
+			berElement(0x04, berElement(0x30, berInteger(0x02, ldapPageSize), berElement(0x04, cookie))),
+		))
+
+		cookie, err = l.request(search, paging, func(entry ldapEntry) {
+			entries = append(entries, entry)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(cookie) == 0 {
+			return entries, nil
+		}
+	}
+}
+
+// send writes a request to the directory as a message of its own.
+func (l *ldapConn) send(request []byte, controls ...[]byte) error {
+	l.id++
+	_, err := l.conn.Write(berElement(0x30, append([][]byte{berInteger(0x02, l.id), request}, controls...)...))
+	return err
+}
+
+// request sends a request, bind or search, with the given controls and
+// reads the responses to it, passing the entries of a search to found. It
+// returns the cookie of the next page of the search, if there is one.
+func (l *ldapConn) request(request, controls []byte, found func(ldapEntry)) ([]byte, error) {
+	err := l.send(request, controls)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		message, err := readBER(l.reader)
+		if err != nil {
+			return nil, err
+		}
+		_, id, rest, err := berNext(message)
+		if err != nil {
+			return nil, err
+		}
+		if berToInteger(id) != l.id {
+			continue
+		}
+		tag, op, rest, err := berNext(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		switch tag {
+		case 0x64:
+			if found != nil {
+				entry, err := parseLDAPEntry(op)
+				if err != nil {
+					return nil, err
+				}
+				found(entry)
+			}
+		case 0x61, 0x65:
+			err = ldapResult(op)
+			if err != nil {
+				return nil, err
+			}
+			return pagingCookie(rest)
+		}
+	}
+}
+
+// ldapResult returns the error a result reports, or nil if it reports
+// success.
+func ldapResult(result []byte) error {
+	_, code, rest, err := berNext(result)
+	if err != nil {
+		return err
+	}
+	if berToInteger(code) == 0 {
+		return nil
+	}
+
+	var diagnostic []byte
+	if _, _, rest, err = berNext(rest); err == nil {
+		_, diagnostic, _, _ = berNext(rest)
+	}
+	return fmt.Errorf("directory answered with result %d: %s", berToInteger(code), diagnostic)
+}
+
+// pagingCookie returns the cookie of the paged results control among the
+// controls of a response, or nil if there are no more pages.
+func pagingCookie(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	_, controls, _, err := berNext(data)
+	if err != nil {
+		return nil, err
+	}
+
+	for len(controls) > 0 {
+		var control []byte
+		_, control, controls, err = berNext(controls)
+		if err != nil {
+			return nil, err
+		}
+		_, oid, rest, err := berNext(control)
+		if err != nil || string(oid) != ldapPagedResults {
+			continue
+		}
+
+		// Past the criticality, if it is given, is the value holding the
+		// size and the cookie
+		tag, value, rest, err := berNext(rest)
+		if err == nil && tag == 0x01 {
+			_, value, _, err = berNext(rest)
+		}
+		if err != nil {
+			return nil, err
+		}
+		_, value, _, err = berNext(value)
+		if err != nil {
+			return nil, err
+		}
+		_, _, rest, err = berNext(value)
+		if err != nil {
+			return nil, err
+		}
+		_, cookie, _, err := berNext(rest)
+		return cookie, err
+	}
+
+	return nil, nil
+}
+
+// parseLDAPEntry reads the attributes of an entry found by a search.
+func parseLDAPEntry(data []byte) (ldapEntry, error) {
+	_, _, rest, err := berNext(data)
+	if err != nil {
+		return nil, err
+	}
+	_, attributes, _, err := berNext(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := ldapEntry{}
+	for len(attributes) > 0 {
+		var attribute []byte
+		_, attribute, attributes, err = berNext(attributes)
+		if err != nil {
+			return nil, err
+		}
+		_, name, rest, err := berNext(attribute)
+		if err != nil {
+			return nil, err
+		}
+		_, values, _, err := berNext(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		key := strings.ToLower(string(name))
+		for len(values) > 0 {
+			var value []byte
+			_, value, values, err = berNext(values)
+			if err != nil {
+				return nil, err
+			}
+			entry[key] = append(entry[key], string(value))
+		}
+	}
+
+	return entry, nil
+}
+
+// encodeLDAPFilter encodes a search filter in its string form (RFC 4515),
+// such as (&(objectClass=ipHost)(cn=web*)).
+func encodeLDAPFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+
+	encoded, rest, err := parseLDAPFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, fmt.Errorf("unexpected %q", rest)
+	}
+	return encoded, nil
+}
+
+// parseLDAPFilter encodes the filter at the start of s, returning what
+// follows it.
+func parseLDAPFilter(s string) ([]byte, string, error) {
+	if len(s) < 2 || s[0] != '(' {
+		return nil, "", fmt.Errorf("expected ( at %q", s)
+	}
+	s = s[1:]
+
+	switch s[0] {
+	case '&', '|', '!':
+		tag := map[byte]byte{'&': 0xa0, '|': 0xa1, '!': 0xa2}[s[0]]
+		s = s[1:]
+		var filters [][]byte
+		for len(s) > 0 && s[0] == '(' {
+			var filter []byte
+			var err error
+			filter, s, err = parseLDAPFilter(s)
+			if err != nil {
+				return nil, "", err
+			}
+			filters = append(filters, filter)
+		}
+		if len(s) == 0 || s[0] != ')' || len(filters) == 0 || (tag == 0xa2 && len(filters) != 1) {
+			return nil, "", fmt.Errorf("malformed filter")
+		}
+		return berElement(tag, filters...), s[1:], nil
+	}
+
+	end := strings.IndexByte(s, ')')
+	if end < 0 {
+		return nil, "", fmt.Errorf("expected )")
+	}
+	item, err := encodeLDAPFilterItem(s[:end])
+	return item, s[end+1:], err
+}
+
+// encodeLDAPFilterItem encodes a comparison of an attribute, such as
+// cn=web*, objectClass=* or uidNumber>=1000.
+func encodeLDAPFilterItem(item string) ([]byte, error) {
+	equals := strings.IndexByte(item, '=')
+	if equals < 1 {
+		return nil, fmt.Errorf("malformed comparison %q", item)
+	}
+	attribute, value := item[:equals], item[equals+1:]
+
+	tag := byte(0xa3)
+	switch attribute[len(attribute)-1] {
+	case '>':
+		tag = 0xa5
+	case '<':
+		tag = 0xa6
+	case '~':
+		tag = 0xa8
+	}
+	if tag != 0xa3 {
+		attribute = attribute[:len(attribute)-1]
+	}
+	attribute = strings.TrimSpace(attribute)
+	if attribute == "" {
+		return nil, fmt.Errorf("malformed comparison %q", item)
+	}
+
+	if tag == 0xa3 && value == "*" {
+		return berElement(0x87, []byte(attribute)), nil
+	}
+	if tag == 0xa3 && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for i, part := range parts {
+			if part == "" {
+				continue
+			}
+			unescaped, err := unescapeLDAPValue(part)
+			if err != nil {
+				return nil, err
+			}
+			kind := byte(0x81)
+			if i == 0 {
+				kind = 0x80
+			} else if i == len(parts)-1 {
+				kind = 0x82
+			}
+			substrings = append(substrings, berElement(kind, unescaped))
+		}
+		return berElement(0xa4, berElement(0x04, []byte(attribute)), berElement(0x30, substrings...)), nil
+	}
+
+	unescaped, err := unescapeLDAPValue(value)
+	if err != nil {
+		return nil, err
+	}
+	return berElement(tag, berElement(0x04, []byte(attribute)), berElement(0x04, unescaped)), nil
+}
+
+// unescapeLDAPValue decodes the \XX escapes of a value of a filter.
+func unescapeLDAPValue(value string) ([]byte, error) {
+	var unescaped []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			unescaped = append(unescaped, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, fmt.Errorf("malformed escape in %q", value)
+		}
+		decoded, err := hex.DecodeString(value[i+1 : i+3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed escape in %q", value)
+		}
+		unescaped = append(unescaped, decoded...)
+		i += 2
+	}
+
+	return unescaped, nil
+}
+
+// berElement encodes an element of BER with the given tag, its content
+// made of the parts given.
+func berElement(tag byte, parts ...[]byte) []byte {
+	var content []byte
+	for _, part := range parts {
+		content = append(content, part...)
+	}
+
+	encoded := []byte{tag}
+	switch n := len(content); {
+	case n < 0x80:
+		encoded = append(encoded, byte(n))
+	case n < 0x100:
+		encoded = append(encoded, 0x81, byte(n))
+	case n < 0x10000:
+		encoded = append(encoded, 0x82, byte(n>>8), byte(n))
+	default:
+		encoded = append(encoded, 0x84, byte(n>>24), byte(n>>16), byte(n>>8), byte(n))
+	}
+
+	return append(encoded, content...)
+}
+
+// berInteger encodes an integer, or an enumerated value, with the given
+// tag.
+func berInteger(tag byte, n int64) []byte {
+	content := []byte{byte(n)}
+	for n >= 0x80 || n < -0x80 {
+		n >>= 8
+		content = append([]byte{byte(n)}, content...)
+	}
+
+	return berElement(tag, content)
+}
+
+// berToInteger decodes the content of an integer.
+func berToInteger(content []byte) int64 {
+	var n int64
+	for i, b := range content {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+
+	return n
+}
+
+// berNext splits the first element off BER encoded data, returning its
+// tag, its content and the data following it.
+func berNext(data []byte) (byte, []byte, []byte, error) {
+	if len(data) < 2 {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+	tag, length, data := data[0], int(data[1]), data[2:]
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 || len(data) < size {
+			return 0, nil, nil, fmt.Errorf("unsupported BER length")
+		}
+		length = 0
+		for _, b := range data[:size] {
+			length = length<<8 | int(b)
+		}
+		data = data[size:]
+	}
+	if length > len(data) {
+		return 0, nil, nil, fmt.Errorf("truncated BER element")
+	}
+
+	return tag, data[:length], data[length:], nil
+}
+
+// readBER reads an element of BER from r, returning its content.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	header := make([]byte, 2)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		size := length & 0x7f
+		if size == 0 || size > 4 {
+			return nil, fmt.Errorf("unsupported BER length")
+		}
+		bytes := make([]byte, size)
+		_, err = io.ReadFull(r, bytes)
+		if err != nil {
+			return nil, err
+		}
+		length = 0
+		for _, b := range bytes {
+			length = length<<8 | int(b)
+		}
+	}
+
+	content := make([]byte, length)
+	_, err = io.ReadFull(r, content)
+	return content, err
+}
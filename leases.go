@@ -0,0 +1,185 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// expiryInterval is how often records are checked for having expired.
+const expiryInterval = time.Second
+
+// expireRecords removes records from service as their expiry times pass,
+// checking for expired records every expiryInterval.
+func (s *dnsServer) expireRecords() {
+	go func() {
+		ticker := time.NewTicker(expiryInterval)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			if s.records.Load().hasExpired(now) {
+				s.removeExpired(now)
+			}
+		}
+	}()
+}
+
+// removeExpired stops serving the records that have expired. Zones losing
+// records are changed as a dynamic update would change them, so that their
+// serial increases and their secondaries follow.
+func (s *dnsServer) removeExpired(now time.Time) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	for _, zone := range current.Zones {
+		if len(zone.Primaries) > 0 || zone.expired {
+			continue
+		}
+
+		err := s.expireZoneRecords(current, zone, now)
+		if err != nil {
+			log.Printf("Failed to remove expired records of zone %s: %v", zone.Origin, err)
+		}
+		current = s.records.Load()
+	}
+	if !current.hasExpired(now) {
+		return
+	}
+
+	next := &DNSRecords{
+		TTL:      current.TTL,
+		Zones:    current.Zones,
+		Views:    append([]View{}, current.Views...),
+		Records:  unexpired(current.Records, now),
+		includes: current.includes,
+	}
+	for i := range next.Views {
+		view := &next.Views[i]
+		view.Records = unexpired(view.Records, now)
+		err := view.prepare(next)
+		if err != nil {
+			log.Printf("Failed to remove expired records: %v", err)
+			return
+		}
+	}
+
+	s.serveRecords(next)
+	log.Printf("Removed %d expired DNS records", len(current.Records)-len(next.Records))
+}
+
+// expireZoneRecords removes a zone's expired records, if it has any.
+func (s *dnsServer) expireZoneRecords(current *DNSRecords, zone Zone, now time.Time) error {
+	expiries := current.expiries(zone.Origin)
+
+	removed := map[string]bool{}
+	for key, expires := range expiries {
+		if !now.Before(expires) {
+			removed[key] = true
+		}
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+
+	rrs, err := current.zoneRRs(&zone)
+	if err != nil {
+		return err
+	}
+
+	var content []dns.RR
+	for _, rr := range rrs[:len(rrs)-1] {
+		if !removed[leaseKey(rr)] {
+			content = append(content, rr)
+		}
+	}
+
+	return s.storeZone(current, zone, content, expiries, true)
+}
+
+// hasExpired reports whether any record, global or of a view, has expired.
+func (r *DNSRecords) hasExpired(now time.Time) bool {
+	for _, record := range r.Records {
+		if record.expiredAt(now) {
+			return true
+		}
+	}
+	for _, view := range r.Views {
+		for _, record := range view.Records {
+			if record.expiredAt(now) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// expiries returns the expiry times of the records of a zone that have one,
+// keyed by leaseKey.
+func (r *DNSRecords) expiries(origin string) map[string]time.Time {
+	expiries := map[string]time.Time{}
+	for _, record := range r.Records {
+		if record.Expires.IsZero() {
+			continue
+		}
+		if owner := r.FindZone(record.Hostname); owner == nil || owner.Origin != origin {
+			continue
+		}
+
+		rrs, err := record.RRs(record.Hostname)
+		if err != nil {
+			continue
+		}
+		for _, rr := range rrs {
+			expiries[leaseKey(rr)] = record.Expires
+		}
+	}
+
+	return expiries
+}
+
+// expiredAt reports whether the record has an expiry time that has passed.
+func (r DNSRecord) expiredAt(now time.Time) bool {
+	return !r.Expires.IsZero() && !now.Before(r.Expires)
+}
+
+// unexpired returns the records that have not expired.
+func unexpired(records []DNSRecord, now time.Time) []DNSRecord {
+	var kept []DNSRecord
+	for _, record := range records {
+		if !record.expiredAt(now) {
+			kept = append(kept, record)
+		}
+	}
+
+	return kept
+}
+
+// leaseKey identifies a resource record by its name, type and data,
+// regardless of its TTL, so that renewing the lease of a record finds it.
+func leaseKey(rr dns.RR) string {
+	header := rr.Header()
+	data := strings.TrimPrefix(rr.String(), header.String())
+	return dns.CanonicalName(header.Name) + " " + dns.Type(header.Rrtype).String() + " " + data
+}
+
+// updateLease returns the lease in seconds an update asks for its records
+// with the UPDATE-LEASE option (draft-sekar-dns-ul), or zero if it asks for
+// none.
+func updateLease(request *dns.Msg) uint32 {
+	opt := request.IsEdns0()
+	if opt == nil {
+		return 0
+	}
+
+	for _, option := range opt.Option {
+		if lease, ok := option.(*dns.EDNS0_UL); ok {
+			return lease.Lease
+		}
+	}
+
+	return 0
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// listenNetwork returns the network to listen on for an address, given the
+// base network of "udp" or "tcp". IP literals are bound to their own address
+// family, so that IPv6 wildcard listeners do not also claim the IPv4 port and
+// both [::]:53 and 0.0.0.0:53 may be configured together. Link-local IPv6
+// addresses must name the interface they belong to, as in [fe80::1%eth0]:53.
+func listenNetwork(base string, address string) (string, error) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", err
+	}
+
+	literal, zone, _ := strings.Cut(host, "%")
+	ip := net.ParseIP(literal)
+	if ip == nil {
+		return base, nil
+	}
+
+	if ip.To4() != nil {
+		return base + "4", nil
+	}
+
+	if (ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()) && zone == "" {
+		return "", fmt.Errorf("link-local address %s needs a zone, e.g. [%s%%eth0]", literal, literal)
+	}
+
+	return base + "6", nil
+}
+
+// listen binds and serves every configured listen address.
+func (s *dnsServer) listen() {
+	// The encrypted transports bind their own ports on each listen host
+	encryptedHosts := map[string]bool{}
+
+	for _, address := range s.config.Listen {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			log.Fatalf("Invalid listen address %s: %v", address, err)
+		}
+
+		// Set up the UDP listeners
+		conns, err := s.listenUDP(address)
+		if err != nil {
+			log.Fatalf("Failed to set up UDP listener: %v", err)
+		}
+
+		for _, conn := range conns {
+			go s.runUDP(conn)
+		}
+
+		// Set up the TCP listener on the same address
+		network, err := listenNetwork("tcp", address)
+		if err != nil {
+			log.Fatalf("Invalid listen address %s: %v", address, err)
+		}
+		listener, err := net.Listen(network, address)
+		if err != nil {
+			log.Fatalf("Failed to set up TCP listener: %v", err)
+		}
+
+		go s.runTCP(listener)
+
+		log.Printf("Listening on %s", address)
+
+		if encryptedHosts[host] {
+			continue
+		}
+		encryptedHosts[host] = true
+
+		// Set up the optional DNS-over-TLS listener
+		if s.config.TLS.Enabled() {
+			tlsListener, err := s.listenTLS(host)
+			if err != nil {
+				log.Fatalf("Failed to set up TLS listener: %v", err)
+			}
+
+			go s.runTCP(tlsListener)
+		}
+
+		// Set up the optional DNS-over-QUIC listener
+		if s.config.QUIC.Enabled {
+			quicListener, err := s.listenQUIC(host)
+			if err != nil {
+				log.Fatalf("Failed to set up QUIC listener: %v", err)
+			}
+
+			go s.runQUIC(quicListener)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/miekg/dns"
+)
+
+// lookupRRs returns every local resource record for name, including the SOA
+// and NS records of a zone apex, any derived PTR records, any records
+// synthesised from a wildcard and, for a single-label name, the records of
+// that name under the local domain.
+func (s *dnsServer) lookupRRs(records *DNSRecords, name string) []dns.RR {
+	var rrs []dns.RR
+
+	matches := records.Lookup(name)
+	if len(matches) == 0 && s.config.AutoPTR {
+		matches = records.ReverseLookup(name)
+	}
+	if len(matches) == 0 {
+		matches = records.WildcardLookup(name)
+	}
+	if len(matches) == 0 && s.config.LocalDomain != "" && dns.CountLabel(name) == 1 {
+		// Answer a bare hostname such as "nas" as if it were qualified
+		matches = records.Lookup(name + s.config.LocalDomain)
+	}
+
+	for _, record := range matches {
+		recordRRs, err := record.RRs(name)
+		if err != nil {
+			log.Printf("Skipping record: %v", err)
+			continue
+		}
+
+		rrs = append(rrs, recordRRs...)
+	}
+
+	if zone := records.FindZone(name); zone != nil && dns.CanonicalName(zone.Origin) == dns.CanonicalName(name) {
+		rrs = append(rrs, zone.ApexRRs(name)...)
+	}
+
+	return rrs
+}
+
+// localHandler answers the names of the local zones and records from the
+// client's view, passing on the names that are not local.
+func (s *dnsServer) localHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	request, response := q.request, q.response
+	question := request.Question[0]
+
+	// Search for the corresponding DNS records in the client's view
+	records := s.records.Load().ForClient(q.client)
+	answers, found := s.answerLocal(records, question)
+	if question.Qtype == dns.TypeANY && len(answers) > 0 && s.config.AnyQueries == anyMinimal {
+		answers = []dns.RR{minimalANY(question.Name)}
+	}
+
+	zone := records.FindZone(question.Name)
+	var delegation []dns.RR
+	if zone != nil {
+		delegation = records.delegation(zone, question.Name)
+	}
+
+	if zone != nil && zone.expired {
+		// A secondary zone that has not been refreshed from its primaries
+		// before it expired holds no data to answer from
+		response.Rcode = dns.RcodeServerFailure
+	} else if isReferred(question, delegation) {
+		// Names delegated to other servers are answered with a referral
+		// to them, along with any glue addresses of their name servers
+		response.Ns = delegation
+		response.Extra = s.additionalLocal(records, delegation)
+
+		if opt := request.IsEdns0(); opt != nil && opt.Do() && zone.signer != nil {
+			response.Ns = append(response.Ns, s.delegationProof(records, zone, delegation[0].Header().Name)...)
+		}
+	} else if zone != nil {
+		// Names in a local zone are answered authoritatively, with the
+		// zone's SOA in the authority section of negative answers so that
+		// resolvers know how long to cache them.
+		response.Authoritative = true
+		response.Answer = answers
+		response.Extra = s.additionalLocal(records, answers)
+
+		if !found {
+			response.Rcode = dns.RcodeNameError
+		}
+		if len(answers) == 0 {
+			response.Ns = []dns.RR{zone.NegativeSOA()}
+		}
+
+		// Clients that validate are given the zone's signatures, along
+		// with proof of any name or type that does not exist
+		if opt := request.IsEdns0(); opt != nil && opt.Do() && zone.signer != nil {
+			if len(answers) == 0 {
+				response.Ns = append(response.Ns, s.denialRecords(records, zone, question.Name, !found)...)
+			}
+			signResponse(records, response)
+		}
+	} else if found {
+		// If the name is known, answer with its records of the requested
+		// type. A name with no records of that type gets an empty NOERROR
+		// (NODATA) response rather than being relayed.
+		response.Answer = answers
+		response.Extra = s.additionalLocal(records, answers)
+	} else {
+		return next()
+	}
+
+	return response
+}
+
+// maxCNAMEDepth is the longest chain of local CNAME records that will be
+// followed when answering a query.
+const maxCNAMEDepth = 8
+
+// answerLocal answers a question from the given local records, following CNAME
+// chains to their targets. It reports whether the name exists locally at all,
+// including as an empty non-terminal of a local zone with records only below
+// it, so that a query for a missing type can be answered with NODATA rather
+// than NXDOMAIN.
+func (s *dnsServer) answerLocal(records *DNSRecords, question dns.Question) ([]dns.RR, bool) {
+	var answers []dns.RR
+
+	name := question.Name
+	seen := map[string]bool{dns.CanonicalName(name): true}
+	for depth := 0; ; depth++ {
+		rrs := s.lookupRRs(records, name)
+		if len(rrs) == 0 {
+			return answers, depth > 0 || records.FindZone(name) != nil && records.NameExists(name)
+		}
+
+		var cname *dns.CNAME
+		start := len(answers)
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+				answers = append(answers, rr)
+			} else if alias, ok := rr.(*dns.CNAME); ok {
+				cname = alias
+			}
+		}
+
+		// Rotate the order of each answer set for simple round-robin load
+		// distribution across its addresses
+		rotate(answers[start:], atomic.AddUint64(&s.rotation, 1))
+
+		// Stop unless the name is an alias that needs to be followed
+		if cname == nil {
+			return answers, true
+		}
+
+		answers = append(answers, cname)
+
+		target := dns.CanonicalName(cname.Target)
+		if seen[target] {
+			log.Printf("CNAME loop detected at %s", cname.Target)
+			return answers, true
+		}
+		if depth+1 >= maxCNAMEDepth {
+			log.Printf("CNAME chain for %s exceeds %d records", question.Name, maxCNAMEDepth)
+			return answers, true
+		}
+
+		seen[target] = true
+		name = cname.Target
+	}
+}
+
+// rotate rotates rrs left by n places in place.
+func rotate(rrs []dns.RR, n uint64) {
+	if len(rrs) < 2 {
+		return
+	}
+
+	shift := int(n % uint64(len(rrs)))
+	rotated := append(rrs[shift:len(rrs):len(rrs)], rrs[:shift]...)
+	copy(rrs, rotated)
+}
+
+// additionalLocal returns the local addresses of the hosts named by NS, MX and
+// SRV answers, saving the client a follow-up query for each of them.
+func (s *dnsServer) additionalLocal(records *DNSRecords, answers []dns.RR) []dns.RR {
+	var extra []dns.RR
+
+	seen := map[string]bool{}
+	for _, answer := range answers {
+		var target string
+		switch rr := answer.(type) {
+		case *dns.NS:
+			target = rr.Ns
+		case *dns.MX:
+			target = rr.Mx
+		case *dns.SRV:
+			target = rr.Target
+		default:
+			continue
+		}
+
+		key := dns.CanonicalName(target)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		for _, rr := range s.lookupRRs(records, target) {
+			if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+				extra = append(extra, rr)
+			}
+		}
+	}
+
+	return extra
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+)
+
+// Hooks a Lua script may define.
+const (
+	luaQueryReceived  = "query_received"
+	luaBeforeResponse = "before_response"
+)
+
+// luaDrop is the verdict of a hook that drops a query without responding.
+const luaDrop = "DROP"
+
+// luaStates is the most Lua states kept for reuse between queries, each of
+// which runs one hook at a time.
+const luaStates = 16
+
+// LuaConfig runs the hooks of a Lua script on each query and response.
+type LuaConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Script is the file holding the script.
+	Script string `yaml:"script"`
+
+	// Timeout is how long a hook may run for a query.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Routes are the named groups of upstream servers query_received may
+	// send a query to instead of handling it as usual.
+	Routes map[string][]Upstream `yaml:"routes"`
+
+	proto  *lua.FunctionProto
+	states chan *lua.LState
+}
+
+// parse compiles the script and validates the timeout.
+func (c *LuaConfig) parse() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid lua timeout %v", c.Timeout)
+	}
+
+	source, err := os.ReadFile(c.Script)
+	if err != nil {
+		return fmt.Errorf("failed to read lua script: %v", err)
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(source)), c.Script)
+	if err != nil {
+		return fmt.Errorf("invalid lua script: %v", err)
+	}
+	c.proto, err = lua.Compile(chunk, c.Script)
+	if err != nil {
+		return fmt.Errorf("invalid lua script: %v", err)
+	}
+	c.states = make(chan *lua.LState, luaStates)
+
+	// Running the script once catches errors in its top level
+	state, err := c.state()
+	if err != nil {
+		return fmt.Errorf("failed to run lua script: %v", err)
+	}
+	c.release(state)
+
+	return nil
+}
+
+// state returns a Lua state that has run the script, reusing an idle one if
+// there is one. Only the base, table, string and math libraries are opened.
+func (c *LuaConfig) state() (*lua.LState, error) {
+	select {
+	case state := <-c.states:
+		return state, nil
+	default:
+	}
+
+	state := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, library := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		state.Push(state.NewFunction(library.open))
+		state.Push(lua.LString(library.name))
+		state.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		state.SetGlobal(name, lua.LNil)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	state.Push(state.NewFunctionFromProto(c.proto))
+	err := state.PCall(0, 0, nil)
+	state.RemoveContext()
+	if err != nil {
+		state.Close()
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// release keeps a state for reuse, or closes it if enough are kept.
+func (c *LuaConfig) release(state *lua.LState) {
+	select {
+	case c.states <- state:
+	default:
+		state.Close()
+	}
+}
+
+// call runs a hook of the script, if it defines it, passing what it
+// returns to result.
+func (c *LuaConfig) call(hook string, args func(*lua.LState) []lua.LValue, result func(lua.LValue) error) error {
+	state, err := c.state()
+	if err != nil {
+		return err
+	}
+
+	fn := state.GetGlobal(hook)
+	if fn.Type() != lua.LTFunction {
+		c.release(state)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	state.SetContext(ctx)
+	err = state.CallByParam(lua.P{Fn: fn, NRet: 1, Protect: true}, args(state)...)
+	state.RemoveContext()
+	if err != nil {
+		// A hook stopped part way may have left the state inconsistent
+		state.Close()
+		return fmt.Errorf("%s: %v", hook, err)
+	}
+
+	returned := state.Get(-1)
+	state.Pop(1)
+	err = result(returned)
+	c.release(state)
+	if err != nil {
+		return fmt.Errorf("%s: %v", hook, err)
+	}
+
+	return nil
+}
+
+// luaVerdict is what a hook decided to do with a query.
+type luaVerdict struct {
+	drop     bool
+	answered bool
+	rcode    int
+	answers  []dns.RR
+	route    string
+}
+
+// luaQuery returns a query as hooks are given it.
+func luaQuery(state *lua.LState, q *query) *lua.LTable {
+	question := q.request.Question[0]
+
+	table := state.NewTable()
+	table.RawSetString("name", lua.LString(question.Name))
+	table.RawSetString("type", lua.LString(dns.TypeToString[question.Qtype]))
+	table.RawSetString("class", lua.LString(dns.ClassToString[question.Qclass]))
+	if q.client != nil {
+		table.RawSetString("client", lua.LString(q.client.String()))
+	}
+
+	return table
+}
+
+// luaResponse returns a response as before_response is given it, with its
+// answers in the master file format.
+func luaResponse(state *lua.LState, response *dns.Msg) *lua.LTable {
+	answers := state.NewTable()
+	for _, rr := range response.Answer {
+		answers.Append(lua.LString(rr.String()))
+	}
+
+	table := state.NewTable()
+	table.RawSetString("rcode", lua.LString(dns.RcodeToString[response.Rcode]))
+	table.RawSetString("answers", answers)
+
+	return table
+}
+
+// decodeVerdict decodes what a hook returned. The rcode and answers a table
+// leaves out are those of response.
+func decodeVerdict(value lua.LValue, response *dns.Msg) (luaVerdict, error) {
+	var verdict luaVerdict
+	switch value := value.(type) {
+	case *lua.LNilType:
+		return verdict, nil
+	case lua.LString:
+		if strings.ToUpper(string(value)) == luaDrop {
+			verdict.drop = true
+			return verdict, nil
+		}
+		rcode, ok := dns.StringToRcode[strings.ToUpper(string(value))]
+		if !ok {
+			return verdict, fmt.Errorf("unknown rcode %q", value)
+		}
+		verdict.answered, verdict.rcode = true, rcode
+		return verdict, nil
+	case *lua.LTable:
+		if route := value.RawGetString("route"); route != lua.LNil {
+			verdict.route = route.String()
+			return verdict, nil
+		}
+
+		verdict.answered = true
+		verdict.rcode, verdict.answers = response.Rcode, response.Answer
+		if rcode := value.RawGetString("rcode"); rcode != lua.LNil {
+			code, ok := dns.StringToRcode[strings.ToUpper(rcode.String())]
+			if !ok {
+				return verdict, fmt.Errorf("unknown rcode %q", rcode.String())
+			}
+			verdict.rcode = code
+		}
+
+		answers, ok := value.RawGetString("answers").(*lua.LTable)
+		if !ok {
+			return verdict, nil
+		}
+		verdict.answers = nil
+		var err error
+		answers.ForEach(func(_, answer lua.LValue) {
+			if err != nil {
+				return
+			}
+			var rr dns.RR
+			rr, err = dns.NewRR(answer.String())
+			if err == nil && rr != nil {
+				verdict.answers = append(verdict.answers, rr)
+			}
+		})
+		return verdict, err
+	}
+
+	return verdict, fmt.Errorf("unexpected %s returned", value.Type())
+}
+
+// luaHandler runs the hooks of the script around the rest of the chain,
+// answering with SERVFAIL if a hook fails.
+func (s *dnsServer) luaHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	config := &s.config.Lua
+
+	var verdict luaVerdict
+	err := config.call(luaQueryReceived, func(state *lua.LState) []lua.LValue {
+		return []lua.LValue{luaQuery(state, q)}
+	}, func(value lua.LValue) error {
+		var err error
+		verdict, err = decodeVerdict(value, q.response)
+		return err
+	})
+	if err != nil {
+		log.Printf("Lua hook failed for %s: %v", q.request.Question[0].Name, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	}
+
+	var response *dns.Msg
+	switch {
+	case verdict.drop:
+		return nil
+	case verdict.answered:
+		response = q.response
+		response.Rcode = verdict.rcode
+		response.Answer = verdict.answers
+	case verdict.route != "":
+		response = s.routeLua(q, verdict.route)
+	default:
+		response = next()
+	}
+	if response == nil {
+		return nil
+	}
+
+	err = config.call(luaBeforeResponse, func(state *lua.LState) []lua.LValue {
+		return []lua.LValue{luaQuery(state, q), luaResponse(state, response)}
+	}, func(value lua.LValue) error {
+		var err error
+		verdict, err = decodeVerdict(value, response)
+		return err
+	})
+	if err != nil {
+		log.Printf("Lua hook failed for %s: %v", q.request.Question[0].Name, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		q.response.Answer = nil
+		return q.response
+	}
+
+	switch {
+	case verdict.drop:
+		return nil
+	case verdict.answered:
+		response.Rcode = verdict.rcode
+		response.Answer = verdict.answers
+	}
+
+	return response
+}
+
+// routeLua relays a query to the upstreams of the route query_received
+// sent it to.
+func (s *dnsServer) routeLua(q *query, route string) *dns.Msg {
+	upstreams, ok := s.config.Lua.Routes[route]
+	if !ok {
+		log.Printf("Lua hook routed %s to unknown route %s", q.request.Question[0].Name, route)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	}
+
+	remote, err := s.forward(q.request, upstreams)
+	if err != nil {
+		log.Printf("Failed to relay DNS query to route %s: %v", route, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	}
+
+	// The server is not authoritative for answers it relays
+	remote.Authoritative = false
+	return remote
+}
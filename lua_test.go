@@ -0,0 +1,142 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+const luaTestScript = `
+function query_received(query)
+  if query.name == "dropped.lan." then
+    return "DROP"
+  end
+  if query.name == "blocked.lan." then
+    return "nxdomain"
+  end
+  if query.name == "answered.lan." and query.client == "192.168.1.20" then
+    return {answers = {query.name .. " 60 IN A 10.0.0.1"}}
+  end
+  if query.name == "broken.lan." then
+    error("broken")
+  end
+end
+
+function before_response(query, response)
+  if query.name == "rewritten.lan." then
+    for i, answer in ipairs(response.answers) do
+      response.answers[i] = string.gsub(answer, "192%.168%.1%.10", "10.0.0.10")
+    end
+    return response
+  end
+  if query.name == "refused.lan." then
+    return {rcode = "REFUSED", answers = {}}
+  end
+end
+`
+
+// luaTestServer returns a server running the test script.
+func luaTestServer(t *testing.T) *dnsServer {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.Lua.Enabled = true
+	config.Lua.Script = filepath.Join(t.TempDir(), "hooks.lua")
+	err := os.WriteFile(config.Lua.Script, []byte(luaTestScript), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = config.Lua.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &dnsServer{config: config}
+}
+
+func TestLuaHandler(t *testing.T) {
+	s := luaTestServer(t)
+
+	tests := []struct {
+		name    string
+		dropped bool
+		rcode   int
+		answers []string
+		passed  bool
+	}{
+		{name: "dropped.lan.", dropped: true},
+		{name: "blocked.lan.", rcode: dns.RcodeNameError},
+		{name: "answered.lan.", answers: []string{"answered.lan.\t60\tIN\tA\t10.0.0.1"}},
+		{name: "broken.lan.", rcode: dns.RcodeServerFailure},
+		{name: "rewritten.lan.", answers: []string{"rewritten.lan.\t60\tIN\tA\t10.0.0.10"}, passed: true},
+		{name: "refused.lan.", rcode: dns.RcodeRefused, passed: true},
+		{name: "other.lan.", answers: []string{"other.lan.\t60\tIN\tA\t192.168.1.10"}, passed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := new(dns.Msg)
+			request.SetQuestion(test.name, dns.TypeA)
+			response := new(dns.Msg)
+			response.SetReply(request)
+			q := &query{request: request, response: response, client: net.ParseIP("192.168.1.20")}
+
+			passed := false
+			got := s.luaHandler(q, func() *dns.Msg {
+				passed = true
+				rr, _ := dns.NewRR(test.name + " 60 IN A 192.168.1.10")
+				q.response.Answer = append(q.response.Answer, rr)
+				return q.response
+			})
+
+			if passed != test.passed {
+				t.Fatalf("got passed on %t, want %t", passed, test.passed)
+			}
+			if test.dropped {
+				if got != nil {
+					t.Fatalf("got response %v, want it dropped", got)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("response dropped")
+			}
+			if got.Rcode != test.rcode {
+				t.Fatalf("got rcode %s, want %s", dns.RcodeToString[got.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if len(got.Answer) != len(test.answers) {
+				t.Fatalf("got answers %v, want %q", got.Answer, test.answers)
+			}
+			for i, rr := range got.Answer {
+				if rr.String() != test.answers[i] {
+					t.Fatalf("got answers %v, want %q", got.Answer, test.answers)
+				}
+			}
+		})
+	}
+}
+
+func TestLuaScriptRestricted(t *testing.T) {
+	for _, script := range []string{
+		`io.open("/etc/passwd")`,
+		`os.execute("true")`,
+		`dofile("/etc/passwd")`,
+		`while true do end`,
+	} {
+		t.Run(script, func(t *testing.T) {
+			config := DefaultConfig().Lua
+			config.Script = filepath.Join(t.TempDir(), "hooks.lua")
+			err := os.WriteFile(config.Script, []byte(script), 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if err := config.parse(); err == nil {
+				t.Fatal("script ran")
+			}
+		})
+	}
+}
@@ -1,200 +1,331 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/miekg/dns"
-	"gopkg.in/yaml.v2"
 )
 
-// DNSRecord represents a DNS record.
-type DNSRecord struct {
-	Hostname string `yaml:"hostname"`
-	IP       string `yaml:"ip"`
-}
-
-// DNSRecords represents a collection of DNS records.
-type DNSRecords struct {
-	Records []DNSRecord `yaml:"records"`
-}
-
-// LoadRecords loads DNS records from a YAML file.
-func LoadRecords(filename string) (*DNSRecords, error) {
-	file, err := os.Open(filename)
-	if err != nil {
-		return nil, err
+func main() {
+	configFile := flag.String("config", "lacuna.yaml", "path to the server configuration file")
+	check := flag.Bool("t", false, "check the configuration and records files and exit")
+	exportServer := flag.String("server", "", "address of the running server to export zones from, by default its first listen address")
+	exportKey := flag.String("key", "", "name of the TSIG key to sign zone exports with")
+	flag.Parse()
+
+	// Subcommands take the same flags after their name
+	command := flag.Arg(0)
+	if command != "" {
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	switch {
+	case *check || command == "check":
+		if !checkFiles(*configFile) {
+			os.Exit(1)
+		}
+		return
+	case command == "import":
+		err := importRecords(*configFile, flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to import records: %v", err)
+		}
+		return
+	case command == "export":
+		err := exportZone(*configFile, *exportServer, *exportKey, flag.Arg(0))
+		if err != nil {
+			log.Fatalf("Failed to export zone: %v", err)
+		}
+		return
+	case command != "":
+		log.Fatalf("Unknown command %q", command)
 	}
-	defer file.Close()
 
-	decoder := yaml.NewDecoder(file)
-	records := &DNSRecords{}
-	err = decoder.Decode(records)
+	// Load the server configuration
+	config, err := LoadConfig(*configFile)
 	if err != nil {
-		return nil, err
+		log.Fatalf("Failed to load config: %v", err)
 	}
 
-	return records, nil
-}
+	// Download the records file if it is published elsewhere
+	if config.Download.Enabled {
+		err = config.download()
+		if err != nil {
+			log.Fatalf("Failed to load DNS records: %v", err)
+		}
+	}
 
-// SaveRecords saves DNS records to a YAML file.
-func SaveRecords(filename string, records *DNSRecords) error {
-	file, err := os.Create(filename)
-	if err != nil {
-		return err
+	// Check out the repository the records are kept in
+	if config.Git.Enabled {
+		err = config.Git.checkout()
+		if err != nil {
+			log.Fatalf("Failed to check out the records repository: %v", err)
+		}
 	}
-	defer file.Close()
 
-	encoder := yaml.NewEncoder(file)
-	err = encoder.Encode(records)
+	// Load the DNS records from the records file or database
+	records, err := LoadRecords(config)
 	if err != nil {
-		return err
+		log.Fatalf("Failed to load DNS records: %v", err)
 	}
-
-	return nil
-}
-
-func main() {
-	// Path to the YAML file
-	filename := "dns_records.yaml"
-
-	// Load the DNS records from the YAML file
-	records, err := LoadRecords(filename)
+	err = config.checkKeys(records)
 	if err != nil {
 		log.Fatalf("Failed to load DNS records: %v", err)
 	}
 
 	// Start the DNS server
 	server := &dnsServer{
-		records: records,
+		config:     config,
+		configFile: *configFile,
+		cache:      newResponseCache(config.CacheSize, config.staleWindow(), config.PrefetchHits),
+		chain:      append([]chainHandler{}, defaultChain...),
+		pushes:     make(chan zonePush, pushQueueSize),
+		watchers:   map[chan []recordChange]bool{},
+		started:    time.Now(),
+	}
+	server.records.Store(records)
+	if config.Recursive {
+		server.recursor = newRecursor(config.RootHints)
+	}
+	if config.DNSSEC.Validate {
+		anchors, err := newTrustAnchors(config.DNSSEC.TrustAnchors, config.DNSSEC.TrustAnchorFile)
+		if err != nil {
+			log.Fatalf("Failed to load trust anchors: %v", err)
+		}
+		log.Printf("Validating DNSSEC from trust anchors for %s", anchors)
+		server.validator = newValidator(anchors, server.resolveUpstream)
+	}
+	if config.HealthCheck.Enabled {
+		server.health = newHealthChecker(config.HealthCheck)
+	}
+	if config.Filter.Enabled {
+		config.Filter.subscriptions.refresh(config.Filter.listURLs())
+		filter, err := loadFilter(&config.Filter)
+		if err != nil {
+			log.Fatalf("Failed to load the filter lists: %v", err)
+		}
+		server.filter.Store(filter)
+	}
+	if config.Lua.Enabled {
+		// The hooks see every query first and every response last
+		err = server.registerHandler("lua", "rewrite", (*dnsServer).luaHandler)
+		if err != nil {
+			log.Fatalf("Failed to load the Lua script: %v", err)
+		}
+	}
+	if config.WASM.Enabled {
+		// The plugin sees the queries local names and the filter lists
+		// leave, ahead of the other backends
+		err = server.registerHandler("wasm", "consul", (*dnsServer).wasmHandler)
+		if err != nil {
+			log.Fatalf("Failed to load the wasm plugin: %v", err)
+		}
 	}
 	server.Run()
 }
 
 type dnsServer struct {
-	records *DNSRecords
+	config     *Config
+	configFile string
+
+	// records holds the records being served. Changes to them, such as
+	// secondary zones being refreshed, build a new set of records that
+	// replaces the old one, serialized by updateMu.
+	records  atomic.Pointer[DNSRecords]
+	updateMu sync.Mutex
+
+	// refreshes wakes the refresh loop of each secondary zone, by origin.
+	// Zones are added and removed as records are reloaded, guarded by
+	// refreshMu.
+	refreshes map[string]chan struct{}
+	refreshMu sync.Mutex
+
+	// recursor resolves non-local names from the root servers when
+	// recursive mode is enabled, in place of forwarding.
+	recursor *recursor
+
+	// validator checks the DNSSEC signatures of non-local answers when
+	// validation is enabled.
+	validator *validator
+
+	// health tracks which upstreams are answering their health checks,
+	// when health checking is enabled.
+	health *healthChecker
+
+	// cache holds responses to non-local queries until they expire.
+	cache *responseCache
+
+	// filter holds the names blocked by the blocklists, when filtering is
+	// enabled, replaced as the lists are reloaded.
+	filter atomic.Pointer[filter]
+
+	// policy holds the rules of the response policy zones, built from the
+	// records being served by the first query after they change, guarded
+	// by policyMu.
+	policy   atomic.Pointer[policySet]
+	policyMu sync.Mutex
+
+	// chain is the chain of handlers queries pass through, in order.
+	chain []chainHandler
+
+	// pushes are the updates waiting to be pushed to the servers zones
+	// are pushed to.
+	pushes chan zonePush
+
+	// rotation is incremented for every local answer to rotate the order
+	// of records sharing a name.
+	rotation uint64
+
+	// watchers are sent the changes to the records served, one for each
+	// client of the gRPC API watching them, guarded by watchMu.
+	watchers map[chan []recordChange]bool
+	watchMu  sync.Mutex
+
+	// started is when the server started, and queries counts the queries
+	// it has been sent.
+	started time.Time
+	queries atomic.Uint64
 }
 
-func (s *dnsServer) handleRequest(conn *net.UDPConn, addr *net.UDPAddr, buf []byte) {
+// handleRequest answers a single packed DNS query from client and returns
+// the packed response, or nil if no response should be sent. It is shared by
+// every transport the server listens on, with udp set when the response must
+// fit within the client's UDP payload size.
+func (s *dnsServer) handleRequest(buf []byte, client net.Addr, udp bool) []byte {
 	// Create a new DNS message
 	request := new(dns.Msg)
 
-	log.Printf("Received new request: %v", request)
-
 	// Parse the DNS query
 	err := request.Unpack(buf)
 	if err != nil {
 		log.Printf("Failed to parse DNS query: %v", err)
-		return
+		return nil
 	}
 
 	// Check if the message contains any question
 	if len(request.Question) == 0 {
 		log.Printf("Received DNS message with no question")
-		return
+		return nil
 	}
 
-	// Get the first question from the message
-	question := request.Question[0]
-
-	log.Printf("Searching for recrod: %v", question)
-
-	// Search for the corresponding DNS record
-	var record DNSRecord
-	for _, r := range s.records.Records {
-		log.Printf("Comparing record: %v", r)
-
-		if r.Hostname == question.Name {
-			record = r
-			break
-		}
+	// NOTIFY and dynamic updates change the local zones, and are signed
+	// like zone transfers
+	if request.Opcode == dns.OpcodeNotify {
+		return s.handleNotify(buf, request, addrIP(client))
 	}
-
-	// Create a new DNS message for the response
-	response := new(dns.Msg)
-	response.SetReply(request)
-
-	if record.Hostname != "" {
-		// If a record was found, add it as an answer
-		ip := net.ParseIP(record.IP)
-		if ip == nil {
-			log.Printf("Invalid IP address for hostname %s", record.Hostname)
-			return
-		}
-
-		answer := new(dns.A)
-		answer.Hdr = dns.RR_Header{
-			Name:   question.Name,
-			Rrtype: dns.TypeA,
-			Class:  dns.ClassINET,
-			Ttl:    300, // Time-to-live in seconds
-		}
-		answer.A = ip
-
-		response.Answer = append(response.Answer, answer)
+	if request.Opcode == dns.OpcodeUpdate {
+		return s.handleUpdate(buf, request, addrIP(client))
+	}
+	s.queries.Add(1)
+
+	var response *dns.Msg
+	if opt := request.IsEdns0(); opt != nil && opt.Version() != 0 {
+		// Only EDNS version 0 is supported
+		response = new(dns.Msg)
+		response.SetRcode(request, dns.RcodeBadVers)
+	} else if request.Opcode != dns.OpcodeQuery {
+		// The other opcodes are not supported
+		response = new(dns.Msg)
+		response.SetRcode(request, dns.RcodeNotImplemented)
+	} else if isTransfer(request) {
+		// Zone transfers are only served over TCP
+		response = new(dns.Msg)
+		response.SetRcode(request, dns.RcodeRefused)
+	} else if request.Question[0].Qclass != dns.ClassINET {
+		response = s.answerChaos(request)
 	} else {
-		// If no record was found, relay the query to another DNS server
-		client := new(dns.Client)
-		response, _, err := client.Exchange(request, "8.8.8.8:53") // Replace with the desired DNS server address
-		if err != nil {
-			log.Printf("Failed to relay DNS query: %v", err)
-			return
+		response = s.resolve(request, addrIP(client))
+		if response == nil {
+			return nil
 		}
+	}
+	response.RecursionAvailable = s.recursionAvailable()
 
-		msg, err := response.Pack()
-
-		if err != nil {
-			log.Printf("Failed to pack the DNS response: %v", err)
-			return
-		}
+	s.setResponseEDNS(request, response)
 
-		// Send the DNS response back to the client
-		_, err = conn.WriteToUDP(msg, addr)
-		if err != nil {
-			log.Printf("Failed to send DNS response: %v", err)
-			return
-		}
+	// Make sure the response fits in what the client can receive. Truncate
+	// sets the TC bit when records had to be dropped, telling the client to
+	// retry over TCP where the full answer is served.
+	if udp {
+		response.Truncate(s.udpPayloadSize(request))
 	}
 
 	// Encode the DNS response
 	outBuf, err := response.Pack()
 	if err != nil {
 		log.Printf("Failed to encode DNS response: %v", err)
-		return
-	}
 
-	// Send the DNS response back to the client
-	_, err = conn.WriteToUDP(outBuf, addr)
-	if err != nil {
-		log.Printf("Failed to send DNS response: %v", err)
-		return
+		// Let the client know rather than leaving it to time out
+		failure := new(dns.Msg)
+		failure.SetRcode(request, dns.RcodeServerFailure)
+		outBuf, err = failure.Pack()
+		if err != nil {
+			return nil
+		}
 	}
+
+	return outBuf
+}
+
+// resolve builds the response to a parsed DNS query from the client at the
+// given address, or returns nil if no response should be sent, passing it
+// through the server's chain of handlers.
+func (s *dnsServer) resolve(request *dns.Msg, client net.IP) *dns.Msg {
+	// Create a new DNS message for the response
+	response := new(dns.Msg)
+	response.SetReply(request)
+
+	return s.handle(&query{request: request, response: response, client: client}, 0)
+}
+
+// recursionAvailable reports whether the server resolves non-local names,
+// which it signals to clients with the RA flag.
+func (s *dnsServer) recursionAvailable() bool {
+	return s.recursor != nil || len(s.config.Upstreams) > 0 || len(s.config.ForwardRules) > 0
 }
 
 func (s *dnsServer) Run() {
-	// Set up the UDP listener
-	addr := net.UDPAddr{
-		Port: 53,
-		IP:   net.ParseIP("0.0.0.0"),
-	}
-	conn, err := net.ListenUDP("udp", &addr)
-	if err != nil {
-		log.Fatalf("Failed to set up UDP listener: %v", err)
+	s.sendWebhooks()
+	s.pushZones()
+	s.followSecondaries()
+	s.reloadOnHangup()
+	s.expireRecords()
+	s.rollSigningKeys()
+	s.pollDatabase()
+	s.refreshLists()
+	s.watchStores()
+	s.followRepository()
+	s.followDownload()
+	s.serveAPI()
+	s.serveGRPC()
+	s.watchPlugin()
+	if s.config.WatchFiles {
+		s.watchFiles()
 	}
-	defer conn.Close()
 
-	log.Println("DNS server is running")
-
-	// Start listening for DNS queries
-	buf := make([]byte, 512)
-	for {
-		n, addr, err := conn.ReadFromUDP(buf)
+	// Sockets passed by systemd take the place of the configured listeners
+	if files := activationFiles(); len(files) > 0 {
+		err := s.serveActivated(files)
 		if err != nil {
-			log.Printf("Error while reading from UDP: %v", err)
-			continue
+			log.Fatalf("Failed to serve activated sockets: %v", err)
 		}
+	} else {
+		s.listen()
+	}
 
-		go s.handleRequest(conn, addr, buf[:n])
+	if s.health != nil {
+		s.health.Start(s.config.allUpstreams())
 	}
+
+	s.notifySecondaries()
+
+	log.Println("DNS server is running")
+
+	// The listeners run until the process exits
+	select {}
 }
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/ipv4"
+)
+
+// mdnsAddress is the IPv4 multicast group and port of multicast DNS.
+var mdnsAddress = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// MDNSConfig resolves names under Domains that are not local by asking the
+// LAN with multicast DNS (RFC 6762), so that clients without mDNS of their
+// own can reach devices advertised by Avahi or Bonjour.
+type MDNSConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Domains are the names resolved with mDNS, local. by default. Reverse
+	// zones such as 168.192.in-addr.arpa. may be added to resolve the
+	// names of addresses on the LAN.
+	Domains []string `yaml:"domains"`
+
+	// Interface is the network interface the queries are sent on, rather
+	// than the one the system chooses for multicast.
+	Interface string `yaml:"interface"`
+
+	// Timeout is how long to wait for a device to answer before the name
+	// is taken not to exist.
+	Timeout time.Duration `yaml:"timeout"`
+
+	iface *net.Interface
+}
+
+// parse validates the interface and timeout and canonicalises the domains.
+func (c *MDNSConfig) parse() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid mdns timeout %v", c.Timeout)
+	}
+	if c.Interface != "" {
+		iface, err := net.InterfaceByName(c.Interface)
+		if err != nil {
+			return fmt.Errorf("invalid mdns interface %q: %v", c.Interface, err)
+		}
+		c.iface = iface
+	}
+
+	for i, domain := range c.Domains {
+		c.Domains[i] = dns.CanonicalName(domain)
+	}
+	return nil
+}
+
+// covers reports whether name is resolved with mDNS.
+func (c *MDNSConfig) covers(name string) bool {
+	for _, domain := range c.Domains {
+		if dns.IsSubDomain(domain, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queryMDNS asks the LAN for the answer to a question with a one-shot
+// query from a port other than 5353, which responders answer directly with
+// a conventional unicast response (RFC 6762 section 6.7). It returns the
+// first response holding answers, or nil if none arrives in time.
+func (c *MDNSConfig) queryMDNS(question dns.Question) (*dns.Msg, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if c.iface != nil {
+		err = ipv4.NewPacketConn(conn).SetMulticastInterface(c.iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(question.Name, question.Qtype)
+	query.RecursionDesired = false
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.WriteToUDP(packed, mdnsAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return nil, nil
+			}
+			return nil, err
+		}
+
+		response := new(dns.Msg)
+		if response.Unpack(buf[:n]) != nil || !response.Response || response.Id != query.Id || len(response.Answer) == 0 {
+			continue
+		}
+		return response, nil
+	}
+}
+
+// mdnsHandler asks the LAN for the names resolved with mDNS, such as those
+// under local.
+func (s *dnsServer) mdnsHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	if !s.config.MDNS.Enabled || !s.config.MDNS.covers(q.request.Question[0].Name) {
+		return next()
+	}
+
+	s.answerMDNS(q.request, q.response)
+	return q.response
+}
+
+// answerMDNS answers a query for a name that is not local with what the
+// devices of the LAN answer over mDNS, and with NXDOMAIN should none
+// answer in time. The cache-flush bit responders may set in the class of
+// their records is cleared before they are relayed.
+func (s *dnsServer) answerMDNS(request *dns.Msg, response *dns.Msg) {
+	question := request.Question[0]
+	answer, err := s.config.MDNS.queryMDNS(question)
+	if err != nil {
+		log.Printf("Failed to resolve %s with mDNS: %v", question.Name, err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+	if answer == nil {
+		response.Rcode = dns.RcodeNameError
+		return
+	}
+
+	for _, section := range [][]dns.RR{answer.Answer, answer.Extra} {
+		for _, rr := range section {
+			rr.Header().Class &^= 1 << 15
+		}
+	}
+	for _, rr := range answer.Answer {
+		if rr.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY || rr.Header().Rrtype == dns.TypeCNAME {
+			response.Answer = append(response.Answer, rr)
+		}
+	}
+	for _, rr := range answer.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Rrtype != dns.TypeNSEC {
+			response.Extra = append(response.Extra, rr)
+		}
+	}
+}
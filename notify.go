@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// notifyAttempts is how many times a NOTIFY is sent to a secondary that
+// does not acknowledge it, and notifyTimeout how long each attempt waits.
+const (
+	notifyAttempts = 5
+	notifyTimeout  = 2 * time.Second
+)
+
+// notifySecondaries tells the secondaries of every zone that the zone may
+// have changed, as it may have while the server was not running.
+func (s *dnsServer) notifySecondaries() {
+	for _, zone := range s.records.Load().Zones {
+		if len(zone.Notify) > 0 && !zone.expired {
+			s.notifyZone(zone.Origin)
+		}
+	}
+}
+
+// notifyZone sends a NOTIFY (RFC 1996) for a zone to each of its
+// secondaries, so that they refresh it without waiting for their refresh
+// timers.
+func (s *dnsServer) notifyZone(origin string) {
+	zone := s.records.Load().FindZone(origin)
+
+	var key *TSIGKey
+	if zone.TransferKey != "" {
+		key = s.config.tsigKey(zone.TransferKey)
+	}
+
+	for _, secondary := range zone.Notify {
+		go notify(upstreamAddress(secondary), zone.SOARR(), key)
+	}
+}
+
+// notify sends a NOTIFY carrying a zone's SOA record to a secondary,
+// retrying until the secondary acknowledges it.
+func notify(secondary string, soa *dns.SOA, key *TSIGKey) {
+	client := &dns.Client{Timeout: notifyTimeout}
+	if key != nil {
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	var err error
+	for attempt := 0; attempt < notifyAttempts; attempt++ {
+		msg := new(dns.Msg)
+		msg.SetNotify(soa.Hdr.Name)
+		msg.Answer = []dns.RR{soa}
+		if key != nil {
+			msg.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+		}
+
+		var response *dns.Msg
+		response, _, err = client.Exchange(msg, secondary)
+		if err == nil && response.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("NOTIFY answered with %s", dns.RcodeToString[response.Rcode])
+		}
+		if err == nil {
+			log.Printf("Notified %s of zone %s at serial %d", secondary, soa.Hdr.Name, soa.Serial)
+			return
+		}
+
+		time.Sleep(notifyTimeout)
+	}
+
+	log.Printf("Failed to notify %s of zone %s: %v", secondary, soa.Hdr.Name, err)
+}
+
+// handleNotify answers a NOTIFY for a secondary zone from one of its
+// primaries, refreshing the zone straight away. NOTIFY from anyone else is
+// refused, and one for a zone with a transfer key must be signed with it.
+func (s *dnsServer) handleNotify(buf []byte, request *dns.Msg, client net.IP) []byte {
+	name := dns.CanonicalName(request.Question[0].Name)
+	zone := s.records.Load().FindZone(name)
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Authoritative = true
+
+	var status *tsigStatus
+	var err error
+	switch {
+	case zone == nil || zone.Origin != name || len(zone.Primaries) == 0:
+		response.Rcode = dns.RcodeNotAuth
+		err = fmt.Errorf("not a secondary zone")
+	case !zone.isPrimary(client):
+		response.Rcode = dns.RcodeRefused
+		err = fmt.Errorf("not a primary of the zone")
+	default:
+		status, response.Rcode, err = s.verifyKey(zone.TransferKey, buf, request)
+	}
+
+	if err != nil {
+		log.Printf("Refused NOTIFY of %s from %s: %v", name, client, err)
+	} else {
+		log.Printf("Received NOTIFY of %s from %s", name, client)
+		s.triggerRefresh(name)
+	}
+
+	return packResponse(response, status)
+}
+
+// isPrimary reports whether an address is one of the zone's primaries.
+func (z *Zone) isPrimary(ip net.IP) bool {
+	for _, primary := range z.Primaries {
+		host, _, err := net.SplitHostPort(upstreamAddress(primary))
+		if err == nil && net.ParseIP(host).Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// triggerRefresh wakes a secondary zone's refresh loop to check its
+// primaries straight away.
+func (s *dnsServer) triggerRefresh(origin string) {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	select {
+	case s.refreshes[origin] <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// overlayTimeout is how long reading the status of Tailscale may take.
+const overlayTimeout = 10 * time.Second
+
+// Sources of the peers of an overlay network.
+const (
+	overlayTailscale = "tailscale"
+	overlayWireGuard = "wireguard"
+)
+
+// OverlayConfig publishes the peers of a Tailscale or WireGuard overlay
+// network in Zone.
+type OverlayConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Source is where the peers are read from: "tailscale" or "wireguard".
+	Source string `yaml:"source"`
+
+	// Socket is the socket of the local API of tailscaled.
+	Socket string `yaml:"socket"`
+
+	// WireGuardFile is a WireGuard configuration, such as
+	// /etc/wireguard/wg0.conf, whose [Peer] sections are named by a
+	// "# Name = laptop" comment. Peers without a name are left out.
+	WireGuardFile string `yaml:"wireguard_file"`
+
+	// Zone holds the name of each peer, name.zone.
+	Zone string `yaml:"zone"`
+
+	// Interval is how often the peers are read again for changes. Zero
+	// reads them only when the records are reloaded.
+	Interval time.Duration `yaml:"interval"`
+}
+
+// parse validates the source of the peers and canonicalises the zone.
+func (c *OverlayConfig) parse() error {
+	switch c.Source {
+	case overlayTailscale:
+		if c.Socket == "" {
+			return fmt.Errorf("overlay needs the tailscaled socket")
+		}
+	case overlayWireGuard:
+		if c.WireGuardFile == "" {
+			return fmt.Errorf("overlay needs a wireguard_file")
+		}
+	default:
+		return fmt.Errorf("unsupported overlay source %q", c.Source)
+	}
+	if c.Zone == "" {
+		return fmt.Errorf("overlay needs a zone")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid overlay interval %v", c.Interval)
+	}
+
+	c.Zone = dns.CanonicalName(c.Zone)
+	return nil
+}
+
+// overlayPeer is a machine of the overlay network and its addresses on it.
+type overlayPeer struct {
+	name string
+	ips  []string
+}
+
+func (c *OverlayConfig) Put(record DNSRecord) error {
+	return errPublished
+}
+
+func (c *OverlayConfig) Delete(record DNSRecord) error {
+	return errPublished
+}
+
+// List returns the records of the peers of the overlay network.
+func (c *OverlayConfig) List() ([]DNSRecord, error) {
+	var peers []overlayPeer
+	var err error
+	if c.Source == overlayTailscale {
+		peers, err = c.tailscalePeers()
+	} else {
+		peers, err = readWireGuardPeers(c.WireGuardFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records []DNSRecord
+	for _, peer := range peers {
+		label := overlayLabel(peer.name)
+		if label == "" {
+			continue
+		}
+		for _, ip := range peer.ips {
+			records = append(records, DNSRecord{Hostname: label + "." + c.Zone, IP: ip})
+		}
+	}
+
+	return records, nil
+}
+
+// overlayLabel turns the name of a peer into a label of the zone,
+// lowercasing it and replacing what a hostname may not hold with hyphens.
+func overlayLabel(name string) string {
+	label := []byte(strings.ToLower(strings.TrimSpace(name)))
+	for i, c := range label {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') {
+			label[i] = '-'
+		}
+	}
+
+	return strings.Trim(string(label), "-")
+}
+
+// tailscaleStatus is the part of the status of tailscaled naming the
+// machine itself and its peers.
+type tailscaleStatus struct {
+	Self *tailscalePeer           `json:"Self"`
+	Peer map[string]tailscalePeer `json:"Peer"`
+}
+
+// tailscalePeer is a machine of the tailnet.
+type tailscalePeer struct {
+	HostName     string   `json:"HostName"`
+	DNSName      string   `json:"DNSName"`
+	TailscaleIPs []string `json:"TailscaleIPs"`
+}
+
+// tailscalePeers reads the machine itself and its peers from the local API
+// of tailscaled, in a stable order. Each is named by the first label of its
+// MagicDNS name, falling back to its hostname.
+func (c *OverlayConfig) tailscalePeers() ([]overlayPeer, error) {
+	client := &http.Client{
+		Timeout: overlayTimeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", c.Socket)
+			},
+		},
+	}
+	response, err := client.Get("http://local-tailscaled.sock/localapi/v0/status")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tailscaled answered %s", response.Status)
+	}
+
+	var status tailscaleStatus
+	err = json.NewDecoder(response.Body).Decode(&status)
+	if err != nil {
+		return nil, err
+	}
+
+	machines := make([]tailscalePeer, 0, len(status.Peer)+1)
+	if status.Self != nil {
+		machines = append(machines, *status.Self)
+	}
+	keys := make([]string, 0, len(status.Peer))
+	for key := range status.Peer {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		machines = append(machines, status.Peer[key])
+	}
+
+	var peers []overlayPeer
+	for _, machine := range machines {
+		name := machine.HostName
+		if labels := dns.SplitDomainName(machine.DNSName); len(labels) > 0 {
+			name = labels[0]
+		}
+		peers = append(peers, overlayPeer{name: name, ips: machine.TailscaleIPs})
+	}
+
+	return peers, nil
+}
+
+// readWireGuardPeers reads the named peers of a WireGuard configuration,
+// with the host addresses among their AllowedIPs, the ones the peers hold
+// on the tunnel.
+func readWireGuardPeers(file string) ([]overlayPeer, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var peers []overlayPeer
+	var peer *overlayPeer
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "[") {
+			peer = nil
+			if strings.EqualFold(line, "[Peer]") {
+				peers = append(peers, overlayPeer{})
+				peer = &peers[len(peers)-1]
+			}
+			continue
+		}
+		if peer == nil {
+			continue
+		}
+
+		key, value, ok := strings.Cut(strings.TrimLeft(line, "# "), "=")
+		if !ok {
+			continue
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(line, "#") && strings.EqualFold(key, "Name"):
+			peer.name = value
+		case !strings.HasPrefix(line, "#") && strings.EqualFold(key, "AllowedIPs"):
+			for _, allowed := range strings.Split(value, ",") {
+				prefix, err := netip.ParsePrefix(strings.TrimSpace(allowed))
+				if err == nil && prefix.IsSingleIP() {
+					peer.ips = append(peer.ips, prefix.Addr().String())
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return peers, nil
+}
+
+// Watch reads the peers of the overlay network every Interval, announcing a
+// change when they differ from the last read. The peers are not followed
+// with no Interval.
+func (c *OverlayConfig) Watch(changed func()) error {
+	if c.Interval == 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		last, err := c.List()
+		if err != nil {
+			log.Printf("Failed to read the overlay network peers: %v", err)
+		}
+		for range ticker.C {
+			records, err := c.List()
+			if err != nil {
+				log.Printf("Failed to read the overlay network peers: %v", err)
+				continue
+			}
+			if reflect.DeepEqual(records, last) {
+				continue
+			}
+			last = records
+			changed()
+		}
+	}()
+
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// maxIdleConns is the most idle connections kept open to each upstream for
+// reuse.
+const maxIdleConns = 4
+
+// connPools holds the pool of connections to each TCP and DNS-over-TLS
+// upstream, keyed by its address.
+var connPools = struct {
+	sync.Mutex
+	pools map[string]*connPool
+}{
+	pools: map[string]*connPool{},
+}
+
+// connPool keeps connections to a TCP or DNS-over-TLS upstream open between
+// queries, so that they do not each pay for a new handshake. With EDNS the
+// upstream is asked to keep connections open (RFC 7828), and an idle
+// connection is closed once it has been idle for the shorter of the
+// upstream's timeout and our own.
+type connPool struct {
+	address     string
+	tls         *tls.Config
+	idleTimeout time.Duration
+
+	mu   sync.Mutex
+	idle []idleConn
+}
+
+// idleConn is a pooled connection and when it is to be closed.
+type idleConn struct {
+	conn    *dns.Conn
+	expires time.Time
+}
+
+// poolFor returns the connection pool for an upstream, which is a plain
+// host:port reached over TCP or a tls:// address. Connections are only
+// kept open if the upstream has an idle timeout.
+func poolFor(upstream Upstream) *connPool {
+	connPools.Lock()
+	defer connPools.Unlock()
+
+	pool, ok := connPools.pools[upstream.Address]
+	if !ok {
+		pool = newConnPool(upstream)
+		connPools.pools[upstream.Address] = pool
+	}
+
+	return pool
+}
+
+// newConnPool creates the pool for an upstream. A tls:// upstream may be
+// followed by #servername to give the name its certificate is verified
+// against when its host is an address.
+func newConnPool(upstream Upstream) *connPool {
+	pool := &connPool{address: upstream.Address, idleTimeout: upstream.IdleTimeout}
+	if !strings.HasPrefix(upstream.Address, schemeTLS) {
+		return pool
+	}
+
+	address, name, _ := strings.Cut(strings.TrimPrefix(upstream.Address, schemeTLS), "#")
+	if name == "" {
+		name, _, _ = net.SplitHostPort(address)
+	}
+	pool.address = address
+	pool.tls = &tls.Config{ServerName: name, MinVersion: tls.VersionTLS12}
+
+	return pool
+}
+
+// Exchange sends a query over an idle connection if there is one, falling
+// back to a new connection if the idle one has been closed by the server.
+func (p *connPool) Exchange(ctx context.Context, request *dns.Msg) (*dns.Msg, error) {
+	if conn := p.take(); conn != nil {
+		response, err := p.exchangeOn(ctx, conn, request)
+		if err == nil {
+			return response, nil
+		}
+		conn.Close()
+	}
+
+	conn, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := p.exchangeOn(ctx, conn, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return response, nil
+}
+
+// dial opens a new connection to the upstream.
+func (p *connPool) dial(ctx context.Context) (*dns.Conn, error) {
+	dialer := &net.Dialer{Timeout: encryptedTimeout}
+	if p.tls == nil {
+		netConn, err := dialer.DialContext(ctx, "tcp", p.address)
+		if err != nil {
+			return nil, err
+		}
+		return &dns.Conn{Conn: netConn}, nil
+	}
+
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: p.tls}
+	netConn, err := tlsDialer.DialContext(ctx, "tcp", p.address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &dns.Conn{Conn: netConn}, nil
+}
+
+// exchangeOn sends a query over a connection and returns it to the pool
+// once the answer has been read.
+func (p *connPool) exchangeOn(ctx context.Context, conn *dns.Conn, request *dns.Msg) (*dns.Msg, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(encryptedTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	query := request
+	if opt := request.IsEdns0(); opt != nil && p.idleTimeout > 0 {
+		// Ask the upstream to keep the connection open (RFC 7828)
+		query = request.Copy()
+		opt = query.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_TCP_KEEPALIVE{Code: dns.EDNS0TCPKEEPALIVE})
+	}
+
+	err := conn.WriteMsg(query)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := conn.ReadMsg()
+	if err != nil {
+		return nil, err
+	}
+	if response.Id != request.Id {
+		return nil, dns.ErrId
+	}
+
+	p.put(conn, p.keepalive(response))
+	return response, nil
+}
+
+// keepalive returns how long a connection may be kept idle after the given
+// response, removing any keepalive option from it since the option only
+// concerns this connection.
+func (p *connPool) keepalive(response *dns.Msg) time.Duration {
+	timeout := p.idleTimeout
+
+	opt := response.IsEdns0()
+	if opt == nil {
+		return timeout
+	}
+
+	var options []dns.EDNS0
+	for _, option := range opt.Option {
+		keepalive, ok := option.(*dns.EDNS0_TCP_KEEPALIVE)
+		if !ok {
+			options = append(options, option)
+			continue
+		}
+
+		// The upstream's timeout is given in units of 100 milliseconds
+		if upstream := time.Duration(keepalive.Timeout) * 100 * time.Millisecond; upstream < timeout {
+			timeout = upstream
+		}
+	}
+	opt.Option = options
+
+	return timeout
+}
+
+// take removes an idle connection from the pool, closing any that have been
+// idle too long, or returns nil if there is none.
+func (p *connPool) take() *dns.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for len(p.idle) > 0 {
+		idle := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if now.Before(idle.expires) {
+			return idle.conn
+		}
+		idle.conn.Close()
+	}
+
+	return nil
+}
+
+// put returns a connection to the pool to be kept open for up to timeout,
+// closing it instead if the pool is full or it is not to be kept.
+func (p *connPool) put(conn *dns.Conn, timeout time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if timeout <= 0 || len(p.idle) >= maxIdleConns {
+		conn.Close()
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, expires: time.Now().Add(timeout)})
+}
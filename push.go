@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// pushTimeout is how long a server may take to answer an update pushed to
+// it.
+const pushTimeout = 5 * time.Second
+
+// pushAttempts is how many times an update is pushed to a server before it
+// is given up on.
+const pushAttempts = 3
+
+// pushQueueSize is how many updates may wait to be pushed before further
+// ones are dropped.
+const pushQueueSize = 100
+
+// pushMessageSize is the size past which the changes to a zone are pushed
+// in another update.
+const pushMessageSize = 16384
+
+// zonePush is an update to a zone to push to the servers named in its
+// PushTo.
+type zonePush struct {
+	origin  string
+	servers []string
+	key     *TSIGKey
+	update  *dns.Msg
+}
+
+// pushRRsets returns the records of a zone keyed by their name and type,
+// leaving out the SOA and apex NS records, which the servers pushed to keep
+// for themselves.
+func pushRRsets(records *DNSRecords, zone *Zone) (map[string][]dns.RR, error) {
+	rrs, err := records.zoneRRs(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	rrsets := map[string][]dns.RR{}
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrtype == dns.TypeSOA || (rrtype == dns.TypeNS && dns.CanonicalName(rr.Header().Name) == zone.Origin) {
+			continue
+		}
+		key := rrsetKey(rr)
+		rrsets[key] = append(rrsets[key], rr)
+	}
+
+	return rrsets, nil
+}
+
+// pushUpdates returns the updates taking a zone from one version of its
+// records to another, each replacing the records of the names and types
+// that differ between them in one go. Every record set is replaced when
+// from is nil.
+func pushUpdates(origin string, from, to map[string][]dns.RR) []*dns.Msg {
+	var keys []string
+	for key, rrs := range to {
+		if from == nil || !sameRRs(from[key], rrs) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range from {
+		if _, ok := to[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var updates []*dns.Msg
+	var update *dns.Msg
+	for _, key := range keys {
+		if update == nil || update.Len() > pushMessageSize {
+			update = new(dns.Msg)
+			update.SetUpdate(origin)
+			updates = append(updates, update)
+		}
+
+		rrs := to[key]
+		if len(rrs) > 0 {
+			update.RemoveRRset(rrs[:1])
+			update.Insert(rrs)
+		} else {
+			update.RemoveRRset(from[key][:1])
+		}
+	}
+
+	return updates
+}
+
+// sameRRs reports whether two sets of records hold the same records.
+func sameRRs(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	return len(missingRRs(a, b)) == 0 && len(missingRRs(b, a)) == 0
+}
+
+// queuePushes queues the updates to the zones with servers to push to that
+// changed between two versions of the records.
+func (s *dnsServer) queuePushes(previous, next *DNSRecords) {
+	for i := range next.Zones {
+		zone := &next.Zones[i]
+		if len(zone.PushTo) == 0 || zone.expired {
+			continue
+		}
+
+		// Zones that were not served before are pushed whole
+		var from map[string][]dns.RR
+		if old := previous.findServedZone(zone.Origin); old != nil {
+			var err error
+			from, err = pushRRsets(previous, old)
+			if err != nil {
+				log.Printf("Failed to push zone %s: %v", zone.Origin, err)
+				continue
+			}
+		}
+		to, err := pushRRsets(next, zone)
+		if err != nil {
+			log.Printf("Failed to push zone %s: %v", zone.Origin, err)
+			continue
+		}
+
+		var key *TSIGKey
+		if zone.PushKey != "" {
+			key = s.config.tsigKey(zone.PushKey)
+		}
+		for _, update := range pushUpdates(zone.Origin, from, to) {
+			select {
+			case s.pushes <- zonePush{origin: zone.Origin, servers: zone.PushTo, key: key, update: update}:
+			default:
+				log.Printf("Dropped an update to zone %s: too many waiting to be pushed", zone.Origin)
+			}
+		}
+	}
+}
+
+// findServedZone returns the zone with the given origin, if the records are
+// given and the zone has records to serve.
+func (r *DNSRecords) findServedZone(origin string) *Zone {
+	if r == nil {
+		return nil
+	}
+	zone := r.FindZone(origin)
+	if zone == nil || zone.Origin != origin || zone.expired {
+		return nil
+	}
+
+	return zone
+}
+
+// pushZones pushes every record of the zones with servers to push to, so
+// that the servers hold the records the zones have now, and starts pushing
+// the changes to them as they are made.
+func (s *dnsServer) pushZones() {
+	s.queuePushes(nil, s.records.Load())
+
+	go func() {
+		for push := range s.pushes {
+			for _, server := range push.servers {
+				err := pushUpdate(upstreamAddress(server), push.update, push.key)
+				if err != nil {
+					log.Printf("Failed to push update of zone %s to %s: %v", push.origin, server, err)
+				}
+			}
+		}
+	}()
+}
+
+// pushUpdate sends an update to a server, signed with key if one is given,
+// retrying until the server accepts it.
+func pushUpdate(server string, update *dns.Msg, key *TSIGKey) error {
+	client := &dns.Client{Net: "tcp", Timeout: pushTimeout}
+	if key != nil {
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+	}
+
+	var err error
+	for attempt := 0; attempt < pushAttempts; attempt++ {
+		msg := update.Copy()
+		msg.Id = dns.Id()
+		if key != nil {
+			msg.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+		}
+
+		var response *dns.Msg
+		response, _, err = client.Exchange(msg, server)
+		if err == nil && response.Rcode != dns.RcodeSuccess {
+			err = fmt.Errorf("UPDATE answered with %s", dns.RcodeToString[response.Rcode])
+		}
+		if err == nil {
+			return nil
+		}
+
+		time.Sleep(pushTimeout)
+	}
+
+	return err
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/quic-go/quic-go"
+)
+
+// QUICConfig configures the optional DNS-over-QUIC listener. It shares the
+// certificate and key of the DNS-over-TLS listener.
+type QUICConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Port is the UDP port the DoQ listener binds to.
+	Port int `yaml:"port"`
+}
+
+// doqInternalError is the DOQ_INTERNAL_ERROR code from RFC 9250 section 4.3,
+// used to reset streams the server cannot answer.
+const doqInternalError quic.StreamErrorCode = 0x1
+
+// listenQUIC sets up the DNS-over-QUIC listener described in RFC 9250.
+func (s *dnsServer) listenQUIC(host string) (*quic.Listener, error) {
+	tlsConfig, err := s.config.TLS.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig.NextProtos = []string{"doq"}
+
+	address := net.JoinHostPort(host, strconv.Itoa(s.config.QUIC.Port))
+	network, err := listenNetwork("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	udpAddr, err := net.ResolveUDPAddr(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP(network, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return quic.Listen(conn, tlsConfig, &quic.Config{
+		MaxIdleTimeout: s.config.TCPTimeout,
+	})
+}
+
+// runQUIC accepts QUIC connections and serves each one on its own goroutine.
+func (s *dnsServer) runQUIC(listener *quic.Listener) {
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Printf("Error while accepting QUIC connection: %v", err)
+			return
+		}
+
+		go s.serveQUIC(conn)
+	}
+}
+
+// serveQUIC accepts streams on a QUIC connection until it is closed. Each
+// stream carries exactly one query and its response.
+func (s *dnsServer) serveQUIC(conn *quic.Conn) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+
+		go s.serveQUICStream(conn, stream)
+	}
+}
+
+// serveQUICStream answers the single query carried on a DoQ stream.
+func (s *dnsServer) serveQUICStream(conn *quic.Conn, stream *quic.Stream) {
+	defer stream.Close()
+
+	err := stream.SetDeadline(time.Now().Add(s.config.TCPTimeout))
+	if err != nil {
+		log.Printf("Failed to set QUIC stream deadline: %v", err)
+		return
+	}
+
+	buf, err := readFramedMessage(stream)
+	if err != nil {
+		log.Printf("Error while reading from QUIC stream: %v", err)
+		return
+	}
+
+	response := s.handleRequest(buf, conn.RemoteAddr(), false)
+	if response == nil {
+		// Clients must not be left waiting on a stream with no answer
+		stream.CancelWrite(doqInternalError)
+		return
+	}
+
+	err = writeFramedMessage(stream, response)
+	if err != nil {
+		log.Printf("Failed to send DNS response: %v", err)
+		return
+	}
+}
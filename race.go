@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Upstream strategies selecting how a query is sent to several upstreams.
+const (
+	strategySequential = "sequential"
+	strategyRace       = "race"
+)
+
+// race sends a query to the given upstream servers in parallel and returns
+// the first usable answer, cancelling the queries still outstanding. Each
+// upstream is started RaceStagger after the one before it, or at once if
+// every upstream started so far has failed, so a fast first choice saves
+// the others the traffic.
+func (s *dnsServer) race(request *dns.Msg, upstreams []Upstream) (*dns.Msg, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	type result struct {
+		upstream Upstream
+		response *dns.Msg
+		err      error
+	}
+	results := make(chan result, len(upstreams))
+
+	next := 0
+	launch := func() {
+		upstream := upstreams[next]
+		next++
+		go func() {
+			response, err := exchange(ctx, request, upstream)
+			results <- result{upstream, response, err}
+		}()
+	}
+
+	launch()
+	pending := 1
+	stagger := time.NewTimer(s.config.RaceStagger)
+	defer stagger.Stop()
+
+	var fallback *dns.Msg
+	var lastErr error
+	for pending > 0 {
+		select {
+		case <-stagger.C:
+			if next < len(upstreams) {
+				launch()
+				pending++
+				stagger.Reset(s.config.RaceStagger)
+			}
+		case r := <-results:
+			pending--
+			if r.err != nil {
+				logFailure(r.upstream, r.err)
+				lastErr = r.err
+			} else if r.response.Rcode == dns.RcodeServerFailure || r.response.Rcode == dns.RcodeRefused {
+				log.Printf("Upstream %s answered %s", r.upstream, dns.RcodeToString[r.response.Rcode])
+				fallback = r.response
+			} else {
+				return r.response, nil
+			}
+
+			if pending == 0 && next < len(upstreams) {
+				launch()
+				pending++
+			}
+		}
+	}
+
+	if fallback != nil {
+		return fallback, nil
+	}
+
+	return nil, fmt.Errorf("all upstream servers failed, last error: %v", lastErr)
+}
@@ -0,0 +1,672 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// DNSRecord represents a DNS record. It holds one of the typed fields, such
+// as IP or MX, or a Type and its Data in the master file format.
+type DNSRecord struct {
+	Hostname string `yaml:"hostname"`
+
+	// TTL overrides the default TTL of the record's zone.
+	TTL uint32 `yaml:"ttl,omitempty"`
+
+	// Type and Data give a record of any other type, its data in the master
+	// file format or the generic form of RFC 3597.
+	Type string `yaml:"type,omitempty"`
+	Data string `yaml:"data,omitempty"`
+
+	// IP and IPs are served as A or AAAA records by their family.
+	IP    string       `yaml:"ip,omitempty"`
+	IPs   []string     `yaml:"ips,omitempty"`
+	CNAME string       `yaml:"cname,omitempty"`
+	MX    *MXRecord    `yaml:"mx,omitempty"`
+	TXT   TXTRecord    `yaml:"txt,omitempty"`
+	SRV   *SRVRecord   `yaml:"srv,omitempty"`
+	PTR   string       `yaml:"ptr,omitempty"`
+	CAA   *CAARecord   `yaml:"caa,omitempty"`
+	SVCB  *SVCBRecord  `yaml:"svcb,omitempty"`
+	HTTPS *SVCBRecord  `yaml:"https,omitempty"`
+	NAPTR *NAPTRRecord `yaml:"naptr,omitempty"`
+	TLSA  *TLSARecord  `yaml:"tlsa,omitempty"`
+
+	// Expires is when the record stops being served.
+	Expires time.Time `yaml:"expires,omitempty"`
+
+	// rr is the parsed record of records loaded from zone files.
+	rr  dns.RR
+	ttl uint32
+}
+
+// defaultTTL is the time-to-live in seconds of records outside any zone
+// and of zones that do not set their own, unless the records file sets
+// another.
+const defaultTTL = 300
+
+// MXRecord holds the data of an MX record.
+type MXRecord struct {
+	Preference uint16 `yaml:"preference"`
+	Exchange   string `yaml:"exchange"`
+}
+
+// SRVRecord holds the data of an SRV record.
+type SRVRecord struct {
+	Priority uint16 `yaml:"priority"`
+	Weight   uint16 `yaml:"weight"`
+	Port     uint16 `yaml:"port"`
+	Target   string `yaml:"target"`
+}
+
+// CAARecord holds the data of a CAA record, e.g. a tag of "issue" with the
+// value "letsencrypt.org".
+type CAARecord struct {
+	Flags uint8  `yaml:"flags"`
+	Tag   string `yaml:"tag"`
+	Value string `yaml:"value"`
+}
+
+// SVCBRecord holds the data of an SVCB or HTTPS record (RFC 9460). A target
+// of "." refers to the owner name itself.
+type SVCBRecord struct {
+	Priority uint16   `yaml:"priority"`
+	Target   string   `yaml:"target"`
+	ALPN     []string `yaml:"alpn,omitempty"`
+	Port     uint16   `yaml:"port,omitempty"`
+	IPv4Hint []string `yaml:"ipv4hint,omitempty"`
+	IPv6Hint []string `yaml:"ipv6hint,omitempty"`
+}
+
+// svcb converts the record into its wire representation.
+func (r *SVCBRecord) svcb(header dns.RR_Header) (dns.SVCB, error) {
+	svcb := dns.SVCB{
+		Hdr:      header,
+		Priority: r.Priority,
+		Target:   dns.Fqdn(r.Target),
+	}
+
+	// Parameters are kept in ascending key order as RFC 9460 requires
+	if len(r.ALPN) > 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBAlpn{Alpn: r.ALPN})
+	}
+	if r.Port != 0 {
+		svcb.Value = append(svcb.Value, &dns.SVCBPort{Port: r.Port})
+	}
+	if len(r.IPv4Hint) > 0 {
+		hints, err := parseHints(r.IPv4Hint, true)
+		if err != nil {
+			return svcb, err
+		}
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv4Hint{Hint: hints})
+	}
+	if len(r.IPv6Hint) > 0 {
+		hints, err := parseHints(r.IPv6Hint, false)
+		if err != nil {
+			return svcb, err
+		}
+		svcb.Value = append(svcb.Value, &dns.SVCBIPv6Hint{Hint: hints})
+	}
+
+	return svcb, nil
+}
+
+// parseHints parses the addresses of an ipv4hint or ipv6hint parameter.
+func parseHints(addrs []string, ipv4 bool) ([]net.IP, error) {
+	var hints []net.IP
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil || (ip.To4() != nil) != ipv4 {
+			return nil, fmt.Errorf("invalid address hint %q", addr)
+		}
+		hints = append(hints, ip)
+	}
+
+	return hints, nil
+}
+
+// NAPTRRecord holds the data of a NAPTR record (RFC 3403).
+type NAPTRRecord struct {
+	Order       uint16 `yaml:"order"`
+	Preference  uint16 `yaml:"preference"`
+	Flags       string `yaml:"flags"`
+	Service     string `yaml:"service"`
+	Regexp      string `yaml:"regexp"`
+	Replacement string `yaml:"replacement"`
+}
+
+// TLSARecord holds the data of a TLSA record (RFC 6698), published under
+// names such as _443._tcp.host.lan. The certificate data is hex encoded.
+type TLSARecord struct {
+	Usage        uint8  `yaml:"usage"`
+	Selector     uint8  `yaml:"selector"`
+	MatchingType uint8  `yaml:"matching_type"`
+	Certificate  string `yaml:"certificate"`
+}
+
+// TXTRecord holds the data of a TXT record. It may be written in YAML as a
+// single string or as a list of strings.
+type TXTRecord []string
+
+// UnmarshalYAML accepts either a single string or a list of strings.
+func (t *TXTRecord) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var value string
+	if err := unmarshal(&value); err == nil {
+		*t = TXTRecord{value}
+		return nil
+	}
+
+	var values []string
+	if err := unmarshal(&values); err != nil {
+		return err
+	}
+
+	*t = values
+	return nil
+}
+
+// maxCharacterString is the longest character-string a TXT record can hold.
+const maxCharacterString = 255
+
+// characterStrings splits the TXT values into character-strings of at most
+// 255 bytes each, so that long values such as DKIM keys can be served.
+func (t TXTRecord) characterStrings() []string {
+	var strs []string
+	for _, value := range t {
+		for len(value) > maxCharacterString {
+			strs = append(strs, value[:maxCharacterString])
+			value = value[maxCharacterString:]
+		}
+		strs = append(strs, value)
+	}
+
+	return strs
+}
+
+// DNSRecords represents a collection of DNS records, the zones they are
+// served from and any views that replace them for particular clients. TTL
+// is the default for records outside any zone and for zones that do not set
+// their own. Include names further files whose zones, views and records are
+// served as well, and Generate expands into further records.
+type DNSRecords struct {
+	TTL      uint32            `yaml:"ttl,omitempty"`
+	Include  []string          `yaml:"include,omitempty"`
+	Zones    []Zone            `yaml:"zones,omitempty"`
+	Views    []View            `yaml:"views,omitempty"`
+	Records  []DNSRecord       `yaml:"records"`
+	Generate []RecordGenerator `yaml:"generate,omitempty"`
+
+	// includes are the patterns of every included file, relative to the
+	// working directory, so that the files can be watched for changes.
+	includes []string
+}
+
+// LoadRecords loads DNS records from the configured records file, hosts
+// files and dnsmasq files, along with the zones saved to the state file and
+// the members of consumed catalog zones, recording any changes to zones with
+// journals.
+func LoadRecords(config *Config) (*DNSRecords, error) {
+	records, err := readRecords(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.StateFile != "" {
+		records, err = records.withState(config.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load state file %s: %v", config.StateFile, err)
+		}
+	}
+
+	records, err = records.withCatalogMembers(nil)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range records.Zones {
+		err := records.Zones[i].loadJournal(records)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return records, nil
+}
+
+// readRecords reads DNS records from the configured files, or the database
+// of a database backend, adding those of the configured stores, and
+// prepares them for serving, without touching the journals of
+// their zones.
+func readRecords(config *Config) (*DNSRecords, error) {
+	var records *DNSRecords
+	var err error
+	if config.databaseBackend() {
+		records, err = readDatabase(config)
+	} else {
+		records, err = readRecordsFile(config.RecordsFile, map[string]bool{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, store := range config.stores() {
+		stored, err := store.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %v", store.name, err)
+		}
+		records.Records = append(records.Records, stored...)
+		if store.zone != "" {
+			records.addPublishedZone(store.zone)
+		}
+	}
+	for _, hostsFile := range config.HostsFiles {
+		hosts, err := loadHostsFile(hostsFile)
+		if err != nil {
+			return nil, err
+		}
+		records.Records = append(records.Records, hosts...)
+	}
+	for _, dnsmasqFile := range config.DnsmasqFiles {
+		dnsmasq, err := readDnsmasqFile(dnsmasqFile)
+		if err != nil {
+			return nil, err
+		}
+		records.Records = append(records.Records, dnsmasq.records...)
+		log.Printf("Loaded %d records from dnsmasq file %s, ignoring %d unsupported options", len(dnsmasq.records), dnsmasqFile, dnsmasq.ignored)
+	}
+
+	err = records.prepare()
+	if err != nil {
+		return nil, err
+	}
+
+	return records, nil
+}
+
+// addPublishedZone adds a zone that names discovered from elsewhere are
+// published in, should the records file not define it, so that they are
+// answered authoritatively. Its serial increases as its content changes.
+func (r *DNSRecords) addPublishedZone(origin string) {
+	for _, zone := range r.Zones {
+		if dns.CanonicalName(zone.Origin) == origin {
+			return
+		}
+	}
+
+	r.Zones = append(r.Zones, Zone{Origin: origin, SerialPolicy: serialIncrement})
+}
+
+// prepare canonicalises freshly loaded records and sets up their zones and
+// views for serving.
+func (r *DNSRecords) prepare() error {
+	generated, err := generateRecords(r.Generate)
+	if err != nil {
+		return err
+	}
+	r.Records = append(r.Records, generated...)
+
+	for i := range r.Zones {
+		zone := &r.Zones[i]
+		if zone.File != "" {
+			records, err := zone.loadFile()
+			if os.IsNotExist(err) && len(zone.Primaries) > 0 {
+				// The secondary zone is served once it has been
+				// transferred
+				zone.expired = true
+			} else if err != nil {
+				return err
+			}
+			r.Records = append(r.Records, records...)
+		} else if len(zone.Primaries) > 0 {
+			zone.expired = true
+		}
+
+		if zone.TTL == 0 {
+			zone.TTL = r.TTL
+		}
+		zone.setDefaults()
+		err := zone.checkSerialPolicy()
+		if err != nil {
+			return err
+		}
+		generated, err := generateRecords(zone.Generate)
+		if err != nil {
+			return fmt.Errorf("%v in zone %s", err, zone.Origin)
+		}
+		zone.Records = append(zone.Records, generated...)
+		r.Records = append(r.Records, zone.qualifiedRecords()...)
+
+		err = zone.parseACLs()
+		if err != nil {
+			return err
+		}
+
+		err = zone.loadSigner()
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := range r.Zones {
+		if zone := &r.Zones[i]; zone.Catalog != nil && len(zone.Primaries) == 0 {
+			r.Records = append(r.Records, r.catalogRecords(zone)...)
+		}
+	}
+
+	for i := range r.Records {
+		r.Records[i].Hostname = canonicalHostname(r.Records[i].Hostname)
+		r.Records[i].ttl = r.recordTTL(r.Records[i])
+	}
+	r.Records = unexpired(r.Records, time.Now())
+
+	for i := range r.Views {
+		err := r.Views[i].prepare(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// withZone returns a copy of the records with a zone and all of its records
+// replaced, leaving r untouched for the queries still being answered from
+// it. The zone's views are rebuilt on the new records.
+func (r *DNSRecords) withZone(zone Zone, records []DNSRecord) (*DNSRecords, error) {
+	next := &DNSRecords{
+		TTL:      r.TTL,
+		Zones:    append([]Zone{}, r.Zones...),
+		Views:    append([]View{}, r.Views...),
+		includes: r.includes,
+	}
+	for i := range next.Zones {
+		if next.Zones[i].Origin == zone.Origin {
+			next.Zones[i] = zone
+		}
+	}
+
+	for _, record := range r.Records {
+		if owner := r.FindZone(record.Hostname); owner == nil || owner.Origin != zone.Origin {
+			next.Records = append(next.Records, record)
+		}
+	}
+	for _, record := range records {
+		record.Hostname = canonicalHostname(record.Hostname)
+		record.ttl = next.recordTTL(record)
+		next.Records = append(next.Records, record)
+	}
+
+	for i := range next.Views {
+		view := &next.Views[i]
+		view.Records = append([]DNSRecord{}, view.Records...)
+		err := view.prepare(next)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return next, nil
+}
+
+// recordTTL returns the TTL of a record: its own if it sets one, or else
+// the default TTL of the zone holding it.
+func (r *DNSRecords) recordTTL(record DNSRecord) uint32 {
+	if record.TTL != 0 {
+		return record.TTL
+	}
+	if zone := r.FindZone(record.Hostname); zone != nil {
+		return zone.TTL
+	}
+	if r.TTL != 0 {
+		return r.TTL
+	}
+
+	return defaultTTL
+}
+
+// canonicalHostname returns the form hostnames are stored in, so that they
+// are matched case-insensitively as fully qualified names.
+func canonicalHostname(hostname string) string {
+	return dns.CanonicalName(hostname)
+}
+
+// SaveRecords saves DNS records to a YAML file. The records are written to
+// a temporary file that then replaces the file, so that a crash part way
+// through does not leave it truncated.
+func SaveRecords(filename string, records *DNSRecords) error {
+	data, err := yaml.Marshal(records)
+	if err != nil {
+		return err
+	}
+
+	temporary := filename + ".tmp"
+	err = os.WriteFile(temporary, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, filename)
+}
+
+// Lookup returns all records for the given hostname, which is matched
+// regardless of case or a missing trailing dot.
+func (r *DNSRecords) Lookup(hostname string) []DNSRecord {
+	hostname = dns.CanonicalName(hostname)
+
+	var matches []DNSRecord
+	for _, record := range r.Records {
+		if record.Hostname == hostname {
+			matches = append(matches, record)
+		}
+	}
+
+	return matches
+}
+
+// NameExists reports whether any record is owned by name or by a name below
+// it, in which case name exists as an empty non-terminal.
+func (r *DNSRecords) NameExists(name string) bool {
+	for _, record := range r.Records {
+		if dns.IsSubDomain(name, record.Hostname) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WildcardLookup returns the wildcard records that synthesise answers for a
+// name that does not exist, following RFC 4592: only the wildcard directly
+// below the closest existing ancestor of the name applies.
+func (r *DNSRecords) WildcardLookup(name string) []DNSRecord {
+	if r.NameExists(name) {
+		return nil
+	}
+
+	labels := dns.SplitDomainName(name)
+	for i := 1; i <= len(labels); i++ {
+		encloser := dns.Fqdn(strings.Join(labels[i:], "."))
+		if encloser == "." || r.NameExists(encloser) {
+			return r.Lookup("*." + strings.TrimPrefix(encloser, "."))
+		}
+	}
+
+	return nil
+}
+
+// timeToLive returns the TTL of the record's resource records.
+func (r DNSRecord) timeToLive() uint32 {
+	if r.ttl == 0 {
+		return defaultTTL
+	}
+
+	return r.ttl
+}
+
+// Addresses returns every address listed for the record.
+func (r DNSRecord) Addresses() []string {
+	rr := r.rr
+	if r.Type != "" {
+		rr, _ = r.RR(r.Hostname)
+	}
+
+	switch rr := rr.(type) {
+	case *dns.A:
+		return []string{rr.A.String()}
+	case *dns.AAAA:
+		return []string{rr.AAAA.String()}
+	}
+
+	if r.IP == "" {
+		return r.IPs
+	}
+
+	return append([]string{r.IP}, r.IPs...)
+}
+
+// RRs converts the record into the resource records answering for name.
+// Every address of the record becomes its own A or AAAA record, while all
+// other types give a single record.
+func (r DNSRecord) RRs(name string) ([]dns.RR, error) {
+	if r.rr != nil {
+		rr := dns.Copy(r.rr)
+		rr.Header().Name = name
+		return []dns.RR{rr}, nil
+	}
+
+	addresses := r.Addresses()
+	if len(addresses) == 0 {
+		rr, err := r.RR(name)
+		if err != nil {
+			return nil, err
+		}
+
+		return []dns.RR{rr}, nil
+	}
+
+	header := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   r.timeToLive(),
+	}
+
+	var rrs []dns.RR
+	for _, address := range addresses {
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %q for hostname %s", address, r.Hostname)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			header.Rrtype = dns.TypeA
+			rrs = append(rrs, &dns.A{Hdr: header, A: ip4})
+		} else {
+			header.Rrtype = dns.TypeAAAA
+			rrs = append(rrs, &dns.AAAA{Hdr: header, AAAA: ip})
+		}
+	}
+
+	return rrs, nil
+}
+
+// RR converts a record holding anything other than addresses into a
+// resource record answering for name.
+func (r DNSRecord) RR(name string) (dns.RR, error) {
+	header := dns.RR_Header{
+		Name:  name,
+		Class: dns.ClassINET,
+		Ttl:   r.timeToLive(),
+	}
+
+	switch {
+	case r.Type != "":
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", name, header.Ttl, r.Type, r.Data))
+		if err == nil && rr == nil {
+			err = fmt.Errorf("no data")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s record for hostname %s: %v", r.Type, r.Hostname, err)
+		}
+		return rr, nil
+	case r.CNAME != "":
+		header.Rrtype = dns.TypeCNAME
+		return &dns.CNAME{Hdr: header, Target: dns.Fqdn(r.CNAME)}, nil
+	case r.MX != nil:
+		header.Rrtype = dns.TypeMX
+		return &dns.MX{Hdr: header, Preference: r.MX.Preference, Mx: dns.Fqdn(r.MX.Exchange)}, nil
+	case len(r.TXT) > 0:
+		header.Rrtype = dns.TypeTXT
+		return &dns.TXT{Hdr: header, Txt: r.TXT.characterStrings()}, nil
+	case r.SRV != nil:
+		header.Rrtype = dns.TypeSRV
+		return &dns.SRV{
+			Hdr:      header,
+			Priority: r.SRV.Priority,
+			Weight:   r.SRV.Weight,
+			Port:     r.SRV.Port,
+			Target:   dns.Fqdn(r.SRV.Target),
+		}, nil
+	case r.PTR != "":
+		header.Rrtype = dns.TypePTR
+		return &dns.PTR{Hdr: header, Ptr: dns.Fqdn(r.PTR)}, nil
+	case r.CAA != nil:
+		header.Rrtype = dns.TypeCAA
+		return &dns.CAA{Hdr: header, Flag: r.CAA.Flags, Tag: r.CAA.Tag, Value: r.CAA.Value}, nil
+	case r.SVCB != nil:
+		header.Rrtype = dns.TypeSVCB
+		svcb, err := r.SVCB.svcb(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SVCB record for hostname %s: %v", r.Hostname, err)
+		}
+		return &svcb, nil
+	case r.HTTPS != nil:
+		header.Rrtype = dns.TypeHTTPS
+		svcb, err := r.HTTPS.svcb(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTPS record for hostname %s: %v", r.Hostname, err)
+		}
+		return &dns.HTTPS{SVCB: svcb}, nil
+	case r.NAPTR != nil:
+		header.Rrtype = dns.TypeNAPTR
+
+		// An empty replacement is written as the root name
+		replacement := r.NAPTR.Replacement
+		if replacement == "" {
+			replacement = "."
+		}
+
+		return &dns.NAPTR{
+			Hdr:         header,
+			Order:       r.NAPTR.Order,
+			Preference:  r.NAPTR.Preference,
+			Flags:       r.NAPTR.Flags,
+			Service:     r.NAPTR.Service,
+			Regexp:      r.NAPTR.Regexp,
+			Replacement: dns.Fqdn(replacement),
+		}, nil
+	case r.TLSA != nil:
+		header.Rrtype = dns.TypeTLSA
+
+		certificate := strings.ToLower(r.TLSA.Certificate)
+		if _, err := hex.DecodeString(certificate); err != nil {
+			return nil, fmt.Errorf("invalid TLSA certificate data for hostname %s: %v", r.Hostname, err)
+		}
+
+		return &dns.TLSA{
+			Hdr:          header,
+			Usage:        r.TLSA.Usage,
+			Selector:     r.TLSA.Selector,
+			MatchingType: r.TLSA.MatchingType,
+			Certificate:  certificate,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("no record data for hostname %s", r.Hostname)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// rootHints are the addresses of the root name servers used to prime the
+// recursive resolver, from https://www.internic.net/domain/named.root.
+var rootHints = []string{
+	"198.41.0.4",     // a.root-servers.net
+	"170.247.170.2",  // b.root-servers.net
+	"192.33.4.12",    // c.root-servers.net
+	"199.7.91.13",    // d.root-servers.net
+	"192.203.230.10", // e.root-servers.net
+	"192.5.5.241",    // f.root-servers.net
+	"192.112.36.4",   // g.root-servers.net
+	"198.97.190.53",  // h.root-servers.net
+	"192.36.148.17",  // i.root-servers.net
+	"192.58.128.30",  // j.root-servers.net
+	"193.0.14.129",   // k.root-servers.net
+	"199.7.83.42",    // l.root-servers.net
+	"202.12.27.33",   // m.root-servers.net
+}
+
+const (
+	// maxReferrals is the most delegations followed while resolving a
+	// single name.
+	maxReferrals = 16
+
+	// maxRecursionDepth limits how deeply resolving a CNAME target or a
+	// name server without glue may nest.
+	maxRecursionDepth = 8
+)
+
+// errLameDelegation is returned when a referral does not lead closer to the
+// name being resolved.
+var errLameDelegation = errors.New("lame delegation")
+
+// recursor resolves names iteratively from the root servers rather than
+// relying on an upstream resolver.
+type recursor struct {
+	hints []string
+
+	mu      sync.Mutex
+	roots   []string
+	expires time.Time
+}
+
+// newRecursor creates a recursive resolver primed from the given root hint
+// addresses, or the IANA root servers if none are given.
+func newRecursor(hints []string) *recursor {
+	if len(hints) == 0 {
+		hints = rootHints
+	}
+
+	return &recursor{hints: hints}
+}
+
+// rootServers returns the addresses of the root name servers, refreshing
+// them with a priming query (RFC 8109) when the previous answer has expired.
+func (r *recursor) rootServers() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.roots != nil && time.Now().Before(r.expires) {
+		return r.roots
+	}
+
+	prime := new(dns.Msg)
+	prime.SetQuestion(".", dns.TypeNS)
+	prime.RecursionDesired = false
+
+	response, err := r.query(prime, r.hints)
+	if err != nil {
+		log.Printf("Failed to prime root servers, using hints: %v", err)
+		return r.hints
+	}
+
+	roots := glueAddresses(response.Answer, response.Extra)
+	if len(roots) == 0 {
+		log.Printf("Priming response held no root server addresses, using hints")
+		return r.hints
+	}
+
+	ttl := uint32(86400)
+	for _, rr := range response.Answer {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+
+	r.roots = roots
+	r.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+
+	return r.roots
+}
+
+// Resolve answers a client query by iterating from the root servers.
+func (r *recursor) Resolve(request *dns.Msg) (*dns.Msg, error) {
+	result, err := r.resolve(request.Question[0], request.IsEdns0() != nil && request.IsEdns0().Do(), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+	response.Rcode = result.Rcode
+	response.Answer = result.Answer
+	response.Ns = result.Ns
+	response.RecursionAvailable = true
+
+	return response, nil
+}
+
+// resolve iteratively resolves a single question, following referrals down
+// from the root and any CNAME chain in the final answer.
+func (r *recursor) resolve(question dns.Question, dnssec bool, depth int) (*dns.Msg, error) {
+	if depth > maxRecursionDepth {
+		return nil, fmt.Errorf("recursion too deep resolving %s", question.Name)
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(question.Name, question.Qtype)
+	query.Question[0].Qclass = question.Qclass
+	query.RecursionDesired = false
+	query.SetEdns0(dns.DefaultMsgSize, dnssec)
+
+	zone := "."
+	servers := r.rootServers()
+	for i := 0; i < maxReferrals; i++ {
+		response, err := r.query(query, servers)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(response.Answer) > 0 || response.Rcode != dns.RcodeSuccess || !isReferral(response) {
+			return r.followCNAME(question, response, dnssec, depth)
+		}
+
+		// Follow the referral to the name servers of the child zone
+		child := response.Ns[0].Header().Name
+		if !dns.IsSubDomain(zone, child) || dns.CountLabel(child) <= dns.CountLabel(zone) {
+			return nil, fmt.Errorf("%w from %s to %s", errLameDelegation, zone, child)
+		}
+
+		servers, err = r.delegationServers(child, response, dnssec, depth)
+		if err != nil {
+			return nil, err
+		}
+		zone = child
+	}
+
+	return nil, fmt.Errorf("too many referrals resolving %s", question.Name)
+}
+
+// followCNAME completes an answer that ends in a CNAME to a name the
+// answering server had no data for, by resolving the target separately.
+func (r *recursor) followCNAME(question dns.Question, response *dns.Msg, dnssec bool, depth int) (*dns.Msg, error) {
+	if question.Qtype == dns.TypeCNAME || question.Qtype == dns.TypeANY {
+		return response, nil
+	}
+
+	// Walk the chain as far as the answer section covers it
+	name := question.Name
+	for i := 0; i < maxCNAMEDepth; i++ {
+		target := ""
+		for _, rr := range response.Answer {
+			if dns.CanonicalName(rr.Header().Name) != dns.CanonicalName(name) {
+				continue
+			}
+
+			if rr.Header().Rrtype == question.Qtype {
+				return response, nil
+			}
+			if cname, ok := rr.(*dns.CNAME); ok {
+				target = cname.Target
+			}
+		}
+
+		if target == "" {
+			return response, nil
+		}
+
+		name = target
+		if !inAnswer(response.Answer, name) {
+			next, err := r.resolve(dns.Question{Name: name, Qtype: question.Qtype, Qclass: question.Qclass}, dnssec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+
+			response.Answer = append(response.Answer, next.Answer...)
+			response.Ns = next.Ns
+			response.Rcode = next.Rcode
+
+			return response, nil
+		}
+	}
+
+	return response, nil
+}
+
+// inAnswer reports whether any record in the answer section is owned by name.
+func inAnswer(answers []dns.RR, name string) bool {
+	for _, rr := range answers {
+		if dns.CanonicalName(rr.Header().Name) == dns.CanonicalName(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isReferral reports whether a response delegates to another zone's name
+// servers rather than answering.
+func isReferral(response *dns.Msg) bool {
+	if response.Authoritative || len(response.Ns) == 0 {
+		return false
+	}
+
+	for _, rr := range response.Ns {
+		if rr.Header().Rrtype != dns.TypeNS {
+			return false
+		}
+	}
+
+	return true
+}
+
+// delegationServers returns the addresses of the name servers a referral
+// points to, using the glue records in the response where they are present
+// and resolving the name servers' addresses otherwise.
+func (r *recursor) delegationServers(zone string, referral *dns.Msg, dnssec bool, depth int) ([]string, error) {
+	// Only glue for name servers within the delegated zone is trusted
+	var glue []dns.RR
+	for _, rr := range referral.Extra {
+		if dns.IsSubDomain(zone, rr.Header().Name) {
+			glue = append(glue, rr)
+		}
+	}
+
+	servers := glueAddresses(referral.Ns, glue)
+	if len(servers) > 0 {
+		return servers, nil
+	}
+
+	for _, rr := range referral.Ns {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+
+		response, err := r.resolve(dns.Question{Name: ns.Ns, Qtype: dns.TypeA, Qclass: dns.ClassINET}, dnssec, depth+1)
+		if err != nil {
+			log.Printf("Failed to resolve name server %s: %v", ns.Ns, err)
+			continue
+		}
+
+		for _, answer := range response.Answer {
+			if a, ok := answer.(*dns.A); ok {
+				servers = append(servers, a.A.String())
+			}
+		}
+		if len(servers) > 0 {
+			return servers, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no reachable name servers for %s", zone)
+}
+
+// glueAddresses returns the addresses in extra that belong to the name
+// servers listed in nsRecords. IPv4 addresses are listed first.
+func glueAddresses(nsRecords []dns.RR, extra []dns.RR) []string {
+	names := map[string]bool{}
+	for _, rr := range nsRecords {
+		if ns, ok := rr.(*dns.NS); ok {
+			names[dns.CanonicalName(ns.Ns)] = true
+		}
+	}
+
+	var ipv4, ipv6 []string
+	for _, rr := range extra {
+		if !names[dns.CanonicalName(rr.Header().Name)] {
+			continue
+		}
+
+		switch glue := rr.(type) {
+		case *dns.A:
+			ipv4 = append(ipv4, glue.A.String())
+		case *dns.AAAA:
+			ipv6 = append(ipv6, glue.AAAA.String())
+		}
+	}
+
+	return append(ipv4, ipv6...)
+}
+
+// query sends a query to each of the servers in turn until one answers.
+func (r *recursor) query(query *dns.Msg, servers []string) (*dns.Msg, error) {
+	var lastErr error
+	for _, server := range servers {
+		address := net.JoinHostPort(server, "53")
+		response, err := exchange(context.Background(), query, Upstream{Address: address})
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if response.Rcode == dns.RcodeServerFailure || response.Rcode == dns.RcodeRefused {
+			lastErr = fmt.Errorf("%s answered %s", server, dns.RcodeToString[response.Rcode])
+			continue
+		}
+
+		return response, nil
+	}
+
+	return nil, fmt.Errorf("no name server answered for %s: %v", query.Question[0].Name, lastErr)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient returns a client for the configured Redis server.
+func newRedisClient(config *Config) *redis.Client {
+	return redis.NewClient(&redis.Options{
+		Addr:     config.RedisAddress,
+		Password: config.RedisPassword,
+		DB:       config.RedisDB,
+	})
+}
+
+// redisStore is the store of the records kept in Redis by the redis
+// backend.
+type redisStore struct {
+	config *Config
+}
+
+// List reads the records kept in Redis. Each key of the form
+// prefix:type:hostname, such as dns:a:host.lan, holds the answers for that
+// hostname and type in the master file format, either in a string with one
+// answer to a line, or as the members of a set or list. Keys given an
+// expiry in Redis are served until they expire.
+func (r *redisStore) List() ([]DNSRecord, error) {
+	config := r.config
+	client := newRedisClient(config)
+	defer client.Close()
+
+	ctx := context.Background()
+	var keys []string
+	iter := client.Scan(ctx, 0, config.RedisPrefix+":*", 1000).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if iter.Err() != nil {
+		return nil, iter.Err()
+	}
+
+	types := make([]*redis.StatusCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	_, err := client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			types[i] = pipe.Type(ctx, key)
+			ttls[i] = pipe.PTTL(ctx, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]redis.Cmder, len(keys))
+	_, err = client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, key := range keys {
+			switch types[i].Val() {
+			case "string":
+				values[i] = pipe.Get(ctx, key)
+			case "set":
+				values[i] = pipe.SMembers(ctx, key)
+			case "list":
+				values[i] = pipe.LRange(ctx, key, 0, -1)
+			}
+		}
+		return nil
+	})
+	// A key deleted or expired between the two pipelines is left out
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var records []DNSRecord
+	for i, key := range keys {
+		recordType, hostname, ok := strings.Cut(strings.TrimPrefix(key, config.RedisPrefix+":"), ":")
+		if !ok || recordType == "" || hostname == "" {
+			return nil, fmt.Errorf("invalid Redis key %s, not of the form %s:type:hostname", key, config.RedisPrefix)
+		}
+
+		var answers []string
+		switch value := values[i].(type) {
+		case *redis.StringCmd:
+			if value.Err() == redis.Nil {
+				continue
+			}
+			answers = strings.Split(value.Val(), "\n")
+		case *redis.StringSliceCmd:
+			answers = value.Val()
+		default:
+			// The key was deleted or had expired
+			if types[i].Val() == "none" {
+				continue
+			}
+			return nil, fmt.Errorf("Redis key %s holds a %s rather than a string, set or list", key, types[i].Val())
+		}
+
+		var expires time.Time
+		if ttl := ttls[i].Val(); ttl > 0 {
+			expires = now.Add(ttl)
+		}
+		for _, answer := range answers {
+			answer = strings.TrimSpace(answer)
+			if answer == "" {
+				continue
+			}
+			records = append(records, DNSRecord{
+				Hostname: hostname,
+				Type:     strings.ToUpper(recordType),
+				Data:     answer,
+				Expires:  expires,
+			})
+		}
+	}
+
+	return records, nil
+}
+
+// Put adds the answers of a record to the sets of its hostname and their
+// types, which must not be held in strings or lists.
+func (r *redisStore) Put(record DNSRecord) error {
+	answers, err := recordAnswers(record)
+	if err != nil {
+		return err
+	}
+
+	client := newRedisClient(r.config)
+	defer client.Close()
+
+	ctx := context.Background()
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for rrtype, data := range answers {
+			for _, answer := range data {
+				pipe.SAdd(ctx, r.key(record.Hostname, rrtype), answer)
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Delete removes the answers of a record from the sets of its hostname and
+// their types, which must not be held in strings or lists.
+func (r *redisStore) Delete(record DNSRecord) error {
+	answers, err := recordAnswers(record)
+	if err != nil {
+		return err
+	}
+
+	client := newRedisClient(r.config)
+	defer client.Close()
+
+	ctx := context.Background()
+	_, err = client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for rrtype, data := range answers {
+			for _, answer := range data {
+				pipe.SRem(ctx, r.key(record.Hostname, rrtype), answer)
+			}
+		}
+		return nil
+	})
+
+	return err
+}
+
+// key returns the key holding the answers of a type for a hostname.
+func (r *redisStore) key(hostname, rrtype string) string {
+	return fmt.Sprintf("%s:%s:%s", r.config.RedisPrefix, strings.ToLower(rrtype), strings.TrimSuffix(canonicalHostname(hostname), "."))
+}
+
+// Watch follows the changes other systems make to the records in Redis as
+// keyspace notifications announce them, which needs the server to have
+// notify-keyspace-events enabled. Changes are also announced whenever the
+// subscription is made again after the connection was lost, in case changes
+// were missed in the meantime.
+func (r *redisStore) Watch(changed func()) error {
+	client := newRedisClient(r.config)
+	channel := fmt.Sprintf("__keyspace@%d__:%s:*", r.config.RedisDB, r.config.RedisPrefix)
+	subscription := client.PSubscribe(context.Background(), channel)
+
+	go func() {
+		subscribed := false
+		for {
+			message, err := subscription.Receive(context.Background())
+			if err != nil {
+				log.Printf("Failed to receive changes to the records in Redis: %v", err)
+				time.Sleep(time.Second)
+				continue
+			}
+
+			switch message.(type) {
+			case *redis.Subscription:
+				if !subscribed {
+					subscribed = true
+					continue
+				}
+			case *redis.Message:
+			default:
+				continue
+			}
+			changed()
+		}
+	}()
+
+	return nil
+}
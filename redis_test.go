@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// redisRecords returns the records listed by a Redis store as their
+// hostnames, types and data, and whether they expire.
+func redisRecords(t *testing.T, store *redisStore) []string {
+	t.Helper()
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, record := range records {
+		got = append(got, fmt.Sprintf("%s %s %s %v", record.Hostname, record.Type, record.Data, !record.Expires.IsZero()))
+	}
+	sort.Strings(got)
+
+	return got
+}
+
+func TestRedisStore(t *testing.T) {
+	server := miniredis.RunT(t)
+	config := DefaultConfig()
+	config.RedisAddress = server.Addr()
+	config.RedisPrefix = "dns"
+
+	server.Set("dns:a:www.lan", "192.168.1.10\n192.168.1.11\n")
+	server.SetAdd("dns:aaaa:www.lan", "fd00::10")
+	server.RPush("dns:txt:www.lan", `"v=spf1 -all"`)
+	server.Set("dns:a:lease.lan", "192.168.1.50")
+	server.SetTTL("dns:a:lease.lan", time.Hour)
+	server.Set("other:a:ignored.lan", "192.168.1.99")
+
+	store := &redisStore{config: config}
+
+	want := []string{
+		"lease.lan A 192.168.1.50 true",
+		"www.lan A 192.168.1.10 false",
+		"www.lan A 192.168.1.11 false",
+		"www.lan AAAA fd00::10 false",
+		`www.lan TXT "v=spf1 -all" false`,
+	}
+	if got := redisRecords(t, store); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	// Records are added to and removed from the sets of their answers,
+	// including those loaded from resource records
+	zone := &Zone{Origin: "lan."}
+	loaded := zone.loadRRs(testRRs(t, "mail.lan. 300 IN MX 10 mx.lan."))[0]
+	for _, record := range []DNSRecord{{Hostname: "api.lan.", IP: "192.168.1.12"}, loaded} {
+		err := store.Put(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	added := append([]string{"api.lan A 192.168.1.12 false", "lease.lan A 192.168.1.50 true", "mail.lan MX 10 mx.lan. false"}, want[1:]...)
+	if got := redisRecords(t, store); !reflect.DeepEqual(got, added) {
+		t.Fatalf("got %q after adding records, want %q", got, added)
+	}
+
+	err := store.Delete(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deleted := append(added[:2:2], added[3:]...)
+	if got := redisRecords(t, store); !reflect.DeepEqual(got, deleted) {
+		t.Fatalf("got %q after deleting a record, want %q", got, deleted)
+	}
+
+	// Keys must name a type and hostname, and hold records
+	for key, set := range map[string]func(string){
+		"dns:nohostname": func(key string) { server.Set(key, "192.168.1.1") },
+		"dns:a:hash.lan": func(key string) { server.HSet(key, "field", "value") },
+	} {
+		set(key)
+		_, err = store.List()
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Fatalf("got %v, want an error for key %s", err, key)
+		}
+		server.Del(key)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadOnHangup reloads the records file, hosts files and dnsmasq files
+// each time the server is sent SIGHUP, so records can be edited without
+// restarting it.
+func (s *dnsServer) reloadOnHangup() {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	go func() {
+		for range hangups {
+			s.reloadRecords()
+		}
+	}()
+}
+
+// reloadRecords loads the records file again and serves the new records in
+// place of the old ones. The old records are kept if the file cannot be
+// loaded. Secondary zones are followed or dropped as they are added to or
+// removed from the file, and the secondaries of zones whose serial changed
+// are notified.
+func (s *dnsServer) reloadRecords() {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	records, err := LoadRecords(s.config)
+	if err == nil {
+		err = s.config.checkKeys(records)
+	}
+	if err == nil {
+		err = records.followSerials(current)
+	}
+	if err != nil {
+		log.Printf("Failed to reload DNS records, keeping the previous ones: %v", err)
+		return
+	}
+
+	records, err = records.keepTransferred(current)
+	if err == nil {
+		records, err = records.withCatalogMembers(current)
+	}
+	if err != nil {
+		log.Printf("Failed to reload DNS records, keeping the previous ones: %v", err)
+		return
+	}
+
+	s.serveRecords(records)
+	s.reloadFilter()
+	log.Printf("Reloaded %d DNS records in %d zones from %s", len(records.Records), len(records.Zones), s.config.recordsSource())
+
+	s.followSecondaries()
+
+	for _, zone := range records.Zones {
+		old := current.FindZone(zone.Origin)
+		changed := old == nil || old.Origin != zone.Origin || old.SOA.Serial != zone.SOA.Serial
+		if len(zone.Notify) > 0 && !zone.expired && changed {
+			s.notifyZone(zone.Origin)
+		}
+	}
+}
+
+// keepTransferred returns the records with the content of secondary zones
+// carried over from the records they replace, where the content has not been
+// loaded from a file, so reloading does not wait for the zones to be
+// transferred again.
+func (r *DNSRecords) keepTransferred(current *DNSRecords) (*DNSRecords, error) {
+	next := r
+	for _, zone := range r.Zones {
+		old := current.secondaryZone(zone.Origin)
+		if len(zone.Primaries) == 0 || !zone.expired || old == nil || old.expired {
+			continue
+		}
+
+		rrs, err := current.zoneRRs(old)
+		if err != nil {
+			return nil, err
+		}
+
+		records := zone.loadRRs(rrs[:len(rrs)-1])
+		zone.expired = false
+		next, err = next.withZone(zone, records)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return next, nil
+}
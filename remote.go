@@ -0,0 +1,254 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// RemoteConfig answers names under Zones by asking an HTTP endpoint, in the
+// manner of the PowerDNS remote backend.
+type RemoteConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the base URL of the endpoint the lookups are made under.
+	URL string `yaml:"url"`
+
+	// Zones are the zones the endpoint answers for.
+	Zones []string `yaml:"zones"`
+
+	// Timeout is how long the endpoint may take to answer a lookup.
+	Timeout time.Duration `yaml:"timeout"`
+
+	// Clients in the AllowTransfer networks may transfer the zones.
+	AllowTransfer []string `yaml:"allow_transfer"`
+
+	client           *http.Client
+	transferNetworks []*net.IPNet
+}
+
+// parse validates the endpoint and the networks allowed to transfer the
+// zones, and canonicalises the zones.
+func (c *RemoteConfig) parse() error {
+	address, err := url.Parse(c.URL)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return fmt.Errorf("invalid remote url %q", c.URL)
+	}
+	if len(c.Zones) == 0 {
+		return fmt.Errorf("remote needs at least one zone")
+	}
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid remote timeout %v", c.Timeout)
+	}
+	c.transferNetworks, err = parseNetworks(c.AllowTransfer)
+	if err != nil {
+		return fmt.Errorf("invalid remote allow_transfer: %v", err)
+	}
+
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	for i, zone := range c.Zones {
+		c.Zones[i] = dns.CanonicalName(zone)
+	}
+	c.client = &http.Client{Timeout: c.Timeout}
+	return nil
+}
+
+// zone returns the most specific of the zones holding name, or "" if none
+// does.
+func (c *RemoteConfig) zone(name string) string {
+	var found string
+	for _, zone := range c.Zones {
+		if dns.IsSubDomain(zone, name) && len(zone) > len(found) {
+			found = zone
+		}
+	}
+
+	return found
+}
+
+// remoteRecord is a record as the endpoint answers it, its content in
+// presentation format.
+type remoteRecord struct {
+	Qname   string `json:"qname"`
+	Qtype   string `json:"qtype"`
+	Content string `json:"content"`
+	TTL     uint32 `json:"ttl"`
+}
+
+// remoteGet asks the endpoint for the records at path, returning nil if it
+// has none.
+func (c *RemoteConfig) remoteGet(path string) ([]dns.RR, error) {
+	response, err := c.client.Get(c.URL + path)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote answered %s for %s", response.Status, path)
+	}
+
+	rrs, err := decodeRemoteRecords(response.Body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid answer from remote: %v", err)
+	}
+
+	return rrs, nil
+}
+
+// decodeRemoteRecords decodes an answer holding the records of a lookup,
+// as {"result": [...]}, or {"result": false} if there are none.
+func decodeRemoteRecords(r io.Reader) ([]dns.RR, error) {
+	var answer struct {
+		Result json.RawMessage `json:"result"`
+	}
+	err := json.NewDecoder(r).Decode(&answer)
+	if err != nil {
+		return nil, err
+	}
+	var results []remoteRecord
+	if string(answer.Result) != "false" {
+		err = json.Unmarshal(answer.Result, &results)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var rrs []dns.RR
+	for _, result := range results {
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(result.Qname), result.TTL, result.Qtype, result.Content))
+		if err != nil {
+			return nil, err
+		}
+		if rr != nil {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	return rrs, nil
+}
+
+// lookupRemote asks the endpoint for the records of a name of a type.
+func (c *RemoteConfig) lookupRemote(name string, qtype uint16) ([]dns.RR, error) {
+	return c.remoteGet("/lookup/" + url.PathEscape(name) + "/" + dns.TypeToString[qtype])
+}
+
+// remoteHandler looks the names of the remote zones up from their
+// endpoint.
+func (s *dnsServer) remoteHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	if !s.config.Remote.Enabled || s.config.Remote.zone(q.request.Question[0].Name) == "" {
+		return next()
+	}
+
+	s.answerRemote(q.request, q.response)
+	return q.response
+}
+
+// answerRemote answers a query for a name under the remote zones with the
+// records the endpoint holds for it. Names the endpoint has no records for
+// are NXDOMAIN, and names without records of the type asked for NODATA,
+// with the SOA record of the zone, if the endpoint gives one, so that
+// resolvers know how long to cache them.
+func (s *dnsServer) answerRemote(request *dns.Msg, response *dns.Msg) {
+	c := &s.config.Remote
+	question := request.Question[0]
+	rrs, err := c.lookupRemote(question.Name, dns.TypeANY)
+	if err != nil {
+		log.Printf("Failed to look up %s remotely: %v", question.Name, err)
+		response.Rcode = dns.RcodeServerFailure
+		return
+	}
+
+	response.Authoritative = true
+	var answers []dns.RR
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrtype == question.Qtype || question.Qtype == dns.TypeANY || rrtype == dns.TypeCNAME {
+			rr.Header().Name = question.Name
+			answers = append(answers, rr)
+		}
+	}
+	rotate(answers, atomic.AddUint64(&s.rotation, 1))
+	response.Answer = answers
+	if len(rrs) == 0 {
+		response.Rcode = dns.RcodeNameError
+	}
+	if len(answers) > 0 {
+		return
+	}
+
+	zone := c.zone(question.Name)
+	soas, err := c.lookupRemote(zone, dns.TypeSOA)
+	if err != nil {
+		log.Printf("Failed to look up %s remotely: %v", zone, err)
+	}
+	for _, rr := range soas {
+		if soa, ok := rr.(*dns.SOA); ok {
+			// Negative answers are cached for the smaller of the SOA's
+			// TTL and minimum (RFC 2308)
+			negative := dns.Copy(soa).(*dns.SOA)
+			if negative.Minttl < negative.Hdr.Ttl {
+				negative.Hdr.Ttl = negative.Minttl
+			}
+			response.Ns = []dns.RR{negative}
+			break
+		}
+	}
+}
+
+// serveRemoteTransfer answers a request to transfer one of the remote zones
+// with what the endpoint lists for it, starting and ending with its SOA
+// record. Incremental transfers are answered with the whole zone.
+func (s *dnsServer) serveRemoteTransfer(conn net.Conn, request *dns.Msg) error {
+	c := &s.config.Remote
+	client := addrIP(conn.RemoteAddr())
+	name := dns.CanonicalName(request.Question[0].Name)
+	if !containsIP(c.transferNetworks, client) {
+		log.Printf("Refused zone transfer of %s to %s: client not in allow_transfer", name, client)
+		return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeRefused, nil))
+	}
+
+	listed, err := c.remoteGet("/list/-1/" + url.PathEscape(name))
+	if err != nil {
+		log.Printf("Failed to transfer zone %s: %v", name, err)
+		return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeServerFailure, nil))
+	}
+
+	var soa dns.RR
+	var rrs []dns.RR
+	for _, rr := range listed {
+		if rr.Header().Rrtype == dns.TypeSOA && dns.CanonicalName(rr.Header().Name) == name {
+			soa = rr
+		} else {
+			rrs = append(rrs, rr)
+		}
+	}
+	if soa == nil {
+		log.Printf("Failed to transfer zone %s: remote listed no SOA record", name)
+		return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeServerFailure, nil))
+	}
+	rrs = append(append([]dns.RR{soa}, rrs...), soa)
+
+	log.Printf("Transferring remote zone %s to %s", name, client)
+	for _, msg := range transferMessages(request, rrs) {
+		packed, err := msg.Pack()
+		if err != nil {
+			return err
+		}
+
+		err = s.writeTransfer(conn, packed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
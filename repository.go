@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// gitTimeout is how long a clone or pull of the repository may take.
+const gitTimeout = 5 * time.Minute
+
+// GitConfig serves the records file and zone files from a Git repository,
+// pulled every Interval or when a push to it is announced.
+type GitConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// URL is the repository to clone, in any form git accepts.
+	URL string `yaml:"url"`
+
+	// Branch is the branch whose files are served.
+	Branch string `yaml:"branch"`
+
+	// Directory is where the repository is checked out.
+	Directory string `yaml:"directory"`
+
+	// Interval is how often the repository is pulled. Zero only pulls it
+	// when the webhook is called.
+	Interval time.Duration `yaml:"interval"`
+
+	// Listen is the address, such as :8053, of the webhook that pulls the
+	// repository when it is called by a POST, as the push webhooks of
+	// GitHub, GitLab and Gitea are.
+	Listen string `yaml:"listen"`
+
+	// Secret is the secret the webhook's requests are signed with, checked
+	// against the X-Hub-Signature-256 header of GitHub and Gitea or the
+	// X-Gitlab-Token header of GitLab.
+	Secret string `yaml:"secret"`
+}
+
+// parse validates the repository and where it is checked out.
+func (c *GitConfig) parse() error {
+	if c.URL == "" {
+		return fmt.Errorf("git needs the url of the repository")
+	}
+	if c.Branch == "" {
+		return fmt.Errorf("git needs a branch")
+	}
+	if c.Directory == "" {
+		return fmt.Errorf("git needs a directory to check the repository out in")
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid git interval %v", c.Interval)
+	}
+
+	return nil
+}
+
+// git runs a git command in the directory the repository is checked out
+// in, returning what it writes.
+func (c *GitConfig) git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", append([]string{"-C", c.Directory}, args...)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("git %s: %s", args[0], message)
+		}
+		return "", fmt.Errorf("git %s: %v", args[0], err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// checkout clones the repository into the directory, or pulls it if it is
+// already checked out there. A checkout that cannot be pulled is served as
+// it is.
+func (c *GitConfig) checkout() error {
+	_, err := os.Stat(filepath.Join(c.Directory, ".git"))
+	if err == nil {
+		_, err = c.pull()
+		if err != nil {
+			log.Printf("Failed to pull %s, serving the files already checked out: %v", c.URL, err)
+		}
+		return nil
+	}
+
+	err = os.MkdirAll(c.Directory, 0755)
+	if err != nil {
+		return err
+	}
+	_, err = c.git("clone", "--branch", c.Branch, "--single-branch", c.URL, ".")
+	if err != nil {
+		return fmt.Errorf("failed to clone %s: %v", c.URL, err)
+	}
+
+	log.Printf("Cloned %s into %s", c.URL, c.Directory)
+	return nil
+}
+
+// pull brings the checkout to the latest commit of the branch, reporting
+// whether it changed. The files are reset to the commit rather than merged,
+// so the checkout always matches the repository.
+func (c *GitConfig) pull() (bool, error) {
+	before, err := c.git("rev-parse", "HEAD")
+	if err != nil {
+		return false, err
+	}
+
+	_, err = c.git("fetch", "origin", c.Branch)
+	if err != nil {
+		return false, err
+	}
+	_, err = c.git("reset", "--hard", "FETCH_HEAD")
+	if err != nil {
+		return false, err
+	}
+
+	after, err := c.git("rev-parse", "HEAD")
+	if err != nil {
+		return false, err
+	}
+	if after != before {
+		log.Printf("Pulled %s at %s", c.URL, after)
+	}
+	return after != before, nil
+}
+
+// followRepository pulls the repository every Interval, and whenever the
+// webhook is called, reloading the records each time they change. Records
+// that fail to load leave the previous ones served until the failing commit
+// is fixed or reverted.
+func (s *dnsServer) followRepository() {
+	config := &s.config.Git
+	if !config.Enabled {
+		return
+	}
+
+	pulls := make(chan struct{}, 1)
+	pull := func() {
+		select {
+		case pulls <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		for range pulls {
+			changed, err := config.pull()
+			if err != nil {
+				log.Printf("Failed to pull %s: %v", config.URL, err)
+				continue
+			}
+			if changed {
+				s.reloadRecords()
+			}
+		}
+	}()
+
+	if config.Interval > 0 {
+		go func() {
+			ticker := time.NewTicker(config.Interval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				pull()
+			}
+		}()
+	}
+
+	if config.Listen != "" {
+		server := &http.Server{
+			Addr:              config.Listen,
+			Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { config.serveWebhook(w, r, pull) }),
+			ReadHeaderTimeout: 10 * time.Second,
+		}
+		go func() {
+			log.Printf("Listening for pushes to %s on %s", config.URL, config.Listen)
+			err := server.ListenAndServe()
+			if err != nil {
+				log.Printf("Failed to listen for pushes to %s: %v", config.URL, err)
+			}
+		}()
+	}
+}
+
+// serveWebhook pulls the repository when a push to it is announced by a
+// POST signed with the secret, if one is set.
+func (c *GitConfig) serveWebhook(w http.ResponseWriter, r *http.Request, pull func()) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		http.Error(w, "failed to read request", http.StatusBadRequest)
+		return
+	}
+	if c.Secret != "" && !c.signed(r, body) {
+		log.Printf("Refused a webhook call from %s: bad signature", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusUnauthorized)
+		return
+	}
+
+	pull()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// signed reports whether a call of the webhook is signed with the secret.
+func (c *GitConfig) signed(r *http.Request, body []byte) bool {
+	if token := r.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(c.Secret)) == 1
+	}
+
+	signature, found := strings.CutPrefix(r.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if !found {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(c.Secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
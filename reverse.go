@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// reverseNameIP parses an in-addr.arpa or ip6.arpa name back into the address
+// it represents, returning nil if the name is not a complete reverse name.
+func reverseNameIP(name string) net.IP {
+	name = strings.ToLower(dns.Fqdn(name))
+
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".in-addr.arpa."))
+		if len(labels) != net.IPv4len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv4len)
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return nil
+			}
+			ip[net.IPv4len-1-i] = byte(octet)
+		}
+
+		return ip
+	case strings.HasSuffix(name, ".ip6.arpa."):
+		labels := dns.SplitDomainName(strings.TrimSuffix(name, ".ip6.arpa."))
+		if len(labels) != 2*net.IPv6len {
+			return nil
+		}
+
+		ip := make(net.IP, net.IPv6len)
+		for i, label := range labels {
+			nibble, err := strconv.ParseUint(label, 16, 4)
+			if err != nil || len(label) != 1 {
+				return nil
+			}
+
+			// Labels run from the least significant nibble upwards
+			pos := len(labels) - 1 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(nibble) << 4
+			} else {
+				ip[pos/2] |= byte(nibble)
+			}
+		}
+
+		return ip
+	}
+
+	return nil
+}
+
+// ReverseLookup derives PTR records for a reverse name from the A and AAAA
+// records whose address it represents.
+func (r *DNSRecords) ReverseLookup(name string) []DNSRecord {
+	ip := reverseNameIP(name)
+	if ip == nil {
+		return nil
+	}
+
+	var matches []DNSRecord
+	for _, record := range r.Records {
+		for _, address := range record.Addresses() {
+			if !ip.Equal(net.ParseIP(address)) {
+				continue
+			}
+
+			matches = append(matches, DNSRecord{
+				Hostname: name,
+				PTR:      record.Hostname,
+			})
+		}
+	}
+
+	return matches
+}
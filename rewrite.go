@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// RewriteRule changes the answers to queries for names under Domain before
+// they are returned. Answer records of Type, and whose data is Value if one
+// is given, are either removed when Strip is set or have their data
+// replaced by Replace, for example to map a public address to its internal
+// equivalent or to hide AAAA records from a broken IPv6 service.
+type RewriteRule struct {
+	Domain  string `yaml:"domain"`
+	Type    string `yaml:"type"`
+	Value   string `yaml:"value"`
+	Replace string `yaml:"replace"`
+	Strip   bool   `yaml:"strip"`
+
+	rrtype      uint16
+	replacement dns.RR
+}
+
+// parse validates a rewrite rule and prepares its replacement record.
+func (r *RewriteRule) parse() error {
+	r.Domain = dns.CanonicalName(r.Domain)
+
+	if r.Type != "" {
+		rrtype, ok := dns.StringToType[strings.ToUpper(r.Type)]
+		if !ok {
+			return fmt.Errorf("unknown record type %q in rewrite for %s", r.Type, r.Domain)
+		}
+		r.rrtype = rrtype
+	}
+
+	if r.Strip == (r.Replace != "") {
+		return fmt.Errorf("rewrite for %s must either strip or replace", r.Domain)
+	}
+
+	if r.Replace != "" {
+		if r.rrtype == dns.TypeNone {
+			return fmt.Errorf("rewrite for %s needs a type to replace", r.Domain)
+		}
+
+		replacement, err := dns.NewRR(fmt.Sprintf(". 0 IN %s %s", dns.TypeToString[r.rrtype], r.Replace))
+		if err != nil || replacement == nil {
+			return fmt.Errorf("invalid replacement %q in rewrite for %s", r.Replace, r.Domain)
+		}
+		r.replacement = replacement
+	}
+
+	return nil
+}
+
+// matches reports whether an answer record to a query for qname is covered
+// by the rule.
+func (r *RewriteRule) matches(qname string, rr dns.RR) bool {
+	if !dns.IsSubDomain(r.Domain, qname) {
+		return false
+	}
+	if r.rrtype != dns.TypeNone && rr.Header().Rrtype != r.rrtype {
+		return false
+	}
+	if r.Value != "" && !strings.EqualFold(strings.TrimSuffix(rdata(rr), "."), strings.TrimSuffix(r.Value, ".")) {
+		return false
+	}
+
+	return true
+}
+
+// rdata returns the presentation form of a record's data.
+func rdata(rr dns.RR) string {
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
+
+// rewriteHandler applies the rewrite rules to the responses of the rest of
+// the chain.
+func (s *dnsServer) rewriteHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	response := next()
+	if response != nil {
+		s.rewrite(response)
+	}
+
+	return response
+}
+
+// rewrite applies the configured rewrite rules to the answer section of a
+// response, using the first rule that matches each record.
+func (s *dnsServer) rewrite(response *dns.Msg) {
+	if len(s.config.Rewrites) == 0 || len(response.Question) == 0 {
+		return
+	}
+
+	qname := response.Question[0].Name
+	answers := make([]dns.RR, 0, len(response.Answer))
+	for _, rr := range response.Answer {
+		for i := range s.config.Rewrites {
+			rule := &s.config.Rewrites[i]
+			if !rule.matches(qname, rr) {
+				continue
+			}
+
+			if rule.Strip {
+				rr = nil
+			} else {
+				header := *rr.Header()
+				rr = dns.Copy(rule.replacement)
+				header.Rdlength = 0
+				*rr.Header() = header
+			}
+			break
+		}
+
+		if rr != nil {
+			answers = append(answers, rr)
+		}
+	}
+	response.Answer = answers
+}
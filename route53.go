@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// route53Timeout is how long a request to the Route 53 API may take.
+const route53Timeout = 10 * time.Second
+
+// route53Namespace is the XML namespace of the Route 53 API.
+const route53Namespace = "https://route53.amazonaws.com/doc/2013-04-01/"
+
+// Route53Config keeps a copy of a Route 53 hosted zone in Zone, read again
+// every Interval, and with Push makes dynamic updates to the zone there too.
+type Route53Config struct {
+	Enabled bool `yaml:"enabled"`
+
+	// HostedZoneID is the ID of the hosted zone, such as
+	// Z0123456789ABCDEFGHIJ, and Zone its name.
+	HostedZoneID string `yaml:"hosted_zone_id"`
+	Zone         string `yaml:"zone"`
+
+	// AccessKeyID, SecretAccessKey and SessionToken are the AWS credentials
+	// the hosted zone is read with. Without them those of the
+	// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN
+	// environment variables are used.
+	AccessKeyID     string `yaml:"access_key_id"`
+	SecretAccessKey string `yaml:"secret_access_key"`
+	SessionToken    string `yaml:"session_token"`
+
+	// Endpoint is the URL of the Route 53 API.
+	Endpoint string `yaml:"endpoint"`
+
+	// Interval is how often the hosted zone is read again for changes.
+	// Zero reads it only when the records are reloaded.
+	Interval time.Duration `yaml:"interval"`
+
+	// Push makes dynamic updates to the zone in the hosted zone too, which
+	// otherwise refuses them.
+	Push bool `yaml:"push"`
+
+	client *http.Client
+}
+
+// parse validates the hosted zone and the endpoint, and canonicalises the
+// zone.
+func (c *Route53Config) parse() error {
+	c.HostedZoneID = strings.TrimPrefix(c.HostedZoneID, "/hostedzone/")
+	if c.HostedZoneID == "" {
+		return fmt.Errorf("route53 needs a hosted_zone_id")
+	}
+	if c.Zone == "" {
+		return fmt.Errorf("route53 needs a zone")
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "http" && endpoint.Scheme != "https") || endpoint.Host == "" {
+		return fmt.Errorf("invalid route53 endpoint %q", c.Endpoint)
+	}
+	if c.Interval < 0 {
+		return fmt.Errorf("invalid route53 interval %v", c.Interval)
+	}
+
+	if c.AccessKeyID == "" {
+		c.AccessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		c.SecretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		c.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return fmt.Errorf("route53 needs AWS credentials")
+	}
+
+	c.Endpoint = strings.TrimSuffix(c.Endpoint, "/")
+	c.Zone = dns.CanonicalName(c.Zone)
+	c.client = &http.Client{Timeout: route53Timeout}
+	return nil
+}
+
+// route53RecordSet is a resource record set of the hosted zone, holding its
+// values in the master file format. Alias record sets hold an AliasTarget
+// instead.
+type route53RecordSet struct {
+	Name            string          `xml:"Name"`
+	Type            string          `xml:"Type"`
+	SetIdentifier   string          `xml:"SetIdentifier,omitempty"`
+	AliasTarget     *struct{}       `xml:"AliasTarget"`
+	TTL             uint32          `xml:"TTL"`
+	ResourceRecords []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+// route53Record is a value of a resource record set.
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+// route53Page is a page of the resource record sets of the hosted zone,
+// followed by the record set the next page starts with if it is truncated.
+type route53Page struct {
+	RecordSets           []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	IsTruncated          bool               `xml:"IsTruncated"`
+	NextRecordName       string             `xml:"NextRecordName"`
+	NextRecordType       string             `xml:"NextRecordType"`
+	NextRecordIdentifier string             `xml:"NextRecordIdentifier"`
+}
+
+// route53Change is a change to a resource record set, made with the
+// CREATE, UPSERT or DELETE action.
+type route53Change struct {
+	Action    string           `xml:"Action"`
+	RecordSet route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+// route53ChangeRequest is the request making changes to the hosted zone.
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+// List reads the resource record sets of the hosted zone, a page at a time.
+// The SOA and NS records of the apex are left to the zone served locally,
+// and alias record sets, which name AWS resources rather than holding
+// records, are left out.
+func (c *Route53Config) List() ([]DNSRecord, error) {
+	var records []DNSRecord
+	query := url.Values{}
+	for {
+		var page route53Page
+		err := c.route53Do(http.MethodGet, "/rrset", query, nil, &page)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, set := range page.RecordSets {
+			name := route53Name(set.Name)
+			if set.AliasTarget != nil || (name == c.Zone && (set.Type == "SOA" || set.Type == "NS")) {
+				continue
+			}
+			for _, record := range set.ResourceRecords {
+				records = append(records, DNSRecord{Hostname: name, TTL: set.TTL, Type: set.Type, Data: record.Value})
+			}
+		}
+
+		if !page.IsTruncated {
+			return records, nil
+		}
+		query = url.Values{"name": {page.NextRecordName}, "type": {page.NextRecordType}}
+		if page.NextRecordIdentifier != "" {
+			query.Set("identifier", page.NextRecordIdentifier)
+		}
+	}
+}
+
+// Put adds the resource records of a record to their record sets in the
+// hosted zone, which take the time-to-live of the record.
+func (c *Route53Config) Put(record DNSRecord) error {
+	if !c.Push {
+		return errPublished
+	}
+
+	return c.change(record, func(set *route53RecordSet, rr dns.RR) {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		for _, value := range set.ResourceRecords {
+			if route53Data(set, value.Value) == data {
+				return
+			}
+		}
+		set.TTL = rr.Header().Ttl
+		set.ResourceRecords = append(set.ResourceRecords, route53Record{Value: data})
+	})
+}
+
+// Delete removes the resource records of a record from their record sets in
+// the hosted zone, deleting the record sets left empty.
+func (c *Route53Config) Delete(record DNSRecord) error {
+	if !c.Push {
+		return errPublished
+	}
+
+	return c.change(record, func(set *route53RecordSet, rr dns.RR) {
+		data := strings.TrimPrefix(rr.String(), rr.Header().String())
+		var kept []route53Record
+		for _, value := range set.ResourceRecords {
+			if route53Data(set, value.Value) != data {
+				kept = append(kept, value)
+			}
+		}
+		set.ResourceRecords = kept
+	})
+}
+
+// change makes the changes edit makes for each resource record of a record
+// to the record set holding it, which is read from the hosted zone first.
+// Only simple record sets are changed, as the record sets of a routing
+// policy are told apart by what they route to rather than by their records.
+func (c *Route53Config) change(record DNSRecord, edit func(*route53RecordSet, dns.RR)) error {
+	rrs, err := record.RRs(canonicalHostname(record.Hostname))
+	if err != nil {
+		return err
+	}
+
+	for _, rr := range rrs {
+		rrtype := dns.TypeToString[rr.Header().Rrtype]
+		var page route53Page
+		err := c.route53Do(http.MethodGet, "/rrset", url.Values{"name": {rr.Header().Name}, "type": {rrtype}, "maxitems": {"1"}}, nil, &page)
+		if err != nil {
+			return err
+		}
+
+		current := route53RecordSet{Name: rr.Header().Name, Type: rrtype, TTL: rr.Header().Ttl}
+		if len(page.RecordSets) > 0 && route53Name(page.RecordSets[0].Name) == canonicalHostname(rr.Header().Name) && page.RecordSets[0].Type == rrtype {
+			current = page.RecordSets[0]
+			if current.SetIdentifier != "" || current.AliasTarget != nil {
+				return fmt.Errorf("the %s records of %s in Route 53 are not a simple record set", rrtype, rr.Header().Name)
+			}
+		}
+
+		changed := current
+		changed.ResourceRecords = append([]route53Record(nil), current.ResourceRecords...)
+		edit(&changed, rr)
+		if reflect.DeepEqual(changed, current) {
+			continue
+		}
+
+		change := route53Change{Action: "UPSERT", RecordSet: changed}
+		if len(changed.ResourceRecords) == 0 {
+			change = route53Change{Action: "DELETE", RecordSet: current}
+		}
+		request := route53ChangeRequest{Xmlns: route53Namespace, Changes: []route53Change{change}}
+		err = c.route53Do(http.MethodPost, "/rrset/", nil, request, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Watch reads the hosted zone every Interval, announcing a change when its
+// records differ from the last read. The hosted zone is not followed with
+// no Interval.
+func (c *Route53Config) Watch(changed func()) error {
+	if c.Interval == 0 {
+		return nil
+	}
+
+	go func() {
+		ticker := time.NewTicker(c.Interval)
+		defer ticker.Stop()
+
+		last, err := c.List()
+		if err != nil {
+			log.Printf("Failed to read the Route 53 hosted zone: %v", err)
+		}
+		for range ticker.C {
+			records, err := c.List()
+			if err != nil {
+				log.Printf("Failed to read the Route 53 hosted zone: %v", err)
+				continue
+			}
+			if reflect.DeepEqual(records, last) {
+				continue
+			}
+			last = records
+			changed()
+		}
+	}()
+
+	return nil
+}
+
+// route53Do sends a request for path below the hosted zone to the Route 53
+// API, with body encoded as XML if given, decoding the XML it answers with
+// into value if given.
+func (c *Route53Config) route53Do(method, path string, query url.Values, body, value interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = xml.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = append([]byte(xml.Header), payload...)
+	}
+
+	address := c.Endpoint + "/2013-04-01/hostedzone/" + c.HostedZoneID + path
+	if len(query) > 0 {
+		address += "?" + strings.ReplaceAll(query.Encode(), "+", "%20")
+	}
+	request, err := http.NewRequest(method, address, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/xml")
+	}
+	c.sign(request, payload, time.Now().UTC())
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		var failure struct {
+			Message string `xml:"Error>Message"`
+		}
+		data, _ := io.ReadAll(response.Body)
+		if xml.Unmarshal(data, &failure) == nil && failure.Message != "" {
+			return fmt.Errorf("route 53 answered %s: %s", response.Status, failure.Message)
+		}
+		return fmt.Errorf("route 53 answered %s", response.Status)
+	}
+
+	if value == nil {
+		return nil
+	}
+	return xml.NewDecoder(response.Body).Decode(value)
+}
+
+// sign signs a request with the credentials, Route 53 being a global
+// service signed for us-east-1.
+func (c *Route53Config) sign(request *http.Request, payload []byte, now time.Time) {
+	credentials := awsCredentials{c.AccessKeyID, c.SecretAccessKey, c.SessionToken}
+	credentials.sign(request, payload, now, "us-east-1", "route53")
+}
+
+// route53Name returns the canonical form of a name as Route 53 gives it,
+// with the characters other than letters, digits, hyphens and underscores
+// escaped as three octal digits, such as \052 for the asterisk of a
+// wildcard.
+func route53Name(name string) string {
+	var unescaped strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] == '\\' && i+4 <= len(name) {
+			if c, err := strconv.ParseUint(name[i+1:i+4], 8, 8); err == nil {
+				unescaped.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped.WriteByte(name[i])
+	}
+
+	return canonicalHostname(unescaped.String())
+}
+
+// route53Data returns a value of a record set in the form the server writes
+// the data of a resource record, so that values are compared regardless of
+// how they were written to Route 53.
+func route53Data(set *route53RecordSet, value string) string {
+	rr, err := dns.NewRR(fmt.Sprintf("%s 0 IN %s %s", route53Name(set.Name), set.Type, value))
+	if err != nil || rr == nil {
+		return value
+	}
+
+	return strings.TrimPrefix(rr.String(), rr.Header().String())
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"log"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of the rules of response policy zones.
+const (
+	rpzNXDomain = iota
+	rpzNoData
+	rpzPassthru
+	rpzDrop
+	rpzLocalData
+)
+
+// rpzRule is what a response policy zone does with the names it triggers
+// on, and the records answering them for local data.
+type rpzRule struct {
+	action int
+	rrs    []dns.RR
+}
+
+// policySet holds the rules of the response policy zones of a set of
+// records, those of each zone keyed by the name they trigger on, which for
+// wildcard rules starts with "*.".
+type policySet struct {
+	records *DNSRecords
+	zones   []map[string]*rpzRule
+}
+
+// policies returns the rules of the response policy zones for the records
+// being served, built again whenever the records change, such as when a
+// policy zone is transferred from its primaries.
+func (s *dnsServer) policies() *policySet {
+	records := s.records.Load()
+	if current := s.policy.Load(); current != nil && current.records == records {
+		return current
+	}
+
+	s.policyMu.Lock()
+	defer s.policyMu.Unlock()
+	if current := s.policy.Load(); current != nil && current.records == records {
+		return current
+	}
+
+	policies := &policySet{records: records}
+	for _, origin := range s.config.Filter.PolicyZones {
+		zone := records.FindZone(origin)
+		if zone == nil || zone.Origin != origin {
+			log.Printf("Response policy zone %s is not a local zone", origin)
+			continue
+		}
+
+		rules, skipped, err := policyRules(records, zone)
+		if err != nil {
+			log.Printf("Failed to read response policy zone %s: %v", origin, err)
+			continue
+		}
+		if skipped > 0 {
+			log.Printf("Skipped %d rules of response policy zone %s with unsupported triggers or actions", skipped, origin)
+		}
+		policies.zones = append(policies.zones, rules)
+	}
+
+	s.policy.Store(policies)
+	return policies
+}
+
+// policyRules reads the rules of a response policy zone from its records,
+// returning how many it skipped. Only QNAME triggers are supported, and of
+// the special actions, NXDOMAIN (CNAME .), NODATA (CNAME *.), PASSTHRU
+// (CNAME rpz-passthru.) and DROP (CNAME rpz-drop.). Any other records are
+// local data answering the names they trigger on.
+func policyRules(records *DNSRecords, zone *Zone) (map[string]*rpzRule, int, error) {
+	rrs, err := records.zoneRRs(zone)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rules := map[string]*rpzRule{}
+	skipped := 0
+	for _, rr := range rrs {
+		owner := canonicalHostname(rr.Header().Name)
+		if owner == zone.Origin {
+			continue
+		}
+		trigger := strings.TrimSuffix(owner, zone.Origin)
+		if isPolicyTrigger(trigger) {
+			skipped++
+			continue
+		}
+
+		action := rpzLocalData
+		if cname, ok := rr.(*dns.CNAME); ok {
+			switch dns.CanonicalName(cname.Target) {
+			case ".":
+				action = rpzNXDomain
+			case "*.":
+				action = rpzNoData
+			case "rpz-passthru.":
+				action = rpzPassthru
+			case "rpz-drop.":
+				action = rpzDrop
+			default:
+				if strings.HasPrefix(cname.Target, "*.") || strings.HasPrefix(cname.Target, "rpz-") {
+					skipped++
+					continue
+				}
+			}
+		}
+
+		rule := rules[trigger]
+		if rule == nil {
+			rule = &rpzRule{action: action}
+			rules[trigger] = rule
+		}
+		if action == rpzLocalData {
+			rule.rrs = append(rule.rrs, rr)
+		}
+	}
+
+	return rules, skipped, nil
+}
+
+// isPolicyTrigger reports whether the name of a rule, relative to its zone,
+// triggers on something other than the name queried for, such as the
+// addresses of the answer or the client.
+func isPolicyTrigger(name string) bool {
+	for _, label := range dns.SplitDomainName(name) {
+		switch label {
+		case "rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip":
+			return true
+		}
+	}
+
+	return false
+}
+
+// rule returns the rule the first response policy zone holding one for a
+// name applies to it. A rule for the name itself takes precedence over a
+// wildcard rule, and wildcard rules for closer domains over those of
+// farther ones.
+func (p *policySet) rule(name string) *rpzRule {
+	name = canonicalHostname(name)
+	for _, rules := range p.zones {
+		if rule := rules[name]; rule != nil {
+			return rule
+		}
+		for offset, end := dns.NextLabel(name, 0); !end; offset, end = dns.NextLabel(name, offset) {
+			if rule := rules["*."+name[offset:]]; rule != nil {
+				return rule
+			}
+		}
+	}
+
+	return nil
+}
+
+// policyRule returns the rule of the response policy zones for a name, or
+// nil if they leave the name alone.
+func (s *dnsServer) policyRule(name string) *rpzRule {
+	if !s.config.Filter.Enabled || len(s.config.Filter.PolicyZones) == 0 {
+		return nil
+	}
+
+	return s.policies().rule(name)
+}
+
+// policyHandler answers the names the response policy zones rewrite as
+// their rules say, or drops their queries. Names of PASSTHRU rules are
+// exempt from the rest of the filter.
+func (s *dnsServer) policyHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	rule := s.policyRule(q.request.Question[0].Name)
+	if rule == nil {
+		return next()
+	}
+	if rule.action == rpzPassthru {
+		q.exempt = true
+		return next()
+	}
+
+	if !s.answerPolicy(q.request, q.response, rule, q.client) {
+		return nil
+	}
+	return q.response
+}
+
+// answerPolicy answers a query as a rule of the response policy zones says,
+// reporting false if the query is to be dropped. Local data that is an
+// alias is followed to its target, unless the target is local data too.
+func (s *dnsServer) answerPolicy(request *dns.Msg, response *dns.Msg, rule *rpzRule, client net.IP) bool {
+	question := request.Question[0]
+	switch rule.action {
+	case rpzDrop:
+		return false
+	case rpzNXDomain:
+		response.Rcode = dns.RcodeNameError
+		return true
+	case rpzNoData:
+		return true
+	}
+
+	var cname *dns.CNAME
+	for _, rr := range rule.rrs {
+		answer := dns.Copy(rr)
+		answer.Header().Name = question.Name
+		if answer.Header().Rrtype == question.Qtype || question.Qtype == dns.TypeANY {
+			response.Answer = append(response.Answer, answer)
+		} else if alias, ok := answer.(*dns.CNAME); ok {
+			cname = alias
+		}
+	}
+	if len(response.Answer) > 0 || cname == nil {
+		return true
+	}
+
+	response.Answer = append(response.Answer, cname)
+	if target := s.policyRule(cname.Target); target != nil && target.action == rpzLocalData {
+		return true
+	}
+	alias := request.Copy()
+	alias.Question[0].Name = cname.Target
+	if resolved := s.resolve(alias, client); resolved != nil {
+		response.Answer = append(response.Answer, resolved.Answer...)
+		response.Rcode = resolved.Rcode
+	}
+
+	return true
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferTimeout is how long a secondary waits for its primaries to answer
+// SOA queries and zone transfers.
+const transferTimeout = 10 * time.Second
+
+// minRefreshInterval keeps a secondary from hammering its primaries when
+// their SOA timers are very short.
+const minRefreshInterval = 10 * time.Second
+
+// followSecondaries starts keeping each secondary zone up to date with its
+// primaries, for zones that are not followed already.
+func (s *dnsServer) followSecondaries() {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	if s.refreshes == nil {
+		s.refreshes = map[string]chan struct{}{}
+	}
+	for _, zone := range s.records.Load().Zones {
+		if len(zone.Primaries) > 0 && s.refreshes[zone.Origin] == nil {
+			refresh := make(chan struct{}, 1)
+			s.refreshes[zone.Origin] = refresh
+			go s.followZone(zone.Origin, refresh)
+		}
+	}
+}
+
+// followZone refreshes a secondary zone from its primaries every SOA
+// refresh interval, or retry interval after a failure, until the zone is
+// removed from the records. The zone expires, and is no longer served, if it
+// cannot be refreshed within its SOA expire time. A NOTIFY from a primary
+// refreshes the zone straight away.
+func (s *dnsServer) followZone(origin string, refresh chan struct{}) {
+	// A copy of the zone saved to disk was current when it was written
+	var refreshed time.Time
+	if zone := s.records.Load().secondaryZone(origin); zone != nil && !zone.expired {
+		if info, err := os.Stat(zone.File); err == nil {
+			refreshed = info.ModTime()
+		}
+	}
+
+	for {
+		zone := s.followedZone(origin)
+		if zone == nil {
+			log.Printf("Stopped refreshing zone %s", origin)
+			return
+		}
+
+		err := s.refreshZone(zone)
+		if refreshedZone := s.records.Load().secondaryZone(origin); refreshedZone != nil {
+			zone = refreshedZone
+		}
+
+		wait := time.Duration(zone.SOA.Refresh) * time.Second
+		if err == nil {
+			refreshed = time.Now()
+		} else {
+			log.Printf("Failed to refresh zone %s: %v", origin, err)
+			wait = time.Duration(zone.SOA.Retry) * time.Second
+
+			if !zone.expired && time.Since(refreshed) > time.Duration(zone.SOA.Expire)*time.Second {
+				log.Printf("Zone %s expired without being refreshed", origin)
+				s.expireZone(origin)
+			}
+		}
+
+		select {
+		case <-time.After(max(wait, minRefreshInterval)):
+		case <-refresh:
+		}
+	}
+}
+
+// followedZone returns the secondary zone with the given origin, or nil once
+// it has been removed from the records, when it is no longer followed.
+func (s *dnsServer) followedZone(origin string) *Zone {
+	s.refreshMu.Lock()
+	defer s.refreshMu.Unlock()
+
+	zone := s.records.Load().secondaryZone(origin)
+	if zone == nil {
+		delete(s.refreshes, origin)
+	}
+
+	return zone
+}
+
+// secondaryZone returns the secondary zone with the given origin, or nil if
+// there is none.
+func (r *DNSRecords) secondaryZone(origin string) *Zone {
+	zone := r.FindZone(origin)
+	if zone == nil || zone.Origin != origin || len(zone.Primaries) == 0 {
+		return nil
+	}
+
+	return zone
+}
+
+// refreshZone brings a secondary zone up to date from the first of its
+// primaries that answers.
+func (s *dnsServer) refreshZone(zone *Zone) error {
+	var key *TSIGKey
+	if zone.TransferKey != "" {
+		key = s.config.tsigKey(zone.TransferKey)
+	}
+
+	var err error
+	for _, primary := range zone.Primaries {
+		err = s.refreshFrom(zone, upstreamAddress(primary), key)
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("%s: %v", primary, err)
+	}
+
+	return err
+}
+
+// refreshFrom checks the serial of a secondary zone on one of its primaries
+// and transfers the zone if the primary's copy is newer. A zone that has
+// not been transferred yet is always transferred whole, and one that is
+// already held incrementally where the primary supports it.
+func (s *dnsServer) refreshFrom(zone *Zone, primary string, key *TSIGKey) error {
+	if !zone.expired {
+		serial, err := primarySerial(zone.Origin, primary, key)
+		if err != nil {
+			return err
+		}
+		if !serialNewer(serial, zone.SOA.Serial) {
+			markRefreshed(zone)
+			return nil
+		}
+	}
+
+	request := new(dns.Msg)
+	if zone.expired {
+		request.SetAxfr(zone.Origin)
+	} else {
+		request.SetIxfr(zone.Origin, zone.SOA.Serial, zone.SOA.Mname, zone.SOA.Rname)
+	}
+
+	transfer := &dns.Transfer{DialTimeout: transferTimeout, ReadTimeout: transferTimeout}
+	if key != nil {
+		transfer.TsigSecret = map[string]string{key.Name: key.Secret}
+		request.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	envelopes, err := transfer.In(request, primary)
+	if err != nil {
+		return err
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	// A single SOA record means the zone is already up to date
+	if len(rrs) == 1 {
+		markRefreshed(zone)
+		return nil
+	}
+
+	return s.applyTransfer(zone.Origin, rrs)
+}
+
+// primarySerial queries a primary for the serial of a zone.
+func primarySerial(origin, primary string, key *TSIGKey) (uint32, error) {
+	query := new(dns.Msg)
+	query.SetQuestion(origin, dns.TypeSOA)
+
+	client := &dns.Client{Timeout: transferTimeout}
+	if key != nil {
+		client.TsigSecret = map[string]string{key.Name: key.Secret}
+		query.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	response, _, err := client.Exchange(query, primary)
+	if err != nil {
+		return 0, err
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		return 0, fmt.Errorf("SOA query answered with %s", dns.RcodeToString[response.Rcode])
+	}
+
+	for _, rr := range response.Answer {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Serial, nil
+		}
+	}
+
+	return 0, errors.New("SOA query answered without an SOA record")
+}
+
+// markRefreshed notes on disk that a secondary zone's saved copy has been
+// found to be current, so that it does not expire early after a restart.
+func markRefreshed(zone *Zone) {
+	if zone.File == "" {
+		return
+	}
+
+	now := time.Now()
+	err := os.Chtimes(zone.File, now, now)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("Failed to update zone file %s: %v", zone.File, err)
+	}
+}
+
+// applyTransfer replaces a secondary zone with its content from a transfer,
+// saving it to the zone's file and recording the change in its journal.
+func (s *dnsServer) applyTransfer(origin string, rrs []dns.RR) error {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	found := current.secondaryZone(origin)
+	if found == nil {
+		return errors.New("zone is no longer a secondary")
+	}
+	zone := *found
+
+	content, err := transferContent(current, &zone, rrs)
+	if err != nil {
+		return err
+	}
+
+	records := zone.loadRRs(content)
+	zone.expired = false
+	next, err := current.withZone(zone, records)
+	if err != nil {
+		return err
+	}
+
+	if zone.File != "" {
+		err = writeZoneFile(zone.File, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	if zone.journal != nil {
+		served, err := next.zoneRRs(next.FindZone(origin))
+		if err != nil {
+			return err
+		}
+		err = zone.journal.record(origin, served[:len(served)-1])
+		if err != nil {
+			log.Printf("Failed to save journal of zone %s: %v", origin, err)
+		}
+	}
+
+	s.serveRecords(next)
+	log.Printf("Transferred zone %s at serial %d with %d records", origin, zone.SOA.Serial, len(records))
+
+	s.notifyZone(origin)
+
+	// Members added to or removed from a catalog are followed or dropped
+	if zone.Catalog != nil {
+		next, err = next.withCatalogMembers(next)
+		if err != nil {
+			return err
+		}
+		s.serveRecords(next)
+		s.followSecondaries()
+	}
+
+	return nil
+}
+
+// transferContent returns a zone's content after a transfer, starting with
+// its SOA record: the records of a full transfer, or the zone's current
+// records with the changes of an incremental transfer applied (RFC 1995).
+func transferContent(records *DNSRecords, zone *Zone, rrs []dns.RR) ([]dns.RR, error) {
+	last := len(rrs) - 1
+	soa, ok := rrs[0].(*dns.SOA)
+	if !ok {
+		return nil, errors.New("transfer does not start with an SOA record")
+	}
+	if end, ok := rrs[last].(*dns.SOA); !ok || end.Serial != soa.Serial {
+		return nil, errors.New("transfer does not end with its SOA record")
+	}
+
+	old, ok := rrs[1].(*dns.SOA)
+	if zone.expired || !ok {
+		return rrs[:last], nil
+	}
+	if old.Serial != zone.SOA.Serial {
+		return nil, fmt.Errorf("incremental transfer starts from serial %d rather than %d", old.Serial, zone.SOA.Serial)
+	}
+
+	current, err := records.zoneRRs(zone)
+	if err != nil {
+		return nil, err
+	}
+	content := current[1 : len(current)-1]
+
+	// Each change lists the records removed after the old SOA record and
+	// those added after the new one
+	for i := 1; i < last; {
+		i++
+		for ; i < last && !isSOA(rrs[i]); i++ {
+			content = removeRR(content, rrs[i])
+		}
+		if i >= last {
+			return nil, errors.New("incremental transfer ends part way through a change")
+		}
+
+		i++
+		for ; i < last && !isSOA(rrs[i]); i++ {
+			content = append(removeRR(content, rrs[i]), rrs[i])
+		}
+	}
+
+	return append([]dns.RR{soa}, content...), nil
+}
+
+// isSOA reports whether a record is an SOA record.
+func isSOA(rr dns.RR) bool {
+	return rr.Header().Rrtype == dns.TypeSOA
+}
+
+// removeRR returns the records without any that are the same as rr, which
+// records are regardless of their TTL.
+func removeRR(rrs []dns.RR, rr dns.RR) []dns.RR {
+	var kept []dns.RR
+	for _, other := range rrs {
+		if !dns.IsDuplicate(other, rr) {
+			kept = append(kept, other)
+		}
+	}
+
+	return kept
+}
+
+// writeZoneFile saves a zone to a master file, replacing any earlier copy
+// only once the new one has been written in full.
+func writeZoneFile(filename string, rrs []dns.RR) error {
+	temporary := filename + ".tmp"
+	err := os.WriteFile(temporary, []byte(zoneFileText(rrs)), 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temporary, filename)
+}
+
+// zoneFileText returns records in the master file format (RFC 1035), one
+// per line.
+func zoneFileText(rrs []dns.RR) string {
+	var content strings.Builder
+	for _, rr := range rrs {
+		content.WriteString(rr.String())
+		content.WriteString("\n")
+	}
+
+	return content.String()
+}
+
+// expireZone stops serving a secondary zone that could not be refreshed in
+// time, until it is transferred again.
+func (s *dnsServer) expireZone(origin string) {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	found := current.secondaryZone(origin)
+	if found == nil {
+		return
+	}
+	zone := *found
+	zone.expired = true
+
+	next, err := current.withZone(zone, nil)
+	if err != nil {
+		log.Printf("Failed to expire zone %s: %v", origin, err)
+		return
+	}
+	s.serveRecords(next)
+}
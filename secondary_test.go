@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// servePrimary serves queries over UDP and zone transfers over TCP on the
+// same local port, returning its address.
+func servePrimary(t *testing.T, s *dnsServer) string {
+	t.Helper()
+
+	address := serveTestTCP(t, s)
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		for {
+			buf := make([]byte, 65535)
+			n, client, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			go s.serveUDP(conn, client, buf[:n])
+		}
+	}()
+
+	return address
+}
+
+// secondaryRRs returns the records a secondary serves for example.lan.
+func secondaryRRs(t *testing.T, s *dnsServer) []string {
+	t.Helper()
+
+	records := s.records.Load()
+	zone := records.FindZone("example.lan.")
+	if zone.expired {
+		t.Fatal("got the zone expired, want it served")
+	}
+	rrs, err := records.zoneRRs(zone)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return summarize(rrs)
+}
+
+func TestSecondaryZone(t *testing.T) {
+	dir := t.TempDir()
+	journal := filepath.Join(dir, "primary.journal")
+	primary := testServer(DefaultConfig(), journalVersions(t, journal, journalTestVersions[0]))
+	address := servePrimary(t, primary)
+
+	records := &DNSRecords{Zones: []Zone{{
+		Origin:    "example.lan.",
+		File:      filepath.Join(dir, "example.lan.zone"),
+		Primaries: []string{address},
+	}}}
+	err := records.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondary := testServer(DefaultConfig(), records)
+	if !records.Zones[0].expired {
+		t.Fatal("got the zone served before its first transfer")
+	}
+
+	// The first transfer is a full one, after which the primary's changes
+	// are transferred incrementally
+	for _, version := range journalTestVersions {
+		primary.records.Store(journalVersions(t, journal, version))
+		err = secondary.refreshZone(secondary.records.Load().FindZone("example.lan."))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want, err := primary.records.Load().zoneRRs(primary.records.Load().FindZone("example.lan."))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := secondaryRRs(t, secondary); !reflect.DeepEqual(got, summarize(want)) {
+			t.Fatalf("got %q at serial %d, want %q", got, version.serial, summarize(want))
+		}
+	}
+
+	// The saved copy is served after a restart
+	restarted := &DNSRecords{Zones: []Zone{{
+		Origin:    "example.lan.",
+		File:      filepath.Join(dir, "example.lan.zone"),
+		Primaries: []string{address},
+	}}}
+	err = restarted.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := secondaryRRs(t, testServer(DefaultConfig(), restarted)), secondaryRRs(t, secondary); !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q after a restart, want %q", got, want)
+	}
+}
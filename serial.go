@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Serial policies choosing the serial of a new version of a zone.
+const (
+	serialIncrement = "increment"
+	serialDate      = "date"
+)
+
+// checkSerialPolicy checks that the zone's serial policy is supported.
+func (z *Zone) checkSerialPolicy() error {
+	switch z.SerialPolicy {
+	case "", serialIncrement, serialDate:
+		return nil
+	}
+
+	return fmt.Errorf("unsupported serial_policy %q for zone %s", z.SerialPolicy, z.Origin)
+}
+
+// nextSerial returns the serial following serial under a policy: the next
+// number, or under the date policy the first serial of the day in the
+// YYYYMMDDnn form if that is newer.
+func nextSerial(policy string, serial uint32) uint32 {
+	next := serial + 1
+	if policy == serialDate {
+		year, month, day := time.Now().UTC().Date()
+		today := uint32(year*1000000 + int(month)*10000 + day*100)
+		if serialNewer(today, next) {
+			next = today
+		}
+	}
+
+	return next
+}
+
+// followSerial gives a zone with a serial policy the serial of the
+// previous version of its content if the content is unchanged, or the
+// serial following it if it changed, unless the zone sets a newer serial of
+// its own. Both contents start with their SOA records.
+func (z *Zone) followSerial(content, previous []dns.RR) {
+	if z.SerialPolicy == "" || len(z.Primaries) > 0 || len(previous) == 0 {
+		return
+	}
+
+	old := previous[0].(*dns.SOA)
+	if serialNewer(z.SOA.Serial, old.Serial) {
+		return
+	}
+
+	soa := dns.Copy(content[0]).(*dns.SOA)
+	soa.Serial = old.Serial
+	unchanged := soa.String() == old.String() &&
+		len(missingRRs(content[1:], previous[1:])) == 0 &&
+		len(missingRRs(previous[1:], content[1:])) == 0
+	if unchanged {
+		z.SOA.Serial = old.Serial
+	} else {
+		z.SOA.Serial = nextSerial(z.SerialPolicy, old.Serial)
+	}
+}
+
+// followSerials follows the serials of zones with a serial policy on from
+// those of the zones they replace. Zones with a journal are left out, as
+// their serials follow on from their journals as they are loaded.
+func (r *DNSRecords) followSerials(current *DNSRecords) error {
+	for i := range r.Zones {
+		zone := &r.Zones[i]
+		old := current.FindZone(zone.Origin)
+		if zone.SerialPolicy == "" || zone.journal != nil || old == nil || old.Origin != zone.Origin || old.expired {
+			continue
+		}
+
+		content, err := r.zoneRRs(zone)
+		if err != nil {
+			return err
+		}
+		previous, err := current.zoneRRs(old)
+		if err != nil {
+			return err
+		}
+		zone.followSerial(content[:len(content)-1], previous[:len(previous)-1])
+	}
+
+	return nil
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"crypto"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneSigning enables online DNSSEC signing of a zone's answers, with keys
+// kept in KeyDirectory in the BIND format.
+type ZoneSigning struct {
+	// KeyDirectory holds the keys, which are generated with Algorithm if
+	// there are none yet.
+	KeyDirectory string `yaml:"key_directory"`
+	Algorithm    string `yaml:"algorithm"`
+
+	// Denial is how missing names and types are proven, with NSEC or NSEC3.
+	Denial string `yaml:"denial"`
+
+	// ZSKLifetime is how long a zone signing key signs before it is rolled
+	// over.
+	ZSKLifetime time.Duration `yaml:"zsk_lifetime"`
+
+	// CDS publishes CDS and CDNSKEY records for the key signing keys (RFC
+	// 7344), so that the parent can keep its DS records up to date.
+	CDS bool `yaml:"cds"`
+}
+
+// signingKeyBits is the key size generated for each supported algorithm.
+var signingKeyBits = map[uint8]int{
+	dns.RSASHA256:       2048,
+	dns.RSASHA512:       2048,
+	dns.ECDSAP256SHA256: 256,
+	dns.ECDSAP384SHA384: 384,
+	dns.ED25519:         256,
+}
+
+// signatureValidity is how long online signatures are valid for, and
+// signatureSkew how far their inception is backdated to allow for clients
+// with slow clocks.
+const (
+	signatureValidity = 7 * 24 * time.Hour
+	signatureSkew     = time.Hour
+)
+
+// keyPublishInterval is how long a new zone signing key is published before
+// it signs, and how long an old one stays published after it stops, so that
+// the DNSKEY RRsets and signatures cached by resolvers stay valid through a
+// rollover. Rollovers are checked for every keyRolloverCheck.
+const (
+	keyPublishInterval = 24 * time.Hour
+	keyRolloverCheck   = time.Hour
+)
+
+// keyTimeFormat is the format of the times in a key's timing metadata.
+const keyTimeFormat = "20060102150405"
+
+// timingFields are the names of the timing metadata of a key, in the order
+// they are written.
+var timingFields = []string{"Created", "Publish", "Activate", "Inactive", "Delete"}
+
+// keyTiming holds the times of a key's lifecycle, kept as BIND keeps them in
+// comments of its .key file. A key with no Publish or Activate time is
+// published and signs from the start, and one with no Inactive or Delete
+// time keeps doing so.
+type keyTiming struct {
+	Created  time.Time
+	Publish  time.Time
+	Activate time.Time
+	Inactive time.Time
+	Delete   time.Time
+}
+
+// fields returns the times of the timing metadata by name.
+func (t *keyTiming) fields() map[string]*time.Time {
+	return map[string]*time.Time{
+		"Created":  &t.Created,
+		"Publish":  &t.Publish,
+		"Activate": &t.Activate,
+		"Inactive": &t.Inactive,
+		"Delete":   &t.Delete,
+	}
+}
+
+// signingKey is a DNSKEY record with its private key, the path of its files
+// without their extension and its timing metadata.
+type signingKey struct {
+	dnskey  *dns.DNSKEY
+	private crypto.Signer
+	file    string
+	timing  keyTiming
+}
+
+// published reports whether the key is in the zone's DNSKEY RRset at now.
+func (k signingKey) published(now time.Time) bool {
+	return !now.Before(k.timing.Publish) && !k.deleted(now)
+}
+
+// deleted reports whether the key has been removed from the zone at now.
+func (k signingKey) deleted(now time.Time) bool {
+	return !k.timing.Delete.IsZero() && !now.Before(k.timing.Delete)
+}
+
+// activated reports whether the key has started signing at now.
+func (k signingKey) activated(now time.Time) bool {
+	return k.published(now) && !now.Before(k.timing.Activate)
+}
+
+// retired reports whether the key has stopped signing at now.
+func (k signingKey) retired(now time.Time) bool {
+	return !k.timing.Inactive.IsZero() && !now.Before(k.timing.Inactive)
+}
+
+// isKSK reports whether the key is a key signing key.
+func (k signingKey) isKSK() bool {
+	return k.dnskey.Flags&dns.SEP != 0
+}
+
+// zoneSigner signs the records of a zone as they are served, with the keys
+// that are active at the time, and rolls its zone signing key over.
+type zoneSigner struct {
+	origin    string
+	config    *ZoneSigning
+	algorithm uint8
+
+	mu   sync.Mutex
+	keys []signingKey
+}
+
+// newZoneSigner loads the keys of a zone from its key directory, generating
+// any that are missing and rolling over any whose lifetime is running out.
+func newZoneSigner(origin string, config *ZoneSigning) (*zoneSigner, error) {
+	algorithm, ok := dns.StringToAlgorithm[strings.ToUpper(config.Algorithm)]
+	if !ok || signingKeyBits[algorithm] == 0 {
+		return nil, fmt.Errorf("unsupported DNSSEC algorithm %q for zone %s", config.Algorithm, origin)
+	}
+
+	signer := &zoneSigner{origin: origin, config: config, algorithm: algorithm}
+	files, err := filepath.Glob(filepath.Join(config.KeyDirectory, "K"+origin+"+*.key"))
+	if err != nil {
+		return nil, err
+	}
+
+	// Keys removed from the zone are left in the directory, but not loaded
+	now := time.Now()
+	for _, file := range files {
+		key, err := readSigningKey(file)
+		if err != nil {
+			return nil, err
+		}
+		if !key.deleted(now) {
+			signer.keys = append(signer.keys, key)
+		}
+	}
+
+	err = signer.roll(now)
+	if err != nil {
+		return nil, err
+	}
+
+	return signer, nil
+}
+
+// readSigningKey reads a key from a BIND .key file and the matching
+// .private file.
+func readSigningKey(file string) (signingKey, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	rr, err := dns.NewRR(string(data))
+	if err != nil {
+		return signingKey{}, fmt.Errorf("invalid key in %s: %v", file, err)
+	}
+	dnskey, ok := rr.(*dns.DNSKEY)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s does not hold a DNSKEY record", file)
+	}
+
+	// Timing metadata is written in comments such as
+	// "; Activate: 20240101000000 (Mon Jan  1 00:00:00 2024)"
+	var timing keyTiming
+	fields := timing.fields()
+	for _, line := range strings.Split(string(data), "\n") {
+		comment, ok := strings.CutPrefix(strings.TrimSpace(line), ";")
+		if !ok {
+			continue
+		}
+		name, value, _ := strings.Cut(comment, ":")
+		field := fields[strings.TrimSpace(name)]
+		if field == nil || len(strings.Fields(value)) == 0 {
+			continue
+		}
+
+		*field, err = time.Parse(keyTimeFormat, strings.Fields(value)[0])
+		if err != nil {
+			return signingKey{}, fmt.Errorf("invalid %s time in %s", strings.TrimSpace(name), file)
+		}
+	}
+
+	privateFile := strings.TrimSuffix(file, ".key") + ".private"
+	privateData, err := os.Open(privateFile)
+	if err != nil {
+		return signingKey{}, err
+	}
+	defer privateData.Close()
+
+	private, err := dnskey.ReadPrivateKey(privateData, privateFile)
+	if err != nil {
+		return signingKey{}, err
+	}
+	signer, ok := private.(crypto.Signer)
+	if !ok {
+		return signingKey{}, fmt.Errorf("%s does not hold a signing key", privateFile)
+	}
+
+	return signingKey{
+		dnskey:  dnskey,
+		private: signer,
+		file:    strings.TrimSuffix(file, ".key"),
+		timing:  timing,
+	}, nil
+}
+
+// generateSigningKey creates a new key for a zone with the given timing and
+// saves it to the key directory.
+func generateSigningKey(origin string, flags uint16, algorithm uint8, directory string, timing keyTiming) (signingKey, error) {
+	dnskey := &dns.DNSKEY{
+		Hdr: dns.RR_Header{
+			Name:   origin,
+			Rrtype: dns.TypeDNSKEY,
+			Class:  dns.ClassINET,
+			Ttl:    3600,
+		},
+		Flags:     flags,
+		Protocol:  3,
+		Algorithm: algorithm,
+	}
+
+	private, err := dnskey.Generate(signingKeyBits[algorithm])
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	timing.Created = time.Now()
+	key := signingKey{
+		dnskey:  dnskey,
+		private: private.(crypto.Signer),
+		file:    filepath.Join(directory, fmt.Sprintf("K%s+%03d+%05d", origin, algorithm, dnskey.KeyTag())),
+		timing:  timing,
+	}
+	err = key.save()
+	if err != nil {
+		return signingKey{}, err
+	}
+	err = os.WriteFile(key.file+".private", []byte(dnskey.PrivateKeyString(private)), 0600)
+	if err != nil {
+		return signingKey{}, err
+	}
+
+	log.Printf("Generated DNSSEC key %d for zone %s", dnskey.KeyTag(), origin)
+
+	return key, nil
+}
+
+// save writes the key's DNSKEY record to its .key file, after its timing
+// metadata.
+func (k signingKey) save() error {
+	var text strings.Builder
+	fields := k.timing.fields()
+	for _, name := range timingFields {
+		if t := fields[name].UTC(); !fields[name].IsZero() {
+			fmt.Fprintf(&text, "; %s: %s (%s)\n", name, t.Format(keyTimeFormat), t.Format(time.ANSIC))
+		}
+	}
+	text.WriteString(k.dnskey.String() + "\n")
+
+	return os.WriteFile(k.file+".key", []byte(text.String()), 0644)
+}
+
+// roll brings the zone's keys up to date at now. Keys removed from the zone
+// are dropped, a key signing or zone signing key is generated if none is
+// left to sign, and with a ZSKLifetime the zone signing key in use is given
+// an end, with a successor published in time to take over from it.
+func (s *zoneSigner) roll(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []signingKey
+	for _, key := range s.keys {
+		if key.deleted(now) {
+			log.Printf("Removed DNSSEC key %d from zone %s", key.dnskey.KeyTag(), s.origin)
+			continue
+		}
+		kept = append(kept, key)
+	}
+	s.keys = kept
+
+	for _, flags := range []uint16{dns.ZONE | dns.SEP, dns.ZONE} {
+		if s.lastKey(flags&dns.SEP != 0, now) >= 0 {
+			continue
+		}
+
+		key, err := generateSigningKey(s.origin, flags, s.algorithm, s.config.KeyDirectory, keyTiming{Publish: now, Activate: now})
+		if err != nil {
+			return err
+		}
+		s.keys = append(s.keys, key)
+	}
+
+	lifetime := s.config.ZSKLifetime
+	if lifetime == 0 {
+		return nil
+	}
+
+	// The zone signing key activated last is either the one in use or its
+	// successor, already published
+	current := &s.keys[s.lastKey(false, now)]
+	if current.timing.Inactive.IsZero() {
+		start := current.timing.Activate
+		if start.IsZero() {
+			start = now
+		}
+		current.timing.Inactive = start.Add(lifetime)
+		current.timing.Delete = current.timing.Inactive.Add(keyPublishInterval)
+		err := current.save()
+		if err != nil {
+			return err
+		}
+	}
+	if now.Before(current.timing.Inactive.Add(-keyPublishInterval)) {
+		return nil
+	}
+
+	activate := current.timing.Inactive
+	successor, err := generateSigningKey(s.origin, dns.ZONE, s.algorithm, s.config.KeyDirectory, keyTiming{
+		Publish:  now,
+		Activate: activate,
+		Inactive: activate.Add(lifetime),
+		Delete:   activate.Add(lifetime + keyPublishInterval),
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Rolling over DNSSEC key %d of zone %s to key %d at %s", current.dnskey.KeyTag(), s.origin, successor.dnskey.KeyTag(), activate.Format(time.RFC3339))
+	s.keys = append(s.keys, successor)
+
+	return nil
+}
+
+// lastKey returns the index of the key signing or zone signing key that is
+// activated last of those not retired at now, or -1 if there is none. Keys
+// with no Activate time count as activated first.
+func (s *zoneSigner) lastKey(ksk bool, now time.Time) int {
+	last := -1
+	for i, key := range s.keys {
+		if key.isKSK() != ksk || key.retired(now) {
+			continue
+		}
+		if last < 0 || !key.timing.Activate.Before(s.keys[last].timing.Activate) {
+			last = i
+		}
+	}
+
+	return last
+}
+
+// signingKeys returns the key signing or zone signing keys that sign at now,
+// or if none do, the one activated last, rather than leaving answers
+// unsigned. The key activated last comes last.
+func (s *zoneSigner) signingKeys(ksk bool, now time.Time) []signingKey {
+	var keys, activated []signingKey
+	for _, key := range s.keys {
+		if key.isKSK() != ksk || !key.activated(now) {
+			continue
+		}
+
+		if !key.retired(now) {
+			keys = append(keys, key)
+		}
+		activated = append(activated, key)
+	}
+	if len(keys) == 0 && len(activated) > 0 {
+		keys = activated
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].timing.Activate.Before(keys[j].timing.Activate)
+	})
+
+	return keys
+}
+
+// DNSKEYs returns the zone's published DNSKEY records under the given owner
+// name.
+func (s *zoneSigner) DNSKEYs(name string) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rrs []dns.RR
+	now := time.Now()
+	for _, key := range s.keys {
+		if !key.published(now) {
+			continue
+		}
+
+		rr := dns.Copy(key.dnskey).(*dns.DNSKEY)
+		rr.Hdr.Name = name
+		rrs = append(rrs, rr)
+	}
+
+	return rrs
+}
+
+// CDSRRs returns the CDS and CDNSKEY records of the zone's key signing keys
+// under the given owner name, asking the parent zone for DS records that
+// match them.
+func (s *zoneSigner) CDSRRs(name string) []dns.RR {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var rrs []dns.RR
+	for _, key := range s.signingKeys(true, time.Now()) {
+		cds := key.dnskey.ToDS(dns.SHA256).ToCDS()
+		cds.Hdr.Name = name
+		cdnskey := key.dnskey.ToCDNSKEY()
+		cdnskey.Hdr.Name = name
+		rrs = append(rrs, cds, cdnskey)
+	}
+
+	return rrs
+}
+
+// DS returns the DS record for the zone's key signing key, which is added
+// to the parent zone or configured as a trust anchor.
+func (s *zoneSigner) DS() *dns.DS {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.signingKeys(true, time.Now())
+	return keys[len(keys)-1].dnskey.ToDS(dns.SHA256)
+}
+
+// Sign returns the signatures over an RRset, made with each key signing key
+// for the DNSKEY, CDS and CDNSKEY RRsets and with the zone signing key
+// otherwise.
+func (s *zoneSigner) Sign(rrset []dns.RR) ([]dns.RR, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var keys []signingKey
+	switch rrset[0].Header().Rrtype {
+	case dns.TypeDNSKEY, dns.TypeCDS, dns.TypeCDNSKEY:
+		keys = s.signingKeys(true, now)
+	default:
+		keys = s.signingKeys(false, now)
+		keys = keys[len(keys)-1:]
+	}
+
+	var sigs []dns.RR
+	for _, key := range keys {
+		sig := &dns.RRSIG{
+			Hdr: dns.RR_Header{
+				Name:   rrset[0].Header().Name,
+				Rrtype: dns.TypeRRSIG,
+				Class:  dns.ClassINET,
+				Ttl:    rrset[0].Header().Ttl,
+			},
+			KeyTag:     key.dnskey.KeyTag(),
+			SignerName: key.dnskey.Hdr.Name,
+			Algorithm:  key.dnskey.Algorithm,
+			Inception:  uint32(now.Add(-signatureSkew).Unix()),
+			Expiration: uint32(now.Add(signatureValidity).Unix()),
+		}
+
+		err := sig.Sign(key.private, rrset)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+
+	return sigs, nil
+}
+
+// rollSigningKeys rolls the keys of signed zones over as their lifetimes
+// run out, checking every keyRolloverCheck.
+func (s *dnsServer) rollSigningKeys() {
+	go func() {
+		ticker := time.NewTicker(keyRolloverCheck)
+		defer ticker.Stop()
+
+		for now := range ticker.C {
+			s.updateMu.Lock()
+			for _, zone := range s.records.Load().Zones {
+				if zone.signer == nil {
+					continue
+				}
+
+				err := zone.signer.roll(now)
+				if err != nil {
+					log.Printf("Failed to roll over DNSSEC keys of zone %s: %v", zone.Origin, err)
+				}
+			}
+			s.updateMu.Unlock()
+		}
+	}()
+}
+
+// signResponse adds signatures to the RRsets of a response that belong to
+// a signed local zone.
+func signResponse(records *DNSRecords, msg *dns.Msg) {
+	for _, section := range []*[]dns.RR{&msg.Answer, &msg.Ns, &msg.Extra} {
+		for _, rrset := range rrsets(*section) {
+			zone := records.FindZone(rrset[0].Header().Name)
+			if zone == nil || zone.signer == nil {
+				continue
+			}
+
+			sigs, err := zone.signer.Sign(rrset)
+			if err != nil {
+				log.Printf("Failed to sign %s: %v", rrset[0].Header().Name, err)
+				continue
+			}
+
+			*section = append(*section, sigs...)
+		}
+	}
+}
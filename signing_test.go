@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// signedServer returns a server for the signed zone example.lan., whose
+// keys are generated in a temporary directory.
+func signedServer(t *testing.T) *dnsServer {
+	t.Helper()
+
+	records := &DNSRecords{
+		Zones: []Zone{{
+			Origin: "example.lan.",
+			NS:     []string{"ns1.example.lan."},
+			DNSSEC: &ZoneSigning{KeyDirectory: t.TempDir()},
+		}},
+		Records: []DNSRecord{
+			{Hostname: "ns1.example.lan.", IP: "192.168.1.1"},
+			{Hostname: "www.example.lan.", IP: "192.168.1.10"},
+		},
+	}
+	err := records.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testServer(DefaultConfig(), records)
+}
+
+// testServer returns a server for config answering from records.
+func testServer(config *Config, records *DNSRecords) *dnsServer {
+	s := &dnsServer{config: config, chain: append([]chainHandler{}, defaultChain...)}
+	s.records.Store(records)
+	return s
+}
+
+// signedQuery resolves a query for name, asking for signatures if do is
+// set.
+func signedQuery(s *dnsServer, name string, qtype uint16, do bool) *dns.Msg {
+	request := new(dns.Msg)
+	request.SetQuestion(name, qtype)
+	request.SetEdns0(1232, do)
+
+	return s.resolve(request, net.ParseIP("192.168.1.20"))
+}
+
+// activeKey returns the key signing or zone signing key a signer signs
+// with now.
+func activeKey(signer *zoneSigner, ksk bool) *dns.DNSKEY {
+	keys := signer.signingKeys(ksk, time.Now())
+	return keys[len(keys)-1].dnskey
+}
+
+// verifySection checks that every RRset of a section is signed, with the
+// key signing key for DNSKEY records and the zone signing key otherwise.
+func verifySection(t *testing.T, signer *zoneSigner, section []dns.RR) {
+	t.Helper()
+
+	for _, rrset := range rrsets(section) {
+		key := activeKey(signer, false)
+		if rrset[0].Header().Rrtype == dns.TypeDNSKEY {
+			key = activeKey(signer, true)
+		}
+
+		sigs := signatures(rrset, section)
+		if len(sigs) != 1 {
+			t.Fatalf("got %d signatures over %v, want 1", len(sigs), rrset)
+		}
+		if sigs[0].KeyTag != key.KeyTag() {
+			t.Fatalf("got %v signed with key %d, want key %d", rrset, sigs[0].KeyTag, key.KeyTag())
+		}
+		err := sigs[0].Verify(key, rrset)
+		if err != nil {
+			t.Fatalf("signature over %v does not verify: %v", rrset, err)
+		}
+	}
+}
+
+func TestZoneSignerKeys(t *testing.T) {
+	config := &ZoneSigning{KeyDirectory: t.TempDir(), Algorithm: "ECDSAP256SHA256"}
+	signer, err := newZoneSigner("example.lan.", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ksk, zsk := activeKey(signer, true), activeKey(signer, false)
+	if ksk.Flags&dns.SEP == 0 || zsk.Flags&dns.SEP != 0 {
+		t.Fatalf("got key flags %d and %d, want a KSK and a ZSK", ksk.Flags, zsk.Flags)
+	}
+	files, err := os.ReadDir(config.KeyDirectory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("got %d key files, want 4", len(files))
+	}
+
+	// The keys are loaded again rather than generated anew
+	loaded, err := newZoneSigner("example.lan.", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if activeKey(loaded, true).KeyTag() != ksk.KeyTag() || activeKey(loaded, false).KeyTag() != zsk.KeyTag() {
+		t.Fatal("keys were generated again instead of loaded")
+	}
+	if ds := loaded.DS(); ds.KeyTag != ksk.KeyTag() || ds.DigestType != dns.SHA256 {
+		t.Fatalf("got DS %v, want the SHA-256 digest of the KSK", ds)
+	}
+
+	_, err = newZoneSigner("example.lan.", &ZoneSigning{KeyDirectory: t.TempDir(), Algorithm: "DSA"})
+	if err == nil {
+		t.Fatal("generated keys for an unsupported algorithm")
+	}
+}
+
+func TestSignedAnswers(t *testing.T) {
+	s := signedServer(t)
+	signer := s.records.Load().Zones[0].signer
+
+	tests := []struct {
+		name    string
+		qtype   uint16
+		do      bool
+		rcode   int
+		answers int
+	}{
+		{"www.example.lan.", dns.TypeA, true, dns.RcodeSuccess, 1},
+		{"example.lan.", dns.TypeDNSKEY, true, dns.RcodeSuccess, 2},
+		{"example.lan.", dns.TypeNS, true, dns.RcodeSuccess, 1},
+		{"www.example.lan.", dns.TypeAAAA, true, dns.RcodeSuccess, 0},
+		{"missing.example.lan.", dns.TypeA, true, dns.RcodeNameError, 0},
+		{"www.example.lan.", dns.TypeA, false, dns.RcodeSuccess, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(dns.TypeToString[test.qtype]+" "+test.name, func(t *testing.T) {
+			response := signedQuery(s, test.name, test.qtype, test.do)
+			if response.Rcode != test.rcode {
+				t.Fatalf("got rcode %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			}
+			answers := 0
+			for _, rrset := range rrsets(response.Answer) {
+				answers += len(rrset)
+			}
+			if answers != test.answers {
+				t.Fatalf("got answers %v, want %d", response.Answer, test.answers)
+			}
+
+			if !test.do {
+				for _, rr := range append(response.Answer, response.Ns...) {
+					if rr.Header().Rrtype == dns.TypeRRSIG {
+						t.Fatalf("got signature %v without the DO flag", rr)
+					}
+				}
+				return
+			}
+			verifySection(t, signer, response.Answer)
+			verifySection(t, signer, response.Ns)
+		})
+	}
+}
+
+// zoneSigningKeys returns the tags of a signer's zone signing keys that are
+// published at now, and of the one it signs with.
+func zoneSigningKeys(signer *zoneSigner, now time.Time) ([]uint16, uint16) {
+	var published []uint16
+	for _, key := range signer.keys {
+		if !key.isKSK() && key.published(now) {
+			published = append(published, key.dnskey.KeyTag())
+		}
+	}
+	keys := signer.signingKeys(false, now)
+
+	return published, keys[len(keys)-1].dnskey.KeyTag()
+}
+
+func TestZoneSignerRollover(t *testing.T) {
+	lifetime := 30 * 24 * time.Hour
+	config := &ZoneSigning{KeyDirectory: t.TempDir(), Algorithm: "ECDSAP256SHA256", ZSKLifetime: lifetime}
+	signer, err := newZoneSigner("example.lan.", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := signer.keys[signer.lastKey(false, time.Now())]
+	if first.timing.Inactive.IsZero() {
+		t.Fatal("got a zone signing key with no end, want its lifetime applied")
+	}
+	end := first.timing.Inactive
+
+	// The successor is published ahead of taking over, and the old key
+	// kept published until signatures made with it have expired
+	err = signer.roll(end.Add(-keyPublishInterval))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signer.keys) != 3 {
+		t.Fatalf("got %d keys, want a successor generated", len(signer.keys))
+	}
+	successor := signer.keys[2].dnskey.KeyTag()
+	firstTag := first.dnskey.KeyTag()
+
+	tests := []struct {
+		name      string
+		at        time.Time
+		published []uint16
+		signing   uint16
+	}{
+		{"before the rollover", end.Add(-time.Hour), []uint16{firstTag, successor}, firstTag},
+		{"after the rollover", end.Add(time.Hour), []uint16{firstTag, successor}, successor},
+		{"after the old key is removed", end.Add(keyPublishInterval + time.Hour), []uint16{successor}, successor},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			published, signing := zoneSigningKeys(signer, test.at)
+			if !reflect.DeepEqual(published, test.published) || signing != test.signing {
+				t.Fatalf("got keys %v signing with %d, want %v signing with %d", published, signing, test.published, test.signing)
+			}
+		})
+	}
+
+	// The timings are saved with the keys, so the rollover carries on
+	// after a restart
+	loaded, err := newZoneSigner("example.lan.", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, signing := zoneSigningKeys(loaded, end.Add(time.Hour)); signing != successor {
+		t.Fatalf("got key %d signing after a restart, want %d", signing, successor)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// withState returns the records with the zones saved in the state file
+// served in place of those of the records file, so that dynamic updates to
+// zones without a file of their own survive restarts and reloads. A zone
+// whose serial in the records file is newer than the saved one was edited
+// since, and is served as the records file has it.
+func (r *DNSRecords) withState(filename string) (*DNSRecords, error) {
+	state, err := readState(filename)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	next := r
+	for _, saved := range state.Zones {
+		found := next.FindZone(saved.Origin)
+		if found == nil || found.Origin != saved.Origin || found.File != "" || len(found.Primaries) > 0 {
+			continue
+		}
+		if serialNewer(found.SOA.Serial, saved.SOA.Serial) {
+			log.Printf("Zone %s in the records file is newer than its changes saved to %s, which are discarded", saved.Origin, filename)
+			continue
+		}
+
+		zone := *found
+		zone.SOA = saved.SOA
+		zone.NS = saved.NS
+		next, err = next.withZone(zone, unexpired(saved.qualifiedRecords(), time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("Loaded saved changes to zone %s at serial %d from %s", zone.Origin, zone.SOA.Serial, filename)
+	}
+
+	return next, nil
+}
+
+// readState reads the zones saved to a state file.
+func readState(filename string) (*DNSRecords, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &DNSRecords{}
+	err = yaml.Unmarshal(data, state)
+	if err != nil {
+		return nil, err
+	}
+
+	return state, nil
+}
+
+// saveZoneState saves a zone and its records to the state file in the
+// records file format, replacing any version of the zone saved before.
+func saveZoneState(filename string, zone *Zone, records []DNSRecord) error {
+	state, err := readState(filename)
+	if os.IsNotExist(err) {
+		state, err = &DNSRecords{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	saved := Zone{Origin: zone.Origin, NS: zone.NS, SOA: zone.SOA}
+	for _, record := range records {
+		saved.Records = append(saved.Records, savedRecord(record))
+	}
+
+	zones := []Zone{saved}
+	for _, other := range state.Zones {
+		if other.Origin != zone.Origin {
+			zones = append(zones, other)
+		}
+	}
+	state.Zones = zones
+
+	return SaveRecords(filename, state)
+}
+
+// savedRecord returns a record loaded from a resource record as a record of
+// the records file, giving its type and data in the master file format.
+func savedRecord(record DNSRecord) DNSRecord {
+	header := record.rr.Header()
+	return DNSRecord{
+		Hostname: header.Name,
+		TTL:      header.Ttl,
+		Type:     dns.Type(header.Rrtype).String(),
+		Data:     strings.TrimPrefix(record.rr.String(), header.String()),
+		Expires:  record.Expires,
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Store is a place records are kept in or published from, such as Redis or
+// a Docker host, whose records are served along with those of the records
+// file and loaded again as it announces changes.
+type Store interface {
+	// List returns every record of the store.
+	List() ([]DNSRecord, error)
+
+	// Put adds a record to the store, and Delete removes one.
+	Put(record DNSRecord) error
+	Delete(record DNSRecord) error
+
+	// Watch starts following the store in the background, calling changed
+	// whenever its records may have changed.
+	Watch(changed func()) error
+}
+
+// errPublished is returned when changing the records of a store that
+// publishes them from another system, which owns them.
+var errPublished = errors.New("published records cannot be changed")
+
+// configuredStore is a store that is configured, what it is called in
+// messages, and the zone its records are published in if they have one of
+// their own.
+type configuredStore struct {
+	Store
+	name string
+	zone string
+}
+
+// stores returns the stores whose records are served along with those of
+// the records file or database, which also configure the zones and views.
+func (c *Config) stores() []configuredStore {
+	var stores []configuredStore
+	switch c.Backend {
+	case backendRedis:
+		stores = append(stores, configuredStore{Store: &redisStore{config: c}, name: "the records in Redis"})
+	case backendEtcd:
+		stores = append(stores, configuredStore{Store: &etcdStore{config: c}, name: "the records in etcd"})
+	}
+	if c.Kubernetes.Enabled {
+		stores = append(stores, configuredStore{Store: &c.Kubernetes, name: "the Kubernetes cluster", zone: c.Kubernetes.Zone})
+	}
+	if c.Docker.Enabled {
+		stores = append(stores, configuredStore{Store: &c.Docker, name: "Docker containers", zone: c.Docker.Domain})
+	}
+	if c.Overlay.Enabled {
+		stores = append(stores, configuredStore{Store: &c.Overlay, name: "the overlay network peers", zone: c.Overlay.Zone})
+	}
+	if c.LDAP.Enabled {
+		stores = append(stores, configuredStore{Store: &c.LDAP, name: "the LDAP directory", zone: c.LDAP.Zone})
+	}
+	if c.Route53.Enabled {
+		stores = append(stores, configuredStore{Store: &c.Route53, name: "the Route 53 hosted zone", zone: c.Route53.Zone})
+	}
+
+	return stores
+}
+
+// zoneStore returns the store whose records are published in a zone, or
+// nil if none is.
+func (c *Config) zoneStore(origin string) Store {
+	for _, store := range c.stores() {
+		if store.zone != "" && store.zone == dns.CanonicalName(origin) {
+			return store.Store
+		}
+	}
+
+	return nil
+}
+
+// pushZone makes the changes to the content of a zone published from a
+// store in the store, leaving out the SOA and NS records of the apex, which
+// the zone keeps for itself.
+func pushZone(store Store, origin string, from, to []dns.RR) error {
+	origin = canonicalHostname(origin)
+	apex := func(rr dns.RR) bool {
+		rrtype := rr.Header().Rrtype
+		return canonicalHostname(rr.Header().Name) == origin && (rrtype == dns.TypeSOA || rrtype == dns.TypeNS)
+	}
+
+	for _, rr := range missingRRs(from, to) {
+		if apex(rr) {
+			continue
+		}
+		err := store.Delete(DNSRecord{Hostname: rr.Header().Name, rr: rr})
+		if err != nil {
+			return err
+		}
+	}
+	for _, rr := range missingRRs(to, from) {
+		if apex(rr) {
+			continue
+		}
+		err := store.Put(DNSRecord{Hostname: rr.Header().Name, rr: rr})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// watchStores reloads the records as the stores announce changes to them,
+// once the changes have settled.
+func (s *dnsServer) watchStores() {
+	for _, store := range s.config.stores() {
+		changes := make(chan struct{}, 1)
+		err := store.Watch(func() {
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		})
+		if err != nil {
+			log.Printf("Failed to watch %s: %v", store.name, err)
+			continue
+		}
+
+		go func() {
+			for range changes {
+				time.Sleep(settleDelay)
+				log.Printf("%s changed, reloading DNS records", strings.ToUpper(store.name[:1])+store.name[1:])
+				s.reloadRecords()
+			}
+		}()
+	}
+}
+
+// recordAnswers returns the type and data in the master file format of each
+// resource record a record is served as.
+func recordAnswers(record DNSRecord) (map[string][]string, error) {
+	rrs, err := record.RRs(canonicalHostname(record.Hostname))
+	if err != nil {
+		return nil, err
+	}
+
+	answers := map[string][]string{}
+	for _, rr := range rrs {
+		rrtype := dns.TypeToString[rr.Header().Rrtype]
+		answers[rrtype] = append(answers[rrtype], strings.TrimPrefix(rr.String(), rr.Header().String()))
+	}
+
+	return answers, nil
+}
+
+// sameAnswers reports whether two records are served as the same answers.
+func sameAnswers(a, b map[string][]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for rrtype, data := range a {
+		if strings.Join(data, "\n") != strings.Join(b[rrtype], "\n") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// listTimeout is how long downloading a filter list may take.
+const listTimeout = time.Minute
+
+// listSubscriptions keeps the latest copy of each filter list given as a
+// URL, so that the filter is built from copies in memory and a list that
+// cannot be downloaded is served from its last copy.
+type listSubscriptions struct {
+	client *http.Client
+
+	// directory keeps a copy of each list on disk, if set, so that lists
+	// are served after a restart even if they cannot be downloaded.
+	directory string
+
+	mu     sync.Mutex
+	copies map[string]*listCopy
+}
+
+// listCopy is a downloaded copy of a list, with the validators the server
+// gave it for asking whether it has changed since.
+type listCopy struct {
+	body         []byte
+	etag         string
+	lastModified string
+}
+
+// newListSubscriptions returns the subscriptions of the lists at URLs,
+// keeping copies in directory if one is given.
+func newListSubscriptions(directory string) *listSubscriptions {
+	return &listSubscriptions{
+		client:    &http.Client{Timeout: listTimeout},
+		directory: directory,
+		copies:    map[string]*listCopy{},
+	}
+}
+
+// isListURL reports whether a filter list is given as a URL to download,
+// rather than as a file.
+func isListURL(list string) bool {
+	return strings.HasPrefix(list, "http://") || strings.HasPrefix(list, "https://")
+}
+
+// refresh downloads each list of urls that has changed since it was last
+// downloaded, reporting whether any had. Lists that fail to download keep
+// their last copy, or that saved in the directory.
+func (l *listSubscriptions) refresh(urls []string) bool {
+	changed := false
+	for _, url := range urls {
+		updated, err := l.download(url)
+		if err != nil {
+			log.Printf("Failed to download filter list %s, keeping the last copy: %v", url, err)
+			updated = l.restore(url)
+		}
+		changed = changed || updated
+	}
+
+	return changed
+}
+
+// download downloads a list, asking the server for it only if it has
+// changed since the last copy, and reports whether it had.
+func (l *listSubscriptions) download(url string) (bool, error) {
+	l.mu.Lock()
+	last := l.copies[url]
+	l.mu.Unlock()
+
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, err
+	}
+	if last != nil && last.etag != "" {
+		request.Header.Set("If-None-Match", last.etag)
+	}
+	if last != nil && last.lastModified != "" {
+		request.Header.Set("If-Modified-Since", last.lastModified)
+	}
+
+	response, err := l.client.Do(request)
+	if err != nil {
+		return false, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNotModified && last != nil {
+		return false, nil
+	}
+	if response.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("server answered %s", response.Status)
+	}
+
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		return false, err
+	}
+	downloaded := &listCopy{
+		body:         body,
+		etag:         response.Header.Get("ETag"),
+		lastModified: response.Header.Get("Last-Modified"),
+	}
+
+	l.mu.Lock()
+	l.copies[url] = downloaded
+	l.mu.Unlock()
+	if l.directory != "" {
+		err = l.save(url, body)
+		if err != nil {
+			log.Printf("Failed to save a copy of filter list %s: %v", url, err)
+		}
+	}
+
+	return last == nil || !bytes.Equal(last.body, body), nil
+}
+
+// restore loads the copy of a list saved in the directory, if the list has
+// no copy in memory, reporting whether it did.
+func (l *listSubscriptions) restore(url string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.copies[url] != nil || l.directory == "" {
+		return false
+	}
+
+	body, err := os.ReadFile(l.file(url))
+	if err != nil {
+		return false
+	}
+	l.copies[url] = &listCopy{body: body}
+	log.Printf("Using the saved copy of filter list %s", url)
+
+	return true
+}
+
+// save writes the copy of a list to the directory, replacing the previous
+// copy only once it is written in full.
+func (l *listSubscriptions) save(url string, body []byte) error {
+	err := os.MkdirAll(l.directory, 0755)
+	if err != nil {
+		return err
+	}
+
+	file := l.file(url)
+	err = os.WriteFile(file+".tmp", body, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(file+".tmp", file)
+}
+
+// file returns the file in the directory a list is saved to, named by the
+// hash of its URL.
+func (l *listSubscriptions) file(url string) string {
+	return filepath.Join(l.directory, fmt.Sprintf("%x.list", sha256.Sum256([]byte(url))))
+}
+
+// open returns the latest copy of a list.
+func (l *listSubscriptions) open(url string) (io.Reader, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	last := l.copies[url]
+	if last == nil {
+		return nil, fmt.Errorf("never downloaded")
+	}
+
+	return bytes.NewReader(last.body), nil
+}
+
+// refreshLists downloads the lists given as URLs again every
+// RefreshInterval, serving a filter rebuilt from them whenever one has
+// changed.
+func (s *dnsServer) refreshLists() {
+	config := &s.config.Filter
+	urls := config.listURLs()
+	if !config.Enabled || len(urls) == 0 || config.RefreshInterval == 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(config.RefreshInterval)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			if config.subscriptions.refresh(urls) {
+				log.Printf("Filter lists changed, reloading the filter")
+				s.reloadFilter()
+			}
+		}
+	}()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// readFramedMessage reads a single length-prefixed DNS message from a stream,
+// as described in RFC 1035 section 4.2.2.
+func readFramedMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	_, err := io.ReadFull(r, length[:])
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf, nil
+}
+
+// writeFramedMessage writes a single DNS message to a stream, prefixed with
+// its two byte length.
+func writeFramedMessage(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+
+	_, err := w.Write(buf)
+	return err
+}
+
+// serveTCP answers queries on a TCP connection until the client closes it or
+// it sits idle for longer than the configured timeout.
+func (s *dnsServer) serveTCP(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(s.config.TCPTimeout))
+		if err != nil {
+			log.Printf("Failed to set TCP read deadline: %v", err)
+			return
+		}
+
+		buf, err := readFramedMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Error while reading from TCP: %v", err)
+			}
+			return
+		}
+
+		// Zone transfers are answered with a stream of messages
+		request := new(dns.Msg)
+		if request.Unpack(buf) == nil && isTransfer(request) {
+			err = s.serveTransfer(conn, buf, request)
+			if err != nil {
+				log.Printf("Failed to send zone transfer: %v", err)
+				return
+			}
+			continue
+		}
+
+		response := s.handleRequest(buf, conn.RemoteAddr(), false)
+		if response == nil {
+			continue
+		}
+
+		err = conn.SetWriteDeadline(time.Now().Add(s.config.TCPTimeout))
+		if err != nil {
+			log.Printf("Failed to set TCP write deadline: %v", err)
+			return
+		}
+
+		err = writeFramedMessage(conn, response)
+		if err != nil {
+			log.Printf("Failed to send DNS response: %v", err)
+			return
+		}
+	}
+}
+
+// runTCP accepts TCP connections and serves each one on its own goroutine.
+func (s *dnsServer) runTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Printf("Error while accepting TCP connection: %v", err)
+			continue
+		}
+
+		go s.serveTCP(conn)
+	}
+}
@@ -0,0 +1,74 @@
+// Command wasmplugin is the plugin loaded by the tests of wasm plugins,
+// built with
+//
+//	GOOS=wasip1 GOARCH=wasm go build -buildmode=c-shared
+//
+// It blocks blocked.lan., refuses refused.lan. and drops dropped.lan., and
+// answers the names under plugin.lan. with an A record, leaving the rest to
+// the server. Built with -ldflags=-X=main.version=<n>, it answers with
+// 10.0.0.<n> instead.
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"unsafe"
+)
+
+// version is the last byte of the addresses the plugin answers with.
+var version = "1"
+
+// buffers keeps the memory handed to the host alive for the life of the
+// instance, which only handles a single query.
+var buffers [][]byte
+
+func main() {}
+
+type query struct {
+	Qname string `json:"qname"`
+	Qtype string `json:"qtype"`
+}
+
+func decode(ptr, size uint32) query {
+	var q query
+	json.Unmarshal(unsafe.Slice((*byte)(unsafe.Pointer(uintptr(ptr))), size), &q)
+	return q
+}
+
+//go:wasmexport alloc
+func alloc(size uint32) uint32 {
+	buffer := make([]byte, size+1)
+	buffers = append(buffers, buffer)
+	return uint32(uintptr(unsafe.Pointer(&buffer[0])))
+}
+
+//go:wasmexport filter
+func filter(ptr, size uint32) uint32 {
+	switch decode(ptr, size).Qname {
+	case "blocked.lan.":
+		return 1
+	case "refused.lan.":
+		return 2
+	case "dropped.lan.":
+		return 3
+	}
+
+	return 0
+}
+
+//go:wasmexport lookup
+func lookup(ptr, size uint32) uint64 {
+	q := decode(ptr, size)
+	if !strings.HasSuffix(q.Qname, ".plugin.lan.") {
+		return 0
+	}
+
+	answer, _ := json.Marshal(map[string]any{
+		"result": []map[string]any{
+			{"qtype": "A", "qname": q.Qname, "content": "10.0.0." + version, "ttl": 60},
+		},
+	})
+	buffers = append(buffers, answer)
+
+	return uint64(uintptr(unsafe.Pointer(&answer[0])))<<32 | uint64(len(answer))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// TLSConfig configures the optional DNS-over-TLS listener.
+type TLSConfig struct {
+	// Port is the port the DoT listener binds to.
+	Port int `yaml:"port"`
+
+	// CertFile and KeyFile are the PEM encoded certificate and private key
+	// served to clients. The listener is only started when both are set.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// MinVersion is the lowest TLS version accepted, e.g. "1.2" or "1.3".
+	MinVersion string `yaml:"min_version"`
+}
+
+// Enabled reports whether the DoT listener has been configured.
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" && c.KeyFile != ""
+}
+
+// tlsVersions maps the configurable version names to their crypto/tls values.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// serverTLSConfig builds the crypto/tls configuration for the DoT listener.
+func (c *TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	minVersion, ok := tlsVersions[c.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS min_version %q", c.MinVersion)
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   minVersion,
+	}, nil
+}
+
+// listenTLS sets up the DNS-over-TLS listener described in RFC 7858. Queries
+// use the same length-prefixed framing as plain TCP, so the resulting
+// listener is served by runTCP.
+func (s *dnsServer) listenTLS(host string) (net.Listener, error) {
+	tlsConfig, err := s.config.TLS.serverTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	address := net.JoinHostPort(host, strconv.Itoa(s.config.TLS.Port))
+	network, err := listenNetwork("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(listener, tlsConfig), nil
+}
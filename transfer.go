@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// transferMessageSize is the size zone transfers are split into messages
+// of, well within the 64KB a TCP message may hold.
+const transferMessageSize = 16384
+
+// isTransfer reports whether a request asks for a zone transfer.
+func isTransfer(request *dns.Msg) bool {
+	if request.Opcode != dns.OpcodeQuery || len(request.Question) == 0 {
+		return false
+	}
+
+	qtype := request.Question[0].Qtype
+	return qtype == dns.TypeAXFR || qtype == dns.TypeIXFR
+}
+
+// serveTransfer answers a zone transfer request on a TCP connection with
+// the whole zone (RFC 5936), or for an incremental transfer with the
+// changes since the secondary's version (RFC 1995). Incremental transfers
+// are answered with the whole zone when those changes are not known.
+func (s *dnsServer) serveTransfer(conn net.Conn, buf []byte, request *dns.Msg) error {
+	client := addrIP(conn.RemoteAddr())
+	global := s.records.Load()
+	records := global.ForClient(client)
+	name := dns.CanonicalName(request.Question[0].Name)
+
+	zone := records.FindZone(name)
+	if zone == nil && s.config.Remote.Enabled && s.config.Remote.zone(name) == name {
+		return s.serveRemoteTransfer(conn, request)
+	}
+	if zone == nil || zone.Origin != name {
+		log.Printf("Refused zone transfer of %s to %s: not authoritative", name, client)
+		return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeNotAuth, nil))
+	}
+
+	if zone.expired {
+		log.Printf("Refused zone transfer of %s to %s: zone expired", name, client)
+		return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeServerFailure, nil))
+	}
+
+	status, rcode, err := s.authorizeTransfer(zone, buf, request, client)
+	if err != nil {
+		log.Printf("Refused zone transfer of %s to %s: %v", name, client, err)
+		return s.writeTransfer(conn, refuseTransfer(request, rcode, status))
+	}
+
+	// The journal only follows the global records, so clients answered
+	// from a view are always sent the whole zone
+	var rrs []dns.RR
+	if request.Question[0].Qtype == dns.TypeIXFR && records == global {
+		rrs = incrementalRRs(zone, request)
+	}
+
+	if rrs != nil {
+		log.Printf("Transferring changes to zone %s to %s", name, client)
+	} else {
+		rrs, err = records.zoneRRs(zone)
+		if err != nil {
+			log.Printf("Failed to transfer zone %s: %v", name, err)
+			return s.writeTransfer(conn, refuseTransfer(request, dns.RcodeServerFailure, nil))
+		}
+
+		log.Printf("Transferring zone %s to %s", name, client)
+	}
+
+	var key *TSIGKey
+	var mac string
+	if status != nil {
+		key, mac = status.key, status.mac
+	}
+
+	for i, msg := range transferMessages(request, rrs) {
+		var packed []byte
+		if key != nil {
+			packed, mac, err = signTSIG(msg, key, mac, i > 0)
+		} else {
+			packed, err = msg.Pack()
+		}
+		if err != nil {
+			return err
+		}
+
+		err = s.writeTransfer(conn, packed)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// authorizeTransfer checks that a client may transfer a zone: its address
+// must be allowed by the zone, and if the zone names a transfer key the
+// request must be signed with it. It returns how the transfer is signed, or
+// the rcode to refuse it with.
+func (s *dnsServer) authorizeTransfer(zone *Zone, buf []byte, request *dns.Msg, client net.IP) (*tsigStatus, int, error) {
+	if !containsIP(zone.transferNetworks, client) {
+		return nil, dns.RcodeRefused, fmt.Errorf("client not in allow_transfer")
+	}
+
+	return s.verifyKey(zone.TransferKey, buf, request)
+}
+
+// incrementalRRs returns the records of the IXFR response to a request,
+// taking the secondary from the serial of the SOA record in the request's
+// authority section to the zone's current version. A secondary that is up
+// to date is sent just the current SOA record. It returns nil if the
+// changes are not known.
+func incrementalRRs(zone *Zone, request *dns.Msg) []dns.RR {
+	if zone.journal == nil || len(request.Ns) == 0 {
+		return nil
+	}
+	soa, ok := request.Ns[0].(*dns.SOA)
+	if !ok {
+		return nil
+	}
+
+	if !serialNewer(zone.journal.serial(), soa.Serial) {
+		return []dns.RR{zone.SOARR()}
+	}
+
+	return zone.journal.changesSince(soa.Serial)
+}
+
+// refuseTransfer returns the packed response refusing a zone transfer.
+func refuseTransfer(request *dns.Msg, rcode int, status *tsigStatus) []byte {
+	response := new(dns.Msg)
+	response.SetRcode(request, rcode)
+
+	return packResponse(response, status)
+}
+
+// writeTransfer writes one message of a zone transfer to the connection.
+func (s *dnsServer) writeTransfer(conn net.Conn, msg []byte) error {
+	if msg == nil {
+		return nil
+	}
+
+	err := conn.SetWriteDeadline(time.Now().Add(s.config.TCPTimeout))
+	if err != nil {
+		return err
+	}
+
+	return writeFramedMessage(conn, msg)
+}
+
+// zoneRRs returns the records of a zone in transfer order: the SOA record,
+// the apex NS records and every record held in the zone, ending with the
+// SOA record again. Records of zones delegated below it are left out.
+func (r *DNSRecords) zoneRRs(zone *Zone) ([]dns.RR, error) {
+	rrs := []dns.RR{zone.SOARR()}
+	for _, rr := range zone.ApexRRs(zone.Origin) {
+		if rr.Header().Rrtype == dns.TypeNS {
+			rrs = append(rrs, rr)
+		}
+	}
+
+	for _, record := range r.Records {
+		if owner := r.FindZone(record.Hostname); owner == nil || owner.Origin != zone.Origin {
+			continue
+		}
+
+		recordRRs, err := record.RRs(record.Hostname)
+		if err != nil {
+			return nil, err
+		}
+		rrs = append(rrs, recordRRs...)
+	}
+
+	return append(rrs, zone.SOARR()), nil
+}
+
+// transferMessages splits the records of a zone transfer into responses of
+// up to transferMessageSize bytes each.
+func transferMessages(request *dns.Msg, rrs []dns.RR) []*dns.Msg {
+	newMessage := func() *dns.Msg {
+		msg := new(dns.Msg)
+		msg.SetReply(request)
+		msg.Authoritative = true
+		msg.Compress = true
+		return msg
+	}
+
+	msg := newMessage()
+	msgs := []*dns.Msg{msg}
+	for _, rr := range rrs {
+		msg.Answer = append(msg.Answer, rr)
+		if len(msg.Answer) > 1 && msg.Len() > transferMessageSize {
+			msg.Answer = msg.Answer[:len(msg.Answer)-1]
+			msg = newMessage()
+			msg.Question = nil
+			msg.Answer = []dns.RR{rr}
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// testSecret is the secret of the TSIG key transfer. the transfer tests
+// sign with.
+var testSecret = base64.StdEncoding.EncodeToString([]byte("a secret shared for transfers"))
+
+// transferServer starts a server for the zone example.lan., with hosts
+// other than its name server and the delegated zone sub.example.lan., that
+// the networks in allow may transfer, requiring the key named key if it is
+// not empty. It returns the address the server listens on over TCP.
+func transferServer(t *testing.T, allow []string, key string, hosts int) string {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.TSIGKeys = []TSIGKey{{Name: "transfer.", Secret: testSecret}}
+	err := config.TSIGKeys[0].prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records := &DNSRecords{
+		Zones: []Zone{
+			{Origin: "example.lan.", NS: []string{"ns1.example.lan."}, AllowTransfer: allow, TransferKey: key},
+			{Origin: "sub.example.lan."},
+		},
+		Records: []DNSRecord{
+			{Hostname: "ns1.example.lan.", IP: "192.168.1.1"},
+			{Hostname: "host.sub.example.lan.", IP: "192.168.2.1"},
+			{Hostname: "www.other.lan.", IP: "192.168.3.1"},
+		},
+	}
+	for i := 0; i < hosts; i++ {
+		records.Records = append(records.Records, DNSRecord{
+			Hostname: fmt.Sprintf("host%d.example.lan.", i),
+			IP:       fmt.Sprintf("192.168.%d.%d", 10+i/250, 1+i%250),
+		})
+	}
+	err = records.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return serveTestTCP(t, testServer(config, records))
+}
+
+// serveTestTCP serves queries and zone transfers over TCP on a local port,
+// returning its address.
+func serveTestTCP(t *testing.T, s *dnsServer) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveTCP(conn)
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+// transferZone transfers a zone from a server, signing the request with
+// the key transfer. and secret if secret is not empty.
+func transferZone(address, zone, secret string) ([]dns.RR, error) {
+	request := new(dns.Msg)
+	request.SetAxfr(zone)
+	transfer := &dns.Transfer{}
+	if secret != "" {
+		request.SetTsig("transfer.", dns.HmacSHA256, tsigFudge, time.Now().Unix())
+		transfer.TsigSecret = map[string]string{"transfer.": secret}
+	}
+
+	envelopes, err := transfer.In(request, address)
+	if err != nil {
+		return nil, err
+	}
+
+	var rrs []dns.RR
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, envelope.Error
+		}
+		rrs = append(rrs, envelope.RR...)
+	}
+
+	return rrs, nil
+}
+
+func TestTransfer(t *testing.T) {
+	wrongSecret := base64.StdEncoding.EncodeToString([]byte("not the secret"))
+
+	tests := []struct {
+		name   string
+		allow  []string
+		key    string
+		zone   string
+		secret string
+		hosts  int
+		err    string
+	}{
+		{name: "allowed", allow: []string{"127.0.0.0/8"}, zone: "example.lan."},
+		{name: "not allowed", allow: []string{"192.168.0.0/16"}, zone: "example.lan.", err: "bad xfr rcode: 5"},
+		{name: "not authoritative", allow: []string{"127.0.0.0/8"}, zone: "other.lan.", err: "bad xfr rcode: 9"},
+		{name: "below the origin", allow: []string{"127.0.0.0/8"}, zone: "www.example.lan.", err: "bad xfr rcode: 9"},
+		{name: "signed", allow: []string{"127.0.0.0/8"}, key: "transfer.", zone: "example.lan.", secret: testSecret, hosts: 2000},
+		{name: "unsigned", allow: []string{"127.0.0.0/8"}, key: "transfer.", zone: "example.lan.", err: "bad xfr rcode: 9"},
+		{name: "wrong secret", allow: []string{"127.0.0.0/8"}, key: "transfer.", zone: "example.lan.", secret: wrongSecret, err: "bad authentication"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address := transferServer(t, test.allow, test.key, test.hosts)
+			rrs, err := transferZone(address, test.zone, test.secret)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got %v, want %s", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The zone's own records are sent between two SOA records,
+			// leaving out those of the delegated zone
+			if len(rrs) != 4+test.hosts {
+				t.Fatalf("got %d records, want %d", len(rrs), 4+test.hosts)
+			}
+			if rrs[0].Header().Rrtype != dns.TypeSOA || rrs[len(rrs)-1].Header().Rrtype != dns.TypeSOA {
+				t.Fatalf("got %v and %v, want the transfer framed by SOA records", rrs[0], rrs[len(rrs)-1])
+			}
+			for _, rr := range rrs {
+				if !dns.IsSubDomain("example.lan.", rr.Header().Name) || dns.IsSubDomain("sub.example.lan.", rr.Header().Name) {
+					t.Fatalf("got %v, which is not in the zone", rr)
+				}
+			}
+		})
+	}
+}
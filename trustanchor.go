@@ -0,0 +1,267 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+	"gopkg.in/yaml.v2"
+)
+
+// holdDown is how long a new key signing key must be seen before it is
+// trusted, as RFC 5011 section 2.4.1 requires.
+const holdDown = 30 * 24 * time.Hour
+
+// States of a key signing key tracked for RFC 5011 rollovers.
+const (
+	keyPending = "pending"
+	keyValid   = "valid"
+	keyRevoked = "revoked"
+)
+
+// anchorKey is a key signing key of an anchored zone as saved in the trust
+// anchor file.
+type anchorKey struct {
+	Zone      string    `yaml:"zone"`
+	Key       string    `yaml:"key"`
+	State     string    `yaml:"state"`
+	FirstSeen time.Time `yaml:"first_seen"`
+
+	dnskey *dns.DNSKEY
+}
+
+// trustAnchors holds the DS records validation is anchored to and the key
+// signing keys learnt for their zones through RFC 5011 rollovers.
+type trustAnchors struct {
+	ds   map[string][]*dns.DS
+	file string
+
+	mu   sync.Mutex
+	keys []*anchorKey
+}
+
+// newTrustAnchors parses the configured DS records and loads any keys
+// tracked in the trust anchor file.
+func newTrustAnchors(records []string, file string) (*trustAnchors, error) {
+	anchors := &trustAnchors{ds: map[string][]*dns.DS{}, file: file}
+	for _, record := range records {
+		rr, err := dns.NewRR(record)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trust anchor %q: %v", record, err)
+		}
+
+		ds, ok := rr.(*dns.DS)
+		if !ok {
+			return nil, fmt.Errorf("trust anchor %q is not a DS record", record)
+		}
+
+		zone := dns.CanonicalName(ds.Hdr.Name)
+		anchors.ds[zone] = append(anchors.ds[zone], ds)
+	}
+
+	if file == "" {
+		return anchors, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return anchors, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(data, &anchors.keys)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range anchors.keys {
+		rr, err := dns.NewRR(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key in %s: %v", file, err)
+		}
+
+		dnskey, ok := rr.(*dns.DNSKEY)
+		if !ok {
+			return nil, fmt.Errorf("%s holds a record that is not a DNSKEY", file)
+		}
+		key.dnskey = dnskey
+		key.Zone = dns.CanonicalName(key.Zone)
+	}
+
+	return anchors, nil
+}
+
+// Anchored reports whether validation of a zone is anchored directly.
+func (a *trustAnchors) Anchored(zone string) bool {
+	return len(a.ds[zone]) > 0
+}
+
+// Validate checks the DNSKEY records of an anchored zone against its trust
+// anchors and returns them if they are signed by a trusted key. The key
+// signing keys are then tracked for rollover: new ones are trusted once
+// seen for the hold-down time and revoked ones are no longer trusted.
+func (a *trustAnchors) Validate(zone string, dnskeys []*dns.DNSKEY, sigs []*dns.RRSIG) ([]*dns.DNSKEY, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var trusted []*dns.DNSKEY
+	for _, key := range keysMatchingDS(dnskeys, a.ds[zone]) {
+		if a.state(zone, key) != keyRevoked {
+			trusted = append(trusted, key)
+		}
+	}
+	for _, key := range dnskeys {
+		if a.state(zone, key) == keyValid {
+			trusted = append(trusted, key)
+		}
+	}
+
+	rrset := keySet(dnskeys)
+	if !verifyRRset(rrset, sigs, trusted) {
+		return nil, fmt.Errorf("%w: DNSKEY records of %s do not match its trust anchors", errBogus, zone)
+	}
+
+	if a.track(zone, dnskeys, sigs) {
+		a.save()
+	}
+
+	return dnskeys, nil
+}
+
+// track updates the rollover state of the key signing keys in a validated
+// DNSKEY RRset, reporting whether anything changed.
+func (a *trustAnchors) track(zone string, dnskeys []*dns.DNSKEY, sigs []*dns.RRSIG) bool {
+	changed := false
+	rrset := keySet(dnskeys)
+	now := time.Now()
+	for _, key := range dnskeys {
+		if key.Flags&dns.SEP == 0 {
+			continue
+		}
+
+		tracked := a.find(zone, key)
+		if key.Flags&dns.REVOKE != 0 {
+			// A key revokes itself by signing the RRset with the REVOKE
+			// bit set (RFC 5011 section 2.1)
+			if selfSigned(key, rrset, sigs) && (tracked == nil || tracked.State != keyRevoked) {
+				log.Printf("Trust anchor key %d for %s has been revoked", key.KeyTag(), zone)
+				a.set(zone, key, keyRevoked, tracked)
+				changed = true
+			}
+			continue
+		}
+
+		switch {
+		case tracked == nil:
+			state := keyPending
+			if len(keysMatchingDS([]*dns.DNSKEY{key}, a.ds[zone])) > 0 {
+				state = keyValid
+			} else {
+				log.Printf("New trust anchor key %d for %s seen, trusting it after %v", key.KeyTag(), zone, holdDown)
+			}
+			a.set(zone, key, state, nil)
+			changed = true
+		case tracked.State == keyPending && now.Sub(tracked.FirstSeen) >= holdDown:
+			log.Printf("Trust anchor key %d for %s is now trusted", key.KeyTag(), zone)
+			tracked.State = keyValid
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+// selfSigned reports whether a key has signed an RRset itself.
+func selfSigned(key *dns.DNSKEY, rrset []dns.RR, sigs []*dns.RRSIG) bool {
+	for _, sig := range sigs {
+		if sig.KeyTag == key.KeyTag() && sig.Algorithm == key.Algorithm && sig.ValidityPeriod(time.Now()) && sig.Verify(key, rrset) == nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sameKey reports whether two DNSKEY records hold the same key, ignoring
+// their flags so that a key is recognised once it has been revoked.
+func sameKey(a, b *dns.DNSKEY) bool {
+	return a.Algorithm == b.Algorithm && a.PublicKey == b.PublicKey
+}
+
+// find returns the tracked state of a key, or nil if it is not tracked.
+func (a *trustAnchors) find(zone string, key *dns.DNSKEY) *anchorKey {
+	for _, tracked := range a.keys {
+		if tracked.Zone == zone && sameKey(tracked.dnskey, key) {
+			return tracked
+		}
+	}
+
+	return nil
+}
+
+// state returns the tracked state of a key, or the empty string if it is
+// not tracked.
+func (a *trustAnchors) state(zone string, key *dns.DNSKEY) string {
+	if tracked := a.find(zone, key); tracked != nil {
+		return tracked.State
+	}
+
+	return ""
+}
+
+// set records the state of a key, updating tracked if it is already known.
+func (a *trustAnchors) set(zone string, key *dns.DNSKEY, state string, tracked *anchorKey) {
+	if tracked != nil {
+		tracked.State = state
+		tracked.dnskey = key
+		tracked.Key = key.String()
+		return
+	}
+
+	a.keys = append(a.keys, &anchorKey{
+		Zone:      zone,
+		Key:       key.String(),
+		State:     state,
+		FirstSeen: time.Now(),
+		dnskey:    key,
+	})
+}
+
+// save writes the tracked keys to the trust anchor file, if there is one.
+func (a *trustAnchors) save() {
+	if a.file == "" {
+		return
+	}
+
+	data, err := yaml.Marshal(a.keys)
+	if err != nil {
+		log.Printf("Failed to encode trust anchors: %v", err)
+		return
+	}
+
+	// Replace the file atomically so a crash never leaves it half written
+	temp := a.file + ".tmp"
+	err = os.WriteFile(temp, data, 0644)
+	if err == nil {
+		err = os.Rename(temp, a.file)
+	}
+	if err != nil {
+		log.Printf("Failed to save trust anchors: %v", err)
+	}
+}
+
+// String lists the anchored zones, for logging.
+func (a *trustAnchors) String() string {
+	var zones []string
+	for zone := range a.ds {
+		zones = append(zones, zone)
+	}
+
+	return strings.Join(zones, ", ")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigFudge is the clock skew in seconds allowed between the signer and
+// verifier of a TSIG record.
+const tsigFudge = 300
+
+// TSIGKey is a shared secret authenticating messages such as zone transfers
+// with TSIG (RFC 8945). The secret is base64 encoded, as written by
+// tsig-keygen.
+type TSIGKey struct {
+	Name      string `yaml:"name"`
+	Algorithm string `yaml:"algorithm"`
+	Secret    string `yaml:"secret"`
+}
+
+// tsigAlgorithms maps the algorithm names accepted in the configuration to
+// their TSIG algorithm names.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha224": dns.HmacSHA224,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha384": dns.HmacSHA384,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// prepare canonicalises the key's name and algorithm and checks its secret.
+func (k *TSIGKey) prepare() error {
+	k.Name = dns.CanonicalName(k.Name)
+
+	if k.Algorithm == "" {
+		k.Algorithm = "hmac-sha256"
+	}
+	algorithm, ok := tsigAlgorithms[strings.ToLower(strings.TrimSuffix(k.Algorithm, "."))]
+	if !ok {
+		return fmt.Errorf("unsupported algorithm %q for TSIG key %s", k.Algorithm, k.Name)
+	}
+	k.Algorithm = algorithm
+
+	if _, err := base64.StdEncoding.DecodeString(k.Secret); err != nil {
+		return fmt.Errorf("invalid secret for TSIG key %s: %v", k.Name, err)
+	}
+
+	return nil
+}
+
+// tsigKey returns the configured TSIG key with the given name, or nil if
+// there is none.
+func (c *Config) tsigKey(name string) *TSIGKey {
+	name = dns.CanonicalName(name)
+	for i := range c.TSIGKeys {
+		if c.TSIGKeys[i].Name == name {
+			return &c.TSIGKeys[i]
+		}
+	}
+
+	return nil
+}
+
+// tsigStatus is how the response to a TSIG signed request is signed: with
+// the request's key, covering the request's MAC, and reporting any TSIG
+// error found while verifying the request (RFC 8945 section 5.2).
+type tsigStatus struct {
+	key *TSIGKey
+	mac string
+
+	// name, algorithm and err describe a request that failed to verify.
+	name      string
+	algorithm string
+	err       uint16
+}
+
+// verifyKey checks the TSIG signature of a request, which must be signed
+// with the named key if a key is named. A request signed with any other
+// configured key is accepted where no key is required, and its response is
+// signed with that key. It returns how to sign the response, or the rcode
+// to refuse the request with.
+func (s *dnsServer) verifyKey(required string, buf []byte, request *dns.Msg) (*tsigStatus, int, error) {
+	tsig := request.IsTsig()
+	if tsig == nil {
+		if required != "" {
+			return nil, dns.RcodeNotAuth, fmt.Errorf("request is not signed with TSIG key %s", required)
+		}
+		return nil, dns.RcodeSuccess, nil
+	}
+
+	status := &tsigStatus{name: tsig.Hdr.Name, algorithm: tsig.Algorithm}
+	key := s.config.tsigKey(tsig.Hdr.Name)
+	if key == nil || dns.CanonicalName(tsig.Algorithm) != key.Algorithm {
+		status.err = dns.RcodeBadKey
+		return status, dns.RcodeNotAuth, fmt.Errorf("request is signed with unknown TSIG key %s", tsig.Hdr.Name)
+	}
+	if required != "" && key.Name != dns.CanonicalName(required) {
+		status.err = dns.RcodeBadKey
+		return status, dns.RcodeNotAuth, fmt.Errorf("request is signed with TSIG key %s rather than %s", key.Name, required)
+	}
+
+	err := dns.TsigVerify(buf, key.Secret, "", false)
+	switch {
+	case err == dns.ErrTime:
+		// The response is still signed, telling the client our time
+		status.key, status.mac, status.err = key, tsig.MAC, dns.RcodeBadTime
+		return status, dns.RcodeNotAuth, err
+	case err != nil:
+		status.err = dns.RcodeBadSig
+		return status, dns.RcodeNotAuth, err
+	}
+
+	status.key, status.mac = key, tsig.MAC
+	return status, dns.RcodeSuccess, nil
+}
+
+// signTSIG packs a message signed with key, covering the MAC of the previous
+// message (RFC 8945 section 5.3). Messages after the first in a multiple
+// message response, such as a zone transfer, cover only the TSIG timers
+// besides. It returns the packed message and the MAC of its signature.
+func signTSIG(msg *dns.Msg, key *TSIGKey, previousMAC string, subsequent bool) ([]byte, string, error) {
+	msg.SetTsig(key.Name, key.Algorithm, tsigFudge, time.Now().Unix())
+	return dns.TsigGenerate(msg, key.Secret, previousMAC, subsequent)
+}
+
+// packResponse packs the response to a request, signing it as the request's
+// TSIG status says. Responses reporting an unknown key or bad signature
+// carry the error in an unsigned TSIG record, and those reporting a bad
+// time the server's time.
+func packResponse(response *dns.Msg, status *tsigStatus) []byte {
+	var buf []byte
+	var err error
+	switch {
+	case status == nil:
+		buf, err = response.Pack()
+	case status.key == nil:
+		response.SetTsig(status.name, status.algorithm, tsigFudge, time.Now().Unix())
+		tsig := response.IsTsig()
+		tsig.Error = status.err
+		tsig.OrigId = response.Id
+		buf, err = response.Pack()
+	default:
+		now := time.Now().Unix()
+		response.SetTsig(status.key.Name, status.key.Algorithm, tsigFudge, now)
+		if status.err == dns.RcodeBadTime {
+			tsig := response.IsTsig()
+			tsig.Error = status.err
+			tsig.OtherLen = 6
+			tsig.OtherData = fmt.Sprintf("%012x", now)
+		}
+		buf, _, err = dns.TsigGenerate(response, status.key.Secret, status.mac, false)
+	}
+	if err != nil {
+		log.Printf("Failed to encode DNS response: %v", err)
+		return nil
+	}
+
+	return buf
+}
+
+// checkKeys checks that every TSIG key named by a zone is configured.
+func (c *Config) checkKeys(records *DNSRecords) error {
+	for _, zone := range records.Zones {
+		for _, name := range []string{zone.TransferKey, zone.UpdateKey, zone.PushKey} {
+			if name != "" && c.tsigKey(name) == nil {
+				return fmt.Errorf("unknown TSIG key %s for zone %s", name, zone.Origin)
+			}
+		}
+	}
+
+	return nil
+}
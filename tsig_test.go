@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/base64"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// tsigServer returns a server holding the zone example.lan., which clients
+// on the loopback network may update with the key update., and the
+// secondary zone secondary.lan., transferred from 127.0.0.1 with the key
+// transfer.
+func tsigServer(t *testing.T) *dnsServer {
+	t.Helper()
+
+	config := DefaultConfig()
+	config.TSIGKeys = []TSIGKey{
+		{Name: "update.", Secret: testSecret},
+		{Name: "transfer.", Secret: testSecret},
+	}
+	for i := range config.TSIGKeys {
+		err := config.TSIGKeys[i].prepare()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	records := &DNSRecords{
+		Zones: []Zone{
+			{Origin: "example.lan.", AllowUpdate: []string{"127.0.0.0/8"}, UpdateKey: "update."},
+			{Origin: "secondary.lan.", Primaries: []string{"127.0.0.1"}, TransferKey: "transfer."},
+		},
+	}
+	err := records.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testServer(config, records)
+}
+
+// signedRequest packs a request signed with the named key and secret at
+// time signed, returning it with the MAC of its signature. It is sent
+// unsigned if key is empty.
+func signedRequest(t *testing.T, request *dns.Msg, key, secret string, signed time.Time) ([]byte, string) {
+	t.Helper()
+
+	if key == "" {
+		buf, err := request.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf, ""
+	}
+
+	request.SetTsig(key, dns.HmacSHA256, tsigFudge, signed.Unix())
+	buf, mac, err := dns.TsigGenerate(request, secret, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return buf, mac
+}
+
+func TestTSIGResponses(t *testing.T) {
+	otherSecret := base64.StdEncoding.EncodeToString([]byte("not the secret"))
+
+	update := new(dns.Msg)
+	update.SetUpdate("example.lan.")
+	update.Insert(testRRs(t, "www.example.lan. 300 IN A 192.168.1.10"))
+
+	notify := new(dns.Msg)
+	notify.SetNotify("secondary.lan.")
+
+	tests := []struct {
+		name    string
+		request *dns.Msg
+		key     string
+		secret  string
+		skew    time.Duration
+		rcode   int
+		err     uint16
+		signed  bool
+	}{
+		{"update signed", update, "update.", testSecret, 0, dns.RcodeSuccess, dns.RcodeSuccess, true},
+		{"update unsigned", update, "", "", 0, dns.RcodeNotAuth, dns.RcodeSuccess, false},
+		{"update with unknown key", update, "unknown.", testSecret, 0, dns.RcodeNotAuth, dns.RcodeBadKey, false},
+		{"update with another zone's key", update, "transfer.", testSecret, 0, dns.RcodeNotAuth, dns.RcodeBadKey, false},
+		{"update with wrong secret", update, "update.", otherSecret, 0, dns.RcodeNotAuth, dns.RcodeBadSig, false},
+		{"update signed long ago", update, "update.", testSecret, -time.Hour, dns.RcodeNotAuth, dns.RcodeBadTime, true},
+		{"NOTIFY signed", notify, "transfer.", testSecret, 0, dns.RcodeSuccess, dns.RcodeSuccess, true},
+		{"NOTIFY with wrong secret", notify, "transfer.", otherSecret, 0, dns.RcodeNotAuth, dns.RcodeBadSig, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := tsigServer(t)
+			buf, mac := signedRequest(t, test.request.Copy(), test.key, test.secret, time.Now().Add(test.skew))
+
+			packed := s.handleRequest(buf, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, true)
+			response := new(dns.Msg)
+			err := response.Unpack(packed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if response.Rcode != test.rcode {
+				t.Fatalf("got rcode %s, want %s", dns.RcodeToString[response.Rcode], dns.RcodeToString[test.rcode])
+			}
+
+			tsig := response.IsTsig()
+			if test.key == "" {
+				if tsig != nil {
+					t.Fatalf("got %v, want an unsigned response", tsig)
+				}
+				return
+			}
+			if tsig == nil || tsig.Error != test.err {
+				t.Fatalf("got %v, want TSIG error %s", tsig, dns.RcodeToString[int(test.err)])
+			}
+
+			// Responses are signed when the key is known and the request
+			// was signed with it, even if at the wrong time, which the
+			// response then gives the server's time for
+			if test.signed != (tsig.MAC != "") {
+				t.Fatalf("got MAC %q, want signed %v", tsig.MAC, test.signed)
+			}
+			if test.err == dns.RcodeBadTime && tsig.OtherLen != 6 {
+				t.Fatalf("got other data %q, want the server's time", tsig.OtherData)
+			}
+			if test.rcode == dns.RcodeSuccess {
+				err = dns.TsigVerify(packed, testSecret, mac, false)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
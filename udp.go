@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"runtime"
+
+	"github.com/miekg/dns"
+)
+
+// listenUDP opens the UDP sockets for a listen address. When more than one
+// socket is configured they share the address using SO_REUSEPORT, each with
+// its own read loop.
+func (s *dnsServer) listenUDP(address string) ([]*net.UDPConn, error) {
+	network, err := listenNetwork("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	sockets := s.config.UDPSockets
+	if sockets == 0 {
+		sockets = runtime.NumCPU()
+	}
+
+	if sockets == 1 {
+		udpAddr, err := net.ResolveUDPAddr(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := net.ListenUDP(network, udpAddr)
+		if err != nil {
+			return nil, err
+		}
+
+		return []*net.UDPConn{conn}, nil
+	}
+
+	listenConfig := net.ListenConfig{Control: reusePortControl}
+
+	var conns []*net.UDPConn
+	for i := 0; i < sockets; i++ {
+		conn, err := listenConfig.ListenPacket(context.Background(), network, address)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+
+		conns = append(conns, conn.(*net.UDPConn))
+	}
+
+	return conns, nil
+}
+
+// serveUDP answers a single query received over UDP.
+func (s *dnsServer) serveUDP(conn *net.UDPConn, addr *net.UDPAddr, buf []byte) {
+	response := s.handleRequest(buf, addr, true)
+	if response == nil {
+		return
+	}
+
+	// Send the DNS response back to the client
+	_, err := conn.WriteToUDP(response, addr)
+	if err != nil {
+		log.Printf("Failed to send DNS response: %v", err)
+		return
+	}
+}
+
+// runUDP reads queries from a UDP socket and answers each one on its own
+// goroutine.
+func (s *dnsServer) runUDP(conn *net.UDPConn) {
+	// Queries are read whatever their size, as MaxUDPSize only limits the
+	// responses
+	buf := make([]byte, dns.MaxMsgSize)
+	for {
+		n, addr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("Error while reading from UDP: %v", err)
+			continue
+		}
+
+		// Each query gets its own copy as it is handled concurrently
+		query := make([]byte, n)
+		copy(query, buf[:n])
+		go s.serveUDP(conn, addr, query)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestRunUDPLargeQuery(t *testing.T) {
+	records := &DNSRecords{Records: []DNSRecord{{Hostname: "www.lan.", IP: "192.168.1.10"}}}
+	err := records.prepare()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := DefaultConfig()
+	config.MaxUDPSize = 512
+	s := testServer(config, records)
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go s.runUDP(conn)
+
+	// A query padded beyond the size of the responses is still read whole
+	request := new(dns.Msg).SetQuestion("www.lan.", dns.TypeA)
+	request.SetEdns0(4096, false)
+	opt := request.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_PADDING{Padding: make([]byte, 1000)})
+
+	client := &dns.Client{Timeout: 2 * time.Second}
+	response, _, err := client.Exchange(request, conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Answer) != 1 {
+		t.Fatalf("got %v, want the A record", response.Answer)
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// handleUpdate applies a dynamic update (RFC 2136) to a local zone and
+// returns the packed response. Updates are only accepted for zones that are
+// not secondaries, from clients in the zone's allow_update networks, and
+// signed with its update key if it has one.
+func (s *dnsServer) handleUpdate(buf []byte, request *dns.Msg, client net.IP) []byte {
+	name := dns.CanonicalName(request.Question[0].Name)
+
+	response := new(dns.Msg)
+	response.SetReply(request)
+
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+
+	current := s.records.Load()
+	zone := current.FindZone(name)
+
+	var status *tsigStatus
+	var err error
+	switch {
+	case zone == nil || zone.Origin != name || request.Question[0].Qtype != dns.TypeSOA:
+		response.Rcode = dns.RcodeNotAuth
+		err = fmt.Errorf("not a local zone")
+	case len(zone.Primaries) > 0:
+		response.Rcode = dns.RcodeRefused
+		err = fmt.Errorf("not the primary of the zone")
+	case !containsIP(zone.updateNetworks, client):
+		response.Rcode = dns.RcodeRefused
+		err = fmt.Errorf("client not in allow_update")
+	default:
+		status, response.Rcode, err = s.verifyKey(zone.UpdateKey, buf, request)
+		if err == nil {
+			response.Rcode, err = s.applyUpdate(current, zone, request)
+		}
+	}
+
+	// The lease is granted as asked for
+	if lease := updateLease(request); lease > 0 && response.Rcode == dns.RcodeSuccess {
+		response.SetEdns0(s.config.MaxUDPSize, false)
+		opt := response.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_UL{Code: dns.EDNS0UL, Lease: lease})
+	}
+
+	if err != nil {
+		log.Printf("Refused update of zone %s from %s: %v", name, client, err)
+	}
+
+	return packResponse(response, status)
+}
+
+// applyUpdate checks the prerequisites of an update against a zone and, if
+// they hold, applies its changes and serves the updated zone. Records the
+// update adds with a lease expire when it runs out. It returns the rcode to
+// answer the update with.
+func (s *dnsServer) applyUpdate(current *DNSRecords, found *Zone, request *dns.Msg) (int, error) {
+	zone := *found
+
+	rrs, err := current.zoneRRs(&zone)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+	content := rrs[:len(rrs)-1]
+
+	rcode, err := checkPrerequisites(zone.Origin, content, request.Answer)
+	if err != nil {
+		return rcode, err
+	}
+	rcode, err = checkUpdates(zone.Origin, request.Ns)
+	if err != nil {
+		return rcode, err
+	}
+
+	content, changed := applyUpdates(zone.Origin, content, request.Ns)
+	lease := updateLease(request)
+	if !changed && lease == 0 {
+		return dns.RcodeSuccess, nil
+	}
+
+	// Records added with a lease expire once it runs out, and adding them
+	// again renews it
+	expiries := current.expiries(zone.Origin)
+	if lease > 0 {
+		expires := time.Now().Add(time.Duration(lease) * time.Second)
+		for _, rr := range request.Ns {
+			if rr.Header().Class == dns.ClassINET {
+				expiries[leaseKey(rr)] = expires
+			}
+		}
+	}
+
+	err = s.storeZone(current, zone, content, expiries, changed)
+	if err != nil {
+		return dns.RcodeServerFailure, err
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+// storeZone serves a zone with new content, giving its records the expiry
+// times keyed by leaseKey, and saves it to its file, the records database,
+// the state file or the store it is published from. A changed zone has its
+// serial increased as its serial policy says unless the new content sets a
+// newer one itself, the change recorded in its journal and its secondaries
+// notified, while an unchanged one only has the expiry times of its records
+// renewed.
+func (s *dnsServer) storeZone(current *DNSRecords, zone Zone, content []dns.RR, expiries map[string]time.Time, changed bool) error {
+	if changed {
+		soa := dns.Copy(content[0]).(*dns.SOA)
+		if soa.Serial == zone.SOA.Serial {
+			soa.Serial = nextSerial(zone.SerialPolicy, soa.Serial)
+		}
+		content[0] = soa
+	}
+
+	records := zone.loadRRs(content)
+	for i := range records {
+		records[i].Expires = expiries[leaseKey(records[i].rr)]
+	}
+	next, err := current.withZone(zone, records)
+	if err != nil {
+		return err
+	}
+
+	if store := s.config.zoneStore(zone.Origin); store != nil {
+		if changed {
+			previous, err := current.zoneRRs(&zone)
+			if err != nil {
+				return err
+			}
+			err = pushZone(store, zone.Origin, previous[:len(previous)-1], content)
+			if err != nil {
+				return err
+			}
+		}
+	} else if zone.File != "" && changed {
+		err = writeZoneFile(zone.File, content)
+		if err != nil {
+			return err
+		}
+	} else if zone.File == "" && s.config.databaseBackend() {
+		err = saveZoneDatabase(s.config, next, &zone, records)
+		if err != nil {
+			return err
+		}
+	} else if zone.File == "" && s.config.StateFile != "" {
+		err = saveZoneState(s.config.StateFile, &zone, records)
+		if err != nil {
+			return err
+		}
+	}
+
+	if zone.journal != nil && changed {
+		served, err := next.zoneRRs(next.FindZone(zone.Origin))
+		if err != nil {
+			return err
+		}
+		err = zone.journal.record(zone.Origin, served[:len(served)-1])
+		if err != nil {
+			log.Printf("Failed to save journal of zone %s: %v", zone.Origin, err)
+		}
+	}
+
+	s.serveRecords(next)
+	if !changed {
+		return nil
+	}
+	log.Printf("Updated zone %s to serial %d", zone.Origin, zone.SOA.Serial)
+
+	s.notifyZone(zone.Origin)
+
+	return nil
+}
+
+// checkPrerequisites checks the prerequisites of an update (RFC 2136
+// section 3.2) against the zone's content, returning the rcode to refuse the
+// update with if one fails.
+func checkPrerequisites(origin string, content []dns.RR, prerequisites []dns.RR) (int, error) {
+	// Prerequisites giving records must match whole RRsets
+	var expected [][]dns.RR
+	for _, rr := range prerequisites {
+		header := rr.Header()
+		name := dns.CanonicalName(header.Name)
+		if header.Ttl != 0 {
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite for %s has a TTL", name)
+		}
+		if !dns.IsSubDomain(origin, name) {
+			return dns.RcodeNotZone, fmt.Errorf("prerequisite for %s is outside the zone", name)
+		}
+
+		switch header.Class {
+		case dns.ClassANY:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("prerequisite for %s has data", name)
+			}
+			if header.Rrtype == dns.TypeANY && !nameInUse(content, name) {
+				return dns.RcodeNameError, fmt.Errorf("%s does not exist", name)
+			}
+			if header.Rrtype != dns.TypeANY && len(findRRset(content, name, header.Rrtype)) == 0 {
+				return dns.RcodeNXRrset, fmt.Errorf("%s has no %s records", name, dns.TypeToString[header.Rrtype])
+			}
+		case dns.ClassNONE:
+			if header.Rdlength != 0 {
+				return dns.RcodeFormatError, fmt.Errorf("prerequisite for %s has data", name)
+			}
+			if header.Rrtype == dns.TypeANY && nameInUse(content, name) {
+				return dns.RcodeYXDomain, fmt.Errorf("%s exists", name)
+			}
+			if header.Rrtype != dns.TypeANY && len(findRRset(content, name, header.Rrtype)) > 0 {
+				return dns.RcodeYXRrset, fmt.Errorf("%s has %s records", name, dns.TypeToString[header.Rrtype])
+			}
+		case dns.ClassINET:
+			expected = appendToRRset(expected, rr)
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("prerequisite for %s has class %s", name, dns.ClassToString[header.Class])
+		}
+	}
+
+	for _, rrset := range expected {
+		header := rrset[0].Header()
+		if !sameRRset(findRRset(content, header.Name, header.Rrtype), rrset) {
+			return dns.RcodeNXRrset, fmt.Errorf("%s records of %s differ", dns.TypeToString[header.Rrtype], header.Name)
+		}
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+// checkUpdates checks that the changes of an update are well formed (RFC
+// 2136 section 3.4.1) before any of them are applied, returning the rcode
+// to refuse the update with if one is not.
+func checkUpdates(origin string, updates []dns.RR) (int, error) {
+	for _, rr := range updates {
+		header := rr.Header()
+		name := dns.CanonicalName(header.Name)
+		if !dns.IsSubDomain(origin, name) {
+			return dns.RcodeNotZone, fmt.Errorf("update of %s is outside the zone", name)
+		}
+
+		switch header.Class {
+		case dns.ClassINET:
+			if isMetaType(header.Rrtype) || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError, fmt.Errorf("update adds %s records to %s", dns.TypeToString[header.Rrtype], name)
+			}
+		case dns.ClassANY:
+			if header.Ttl != 0 || header.Rdlength != 0 || isMetaType(header.Rrtype) {
+				return dns.RcodeFormatError, fmt.Errorf("malformed deletion of %s", name)
+			}
+		case dns.ClassNONE:
+			if header.Ttl != 0 || isMetaType(header.Rrtype) || header.Rrtype == dns.TypeANY {
+				return dns.RcodeFormatError, fmt.Errorf("malformed deletion of %s", name)
+			}
+		default:
+			return dns.RcodeFormatError, fmt.Errorf("update of %s has class %s", name, dns.ClassToString[header.Class])
+		}
+	}
+
+	return dns.RcodeSuccess, nil
+}
+
+// isMetaType reports whether a type may only appear in queries, other than
+// ANY.
+func isMetaType(rrtype uint16) bool {
+	switch rrtype {
+	case dns.TypeAXFR, dns.TypeIXFR, dns.TypeMAILA, dns.TypeMAILB, dns.TypeOPT, dns.TypeTSIG:
+		return true
+	}
+
+	return false
+}
+
+// applyUpdates applies the changes of an update to the zone's content (RFC
+// 2136 section 3.4.2), reporting whether anything changed. The SOA record
+// and the last NS record at the apex cannot be deleted, and a name holding
+// a CNAME record cannot hold any other.
+func applyUpdates(origin string, content []dns.RR, updates []dns.RR) ([]dns.RR, bool) {
+	changed := false
+	for _, update := range updates {
+		rr := dns.Copy(update)
+		header := rr.Header()
+		header.Name = dns.CanonicalName(header.Name)
+		name, rrtype := header.Name, header.Rrtype
+		apex := name == origin
+
+		before := len(content)
+		switch header.Class {
+		case dns.ClassINET:
+			if rrtype == dns.TypeSOA {
+				if apex && serialNewer(rr.(*dns.SOA).Serial, content[0].(*dns.SOA).Serial) {
+					content[0] = rr
+					changed = true
+				}
+				continue
+			}
+
+			hasCNAME := len(findRRset(content, name, dns.TypeCNAME)) > 0
+			if rrtype == dns.TypeCNAME && !hasCNAME && nameInUse(content, name) || rrtype != dns.TypeCNAME && hasCNAME {
+				continue
+			}
+			if rrtype == dns.TypeCNAME {
+				content = removeRRs(content, func(other dns.RR) bool {
+					return other.Header().Name == name && other.Header().Rrtype == dns.TypeCNAME
+				})
+			}
+
+			// Adding a record that exists only updates its TTL
+			if i := indexOfDuplicate(content, rr); i >= 0 {
+				if content[i].Header().Ttl == header.Ttl {
+					continue
+				}
+				content[i] = rr
+			} else {
+				content = append(content, rr)
+			}
+			changed = true
+			continue
+		case dns.ClassANY:
+			content = removeRRs(content, func(other dns.RR) bool {
+				otherType := other.Header().Rrtype
+				if other.Header().Name != name || rrtype != dns.TypeANY && otherType != rrtype {
+					return false
+				}
+				return !apex || otherType != dns.TypeSOA && otherType != dns.TypeNS
+			})
+		case dns.ClassNONE:
+			if rrtype == dns.TypeSOA || apex && rrtype == dns.TypeNS && len(findRRset(content, name, dns.TypeNS)) <= 1 {
+				continue
+			}
+			header.Class = dns.ClassINET
+			content = removeRR(content, rr)
+		}
+
+		if len(content) != before {
+			changed = true
+		}
+	}
+
+	return content, changed
+}
+
+// removeRRs returns the records for which remove reports false.
+func removeRRs(rrs []dns.RR, remove func(dns.RR) bool) []dns.RR {
+	var kept []dns.RR
+	for _, rr := range rrs {
+		if !remove(rr) {
+			kept = append(kept, rr)
+		}
+	}
+
+	return kept
+}
+
+// indexOfDuplicate returns the index of the record that is the same as rr,
+// regardless of TTL, or -1 if there is none.
+func indexOfDuplicate(rrs []dns.RR, rr dns.RR) int {
+	for i, other := range rrs {
+		if dns.IsDuplicate(other, rr) {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// nameInUse reports whether any record is owned by name.
+func nameInUse(rrs []dns.RR, name string) bool {
+	for _, rr := range rrs {
+		if dns.CanonicalName(rr.Header().Name) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findRRset returns the records of the given name and type.
+func findRRset(rrs []dns.RR, name string, rrtype uint16) []dns.RR {
+	name = dns.CanonicalName(name)
+
+	var rrset []dns.RR
+	for _, rr := range rrs {
+		if dns.CanonicalName(rr.Header().Name) == name && rr.Header().Rrtype == rrtype {
+			rrset = append(rrset, rr)
+		}
+	}
+
+	return rrset
+}
+
+// appendToRRset adds a record to the RRset of its name and type.
+func appendToRRset(rrsets [][]dns.RR, rr dns.RR) [][]dns.RR {
+	for i, rrset := range rrsets {
+		header := rrset[0].Header()
+		if dns.CanonicalName(header.Name) == dns.CanonicalName(rr.Header().Name) && header.Rrtype == rr.Header().Rrtype {
+			rrsets[i] = append(rrset, rr)
+			return rrsets
+		}
+	}
+
+	return append(rrsets, []dns.RR{rr})
+}
+
+// sameRRset reports whether two RRsets hold the same records, regardless of
+// their TTLs.
+func sameRRset(a, b []dns.RR) bool {
+	for _, rr := range a {
+		if indexOfDuplicate(b, rr) < 0 {
+			return false
+		}
+	}
+	for _, rr := range b {
+		if indexOfDuplicate(a, rr) < 0 {
+			return false
+		}
+	}
+
+	return true
+}
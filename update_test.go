@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testZone is the content of the zone the update tests apply to, with its
+// SOA record first as the zone's content always has.
+var testZone = []string{
+	"lan. 600 IN SOA ns1.lan. hostmaster.lan. 10 3600 600 86400 600",
+	"lan. 600 IN NS ns1.lan.",
+	"ns1.lan. 600 IN A 192.168.1.1",
+	"www.lan. 600 IN A 192.168.1.10",
+	"www.lan. 600 IN A 192.168.1.11",
+	"alias.lan. 600 IN CNAME www.lan.",
+}
+
+// testRRs parses records written in the master file format.
+func testRRs(t *testing.T, lines ...string) []dns.RR {
+	t.Helper()
+
+	rrs, err := parseRRs(lines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rrs
+}
+
+// emptyRR returns a record with no data, as prerequisites and deletions of
+// whole RRsets and names are given.
+func emptyRR(name string, rrtype uint16, class uint16) dns.RR {
+	return &dns.ANY{Hdr: dns.RR_Header{Name: name, Rrtype: rrtype, Class: class}}
+}
+
+// withClass returns a record parsed from line with its class and TTL
+// replaced, as prerequisites and deletions of single records are given.
+func withClass(t *testing.T, line string, class uint16) dns.RR {
+	t.Helper()
+
+	rr := testRRs(t, line)[0]
+	rr.Header().Class = class
+	rr.Header().Ttl = 0
+
+	return rr
+}
+
+// received returns records as a server receives them in a request, with
+// the lengths of their data set.
+func received(t *testing.T, rrs []dns.RR) []dns.RR {
+	t.Helper()
+
+	msg := new(dns.Msg)
+	msg.Ns = rrs
+	buf, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = msg.Unpack(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg.Ns
+}
+
+func TestCheckPrerequisites(t *testing.T) {
+	tests := []struct {
+		name          string
+		prerequisites []dns.RR
+		rcode         int
+	}{
+		{"none", nil, dns.RcodeSuccess},
+		{"name in use", []dns.RR{emptyRR("www.lan.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess},
+		{"name not in use", []dns.RR{emptyRR("missing.lan.", dns.TypeANY, dns.ClassANY)}, dns.RcodeNameError},
+		{"RRset exists", []dns.RR{emptyRR("www.lan.", dns.TypeA, dns.ClassANY)}, dns.RcodeSuccess},
+		{"RRset missing", []dns.RR{emptyRR("www.lan.", dns.TypeAAAA, dns.ClassANY)}, dns.RcodeNXRrset},
+		{"name is not in use", []dns.RR{emptyRR("missing.lan.", dns.TypeANY, dns.ClassNONE)}, dns.RcodeSuccess},
+		{"name is in use", []dns.RR{emptyRR("www.lan.", dns.TypeANY, dns.ClassNONE)}, dns.RcodeYXDomain},
+		{"RRset does not exist", []dns.RR{emptyRR("www.lan.", dns.TypeAAAA, dns.ClassNONE)}, dns.RcodeSuccess},
+		{"RRset does exist", []dns.RR{emptyRR("www.lan.", dns.TypeA, dns.ClassNONE)}, dns.RcodeYXRrset},
+		{
+			"RRset matches",
+			[]dns.RR{
+				withClass(t, "www.lan. IN A 192.168.1.11", dns.ClassINET),
+				withClass(t, "WWW.lan. IN A 192.168.1.10", dns.ClassINET),
+			},
+			dns.RcodeSuccess,
+		},
+		{
+			"RRset has more records",
+			[]dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassINET)},
+			dns.RcodeNXRrset,
+		},
+		{
+			"RRset has other records",
+			[]dns.RR{
+				withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassINET),
+				withClass(t, "www.lan. IN A 192.168.1.12", dns.ClassINET),
+			},
+			dns.RcodeNXRrset,
+		},
+		{"TTL given", []dns.RR{testRRs(t, "www.lan. 600 IN A 192.168.1.10")[0]}, dns.RcodeFormatError},
+		{"data given", []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassANY)}, dns.RcodeFormatError},
+		{"outside the zone", []dns.RR{emptyRR("www.example.", dns.TypeANY, dns.ClassANY)}, dns.RcodeNotZone},
+		{"other class", []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassCHAOS)}, dns.RcodeFormatError},
+	}
+
+	content := testRRs(t, testZone...)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rcode, err := checkPrerequisites("lan.", content, received(t, test.prerequisites))
+			if rcode != test.rcode {
+				t.Fatalf("got rcode %s (%v), want %s", dns.RcodeToString[rcode], err, dns.RcodeToString[test.rcode])
+			}
+			if (err == nil) != (test.rcode == dns.RcodeSuccess) {
+				t.Fatalf("got error %v with rcode %s", err, dns.RcodeToString[rcode])
+			}
+		})
+	}
+}
+
+func TestCheckUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []dns.RR
+		rcode   int
+	}{
+		{"add", testRRs(t, "new.lan. 600 IN A 192.168.1.20"), dns.RcodeSuccess},
+		{"delete RRset", []dns.RR{emptyRR("www.lan.", dns.TypeA, dns.ClassANY)}, dns.RcodeSuccess},
+		{"delete name", []dns.RR{emptyRR("www.lan.", dns.TypeANY, dns.ClassANY)}, dns.RcodeSuccess},
+		{"delete record", []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassNONE)}, dns.RcodeSuccess},
+		{"outside the zone", testRRs(t, "www.example. 600 IN A 192.168.1.20"), dns.RcodeNotZone},
+		{"add meta type", []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.lan.", Rrtype: dns.TypeAXFR, Class: dns.ClassINET}}}, dns.RcodeFormatError},
+		{"add ANY", []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.lan.", Rrtype: dns.TypeANY, Class: dns.ClassINET}}}, dns.RcodeFormatError},
+		{"delete RRset with TTL", []dns.RR{&dns.ANY{Hdr: dns.RR_Header{Name: "www.lan.", Rrtype: dns.TypeA, Class: dns.ClassANY, Ttl: 600}}}, dns.RcodeFormatError},
+		{"delete RRset with data", []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassANY)}, dns.RcodeFormatError},
+		{"delete meta type", []dns.RR{emptyRR("www.lan.", dns.TypeIXFR, dns.ClassANY)}, dns.RcodeFormatError},
+		{"delete record with TTL", testRRs(t, "www.lan. 600 NONE A 192.168.1.10"), dns.RcodeFormatError},
+		{"delete record of type ANY", []dns.RR{emptyRR("www.lan.", dns.TypeANY, dns.ClassNONE)}, dns.RcodeFormatError},
+		{"other class", []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassCHAOS)}, dns.RcodeFormatError},
+		{
+			"any malformed change",
+			[]dns.RR{
+				testRRs(t, "new.lan. 600 IN A 192.168.1.20")[0],
+				emptyRR("www.lan.", dns.TypeANY, dns.ClassNONE),
+			},
+			dns.RcodeFormatError,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rcode, err := checkUpdates("lan.", received(t, test.updates))
+			if rcode != test.rcode {
+				t.Fatalf("got rcode %s (%v), want %s", dns.RcodeToString[rcode], err, dns.RcodeToString[test.rcode])
+			}
+			if (err == nil) != (test.rcode == dns.RcodeSuccess) {
+				t.Fatalf("got error %v with rcode %s", err, dns.RcodeToString[rcode])
+			}
+		})
+	}
+}
+
+func TestApplyUpdates(t *testing.T) {
+	tests := []struct {
+		name    string
+		updates []dns.RR
+		added   []string
+		removed []string
+	}{
+		{
+			name:    "add record",
+			updates: testRRs(t, "new.lan. 300 IN A 192.168.1.20"),
+			added:   []string{"new.lan. 300 IN A 192.168.1.20"},
+		},
+		{
+			name:    "add existing record",
+			updates: testRRs(t, "www.lan. 600 IN A 192.168.1.10"),
+		},
+		{
+			name:    "add existing record with new TTL",
+			updates: testRRs(t, "www.lan. 300 IN A 192.168.1.10"),
+			added:   []string{"www.lan. 300 IN A 192.168.1.10"},
+			removed: []string{"www.lan. 600 IN A 192.168.1.10"},
+		},
+		{
+			name:    "add newer SOA",
+			updates: testRRs(t, "lan. 600 IN SOA ns1.lan. hostmaster.lan. 11 3600 600 86400 600"),
+			added:   []string{"lan. 600 IN SOA ns1.lan. hostmaster.lan. 11 3600 600 86400 600"},
+			removed: []string{testZone[0]},
+		},
+		{
+			name:    "add older SOA",
+			updates: testRRs(t, "lan. 600 IN SOA ns1.lan. hostmaster.lan. 9 3600 600 86400 600"),
+		},
+		{
+			name:    "add SOA below the apex",
+			updates: testRRs(t, "www.lan. 600 IN SOA ns1.lan. hostmaster.lan. 11 3600 600 86400 600"),
+		},
+		{
+			name:    "add CNAME to name in use",
+			updates: testRRs(t, "www.lan. 600 IN CNAME ns1.lan."),
+		},
+		{
+			name:    "add record to CNAME",
+			updates: testRRs(t, "alias.lan. 600 IN A 192.168.1.20"),
+		},
+		{
+			name:    "replace CNAME",
+			updates: testRRs(t, "alias.lan. 600 IN CNAME ns1.lan."),
+			added:   []string{"alias.lan. 600 IN CNAME ns1.lan."},
+			removed: []string{"alias.lan. 600 IN CNAME www.lan."},
+		},
+		{
+			name:    "delete RRset",
+			updates: []dns.RR{emptyRR("www.lan.", dns.TypeA, dns.ClassANY)},
+			removed: []string{testZone[3], testZone[4]},
+		},
+		{
+			name:    "delete name",
+			updates: []dns.RR{emptyRR("WWW.lan.", dns.TypeANY, dns.ClassANY)},
+			removed: []string{testZone[3], testZone[4]},
+		},
+		{
+			name:    "delete record",
+			updates: []dns.RR{withClass(t, "www.lan. IN A 192.168.1.10", dns.ClassNONE)},
+			removed: []string{testZone[3]},
+		},
+		{
+			name:    "delete missing record",
+			updates: []dns.RR{withClass(t, "www.lan. IN A 192.168.1.12", dns.ClassNONE)},
+		},
+		{
+			name:    "delete apex name",
+			updates: []dns.RR{emptyRR("lan.", dns.TypeANY, dns.ClassANY)},
+		},
+		{
+			name:    "delete apex SOA RRset",
+			updates: []dns.RR{emptyRR("lan.", dns.TypeSOA, dns.ClassANY)},
+		},
+		{
+			name:    "delete apex NS RRset",
+			updates: []dns.RR{emptyRR("lan.", dns.TypeNS, dns.ClassANY)},
+		},
+		{
+			name:    "delete apex SOA record",
+			updates: []dns.RR{withClass(t, testZone[0], dns.ClassNONE)},
+		},
+		{
+			name:    "delete last apex NS record",
+			updates: []dns.RR{withClass(t, "lan. IN NS ns1.lan.", dns.ClassNONE)},
+		},
+		{
+			name: "delete apex NS record with another left",
+			updates: []dns.RR{
+				testRRs(t, "lan. 600 IN NS ns2.lan.")[0],
+				withClass(t, "lan. IN NS ns1.lan.", dns.ClassNONE),
+			},
+			added:   []string{"lan. 600 IN NS ns2.lan."},
+			removed: []string{testZone[1]},
+		},
+		{
+			name: "changes applied in order",
+			updates: []dns.RR{
+				emptyRR("alias.lan.", dns.TypeANY, dns.ClassANY),
+				testRRs(t, "alias.lan. 600 IN A 192.168.1.20")[0],
+			},
+			added:   []string{"alias.lan. 600 IN A 192.168.1.20"},
+			removed: []string{testZone[5]},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			content, changed := applyUpdates("lan.", testRRs(t, testZone...), received(t, test.updates))
+
+			want := rrStrings(testRRs(t, test.added...))
+			for _, rr := range testRRs(t, testZone...) {
+				kept := true
+				for _, removed := range testRRs(t, test.removed...) {
+					if rr.String() == removed.String() {
+						kept = false
+					}
+				}
+				if kept {
+					want = append(want, rr.String())
+				}
+			}
+			sort.Strings(want)
+
+			got := rrStrings(content)
+			sort.Strings(got)
+			if len(got) != len(want) {
+				t.Fatalf("got records %q, want %q", got, want)
+			}
+			for i := range got {
+				if got[i] != want[i] {
+					t.Fatalf("got records %q, want %q", got, want)
+				}
+			}
+
+			if wantChanged := len(test.added) > 0 || len(test.removed) > 0; changed != wantChanged {
+				t.Fatalf("got changed %t, want %t", changed, wantChanged)
+			}
+		})
+	}
+}
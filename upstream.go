@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Privacy profiles for encrypted upstreams (RFC 8310): opportunistic ones
+// fall back to plain DNS when encryption fails, while strict ones fail
+// rather than send a query in cleartext.
+const (
+	privacyOpportunistic = "opportunistic"
+	privacyStrict        = "strict"
+)
+
+// Backoff strategies spacing the retries of a query to an upstream.
+const (
+	backoffConstant    = "constant"
+	backoffExponential = "exponential"
+)
+
+// errCaseMismatch is returned when an answer does not echo the randomized
+// case of the query name, as a spoofed answer is unlikely to.
+var errCaseMismatch = errors.New("answer does not match the case of the query name")
+
+// Upstream is a server queries are relayed to. In the configuration it may
+// be given as just its address, or as a map holding the address and the
+// options for that server.
+type Upstream struct {
+	Address string `yaml:"address"`
+
+	// CaseRandomization overrides the global setting of whether the case
+	// of query names sent to this server is randomized, for servers that
+	// do not preserve it.
+	CaseRandomization *bool `yaml:"case_randomization"`
+
+	// Timeout, Retries, RetryDelay and Backoff override the global
+	// settings of how long each attempt at a query waits for this server
+	// and how it is retried if the server fails to answer.
+	Timeout    time.Duration `yaml:"timeout"`
+	Retries    *int          `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retry_delay"`
+	Backoff    string        `yaml:"backoff"`
+
+	// Privacy overrides the global privacy profile of this server, if it
+	// is reached over DNS-over-TLS or DNS-over-HTTPS.
+	Privacy string `yaml:"privacy"`
+
+	// IdleTimeout overrides how long idle TCP, DNS-over-TLS and
+	// DNS-over-HTTPS connections to this server are kept open for reuse.
+	IdleTimeout time.Duration `yaml:"idle_timeout"`
+}
+
+// UnmarshalYAML accepts either an address or a map of upstream options.
+func (u *Upstream) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*u = Upstream{Address: address}
+		return nil
+	}
+
+	type plain Upstream
+	return unmarshal((*plain)(u))
+}
+
+// String returns the upstream's address, for logging.
+func (u Upstream) String() string {
+	return u.Address
+}
+
+// randomizesCase reports whether the case of query names sent to the
+// upstream is randomized.
+func (u Upstream) randomizesCase() bool {
+	return u.CaseRandomization != nil && *u.CaseRandomization
+}
+
+// encrypted reports whether the upstream is reached over DNS-over-TLS or
+// DNS-over-HTTPS.
+func (u Upstream) encrypted() bool {
+	return strings.HasPrefix(u.Address, schemeTLS) || strings.HasPrefix(u.Address, schemeHTTPS)
+}
+
+// cleartext returns the upstream reached over plain DNS on port 53 of the
+// same host, which an opportunistic upstream falls back to.
+func (u Upstream) cleartext() Upstream {
+	var host string
+	if strings.HasPrefix(u.Address, schemeHTTPS) {
+		if parsed, err := url.Parse(u.Address); err == nil {
+			host = parsed.Hostname()
+		}
+	} else {
+		address, _, _ := strings.Cut(strings.TrimPrefix(u.Address, schemeTLS), "#")
+		host, _, _ = net.SplitHostPort(address)
+	}
+
+	u.Address = net.JoinHostPort(host, "53")
+	u.Privacy = ""
+	return u
+}
+
+// retries returns how many more times a query to the upstream is sent
+// after the first attempt fails.
+func (u Upstream) retries() int {
+	if u.Retries == nil {
+		return 0
+	}
+
+	return *u.Retries
+}
+
+// prepareUpstreams adds the default port to each upstream address and
+// applies the global case randomization, retry, idle timeout and privacy
+// settings to upstreams that do not set their own.
+func (c *Config) prepareUpstreams(upstreams []Upstream) error {
+	for i := range upstreams {
+		upstream := &upstreams[i]
+		upstream.Address = upstreamAddress(upstream.Address)
+		if upstream.CaseRandomization == nil {
+			randomize := c.CaseRandomization
+			upstream.CaseRandomization = &randomize
+		}
+
+		if upstream.Timeout == 0 {
+			upstream.Timeout = c.UpstreamTimeout
+		}
+		if upstream.Retries == nil {
+			retries := c.UpstreamRetries
+			upstream.Retries = &retries
+		}
+		if upstream.RetryDelay == 0 {
+			upstream.RetryDelay = c.UpstreamRetryDelay
+		}
+		if upstream.Backoff == "" {
+			upstream.Backoff = c.UpstreamBackoff
+		}
+		if upstream.IdleTimeout == 0 {
+			upstream.IdleTimeout = c.UpstreamIdleTimeout
+		}
+		if upstream.Privacy != "" && !upstream.encrypted() {
+			return fmt.Errorf("privacy %q set for upstream %s, which is not encrypted", upstream.Privacy, upstream)
+		}
+		if upstream.Privacy == "" && upstream.encrypted() {
+			upstream.Privacy = c.UpstreamPrivacy
+		}
+
+		if upstream.Timeout < 0 {
+			return fmt.Errorf("invalid timeout %v for upstream %s", upstream.Timeout, upstream)
+		}
+		if *upstream.Retries < 0 {
+			return fmt.Errorf("invalid retries %d for upstream %s", *upstream.Retries, upstream)
+		}
+		if upstream.Backoff != backoffConstant && upstream.Backoff != backoffExponential {
+			return fmt.Errorf("unsupported backoff %q for upstream %s", upstream.Backoff, upstream)
+		}
+		if upstream.encrypted() && upstream.Privacy != privacyOpportunistic && upstream.Privacy != privacyStrict {
+			return fmt.Errorf("unsupported privacy %q for upstream %s", upstream.Privacy, upstream)
+		}
+	}
+
+	return nil
+}
+
+// isTimeout reports whether an error is an upstream failing to answer in
+// time.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// logFailure logs an upstream failing to answer a query, calling out
+// timeouts so that slow upstreams can be told apart from broken ones.
+func logFailure(upstream Upstream, err error) {
+	if isTimeout(err) {
+		log.Printf("Timed out relaying DNS query to %s after %v", upstream, upstream.Timeout)
+		return
+	}
+
+	log.Printf("Failed to relay DNS query to %s: %v", upstream, err)
+}
+
+// exchange sends a query to a single upstream server, until ctx is
+// cancelled. Each attempt waits up to the upstream's timeout, and failed
+// attempts are retried as many times as it allows, spaced by its retry
+// delay.
+func exchange(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	delay := upstream.RetryDelay
+	for attempt := 0; ; attempt++ {
+		response, err := exchangeOnce(ctx, request, upstream)
+		if err == nil || attempt >= upstream.retries() || ctx.Err() != nil {
+			return response, err
+		}
+
+		if isTimeout(err) {
+			log.Printf("Timed out waiting for %s, retrying in %v", upstream, delay)
+		} else {
+			log.Printf("Failed to relay DNS query to %s, retrying in %v: %v", upstream, delay, err)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if upstream.Backoff == backoffExponential {
+			delay *= 2
+		}
+	}
+}
+
+// exchangeOnce makes a single attempt at a query to an upstream. If an
+// opportunistic upstream cannot be reached over its encrypted transport,
+// the query is sent again over plain DNS.
+func exchangeOnce(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	response, err := attempt(ctx, request, upstream)
+	if err != nil && upstream.Privacy == privacyOpportunistic && ctx.Err() == nil {
+		log.Printf("Falling back to plain DNS for %s: %v", upstream, err)
+		return attempt(ctx, request, upstream.cleartext())
+	}
+
+	return response, err
+}
+
+// attempt sends a query to an upstream, waiting up to its timeout and
+// randomizing the case of the query name if the upstream is set to.
+func attempt(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	if upstream.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, upstream.Timeout)
+		defer cancel()
+	}
+
+	if upstream.randomizesCase() && len(request.Question) > 0 {
+		return exchangeRandomCase(ctx, request, upstream)
+	}
+
+	return send(ctx, request, upstream)
+}
+
+// exchangeRandomCase sends a query with the case of its name randomized
+// (the "0x20" technique) and rejects answers that do not echo it exactly,
+// making spoofed answers far harder to forge. The original name is restored
+// in the answer before it is returned.
+func exchangeRandomCase(ctx context.Context, request *dns.Msg, upstream Upstream) (*dns.Msg, error) {
+	name := request.Question[0].Name
+	query := request.Copy()
+	query.Question[0].Name = randomCase(name)
+
+	response, err := send(ctx, query, upstream)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Question) == 0 || response.Question[0].Name != query.Question[0].Name {
+		return nil, errCaseMismatch
+	}
+
+	response.Question[0].Name = name
+	for _, section := range [][]dns.RR{response.Answer, response.Ns, response.Extra} {
+		for _, rr := range section {
+			if rr.Header().Name == query.Question[0].Name {
+				rr.Header().Name = name
+			}
+		}
+	}
+
+	return response, nil
+}
+
+// randomCase returns a name with each of its letters randomly upper or
+// lower case.
+func randomCase(name string) string {
+	randomized := []byte(name)
+	for i, c := range randomized {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+			randomized[i] = c&^0x20 | byte(rand.IntN(2))<<5
+		}
+	}
+
+	return string(randomized)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dropping returns a handler leaving the first drops queries it is sent
+// unanswered and passing the rest to handler, counting the queries in
+// attempts.
+func dropping(drops int32, attempts *atomic.Int32, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, request *dns.Msg) {
+		if attempts.Add(1) <= drops {
+			return
+		}
+		handler(w, request)
+	}
+}
+
+func TestExchangeRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		drops    int32
+		retries  int
+		backoff  string
+		attempts int32
+		answered bool
+		least    time.Duration
+	}{
+		{"answered at once", 0, 2, backoffConstant, 1, true, 0},
+		{"answered on retry", 2, 2, backoffConstant, 3, true, 2 * 100 * time.Millisecond},
+		{"out of retries", 2, 1, backoffConstant, 2, false, 2 * 100 * time.Millisecond},
+		{"no retries", 1, 0, backoffConstant, 1, false, 100 * time.Millisecond},
+		{"exponential backoff", 2, 2, backoffExponential, 3, true, 2*100*time.Millisecond + 50*time.Millisecond + 100*time.Millisecond},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts atomic.Int32
+			upstream := Upstream{
+				Address:    testUpstream(t, dropping(test.drops, &attempts, answering("192.0.2.1"))),
+				Timeout:    100 * time.Millisecond,
+				Retries:    &test.retries,
+				RetryDelay: 50 * time.Millisecond,
+				Backoff:    test.backoff,
+			}
+			request := new(dns.Msg)
+			request.SetQuestion("www.example.com.", dns.TypeA)
+
+			started := time.Now()
+			response, err := exchange(context.Background(), request, upstream)
+			elapsed := time.Since(started)
+			if test.answered && (err != nil || len(response.Answer) != 1) {
+				t.Fatalf("got %v, %v, want an answer", response, err)
+			}
+			if !test.answered && !isTimeout(err) {
+				t.Fatalf("got %v, %v, want a timeout", response, err)
+			}
+			if got := attempts.Load(); got != test.attempts {
+				t.Fatalf("got %d attempts, want %d", got, test.attempts)
+			}
+			if elapsed < test.least {
+				t.Fatalf("took %v, want at least %v", elapsed, test.least)
+			}
+		})
+	}
+}
+
+func TestPrepareUpstreams(t *testing.T) {
+	config := DefaultConfig()
+	retries := 5
+	upstreams := []Upstream{
+		{Address: "192.0.2.1"},
+		{Address: "tls://192.0.2.2", Timeout: time.Second, Retries: &retries},
+	}
+	err := config.prepareUpstreams(upstreams)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Upstreams keep their own settings, taking the global ones otherwise
+	if upstreams[0].Address != "192.0.2.1:53" || upstreams[0].Timeout != config.UpstreamTimeout || upstreams[0].retries() != config.UpstreamRetries {
+		t.Fatalf("got %+v, want the global settings", upstreams[0])
+	}
+	if upstreams[1].Address != "tls://192.0.2.2:853" || upstreams[1].Timeout != time.Second || upstreams[1].retries() != 5 {
+		t.Fatalf("got %+v, want its own settings", upstreams[1])
+	}
+
+	retries = -1
+	if config.prepareUpstreams(upstreams) == nil {
+		t.Fatal("accepted negative retries")
+	}
+}
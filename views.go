@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"time"
+)
+
+// View gives clients in the listed networks their own records, for example
+// to answer internal clients with private addresses and everyone else with
+// public ones. A view's records replace the global records of the same
+// hostname, while every other name is answered from the global records.
+type View struct {
+	Name    string      `yaml:"name"`
+	Match   []string    `yaml:"match"`
+	Records []DNSRecord `yaml:"records"`
+
+	networks []*net.IPNet
+	merged   *DNSRecords
+}
+
+// prepare parses the view's networks and builds the record set its clients
+// are answered from, layering its records over the global ones.
+func (v *View) prepare(global *DNSRecords) error {
+	networks, err := parseNetworks(v.Match)
+	if err != nil {
+		return fmt.Errorf("%v in view %s", err, v.Name)
+	}
+	v.networks = networks
+
+	v.Records = unexpired(v.Records, time.Now())
+	overridden := map[string]bool{}
+	for i := range v.Records {
+		v.Records[i].Hostname = canonicalHostname(v.Records[i].Hostname)
+		v.Records[i].ttl = global.recordTTL(v.Records[i])
+		overridden[v.Records[i].Hostname] = true
+	}
+
+	merged := &DNSRecords{TTL: global.TTL, Zones: global.Zones}
+	merged.Records = append(merged.Records, v.Records...)
+	for _, record := range global.Records {
+		if !overridden[record.Hostname] {
+			merged.Records = append(merged.Records, record)
+		}
+	}
+	v.merged = merged
+
+	return nil
+}
+
+// matches reports whether the view applies to a client address.
+func (v *View) matches(ip net.IP) bool {
+	return containsIP(v.networks, ip)
+}
+
+// parseNetworks parses a list of networks written as CIDRs or bare
+// addresses, where a bare address matches only itself.
+func parseNetworks(matches []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, match := range matches {
+		_, network, err := net.ParseCIDR(match)
+		if err != nil {
+			ip := net.ParseIP(match)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid network %q", match)
+			}
+
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// containsIP reports whether any of the networks contains an address.
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ForClient returns the records a client is answered from: those of the
+// first view matching its address, or the global records if none match.
+func (r *DNSRecords) ForClient(ip net.IP) *DNSRecords {
+	if ip == nil {
+		return r
+	}
+
+	for i := range r.Views {
+		if r.Views[i].matches(ip) {
+			return r.Views[i].merged
+		}
+	}
+
+	return r
+}
+
+// addrIP returns the IP address of a client's network address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	case nil:
+		return nil
+	}
+
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+
+	return net.ParseIP(host)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/miekg/dns"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+)
+
+// Verdicts the filter function of a plugin returns for a query.
+const (
+	wasmPass   = 0
+	wasmBlock  = 1
+	wasmRefuse = 2
+	wasmDrop   = 3
+)
+
+// wasmMemoryPages is the most memory a plugin may use, in pages of 64 KiB.
+const wasmMemoryPages = 256
+
+// WASMConfig passes each query to the filter and lookup functions of a
+// WebAssembly plugin, loading the module again as its file changes.
+type WASMConfig struct {
+	Enabled bool `yaml:"enabled"`
+
+	// Module is the file holding the WebAssembly module.
+	Module string `yaml:"module"`
+
+	// Timeout is how long the plugin may take to handle a query.
+	Timeout time.Duration `yaml:"timeout"`
+
+	plugin *wasmPlugin
+}
+
+// parse validates the timeout and loads the module.
+func (c *WASMConfig) parse() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("invalid wasm timeout %v", c.Timeout)
+	}
+
+	c.plugin = newWASMPlugin()
+	err := c.plugin.load(c.Module)
+	if err != nil {
+		return fmt.Errorf("failed to load wasm module %s: %v", c.Module, err)
+	}
+
+	return nil
+}
+
+// wasmPlugin is a compiled plugin module. Queries hold mu for reading, so
+// that a replaced module is only closed once no query uses it.
+type wasmPlugin struct {
+	runtime wazero.Runtime
+
+	mu       sync.RWMutex
+	compiled wazero.CompiledModule
+}
+
+// newWASMPlugin returns a plugin with no module loaded.
+func newWASMPlugin() *wasmPlugin {
+	ctx := context.Background()
+	runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().
+		WithCloseOnContextDone(true).
+		WithMemoryLimitPages(wasmMemoryPages))
+	wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+
+	return &wasmPlugin{runtime: runtime}
+}
+
+// load compiles a module and, if it implements the plugin ABI, swaps it for
+// the module in use.
+func (p *wasmPlugin) load(file string) error {
+	binary, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	compiled, err := p.runtime.CompileModule(ctx, binary)
+	if err != nil {
+		return err
+	}
+
+	functions := compiled.ExportedFunctions()
+	exports := func(name string, params []api.ValueType, result api.ValueType) (bool, error) {
+		function, ok := functions[name]
+		if !ok {
+			return false, nil
+		}
+		if fmt.Sprint(function.ParamTypes()) != fmt.Sprint(params) || fmt.Sprint(function.ResultTypes()) != fmt.Sprint([]api.ValueType{result}) {
+			return false, fmt.Errorf("exported function %s has the wrong signature", name)
+		}
+		return true, nil
+	}
+	alloc, err := exports("alloc", []api.ValueType{api.ValueTypeI32}, api.ValueTypeI32)
+	if err == nil && !alloc {
+		err = fmt.Errorf("module does not export alloc")
+	}
+	var filters, lookups bool
+	if err == nil {
+		filters, err = exports("filter", []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, api.ValueTypeI32)
+	}
+	if err == nil {
+		lookups, err = exports("lookup", []api.ValueType{api.ValueTypeI32, api.ValueTypeI32}, api.ValueTypeI64)
+	}
+	if err == nil && !filters && !lookups {
+		err = fmt.Errorf("module exports neither filter nor lookup")
+	}
+	if err == nil && compiled.ExportedMemories()["memory"] == nil {
+		err = fmt.Errorf("module does not export its memory")
+	}
+	if err != nil {
+		compiled.Close(ctx)
+		return err
+	}
+
+	p.mu.Lock()
+	previous := p.compiled
+	p.compiled = compiled
+	p.mu.Unlock()
+
+	if previous != nil {
+		previous.Close(ctx)
+	}
+
+	return nil
+}
+
+// run passes a query to a new instance of the module, returning the
+// verdict of its filter function and the answer of its lookup function.
+func (p *wasmPlugin) run(input []byte, timeout time.Duration) (uint64, []byte, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	module, err := p.runtime.InstantiateModule(ctx, p.compiled, wazero.NewModuleConfig().
+		WithName("").
+		WithStartFunctions("_initialize"))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer module.Close(ctx)
+
+	allocated, err := module.ExportedFunction("alloc").Call(ctx, uint64(len(input)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("alloc: %v", err)
+	}
+	ptr := uint32(allocated[0])
+	if !module.Memory().Write(ptr, input) {
+		return 0, nil, fmt.Errorf("alloc returned memory out of range")
+	}
+
+	if filter := module.ExportedFunction("filter"); filter != nil {
+		verdict, err := filter.Call(ctx, uint64(ptr), uint64(len(input)))
+		if err != nil {
+			return 0, nil, fmt.Errorf("filter: %v", err)
+		}
+		if uint32(verdict[0]) != wasmPass {
+			return uint64(uint32(verdict[0])), nil, nil
+		}
+	}
+
+	lookup := module.ExportedFunction("lookup")
+	if lookup == nil {
+		return wasmPass, nil, nil
+	}
+	results, err := lookup.Call(ctx, uint64(ptr), uint64(len(input)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("lookup: %v", err)
+	}
+	if results[0] == 0 {
+		return wasmPass, nil, nil
+	}
+	answer, ok := module.Memory().Read(uint32(results[0]>>32), uint32(results[0]))
+	if !ok {
+		return 0, nil, fmt.Errorf("lookup returned memory out of range")
+	}
+
+	// The memory goes with the instance
+	return wasmPass, append([]byte(nil), answer...), nil
+}
+
+// pluginQuery is a query as plugins are given it, in JSON.
+type pluginQuery struct {
+	Qname  string `json:"qname"`
+	Qtype  string `json:"qtype"`
+	Client string `json:"client,omitempty"`
+}
+
+// questionAnswers returns the records a plugin gave for a name that answer
+// a question, named as the question is.
+func questionAnswers(question dns.Question, rrs []dns.RR) []dns.RR {
+	var answers []dns.RR
+	for _, rr := range rrs {
+		rrtype := rr.Header().Rrtype
+		if rrtype == question.Qtype || question.Qtype == dns.TypeANY || rrtype == dns.TypeCNAME {
+			rr.Header().Name = question.Name
+			answers = append(answers, rr)
+		}
+	}
+
+	return answers
+}
+
+// wasmHandler answers the queries the plugin filters or has records for,
+// passing the rest on.
+func (s *dnsServer) wasmHandler(q *query, next func() *dns.Msg) *dns.Msg {
+	config := &s.config.WASM
+	question := q.request.Question[0]
+
+	var address string
+	if q.client != nil {
+		address = q.client.String()
+	}
+	input, err := json.Marshal(pluginQuery{
+		Qname:  question.Name,
+		Qtype:  dns.TypeToString[question.Qtype],
+		Client: address,
+	})
+	if err != nil {
+		log.Printf("Failed to encode %s for the wasm plugin: %v", question.Name, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	}
+
+	verdict, answer, err := config.plugin.run(input, config.Timeout)
+	switch {
+	case err != nil:
+		log.Printf("Failed to handle %s with the wasm plugin: %v", question.Name, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	case verdict == wasmBlock:
+		q.response.Rcode = dns.RcodeNameError
+		return q.response
+	case verdict == wasmRefuse:
+		q.response.Rcode = dns.RcodeRefused
+		return q.response
+	case verdict == wasmDrop:
+		return nil
+	case verdict != wasmPass:
+		log.Printf("The wasm plugin filtered %s with unknown verdict %d", question.Name, verdict)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	case answer == nil:
+		return next()
+	}
+
+	rrs, err := decodeRemoteRecords(bytes.NewReader(answer))
+	if err != nil {
+		log.Printf("Invalid answer from the wasm plugin for %s: %v", question.Name, err)
+		q.response.Rcode = dns.RcodeServerFailure
+		return q.response
+	}
+	if len(rrs) == 0 {
+		return next()
+	}
+
+	q.response.Authoritative = true
+	answers := questionAnswers(question, rrs)
+	rotate(answers, atomic.AddUint64(&s.rotation, 1))
+	q.response.Answer = answers
+
+	return q.response
+}
+
+// watchPlugin loads the module of the plugin again whenever its file
+// changes, keeping the module in use if the new one fails to load.
+func (s *dnsServer) watchPlugin() {
+	if !s.config.WASM.Enabled {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch the wasm module for changes: %v", err)
+		return
+	}
+	err = watcher.Add(filepath.Dir(s.config.WASM.Module))
+	if err != nil {
+		watcher.Close()
+		log.Printf("Failed to watch the wasm module for changes: %v", err)
+		return
+	}
+
+	file := filepath.Clean(s.config.WASM.Module)
+	go func() {
+		var settled <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) == file && event.Op != fsnotify.Chmod {
+					settled = time.After(watchDelay)
+				}
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("Failed to watch the wasm module for changes: %v", err)
+			case <-settled:
+				settled = nil
+				err := s.config.WASM.plugin.load(file)
+				if err != nil {
+					log.Printf("Failed to reload wasm module %s, keeping the one loaded: %v", file, err)
+					continue
+				}
+				log.Printf("Reloaded wasm module %s", file)
+			}
+		}
+	}()
+}
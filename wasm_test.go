@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// buildPlugin builds the test plugin into file, answering with addresses
+// ending in version.
+func buildPlugin(t *testing.T, file, version string) {
+	t.Helper()
+
+	source, err := filepath.Abs(filepath.Join("testdata", "wasmplugin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("go", "build", "-buildmode=c-shared", "-ldflags=-X=main.version="+version, "-o", file, ".")
+	cmd.Dir = source
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm")
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Skipf("cannot build the test plugin: %v\n%s", err, output)
+	}
+}
+
+// wasmQuery passes a query for name through the plugin of a server,
+// reporting whether the plugin passed it on.
+func wasmQuery(s *dnsServer, name string) (*dns.Msg, bool) {
+	request := new(dns.Msg)
+	request.SetQuestion(name, dns.TypeA)
+	response := new(dns.Msg)
+	response.SetReply(request)
+	q := &query{request: request, response: response, client: net.ParseIP("192.168.1.20")}
+
+	passed := false
+	got := s.wasmHandler(q, func() *dns.Msg {
+		passed = true
+		return q.response
+	})
+
+	return got, passed
+}
+
+func TestWASMPlugin(t *testing.T) {
+	if testing.Short() {
+		t.Skip("building the test plugin is slow")
+	}
+
+	directory := t.TempDir()
+	config := DefaultConfig()
+	config.WASM.Enabled = true
+	config.WASM.Module = filepath.Join(directory, "plugin.wasm")
+	config.WASM.Timeout = 10 * time.Second
+	buildPlugin(t, config.WASM.Module, "1")
+	err := config.WASM.parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &dnsServer{config: config}
+
+	tests := []struct {
+		name    string
+		dropped bool
+		rcode   int
+		answer  string
+		passed  bool
+	}{
+		{name: "blocked.lan.", rcode: dns.RcodeNameError},
+		{name: "refused.lan.", rcode: dns.RcodeRefused},
+		{name: "dropped.lan.", dropped: true},
+		{name: "host.plugin.lan.", answer: "host.plugin.lan.\t60\tIN\tA\t10.0.0.1"},
+		{name: "other.lan.", passed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, passed := wasmQuery(s, test.name)
+			if passed != test.passed {
+				t.Fatalf("got passed on %t, want %t", passed, test.passed)
+			}
+			if test.dropped {
+				if got != nil {
+					t.Fatalf("got response %v, want it dropped", got)
+				}
+				return
+			}
+			if got.Rcode != test.rcode {
+				t.Fatalf("got rcode %s, want %s", dns.RcodeToString[got.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if test.answer != "" && (len(got.Answer) != 1 || got.Answer[0].String() != test.answer) {
+				t.Fatalf("got answers %v, want %q", got.Answer, test.answer)
+			}
+		})
+	}
+
+	// A new module takes the place of the old one as it is loaded, while a
+	// module that cannot be loaded leaves it in place
+	buildPlugin(t, config.WASM.Module, "2")
+	err = config.WASM.plugin.load(config.WASM.Module)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := wasmQuery(s, "host.plugin.lan.")
+	if len(got.Answer) != 1 || got.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Fatalf("got answers %v from the swapped module, want 10.0.0.2", got.Answer)
+	}
+
+	err = os.WriteFile(config.WASM.Module, []byte("not wasm"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.WASM.plugin.load(config.WASM.Module) == nil {
+		t.Fatal("loaded an invalid module")
+	}
+	got, _ = wasmQuery(s, "host.plugin.lan.")
+	if len(got.Answer) != 1 || got.Answer[0].(*dns.A).A.String() != "10.0.0.2" {
+		t.Fatalf("got answers %v after a failed load, want 10.0.0.2", got.Answer)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDelay is how long watched files must go unchanged before the records
+// are reloaded, so that files are not loaded part way through being written.
+const watchDelay = time.Second
+
+// watchFiles reloads the records whenever the records file, a file it
+// includes, a hosts, dnsmasq or filter list file or the file of a zone it
+// names changes, or a file is added that it would include. The directories
+// holding the files are watched rather than the files themselves, as
+// editors often save a file by replacing it.
+func (s *dnsServer) watchFiles() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("Failed to watch files for changes: %v", err)
+		return
+	}
+
+	go s.followChanges(watcher)
+}
+
+// followChanges reloads the records once the watched files have settled
+// after a change. Changes to the configuration file are only logged, as
+// applying them takes a restart.
+func (s *dnsServer) followChanges(watcher *fsnotify.Watcher) {
+	configFile := filepath.Clean(s.configFile)
+	files, includes := s.watchDirectories(watcher)
+
+	var settled <-chan time.Time
+	var recordsChanged, configChanged bool
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+
+			name := filepath.Clean(event.Name)
+			switch {
+			case files[name] || matchesAny(includes, name):
+				recordsChanged = true
+			case name == configFile:
+				configChanged = true
+			default:
+				continue
+			}
+			settled = time.After(watchDelay)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Failed to watch files for changes: %v", err)
+		case <-settled:
+			settled = nil
+			if configChanged {
+				log.Printf("Config file %s changed, restart the server to apply it", s.configFile)
+				configChanged = false
+			}
+			if recordsChanged {
+				s.reloadRecords()
+				files, includes = s.watchDirectories(watcher)
+				recordsChanged = false
+			}
+		}
+	}
+}
+
+// watchDirectories watches the directories of the files whose changes
+// reload the records, returning those files and the patterns of included
+// files. The files of secondary zones are left out, as they are only
+// written by the server.
+func (s *dnsServer) watchDirectories(watcher *fsnotify.Watcher) (map[string]bool, []string) {
+	records := s.records.Load()
+	files := map[string]bool{}
+	switch s.config.Backend {
+	case backendYAML, backendRedis, backendEtcd:
+		files[filepath.Clean(s.config.RecordsFile)] = true
+	case backendSQLite:
+		files[filepath.Clean(s.config.DatabaseFile)] = true
+	}
+	for _, hostsFile := range s.config.HostsFiles {
+		files[filepath.Clean(hostsFile)] = true
+	}
+	for _, dnsmasqFile := range s.config.DnsmasqFiles {
+		files[filepath.Clean(dnsmasqFile)] = true
+	}
+	if s.config.Filter.Enabled {
+		for _, list := range append(append([]string{}, s.config.Filter.Blocklists...), s.config.Filter.Allowlists...) {
+			if !isListURL(list) {
+				files[filepath.Clean(list)] = true
+			}
+		}
+	}
+	if s.config.Overlay.Enabled && s.config.Overlay.Source == overlayWireGuard {
+		files[filepath.Clean(s.config.Overlay.WireGuardFile)] = true
+	}
+	for _, zone := range records.Zones {
+		if zone.File != "" && len(zone.Primaries) == 0 {
+			files[filepath.Clean(zone.File)] = true
+		}
+	}
+
+	directories := map[string]bool{filepath.Dir(filepath.Clean(s.configFile)): true}
+	for file := range files {
+		directories[filepath.Dir(file)] = true
+	}
+	for _, pattern := range records.includes {
+		directories[filepath.Dir(pattern)] = true
+	}
+	for directory := range directories {
+		err := watcher.Add(directory)
+		if err != nil {
+			log.Printf("Failed to watch %s for changes: %v", directory, err)
+		}
+	}
+
+	return files, records.includes
+}
+
+// matchesAny reports whether a file matches any of the patterns.
+func matchesAny(patterns []string, file string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(filepath.Clean(pattern), file); matched {
+			return true
+		}
+	}
+
+	return false
+}
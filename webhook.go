@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Actions of the changes sent to webhooks.
+const (
+	changeAdded    = "added"
+	changeModified = "modified"
+	changeRemoved  = "removed"
+)
+
+// webhookQueueSize is how many batches of changes may wait to be sent to a
+// webhook before further ones are dropped.
+const webhookQueueSize = 100
+
+// webhookAttempts is how many times a batch of changes is sent to a webhook
+// before it is given up on.
+const webhookAttempts = 3
+
+// Webhook is an HTTP endpoint the changes to the records served are POSTed
+// to as JSON, grouped by name and type.
+type Webhook struct {
+	URL string `yaml:"url"`
+
+	// Secret signs each request with HMAC-SHA256 of its body, sent as
+	// X-Lacuna-Signature: sha256=<hex>, so that the endpoint can tell the
+	// requests are from the server.
+	Secret string `yaml:"secret"`
+
+	// Zones limits the changes sent to those in the given zones. Changes to
+	// every record are sent if none are given.
+	Zones []string `yaml:"zones"`
+
+	// Timeout is how long the endpoint may take to answer.
+	Timeout time.Duration `yaml:"timeout"`
+
+	client *http.Client
+	queue  chan []byte
+}
+
+// parse validates the URL of a webhook and canonicalises its zones.
+func (w *Webhook) parse() error {
+	address, err := url.Parse(w.URL)
+	if err != nil || (address.Scheme != "http" && address.Scheme != "https") || address.Host == "" {
+		return fmt.Errorf("invalid webhook url %q", w.URL)
+	}
+	if w.Timeout == 0 {
+		w.Timeout = 5 * time.Second
+	}
+	if w.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %v of webhook %s", w.Timeout, w.URL)
+	}
+
+	for i, zone := range w.Zones {
+		w.Zones[i] = dns.CanonicalName(zone)
+	}
+	w.client = &http.Client{Timeout: w.Timeout}
+	w.queue = make(chan []byte, webhookQueueSize)
+	return nil
+}
+
+// covers reports whether changes to a name are sent to the webhook.
+func (w *Webhook) covers(name string) bool {
+	return inZones(w.Zones, name)
+}
+
+// inZones reports whether a name is under one of zones, or whether there
+// are no zones to limit names to.
+func inZones(zones []string, name string) bool {
+	if len(zones) == 0 {
+		return true
+	}
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// recordChange is a change to the records of a name of a type, as it is
+// sent to webhooks.
+type recordChange struct {
+	Action   string   `json:"action"`
+	Zone     string   `json:"zone,omitempty"`
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Records  []string `json:"records,omitempty"`
+	Previous []string `json:"previous,omitempty"`
+}
+
+// webhookPayload is the body of a request to a webhook.
+type webhookPayload struct {
+	Time    time.Time      `json:"time"`
+	Changes []recordChange `json:"changes"`
+}
+
+// servedRRs returns the records served outside any view, keyed by their
+// name and type, leaving out the SOA records whose serials change with
+// every change to their zones.
+func servedRRs(records *DNSRecords) map[string][]string {
+	rrsets := map[string][]string{}
+	for _, zone := range records.Zones {
+		for _, rr := range zone.ApexRRs(zone.Origin) {
+			if rr.Header().Rrtype != dns.TypeSOA {
+				key := rrsetKey(rr)
+				rrsets[key] = append(rrsets[key], rr.String())
+			}
+		}
+	}
+	for _, record := range records.Records {
+		rrs, err := record.RRs(record.Hostname)
+		if err != nil {
+			continue
+		}
+		for _, rr := range rrs {
+			key := rrsetKey(rr)
+			rrsets[key] = append(rrsets[key], rr.String())
+		}
+	}
+
+	for _, rrs := range rrsets {
+		sort.Strings(rrs)
+	}
+	return rrsets
+}
+
+// rrsetKey returns the name and type of a record, as "name type".
+func rrsetKey(rr dns.RR) string {
+	return dns.CanonicalName(rr.Header().Name) + " " + dns.TypeToString[rr.Header().Rrtype]
+}
+
+// recordChanges returns the changes between two versions of the records
+// served, sorted by name and type.
+func recordChanges(previous, next *DNSRecords) []recordChange {
+	before, after := servedRRs(previous), servedRRs(next)
+	keys := map[string]bool{}
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	var changes []recordChange
+	for _, key := range sorted {
+		old, current := before[key], after[key]
+		action := changeModified
+		switch {
+		case len(old) == 0:
+			action = changeAdded
+		case len(current) == 0:
+			action = changeRemoved
+		case slices.Equal(old, current):
+			continue
+		}
+
+		split := strings.LastIndex(key, " ")
+		name, rrtype := key[:split], key[split+1:]
+		change := recordChange{Action: action, Name: name, Type: rrtype, Records: current, Previous: old}
+		if zone := next.FindZone(name); zone != nil {
+			change.Zone = zone.Origin
+		} else if zone := previous.FindZone(name); zone != nil {
+			change.Zone = zone.Origin
+		}
+		changes = append(changes, change)
+	}
+
+	return changes
+}
+
+// serveRecords serves new records in place of the old ones, sending what
+// changed to the webhooks and the clients watching the changes, and pushing
+// it to the servers zones are pushed to.
+func (s *dnsServer) serveRecords(next *DNSRecords) {
+	previous := s.records.Swap(next)
+	s.queuePushes(previous, next)
+	if len(s.config.Webhooks) == 0 && !s.watched() {
+		return
+	}
+
+	changes := recordChanges(previous, next)
+	if len(changes) == 0 {
+		return
+	}
+	for i := range s.config.Webhooks {
+		s.config.Webhooks[i].enqueue(changes)
+	}
+	s.sendWatchers(changes)
+}
+
+// sendWebhooks starts sending the changes queued for each webhook.
+func (s *dnsServer) sendWebhooks() {
+	for i := range s.config.Webhooks {
+		go s.config.Webhooks[i].send()
+	}
+}
+
+// enqueue queues the changes the webhook covers to be sent to it.
+func (w *Webhook) enqueue(changes []recordChange) {
+	var covered []recordChange
+	for _, change := range changes {
+		if w.covers(change.Name) {
+			covered = append(covered, change)
+		}
+	}
+	if len(covered) == 0 {
+		return
+	}
+
+	body, err := json.Marshal(webhookPayload{Time: time.Now().UTC(), Changes: covered})
+	if err != nil {
+		log.Printf("Failed to encode changes for webhook %s: %v", w.URL, err)
+		return
+	}
+	select {
+	case w.queue <- body:
+	default:
+		log.Printf("Dropped %d changes for webhook %s: too many waiting to be sent", len(covered), w.URL)
+	}
+}
+
+// send sends the queued changes to the webhook in order, trying each batch
+// again after a growing delay if the endpoint fails.
+func (w *Webhook) send() {
+	for body := range w.queue {
+		delay := time.Second
+		for attempt := 1; ; attempt++ {
+			err := w.post(body)
+			if err == nil {
+				break
+			}
+			if attempt == webhookAttempts {
+				log.Printf("Failed to send changes to webhook %s, giving up: %v", w.URL, err)
+				break
+			}
+
+			log.Printf("Failed to send changes to webhook %s, retrying in %v: %v", w.URL, delay, err)
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// post sends a batch of changes to the webhook, signed with its secret.
+func (w *Webhook) post(body []byte) error {
+	request, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if w.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.Secret))
+		mac.Write(body)
+		request.Header.Set("X-Lacuna-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	response, err := w.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", response.Status)
+	}
+
+	return nil
+}
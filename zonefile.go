@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/miekg/dns"
+)
+
+// loadFile reads the zone's records from its master file (RFC 1035), as
+// written for BIND.
+func (z *Zone) loadFile() ([]DNSRecord, error) {
+	if z.Origin == "" {
+		return nil, fmt.Errorf("zone file %s has no origin", z.File)
+	}
+	origin := dns.CanonicalName(z.Origin)
+
+	file, err := os.Open(z.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	parser := dns.NewZoneParser(file, origin, z.File)
+	parser.SetIncludeAllowed(true)
+
+	var rrs []dns.RR
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		rrs = append(rrs, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, fmt.Errorf("failed to parse zone file %s: %v", z.File, err)
+	}
+
+	records := z.loadRRs(rrs)
+	log.Printf("Loaded %d records for zone %s from %s", len(records), origin, z.File)
+
+	return records, nil
+}
+
+// loadRRs takes the zone's content from a list of resource records, such as
+// those of a zone file or transfer. The SOA and NS records at the apex
+// replace those of the zone, and every other record is returned to be
+// served as it is.
+func (z *Zone) loadRRs(rrs []dns.RR) []DNSRecord {
+	origin := dns.CanonicalName(z.Origin)
+
+	var records []DNSRecord
+	var ns []string
+	for _, rr := range rrs {
+		name := canonicalHostname(rr.Header().Name)
+		if name == origin {
+			switch apex := rr.(type) {
+			case *dns.SOA:
+				if z.TTL == 0 {
+					z.TTL = apex.Hdr.Ttl
+				}
+				z.SOA = SOARecord{
+					Mname:   apex.Ns,
+					Rname:   apex.Mbox,
+					Serial:  apex.Serial,
+					Refresh: apex.Refresh,
+					Retry:   apex.Retry,
+					Expire:  apex.Expire,
+					Minimum: apex.Minttl,
+				}
+				continue
+			case *dns.NS:
+				ns = append(ns, apex.Ns)
+				continue
+			}
+		}
+
+		records = append(records, DNSRecord{Hostname: name, rr: rr})
+	}
+	if len(ns) > 0 {
+		z.NS = ns
+	}
+
+	return records
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+
+	"github.com/miekg/dns"
+)
+
+// Zone represents a zone the server is authoritative for. Names under its
+// origin that have no records are answered with NXDOMAIN instead of being
+// relayed upstream.
+type Zone struct {
+	Origin string `yaml:"origin"`
+
+	// TTL is the default time-to-live of the records in the zone.
+	TTL uint32 `yaml:"ttl,omitempty"`
+
+	// File is a master file the records are read from, and that secondary
+	// and updated zones are saved to.
+	File string `yaml:"file,omitempty"`
+
+	NS     []string     `yaml:"ns"`
+	SOA    SOARecord    `yaml:"soa"`
+	DNSSEC *ZoneSigning `yaml:"dnssec,omitempty"`
+
+	// Clients in the AllowTransfer networks may transfer the zone, signing
+	// their requests with TransferKey if it is set. Changes are recorded in
+	// Journal so that secondaries can transfer just the changes.
+	AllowTransfer []string `yaml:"allow_transfer,omitempty"`
+	TransferKey   string   `yaml:"transfer_key,omitempty"`
+	Journal       string   `yaml:"journal,omitempty"`
+
+	// A zone with Primaries is a secondary zone, transferred from the first
+	// of them that answers.
+	Primaries []string `yaml:"primaries,omitempty"`
+
+	// Notify lists the secondaries told when the zone changes.
+	Notify []string `yaml:"notify,omitempty"`
+
+	// Clients in the AllowUpdate networks may change the records with
+	// dynamic updates, signed with UpdateKey if it is set.
+	AllowUpdate []string `yaml:"allow_update,omitempty"`
+	UpdateKey   string   `yaml:"update_key,omitempty"`
+
+	// PushTo lists the servers the records are pushed to with dynamic
+	// updates as they change, signed with PushKey if it is set.
+	PushTo  []string `yaml:"push_to,omitempty"`
+	PushKey string   `yaml:"push_key,omitempty"`
+
+	Catalog *CatalogZone `yaml:"catalog,omitempty"`
+
+	// SerialPolicy of "increment" or "date" increases the serial whenever
+	// the content of the zone changes.
+	SerialPolicy string `yaml:"serial_policy,omitempty"`
+
+	Records  []DNSRecord       `yaml:"records,omitempty"`
+	Generate []RecordGenerator `yaml:"generate,omitempty"`
+
+	signer           *zoneSigner
+	transferNetworks []*net.IPNet
+	updateNetworks   []*net.IPNet
+	journal          *zoneJournal
+
+	// expired is set while a secondary zone has no data to serve, because
+	// it has not been transferred yet or was not refreshed before expiring.
+	expired bool
+
+	// member is the origin of the consumed catalog zone the zone was taken
+	// from, for zones that are not listed in the records file.
+	member string
+}
+
+// SOARecord holds the data of a zone's SOA record. Any field left unset is
+// given a default when the zone is loaded.
+type SOARecord struct {
+	Mname   string `yaml:"mname"`
+	Rname   string `yaml:"rname"`
+	Serial  uint32 `yaml:"serial"`
+	Refresh uint32 `yaml:"refresh"`
+	Retry   uint32 `yaml:"retry"`
+	Expire  uint32 `yaml:"expire"`
+	Minimum uint32 `yaml:"minimum"`
+}
+
+// setDefaults canonicalises the zone's names and fills in any SOA fields
+// that were left unset.
+func (z *Zone) setDefaults() {
+	z.Origin = dns.CanonicalName(z.Origin)
+	if z.Catalog != nil && len(z.NS) == 0 {
+		// RFC 9432 section 4.1 asks for a single NS record of invalid.
+		z.NS = []string{"invalid."}
+	}
+	z.setCatalogSerial()
+	for i, ns := range z.NS {
+		z.NS[i] = dns.Fqdn(ns)
+	}
+	if z.TTL == 0 {
+		z.TTL = defaultTTL
+	}
+
+	soa := &z.SOA
+	if soa.Mname == "" {
+		if len(z.NS) > 0 {
+			soa.Mname = z.NS[0]
+		} else {
+			soa.Mname = dns.Fqdn("ns." + z.Origin)
+		}
+	}
+	if soa.Rname == "" {
+		soa.Rname = dns.Fqdn("hostmaster." + z.Origin)
+	}
+	soa.Mname = dns.Fqdn(soa.Mname)
+	soa.Rname = dns.Fqdn(soa.Rname)
+
+	if soa.Serial == 0 {
+		soa.Serial = 1
+	}
+	if soa.Refresh == 0 {
+		soa.Refresh = 3600
+	}
+	if soa.Retry == 0 {
+		soa.Retry = 600
+	}
+	if soa.Expire == 0 {
+		soa.Expire = 86400
+	}
+	if soa.Minimum == 0 {
+		soa.Minimum = 300
+	}
+
+	if z.DNSSEC != nil {
+		if z.DNSSEC.KeyDirectory == "" {
+			z.DNSSEC.KeyDirectory = "."
+		}
+		if z.DNSSEC.Algorithm == "" {
+			z.DNSSEC.Algorithm = "ECDSAP256SHA256"
+		}
+		if z.DNSSEC.Denial == "" {
+			z.DNSSEC.Denial = denialNSEC
+		}
+	}
+}
+
+// loadSigner loads or generates the zone's DNSSEC keys if it is signed.
+func (z *Zone) loadSigner() error {
+	if z.DNSSEC == nil {
+		return nil
+	}
+
+	if z.DNSSEC.Denial != denialNSEC && z.DNSSEC.Denial != denialNSEC3 {
+		return fmt.Errorf("unsupported denial %q for zone %s", z.DNSSEC.Denial, z.Origin)
+	}
+	if z.DNSSEC.ZSKLifetime != 0 && z.DNSSEC.ZSKLifetime < 2*keyPublishInterval {
+		return fmt.Errorf("zsk_lifetime of zone %s must be at least %v", z.Origin, 2*keyPublishInterval)
+	}
+
+	signer, err := newZoneSigner(z.Origin, z.DNSSEC)
+	if err != nil {
+		return err
+	}
+	z.signer = signer
+
+	log.Printf("Signing zone %s, DS record: %s", z.Origin, signer.DS())
+
+	return nil
+}
+
+// parseACLs parses the networks allowed to transfer and update the zone.
+func (z *Zone) parseACLs() error {
+	networks, err := parseNetworks(z.AllowTransfer)
+	if err != nil {
+		return fmt.Errorf("%v in allow_transfer of zone %s", err, z.Origin)
+	}
+	z.transferNetworks = networks
+
+	networks, err = parseNetworks(z.AllowUpdate)
+	if err != nil {
+		return fmt.Errorf("%v in allow_update of zone %s", err, z.Origin)
+	}
+	z.updateNetworks = networks
+
+	return nil
+}
+
+// qualifiedRecords returns the records listed with the zone, with their
+// hostnames made absolute. A hostname of "@" is the origin itself, one that
+// ends in a dot is already absolute and any other is relative to the origin.
+func (z *Zone) qualifiedRecords() []DNSRecord {
+	var records []DNSRecord
+	for _, record := range z.Records {
+		switch {
+		case record.Hostname == "@" || record.Hostname == "":
+			record.Hostname = z.Origin
+		case !dns.IsFqdn(record.Hostname):
+			record.Hostname = record.Hostname + "." + z.Origin
+		}
+
+		records = append(records, record)
+	}
+
+	return records
+}
+
+// SOARR returns the zone's SOA record.
+func (z *Zone) SOARR() *dns.SOA {
+	return &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   z.Origin,
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    z.TTL,
+		},
+		Ns:      z.SOA.Mname,
+		Mbox:    z.SOA.Rname,
+		Serial:  z.SOA.Serial,
+		Refresh: z.SOA.Refresh,
+		Retry:   z.SOA.Retry,
+		Expire:  z.SOA.Expire,
+		Minttl:  z.SOA.Minimum,
+	}
+}
+
+// NegativeSOA returns the SOA record placed in the authority section of
+// NXDOMAIN and NODATA responses. Its TTL is capped at the SOA minimum, which
+// resolvers use as the negative caching TTL (RFC 2308 section 3).
+func (z *Zone) NegativeSOA() *dns.SOA {
+	soa := z.SOARR()
+	if soa.Minttl < soa.Hdr.Ttl {
+		soa.Hdr.Ttl = soa.Minttl
+	}
+
+	return soa
+}
+
+// ApexRRs returns the SOA and NS records served at the zone's origin, along
+// with its DNSKEY records and any CDS, CDNSKEY and NSEC3PARAM records if it
+// is signed.
+func (z *Zone) ApexRRs(name string) []dns.RR {
+	soa := z.SOARR()
+	soa.Hdr.Name = name
+
+	rrs := []dns.RR{soa}
+	for _, ns := range z.NS {
+		rrs = append(rrs, &dns.NS{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeNS,
+				Class:  dns.ClassINET,
+				Ttl:    z.TTL,
+			},
+			Ns: ns,
+		})
+	}
+
+	if z.signer != nil {
+		rrs = append(rrs, z.signer.DNSKEYs(name)...)
+		if z.DNSSEC.CDS {
+			rrs = append(rrs, z.signer.CDSRRs(name)...)
+		}
+		if z.DNSSEC.Denial == denialNSEC3 {
+			rrs = append(rrs, nsec3Param(name, z.TTL))
+		}
+	}
+
+	return rrs
+}
+
+// FindZone returns the most specific zone containing name, or nil if the
+// server is not authoritative for it.
+func (r *DNSRecords) FindZone(name string) *Zone {
+	var best *Zone
+	for i := range r.Zones {
+		zone := &r.Zones[i]
+		if !dns.IsSubDomain(zone.Origin, name) {
+			continue
+		}
+
+		if best == nil || dns.CountLabel(zone.Origin) > dns.CountLabel(best.Origin) {
+			best = zone
+		}
+	}
+
+	return best
+}